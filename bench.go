@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/s3"
+	"github.com/impossiblecloud/s3-file-uploader/internal/secret"
+	"github.com/impossiblecloud/s3-file-uploader/internal/synthetic"
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+
+	"github.com/google/logger"
+)
+
+// Bench runs the upload pipeline over generated files and reports throughput and per-phase latency.
+// Files are uploaded to a real bucket with -s3-uri, otherwise to a mock bucket that reads and discards them.
+func runBench(args []string) error {
+	var s3uri, sizes, ageRecipients, partSize, uploadRateLimit, tempDir string
+	var files int
+
+	config := cfg.AppConfig{}
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	flags.IntVar(&files, "files", 100, "Number of files to generate")
+	flags.StringVar(&sizes, "sizes", "1MB", "Comma separated file sizes, e.g. \"1MB,100MB\", used in turn")
+	flags.IntVar(&config.Workers, "workers", 1, "The number of worker threads")
+	flags.StringVar(&s3uri, "s3-uri", "", "S3 bucket to upload to, files are left in the bucket. A mock bucket is used when empty")
+	flags.StringVar(&config.S3Endpoint, "s3-endpoint", "", "Custom S3 endpoint URL for S3-compatible storage, buckets are addressed path-style")
+	flags.StringVar(&partSize, "s3-part-size", "", "S3 multipart upload part size, e.g. \"16MB\", SDK default of 5MB when empty")
+	flags.IntVar(&config.S3Concurrency, "s3-concurrency", 0, "Number of parts uploaded in parallel per file, SDK default of 5 when 0")
+	flags.StringVar(&uploadRateLimit, "upload-rate-limit", "", "Total upload rate limit per second for all workers, e.g. \"10MB\", empty means no limit")
+	flags.StringVar(&config.Compression, "compression", "gzip", "Compression algorithm: gzip, zstd, lz4 or none")
+	flags.IntVar(&config.CompressionLevel, "compression-level", 0, "Compression level, 0 means the compressor default")
+	flags.BoolVar(&config.Encrypt, "encrypt", false, "Encrypt files")
+	flags.StringVar(&config.EncryptEngine, "encrypt-engine", "gpg", "Encryption engine: gpg or age")
+	flags.StringVar(&config.EnvVarGPGPass, "env-var-name-gpg-password", "GPG_PASSWORD", "Env variable name with gpg password")
+	flags.StringVar(&ageRecipients, "age-recipients", "", "Comma separated age public keys, required with -encrypt-engine=age")
+	flags.StringVar(&tempDir, "temp-dir", os.TempDir(), "Directory for generated and temporary files, it's cleaned up on exit")
+	flags.BoolVar(&config.Verbose, "verbose", false, "Print INFO level applog to stdout")
+	flags.Parse(args)
+
+	applog = logger.Init("s3-file-uploader", config.Verbose, false, io.Discard)
+	config.Applog = applog
+
+	if files < 1 {
+		return fmt.Errorf("-files must be positive")
+	}
+	if config.Workers < 1 {
+		return fmt.Errorf("-workers must be positive")
+	}
+	fileSizes, err := synthetic.ParseSizes(sizes)
+	if err != nil {
+		return fmt.Errorf("bad -sizes: %s", err.Error())
+	}
+	if config.S3PartSize, err = utils.ParseBytes(partSize); err == nil {
+		err = s3.ValidatePartSize(config.S3PartSize)
+	}
+	if err != nil {
+		return fmt.Errorf("bad -s3-part-size: %s", err.Error())
+	}
+	rateLimit, err := utils.ParseBytes(uploadRateLimit)
+	if err != nil {
+		return fmt.Errorf("bad -upload-rate-limit: %s", err.Error())
+	}
+	if rateLimit > 0 {
+		config.UploadLimiter = ratelimit.NewLimiter(rateLimit, 0)
+	}
+
+	if err := fs.ValidateCompression(config.Compression, config.CompressionLevel); err != nil {
+		return err
+	}
+	config.Gzip = config.Compression != "none"
+
+	if config.Encrypt {
+		switch config.EncryptEngine {
+		case "age":
+			keys := []string{}
+			for _, key := range strings.Split(ageRecipients, ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					keys = append(keys, key)
+				}
+			}
+			if config.AgeRecipients, err = fs.ParseAgeRecipients(keys, ""); err != nil {
+				return err
+			}
+		case "gpg":
+			config.GpgPassword = secret.Static(os.Getenv(config.EnvVarGPGPass))
+			if _, err := config.GpgPassword.Get(); err != nil {
+				return fmt.Errorf("empty or non existent GGP password env variable")
+			}
+		default:
+			return fmt.Errorf("unsupported -encrypt-engine %q, must be gpg or age", config.EncryptEngine)
+		}
+		if config.EncryptionKeyID, err = fs.DefaultEncryptionKeyID(config); err != nil {
+			return err
+		}
+	}
+
+	var client *s3.Client
+	if s3uri != "" {
+		if err := utils.ValidateUrl(s3uri); err != nil {
+			return err
+		}
+		if config.S3bucket, config.S3path, err = utils.ParseS3URL(s3uri); err != nil {
+			return err
+		}
+		if client, err = s3.NewClient(config); err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+
+	// All files live in a temporary directory: generated files, compressed and encrypted ones
+	root, err := os.MkdirTemp(tempDir, "s3-file-uploader-bench-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(root)
+
+	config.PathToWatch = filepath.Join(root, "watch")
+	config.GzipDir = filepath.Join(root, "gzip")
+	config.EncryptDir = filepath.Join(root, "enc")
+	for _, dir := range []string{config.PathToWatch, config.GzipDir, config.EncryptDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	config.Metrics = metrics.InitMetrics(version, files, secondsDurationBuckets)
+
+	fmt.Printf("Generating %d files of %s in %s\n", files, sizes, config.PathToWatch)
+	started := time.Now()
+	generated, err := synthetic.GenerateFiles(config.PathToWatch, files, fileSizes)
+	if err != nil {
+		return fmt.Errorf("failed to generate files: %s", err.Error())
+	}
+	fmt.Printf("Generated in %s\n", time.Since(started).Round(time.Millisecond))
+
+	destination := "mock bucket"
+	if client != nil {
+		destination = s3uri
+	}
+	fmt.Printf("Uploading to %s with %d workers\n\n", destination, config.Workers)
+
+	queue := make(chan string, len(generated))
+	for _, file := range generated {
+		queue <- file
+	}
+	close(queue)
+
+	var wg sync.WaitGroup
+	stats := &synthetic.Stats{}
+	started = time.Now()
+	for i := 0; i < config.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range queue {
+				size, uploaded, err := benchFile(config, client, stats, file)
+				if err != nil {
+					applog.Errorf("Failed to upload %q: %s", file, err.Error())
+				}
+				stats.Done(size, uploaded, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	stats.Print(os.Stdout, time.Since(started))
+	return nil
+}
+
+// Run a file through all upload phases recording how long each of them takes
+func benchFile(config cfg.AppConfig, client *s3.Client, stats *synthetic.Stats, file string) (int64, int64, error) {
+	var uploaded int64
+
+	fi, err := os.Stat(file)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	started := time.Now()
+	phase := func(name string, fn func() error) error {
+		phaseStarted := time.Now()
+		if err := fn(); err != nil {
+			return err
+		}
+		stats.Record(name, time.Since(phaseStarted))
+		return nil
+	}
+
+	err = phase(cfg.PhaseCompressing, func() error {
+		return fs.CompressFile(context.Background(), config, file)
+	})
+	if err == nil {
+		err = phase(cfg.PhaseEncrypting, func() error {
+			return fs.EncryptFile(context.Background(), config, file)
+		})
+	}
+	if err == nil {
+		err = phase(cfg.PhaseUploading, func() error {
+			if client == nil {
+				uploaded, err = mockUploadFile(config, file)
+			} else {
+				uploaded, err = client.UploadFile(context.Background(), config, file)
+			}
+			return err
+		})
+	}
+	if err == nil {
+		err = phase(cfg.PhaseDeleting, func() error {
+			if err := fs.DeleteTempFiles(config, file); err != nil {
+				return err
+			}
+			return os.Remove(file)
+		})
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stats.Record("total", time.Since(started))
+	return fi.Size(), uploaded, nil
+}
+
+// Mock bucket reads the prepared file with the upload rate limit and discards it
+func mockUploadFile(config cfg.AppConfig, file string) (int64, error) {
+	f, err := os.Open(fs.PreparedFileName(config, file))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var body io.Reader = f
+	if config.UploadLimiter != nil {
+		body = ratelimit.NewReader(f, config.UploadLimiter)
+	}
+	return io.Copy(io.Discard, body)
+}
@@ -0,0 +1,156 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/logger"
+)
+
+// Supported webhook kinds
+const (
+	KindSlack = "slack"
+	KindTeams = "teams"
+)
+
+// Alerter sends a webhook message when consecutive upload errors or backlog age exceed thresholds.
+// Only one message is sent per cooldown window. A nil Alerter does nothing.
+type Alerter struct {
+	URL           string
+	Kind          string
+	MaxErrors     int
+	MaxBacklogAge time.Duration
+	Cooldown      time.Duration
+	Applog        *logger.Logger
+
+	// Enabled tells if alerts are sent now, e.g. by a runtime feature flag. Alerts are always sent when it's nil.
+	Enabled func() bool
+
+	client *http.Client
+	host   string
+
+	mu          sync.Mutex
+	consecutive int
+	lastSent    time.Time
+	now         func() time.Time
+	send        func(text string) error
+}
+
+// New creates an alerter, zero thresholds disable the corresponding check
+func New(url, kind string, maxErrors int, maxBacklogAge, cooldown time.Duration, applog *logger.Logger) (*Alerter, error) {
+	if kind != KindSlack && kind != KindTeams {
+		return nil, fmt.Errorf("unsupported alert webhook kind %q, must be %s or %s", kind, KindSlack, KindTeams)
+	}
+
+	host, _ := os.Hostname()
+	a := &Alerter{
+		URL:           url,
+		Kind:          kind,
+		MaxErrors:     maxErrors,
+		MaxBacklogAge: maxBacklogAge,
+		Cooldown:      cooldown,
+		Applog:        applog,
+		client:        &http.Client{Timeout: 10 * time.Second},
+		host:          host,
+		now:           time.Now,
+	}
+	a.send = a.post
+	return a, nil
+}
+
+// Success resets the consecutive errors counter
+func (a *Alerter) Success() {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.consecutive = 0
+}
+
+// Failure counts an upload error and alerts when there are too many errors in a row
+func (a *Alerter) Failure(err error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.consecutive++
+	if a.MaxErrors > 0 && a.consecutive >= a.MaxErrors {
+		a.fire(fmt.Sprintf("%d uploads failed in a row, last error: %s", a.consecutive, err.Error()))
+	}
+}
+
+// CheckBacklog alerts when the oldest queued file waits for too long
+func (a *Alerter) CheckBacklog(oldest time.Time) {
+	if a == nil || a.MaxBacklogAge <= 0 || oldest.IsZero() {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if age := a.now().Sub(oldest); age > a.MaxBacklogAge {
+		a.fire(fmt.Sprintf("The oldest queued file is %s old, the threshold is %s", age.Round(time.Second), a.MaxBacklogAge))
+	}
+}
+
+// fire sends an alert unless one was sent within the cooldown window, must be called with the lock held
+func (a *Alerter) fire(text string) {
+	if a.Enabled != nil && !a.Enabled() {
+		return
+	}
+	now := a.now()
+	if !a.lastSent.IsZero() && now.Sub(a.lastSent) < a.Cooldown {
+		return
+	}
+	a.lastSent = now
+
+	text = fmt.Sprintf("s3-file-uploader on %s: %s", a.host, text)
+	a.Applog.Warningf("Sending alert: %s", text)
+
+	// Don't block workers on a slow webhook
+	go func() {
+		if err := a.send(text); err != nil {
+			a.Applog.Errorf("Failed to send alert to %s webhook: %s", a.Kind, err.Error())
+		}
+	}()
+}
+
+// post sends the message to Slack or Teams incoming webhook
+func (a *Alerter) post(text string) error {
+	var payload interface{}
+	switch a.Kind {
+	case KindTeams:
+		payload = map[string]string{
+			"@type":    "MessageCard",
+			"@context": "http://schema.org/extensions",
+			"summary":  "s3-file-uploader alert",
+			"text":     text,
+		}
+	default:
+		payload = map[string]string{"text": text}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := a.client.Post(a.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
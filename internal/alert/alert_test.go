@@ -0,0 +1,74 @@
+package alert
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAlerter(t *testing.T) {
+	a, err := New("http://localhost", KindSlack, 3, time.Hour, 10*time.Minute, logger.Init("test", false, false, io.Discard))
+	assert.Nil(t, err)
+
+	now := time.Now()
+	a.now = func() time.Time { return now }
+
+	var mu sync.Mutex
+	var sent []string
+	done := make(chan struct{}, 10)
+	a.send = func(text string) error {
+		mu.Lock()
+		sent = append(sent, text)
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	}
+
+	// Errors are counted in a row only
+	a.Failure(fmt.Errorf("denied"))
+	a.Failure(fmt.Errorf("denied"))
+	a.Success()
+	a.Failure(fmt.Errorf("denied"))
+	a.Failure(fmt.Errorf("denied"))
+	a.Failure(fmt.Errorf("denied"))
+	<-done
+	assert.Len(t, sent, 1)
+	assert.Contains(t, sent[0], "3 uploads failed in a row, last error: denied")
+
+	// Within the cooldown window
+	a.CheckBacklog(now.Add(-2 * time.Hour))
+	a.Failure(fmt.Errorf("denied"))
+
+	now = now.Add(11 * time.Minute)
+	a.CheckBacklog(now.Add(-30 * time.Minute))
+	a.CheckBacklog(now.Add(-2 * time.Hour))
+	<-done
+	mu.Lock()
+	assert.Len(t, sent, 2)
+	assert.Contains(t, sent[1], "The oldest queued file is 2h0m0s old")
+	mu.Unlock()
+
+	// Disabled alerts are not sent and don't start the cooldown window
+	enabled := false
+	a.Enabled = func() bool { return enabled }
+	now = now.Add(11 * time.Minute)
+	a.CheckBacklog(now.Add(-2 * time.Hour))
+	enabled = true
+	a.CheckBacklog(now.Add(-3 * time.Hour))
+	<-done
+	mu.Lock()
+	assert.Len(t, sent, 3)
+	assert.Contains(t, sent[2], "The oldest queued file is 3h0m0s old")
+	mu.Unlock()
+
+	_, err = New("http://localhost", "email", 3, 0, 0, nil)
+	assert.NotNil(t, err)
+
+	var nilAlerter *Alerter
+	nilAlerter.Failure(fmt.Errorf("denied"))
+}
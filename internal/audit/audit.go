@@ -0,0 +1,78 @@
+// Package audit writes an append-only JSONL log of upload attempts, so there's a machine-readable record of what was
+// uploaded where that doesn't depend on the container log
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/logfile"
+)
+
+// Results of upload attempts
+const (
+	ResultUploaded = "uploaded"
+	ResultFailed   = "failed"
+)
+
+// Record is a single upload attempt of a file
+type Record struct {
+	Time         time.Time `json:"time"`
+	Instance     string    `json:"instance,omitempty"`
+	File         string    `json:"file"`
+	Destination  string    `json:"destination"`
+	Key          string    `json:"key,omitempty"`
+	Size         int64     `json:"size"`
+	UploadedSize int64     `json:"uploaded_size"`
+	SourceSHA256 string    `json:"source_sha256,omitempty"`
+	Duration     float64   `json:"duration_seconds"`
+	Result       string    `json:"result"`
+	ErrorClass   string    `json:"error_class,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	DryRun       bool      `json:"dry_run,omitempty"`
+}
+
+// Log appends records to a file, one JSON object per line. The file is rotated when it grows over maxSize, rotated
+// files get .1, .2 and so on suffixes with the oldest ones over maxFiles removed. A nil Log does nothing.
+type Log struct {
+	file *logfile.File
+}
+
+// Open opens the log for appending, zero maxSize disables rotation
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	file, err := logfile.Open(path, logfile.Rotation{MaxSize: maxSize, MaxBackups: maxFiles})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %s", err.Error())
+	}
+	return &Log{file: file}, nil
+}
+
+// Write appends the record, the record is written to disk before Write returns
+func (l *Log) Write(record Record) error {
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// A record that failed to rotate the log is still written
+	_, writeErr := l.file.Write(append(data, '\n'))
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to write audit log: %s", err.Error())
+	}
+	if writeErr != nil {
+		return fmt.Errorf("failed to write audit log: %s", writeErr.Error())
+	}
+	return nil
+}
+
+// Close closes the log file, records can't be written after that
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readRecords reads all records of a log file
+func readRecords(t *testing.T, path string) []Record {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	records := []Record{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var record Record
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := Open(path, 0, 0)
+	assert.Nil(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	assert.Nil(t, l.Write(Record{Time: now, File: "/data/dump.sql", Key: "backups/dump.sql", Size: 10, Result: ResultUploaded}))
+	assert.Nil(t, l.Write(Record{Time: now, File: "/data/big.sql", Result: ResultFailed, ErrorClass: "permanent", Error: "EntityTooLarge"}))
+	assert.Nil(t, l.Close())
+
+	// Reopened log is appended to
+	l, err = Open(path, 0, 0)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Write(Record{Time: now, File: "/data/next.sql", Result: ResultUploaded}))
+	assert.Nil(t, l.Close())
+	assert.NotNil(t, l.Write(Record{File: "/data/late.sql"}))
+
+	records := readRecords(t, path)
+	assert.Len(t, records, 3)
+	assert.Equal(t, Record{Time: now, File: "/data/dump.sql", Key: "backups/dump.sql", Size: 10, Result: ResultUploaded}, records[0])
+	assert.Equal(t, "EntityTooLarge", records[1].Error)
+
+	// Nil log does nothing
+	var none *Log
+	assert.Nil(t, none.Write(Record{}))
+	assert.Nil(t, none.Close())
+}
+
+func TestLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	record := Record{File: "/data/dump.sql", Result: ResultUploaded}
+	data, _ := json.Marshal(record)
+
+	// Two records fit into a file, two rotated files are kept
+	l, err := Open(path, int64(2*(len(data)+1)), 2)
+	assert.Nil(t, err)
+	defer l.Close()
+	for range 7 {
+		assert.Nil(t, l.Write(record))
+	}
+
+	assert.Len(t, readRecords(t, path), 1)
+	assert.Len(t, readRecords(t, path+".1"), 2)
+	assert.Len(t, readRecords(t, path+".2"), 2)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
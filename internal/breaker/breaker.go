@@ -0,0 +1,152 @@
+// Package breaker implements a circuit breaker for S3 uploads. After a number of consecutive upload failures
+// the circuit opens and uploads stop for a backoff period, files keep being queued meanwhile. After the backoff
+// a single probe upload decides if the circuit closes or opens again.
+package breaker
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit states
+const (
+	Closed   = "closed"
+	Open     = "open"
+	HalfOpen = "half_open"
+)
+
+// Breaker counts consecutive upload failures, it's safe for concurrent use
+type Breaker struct {
+	mu        sync.Mutex
+	threshold int
+	backoff   time.Duration
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+
+	// probing is set while the probe upload of the half-open circuit is in progress, probes numbers them
+	probing bool
+	probes  uint64
+}
+
+// New creates a breaker that opens after threshold consecutive failures for the backoff period
+func New(threshold int, backoff time.Duration) *Breaker {
+	return &Breaker{threshold: threshold, backoff: backoff, now: time.Now}
+}
+
+// state must be called with the lock held
+func (b *Breaker) state() string {
+	switch {
+	case b.failures < b.threshold:
+		return Closed
+	case b.now().Before(b.openUntil):
+		return Open
+	default:
+		return HalfOpen
+	}
+}
+
+// State returns the circuit state
+func (b *Breaker) State() string {
+	if b == nil {
+		return Closed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state()
+}
+
+// Allow checks if uploads can be attempted. An upload is allowed again when the backoff is over, but not while
+// the probe upload is in progress.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state() {
+	case Closed:
+		return true
+	case HalfOpen:
+		return !b.probing
+	}
+	return false
+}
+
+// Acquire checks if an upload can be attempted now. While the circuit is half-open, only one probe upload is let
+// through until it fails, which opens the circuit right away, or succeeds, which closes it. release must be called
+// when the attempt is over, it lets another probe through if the attempt ended without a result, e.g. the file
+// was skipped.
+func (b *Breaker) Acquire() (release func(), ok bool) {
+	noop := func() {}
+	if b == nil {
+		return noop, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state() {
+	case Closed:
+		return noop, true
+	case Open:
+		return noop, false
+	}
+	if b.probing {
+		return noop, false
+	}
+	b.probing = true
+	b.probes++
+	probe := b.probes
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if b.probes == probe {
+			b.probing = false
+		}
+	}, true
+}
+
+// Failure records a failed upload and returns true if the circuit has opened
+func (b *Breaker) Failure() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state() == Open {
+		return false
+	}
+	b.probing = false
+	b.failures++
+	if b.failures < b.threshold {
+		return false
+	}
+	b.openUntil = b.now().Add(b.backoff)
+	return true
+}
+
+// Success records a successful upload and returns true if the circuit has closed
+func (b *Breaker) Success() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	closed := b.failures >= b.threshold
+	b.failures = 0
+	b.probing = false
+	return closed
+}
+
+// Backoff returns how long the circuit stays open
+func (b *Breaker) Backoff() time.Duration {
+	return b.backoff
+}
+
+// Threshold returns the number of consecutive failures that opens the circuit
+func (b *Breaker) Threshold() int {
+	return b.threshold
+}
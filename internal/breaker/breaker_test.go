@@ -0,0 +1,72 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := New(3, time.Minute)
+	b.now = func() time.Time { return now }
+
+	assert.False(t, b.Failure())
+	assert.False(t, b.Failure())
+	assert.Equal(t, Closed, b.State())
+	assert.True(t, b.Allow())
+
+	// A success resets consecutive failures
+	assert.False(t, b.Success())
+	assert.False(t, b.Failure())
+	assert.False(t, b.Failure())
+	assert.True(t, b.Failure())
+	assert.Equal(t, Open, b.State())
+	assert.False(t, b.Allow())
+
+	// Failures of uploads that were in flight don't extend the backoff
+	now = now.Add(30 * time.Second)
+	assert.False(t, b.Failure())
+	assert.False(t, b.Allow())
+
+	// Only one probe gets through after the backoff, its failure opens the circuit again
+	now = now.Add(31 * time.Second)
+	assert.Equal(t, HalfOpen, b.State())
+	assert.True(t, b.Allow())
+	release, ok := b.Acquire()
+	assert.True(t, ok)
+	assert.False(t, b.Allow())
+	_, ok = b.Acquire()
+	assert.False(t, ok)
+	assert.True(t, b.Failure())
+	release()
+	assert.False(t, b.Allow())
+	_, ok = b.Acquire()
+	assert.False(t, ok)
+
+	// Probe without a result lets the next one through, a stale release doesn't free it
+	now = now.Add(time.Minute)
+	release, ok = b.Acquire()
+	assert.True(t, ok)
+	release()
+	next, ok := b.Acquire()
+	assert.True(t, ok)
+	release()
+	assert.False(t, b.Allow())
+
+	assert.True(t, b.Success())
+	next()
+	assert.Equal(t, Closed, b.State())
+	_, ok = b.Acquire()
+	assert.True(t, ok)
+	assert.True(t, b.Allow())
+
+	// Disabled breaker always allows uploads
+	var disabled *Breaker
+	assert.True(t, disabled.Allow())
+	_, ok = disabled.Acquire()
+	assert.True(t, ok)
+	assert.False(t, disabled.Failure())
+	assert.Equal(t, Closed, disabled.State())
+}
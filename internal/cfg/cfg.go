@@ -7,43 +7,224 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/impossiblecloud/s3-file-uploader/internal/alert"
+	"github.com/impossiblecloud/s3-file-uploader/internal/audit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/breaker"
+	"github.com/impossiblecloud/s3-file-uploader/internal/control"
+	"github.com/impossiblecloud/s3-file-uploader/internal/dlock"
+	"github.com/impossiblecloud/s3-file-uploader/internal/dryrun"
+	"github.com/impossiblecloud/s3-file-uploader/internal/failures"
+	"github.com/impossiblecloud/s3-file-uploader/internal/features"
+	"github.com/impossiblecloud/s3-file-uploader/internal/manifest"
+	"github.com/impossiblecloud/s3-file-uploader/internal/membudget"
 	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/pool"
+	"github.com/impossiblecloud/s3-file-uploader/internal/progress"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/schedule"
+	"github.com/impossiblecloud/s3-file-uploader/internal/secret"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
 	"github.com/google/logger"
 )
 
 // Config is the main app config struct
 type AppConfig struct {
 	Applog            *logger.Logger
+	InstanceID        string
 	Workers           int
+	PrepareAhead      int
 	WorkersCannelSize int
 	Verbose           bool
 	SendTimeout       time.Duration
+	PerFileTimeout    time.Duration
 	S3bucket          string
 	S3path            string
+	S3PartSize        int64
+	S3Concurrency     int
+	S3Endpoint        string
+	S3Accelerate      bool
+	S3DualStack       bool
+	S3UseFIPS         bool
+	S3RequesterPays   bool
+	S3MaxRetries      int
+	S3SlowDownDelay   time.Duration
+	S3SlowDownMax     time.Duration
 	PathToWatch       string
+	WatchPaths        []WatchPath
+	IncludePatterns   []string
 	EnvVarGPGPass     string
-	GpgPassword       string
+	GpgPassword       secret.Provider
+	GpgRecipients     []string
+	GpgPublicKeyFile  string
+	EncryptEngine     string
+	AgeRecipients     []age.Recipient
+	EncryptionKeyID   string
+	KeyIDInFilename   bool
+
+	KMSKeyID       string
+	KMSEndpoint    string
+	KMSMaxFileSize int64
+	KMS            kmsiface.KMSAPI
 
 	Gzip    bool
 	Encrypt bool
 	DryRun  bool
 
+	DryRunSkipPipeline bool
+	DryRunReport       *dryrun.Report
+
+	LegacyKeyNames    bool
+	KeyOverride       bool
+	KeyOverridePrefix string
+	KeySuffix         string
+	KeyShardLevels    int
+	ReadyMarker       string
+	ReadySuffix       string
+
+	DedupWindow     time.Duration
+	DedupDir        string
+	DedupDirMaxSize int64
+	DedupDirMaxAge  time.Duration
+
+	TrashDir       string
+	TrashRetention time.Duration
+	TrashMaxSize   int64
+
+	ReconcileInterval time.Duration
+	ReconcileWindow   time.Duration
+
+	HTTPURL         string
+	HTTPHeaders     map[string]string
+	HTTPInsecureTLS bool
+	Routes          []Route
+
+	MinFileSize           int64
+	MaxFileSize           int64
+	LargeFileSize         int64
+	LargeFilePrefix       string
+	LargeFileStorageClass string
+	StorageClass          string
+
+	ObjectLockMode string
+	RetainUntil    time.Time
+	RetentionDays  int
+	ExpiryTagDays  int
+	ExpiryCheck    bool
+
+	ChecksumSidecar    bool
+	VerifyBeforeDelete bool
+
+	Compression          string
+	CompressionLevel     int
+	NoCompressExtensions []string
+	// Archive is "tar" to pack files into a tar archive before compression or "none" for plain compressed files
+	Archive string
+	// CompressEngine is "exec" to run external tar and compressors or "native" to compress in the process
+	CompressEngine string
+	// NoExec refuses pipelines that need external tools, it's always set in builds with the noexec tag
+	NoExec bool
+
 	GzipDir    string
 	EncryptDir string
 
+	FileGroups       [][]string
+	FileGroupTimeout time.Duration
+
+	State            *state.DB
+	Features         *features.Registry
+	DeleteRetries    int
+	DeleteRetryDelay time.Duration
+
 	ExitOnFilename string
+	Control        *control.Control
 	CancelFunction context.CancelFunc
 
-	PushGateway  string
-	PushInterval time.Duration
-	ScanInterval time.Duration
+	ConfigErrorThreshold int
+	ConfigErrorWindow    time.Duration
+
+	UploadLimiter *ratelimit.Limiter
+	Pipeline      pool.Pipeline
+	Progress      progress.Config
+	BufferBudget  *membudget.Budget
+	InflightBytes *membudget.Budget
+	UploadWindow  *schedule.Window
+	Alerter       *alert.Alerter
+	Breaker       *breaker.Breaker
+	Failures      *failures.List
+	AuditLog      *audit.Log
+	Status        *StatusRegistry
+
+	Manifest         *manifest.Manifest
+	ManifestPrefix   string
+	ManifestInterval time.Duration
+
+	PushGateway        string
+	RemoteWriteURL     string
+	OTLPEndpoint       string
+	PushInterval       time.Duration
+	PushJobName        string
+	PushGroupingLabels map[string]string
+	PushBasicAuth      string
+	PushBearerToken    secret.Provider
+	PushDeleteOnExit   bool
+	ScanInterval       time.Duration
+	ScanIntervalMax    time.Duration
+	ScanTrigger        chan struct{}
+	MaxFilesPerScan    int
+	Watch              bool
+	EnqueuePolicy      string
+	FollowSymlinks     bool
+	IgnorePatterns     []string
+
+	ReadyCheckS3           bool
+	ReadyQueueStuckTimeout time.Duration
+
+	ClaimMode     string
+	ProcessingDir string
+	Locker        dlock.Locker
 
 	Metrics metrics.AppMetrics
 }
 
+// Route sends files with names matching the pattern to another destination than -s3-uri or -http-url
+type Route struct {
+	Pattern     string            `json:"pattern"`
+	Destination string            `json:"destination"`
+	Headers     map[string]string `json:"headers,omitempty"`
+
+	// Parsed destination, either the bucket and path or the URL are set
+	S3bucket string `json:"-"`
+	S3path   string `json:"-"`
+	HTTPURL  string `json:"-"`
+}
+
+// WatchPath is a watched directory, files in it can be limited to include patterns and uploaded under a key prefix
+type WatchPath struct {
+	Path    string   `json:"path"`
+	Include []string `json:"include,omitempty"`
+	Prefix  string   `json:"prefix,omitempty"`
+}
+
 // Message that is sent to workers
 type Message struct {
 	File string
+
+	// Group contains all files of a file group including File, they are uploaded and deleted together
+	Group   []string
+	Partial bool
+
+	// Used to order the queue
+	ModTime time.Time
+	Size    int64
+
+	// Device and inode of File when it was queued, to detect that it was replaced before it was claimed
+	Dev uint64
+	Ino uint64
+
+	// Set by the queue when the message is queued, the backlog age is measured from it
+	Queued time.Time
 }
 
 // Client stores pointers to configured remote endpoint writes/clients
@@ -54,14 +235,47 @@ type SenderClient struct {
 	SocketWriter *bufio.Writer
 }
 
+// Worker phases
+const (
+	PhaseIdle        = "idle"
+	PhaseClaiming    = "claiming"
+	PhaseQueued      = "queued"
+	PhaseCompressing = "compressing"
+	PhaseEncrypting  = "encrypting"
+	PhaseUploading   = "uploading"
+	PhaseDeleting    = "deleting"
+)
+
 // Workers status
 type WorkerStatus struct {
-	ID      int  `json:"id"`
-	Running bool `json:"running"`
+	ID             int       `json:"id"`
+	Running        bool      `json:"running"`
+	File           string    `json:"file,omitempty"`
+	Phase          string    `json:"phase"`
+	PhaseStarted   time.Time `json:"phase_started"`
+	FilesProcessed int64     `json:"files_processed"`
+	FilesFailed    int64     `json:"files_failed"`
+	BytesUploaded  int64     `json:"bytes_uploaded"`
+	LastError      string    `json:"last_error,omitempty"`
+
+	// Progress of the current upload of a large file
+	UploadDone  int64   `json:"upload_done_bytes,omitempty"`
+	UploadTotal int64   `json:"upload_total_bytes,omitempty"`
+	UploadRate  float64 `json:"upload_bytes_per_second,omitempty"`
 }
 
 // Status defines status
 type AppStatus struct {
-	Workers []WorkerStatus `json:"workers"`
-	Version string         `json:"version"`
+	Workers    []WorkerStatus    `json:"workers"`
+	Instance   string            `json:"instance"`
+	Version    string            `json:"version"`
+	Binaries   map[string]string `json:"binaries,omitempty"`
+	Started    time.Time         `json:"started"`
+	Uptime     string            `json:"uptime"`
+	QueueDepth int               `json:"queue_depth"`
+	Paused     bool              `json:"paused"`
+	Draining   bool              `json:"draining"`
+	Circuit    string            `json:"circuit"`
+
+	Scanners map[string]ScannerStatus `json:"scanners,omitempty"`
 }
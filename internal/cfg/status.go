@@ -0,0 +1,131 @@
+package cfg
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScannerStatus is the status of the scanner or watcher of a watched directory
+type ScannerStatus struct {
+	LastRun    time.Time `json:"last_run"`
+	LastScan   time.Time `json:"last_scan,omitempty"`
+	FilesFound int       `json:"files_found"`
+	Entries    int       `json:"entries"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
+// StatusRegistry keeps the status of workers and directory scanners. Workers and scanners update it while HTTP
+// handlers, health checks and metrics read snapshots of it, it's safe for concurrent use. Methods of a nil
+// registry do nothing.
+type StatusRegistry struct {
+	mu       sync.RWMutex
+	workers  []WorkerStatus
+	scanners map[string]ScannerStatus
+}
+
+// NewStatusRegistry creates a registry of idle workers with IDs from 0 to workers-1
+func NewStatusRegistry(workers int) *StatusRegistry {
+	r := &StatusRegistry{workers: make([]WorkerStatus, workers), scanners: map[string]ScannerStatus{}}
+	for id := range r.workers {
+		r.workers[id] = WorkerStatus{ID: id, Phase: PhaseIdle}
+	}
+	return r
+}
+
+// WorkerRef updates the status of a worker in the registry
+type WorkerRef struct {
+	registry *StatusRegistry
+	id       int
+}
+
+// Worker returns a reference to the status of the worker
+func (r *StatusRegistry) Worker(id int) WorkerRef {
+	return WorkerRef{registry: r, id: id}
+}
+
+// Update changes the status of the worker with fn under the registry lock
+func (w WorkerRef) Update(fn func(status *WorkerStatus)) {
+	if w.registry == nil {
+		return
+	}
+	w.registry.mu.Lock()
+	defer w.registry.mu.Unlock()
+	fn(&w.registry.workers[w.id])
+}
+
+// Workers returns a snapshot of worker statuses ordered by ID
+func (r *StatusRegistry) Workers() []WorkerStatus {
+	if r == nil {
+		return []WorkerStatus{}
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	workers := make([]WorkerStatus, len(r.workers))
+	copy(workers, r.workers)
+	return workers
+}
+
+// WorkerCount returns the number of workers
+func (r *StatusRegistry) WorkerCount() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.workers)
+}
+
+// ScannerRan records that the scanner or watcher loop of the watched directory is running
+func (r *StatusRegistry) ScannerRan(path string) {
+	r.updateScanner(path, func(status *ScannerStatus) {
+		status.LastRun = time.Now()
+	})
+}
+
+// ScanDone records a finished scan of the watched directory
+func (r *StatusRegistry) ScanDone(path string, files, entries int, err error) {
+	r.updateScanner(path, func(status *ScannerStatus) {
+		status.LastScan = time.Now()
+		status.FilesFound, status.Entries, status.LastError = files, entries, ""
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+}
+
+func (r *StatusRegistry) updateScanner(path string, fn func(status *ScannerStatus)) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := r.scanners[path]
+	fn(&status)
+	r.scanners[path] = status
+}
+
+// Scanners returns a snapshot of scanner statuses by watched directory
+func (r *StatusRegistry) Scanners() map[string]ScannerStatus {
+	scanners := map[string]ScannerStatus{}
+	if r == nil {
+		return scanners
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for path, status := range r.scanners {
+		scanners[path] = status
+	}
+	return scanners
+}
+
+// StalledScanners returns sorted watched directories whose scanner or watcher loop hasn't run for longer than
+// timeout
+func (r *StatusRegistry) StalledScanners(timeout time.Duration) []string {
+	stalled := []string{}
+	for path, status := range r.Scanners() {
+		if time.Since(status.LastRun) > timeout {
+			stalled = append(stalled, path)
+		}
+	}
+	sort.Strings(stalled)
+	return stalled
+}
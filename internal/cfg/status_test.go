@@ -0,0 +1,52 @@
+package cfg
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusRegistry(t *testing.T) {
+	registry := NewStatusRegistry(2)
+	assert.Equal(t, 2, registry.WorkerCount())
+
+	var wg sync.WaitGroup
+	for id := range registry.WorkerCount() {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				registry.Worker(id).Update(func(status *WorkerStatus) { status.FilesProcessed++ })
+				registry.Workers()
+			}
+		}()
+	}
+	wg.Wait()
+
+	workers := registry.Workers()
+	assert.Equal(t, 1, workers[1].ID)
+	assert.Equal(t, int64(100), workers[1].FilesProcessed)
+	assert.Equal(t, PhaseIdle, workers[1].Phase)
+
+	// Snapshots don't change with the registry
+	registry.Worker(0).Update(func(status *WorkerStatus) { status.Running = true })
+	assert.False(t, workers[0].Running)
+
+	registry.ScannerRan("/data/db")
+	registry.ScanDone("/data/db", 3, 10, errors.New("stale file handle"))
+	scanners := registry.Scanners()
+	assert.Equal(t, 3, scanners["/data/db"].FilesFound)
+	assert.Equal(t, "stale file handle", scanners["/data/db"].LastError)
+	assert.Empty(t, registry.StalledScanners(time.Minute))
+	assert.Equal(t, []string{"/data/db"}, registry.StalledScanners(0))
+
+	// Nil registry does nothing
+	var none *StatusRegistry
+	none.Worker(0).Update(func(status *WorkerStatus) { status.Running = true })
+	none.ScannerRan("/data/db")
+	assert.Empty(t, none.Workers())
+	assert.Empty(t, none.StalledScanners(0))
+}
@@ -0,0 +1,103 @@
+// Package control implements control files: producers that can only write files drop them into the watched
+// directory to pause uploads, drain the queue and exit, or exit right away.
+package control
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Control file names
+const (
+	// PauseFile pauses workers while it exists
+	PauseFile = ".uploader-pause"
+	// DrainFile stops queueing new files, the uploader exits when queued files are uploaded
+	DrainFile = ".uploader-drain"
+	// ExitFile makes the uploader exit after in-flight uploads
+	ExitFile = ".uploader-exit"
+)
+
+// Control keeps state requested with control files in a directory
+type Control struct {
+	dir      string
+	paused   atomic.Bool
+	draining atomic.Bool
+	exiting  atomic.Bool
+}
+
+// New creates control for files in dir
+func New(dir string) *Control {
+	return &Control{dir: dir}
+}
+
+// IsControlFile checks if a file is one of the control files
+func (c *Control) IsControlFile(filename string) bool {
+	if c == nil || filepath.Dir(filename) != filepath.Clean(c.dir) {
+		return false
+	}
+	switch filepath.Base(filename) {
+	case PauseFile, DrainFile, ExitFile:
+		return true
+	}
+	return false
+}
+
+// Check reads control files and returns true if the state has changed.
+// Drain and exit files are deleted once seen so a restarted uploader doesn't act on them again.
+func (c *Control) Check() (bool, error) {
+	_, err := os.Stat(filepath.Join(c.dir, PauseFile))
+	paused := err == nil
+	changed := c.paused.Swap(paused) != paused
+
+	for _, cmd := range []struct {
+		file  string
+		state *atomic.Bool
+	}{{DrainFile, &c.draining}, {ExitFile, &c.exiting}} {
+		file := filepath.Join(c.dir, cmd.file)
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return changed, err
+		}
+		if !cmd.state.Swap(true) {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// Paused checks if uploads are paused with the pause file
+func (c *Control) Paused() bool {
+	return c != nil && c.paused.Load()
+}
+
+// Draining checks if the uploader was asked to drain the queue and exit
+func (c *Control) Draining() bool {
+	return c != nil && c.draining.Load()
+}
+
+// Exiting checks if the uploader was asked to exit
+func (c *Control) Exiting() bool {
+	return c != nil && c.exiting.Load()
+}
+
+// Pause creates or removes the pause file, so the state is kept by following checks
+func (c *Control) Pause(paused bool) error {
+	file := filepath.Join(c.dir, PauseFile)
+	if paused {
+		if err := os.WriteFile(file, nil, 0644); err != nil {
+			return err
+		}
+	} else if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.paused.Store(paused)
+	return nil
+}
+
+// Drain stops queueing new files, the uploader exits when queued files are uploaded
+func (c *Control) Drain() {
+	c.draining.Store(true)
+}
@@ -0,0 +1,48 @@
+package control
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestControl(t *testing.T) {
+	dir := t.TempDir()
+	c := New(dir)
+
+	changed, err := c.Check()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.False(t, c.Paused())
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, PauseFile), nil, 0644))
+	changed, _ = c.Check()
+	assert.True(t, changed)
+	assert.True(t, c.Paused())
+	changed, _ = c.Check()
+	assert.False(t, changed)
+	assert.FileExists(t, filepath.Join(dir, PauseFile))
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, PauseFile)))
+	changed, _ = c.Check()
+	assert.True(t, changed)
+	assert.False(t, c.Paused())
+
+	// Drain and exit files are consumed
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, DrainFile), nil, 0644))
+	changed, _ = c.Check()
+	assert.True(t, changed)
+	assert.True(t, c.Draining())
+	assert.False(t, c.Exiting())
+	assert.NoFileExists(t, filepath.Join(dir, DrainFile))
+
+	assert.True(t, c.IsControlFile(filepath.Join(dir, ExitFile)))
+	assert.False(t, c.IsControlFile(filepath.Join(dir, "dump.sql")))
+	assert.False(t, c.IsControlFile(filepath.Join(t.TempDir(), ExitFile)))
+
+	var none *Control
+	assert.False(t, none.Paused())
+	assert.False(t, none.IsControlFile(filepath.Join(dir, ExitFile)))
+}
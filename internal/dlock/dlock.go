@@ -0,0 +1,95 @@
+package dlock
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Locker is a lock shared between several uploader replicas
+type Locker interface {
+	// Lock takes the lock for a file, it fails right away if the lock is held by someone else
+	Lock(file string) error
+	// Unlock releases the lock for a file
+	Unlock(file string) error
+}
+
+// Owner returns an identifier of this uploader process
+func Owner() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Flock uses flock(2), or LockFileEx on Windows, on lock files in a shared directory, e.g. on NFS or an SMB share.
+// Locks held by a crashed process are released by the kernel/file server.
+type Flock struct {
+	Dir string
+
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// NewFlock creates a flock based locker with lock files in dir
+func NewFlock(dir string) (*Flock, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Flock{Dir: dir, files: map[string]*os.File{}}, nil
+}
+
+func (l *Flock) lockFileName(file string) string {
+	return filepath.Join(l.Dir, filepath.Base(file)+".lock")
+}
+
+// Lock takes the lock for a file
+func (l *Flock) Lock(file string) error {
+	lockFile := l.lockFileName(file)
+
+	for {
+		f, err := os.OpenFile(lockFile, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+
+		if err := tryLock(f); err != nil {
+			f.Close()
+			return fmt.Errorf("file %q is locked by another uploader", file)
+		}
+
+		// The lock file could have been removed by the previous owner between open and flock,
+		// the lock is valid only if the path still points to the file we locked
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		pathFi, err := os.Stat(lockFile)
+		if err != nil || !os.SameFile(fi, pathFi) {
+			f.Close()
+			continue
+		}
+
+		f.Truncate(0)
+		f.WriteString(Owner())
+
+		l.mu.Lock()
+		l.files[file] = f
+		l.mu.Unlock()
+		return nil
+	}
+}
+
+// Unlock releases the lock for a file and removes the lock file
+func (l *Flock) Unlock(file string) error {
+	l.mu.Lock()
+	f, ok := l.files[file]
+	delete(l.files, file)
+	l.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return releaseLock(f, l.lockFileName(file))
+}
@@ -0,0 +1,23 @@
+package dlock
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlock(t *testing.T) {
+	dir := t.TempDir()
+
+	first, err := NewFlock(dir)
+	assert.Nil(t, err)
+	second, err := NewFlock(dir)
+	assert.Nil(t, err)
+
+	assert.Nil(t, first.Lock("/app/tmp/dump.sql"))
+	assert.NotNil(t, second.Lock("/app/tmp/dump.sql"))
+	assert.Nil(t, second.Lock("/app/tmp/other.sql"))
+
+	assert.Nil(t, first.Unlock("/app/tmp/dump.sql"))
+	assert.Nil(t, second.Lock("/app/tmp/dump.sql"))
+}
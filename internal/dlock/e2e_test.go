@@ -0,0 +1,62 @@
+//go:build e2e
+
+package dlock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/s3mock"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestE2ES3(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithS3ForcePathStyle(true).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("test", "test", "")))
+	assert.Nil(t, err)
+
+	first := NewS3(sess, "bucket", "/backups/.locks/", time.Hour)
+	second := NewS3(sess, "bucket", "backups/.locks", time.Hour)
+
+	assert.Nil(t, first.Lock("/data/dump.sql"))
+	assert.Equal(t, []string{"backups/.locks/dump.sql.lock"}, server.Keys("bucket"))
+	assert.NotNil(t, second.Lock("/data/dump.sql"))
+
+	assert.Nil(t, first.Unlock("/data/dump.sql"))
+	assert.Nil(t, second.Lock("/data/dump.sql"))
+
+	// Expired locks are taken over, the replica that lost it doesn't delete the new lock
+	expiring := NewS3(sess, "bucket", "backups/.locks", 0)
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, expiring.Lock("/data/dump.sql"))
+	assert.NotNil(t, second.Unlock("/data/dump.sql"))
+	assert.Equal(t, []string{"backups/.locks/dump.sql.lock"}, server.Keys("bucket"))
+	assert.Nil(t, expiring.Unlock("/data/dump.sql"))
+	assert.Empty(t, server.Keys("bucket"))
+
+	// Held locks are refreshed and don't expire
+	held := NewS3(sess, "bucket", "backups/.locks", 1500*time.Millisecond)
+	assert.Nil(t, held.Lock("/data/other.sql"))
+	time.Sleep(2500 * time.Millisecond)
+	assert.NotNil(t, held.Lock("/data/other.sql"))
+	assert.Nil(t, held.Unlock("/data/other.sql"))
+	assert.Nil(t, held.Lock("/data/other.sql"))
+	assert.Nil(t, held.Unlock("/data/other.sql"))
+
+	// A lock changed by someone else is lost and left alone
+	assert.Nil(t, held.Lock("/data/other.sql"))
+	server.Store("bucket", "backups/.locks/other.sql.lock", []byte("someone 1"))
+	time.Sleep(700 * time.Millisecond)
+	assert.NotNil(t, held.Unlock("/data/other.sql"))
+	assert.Equal(t, []string{"backups/.locks/other.sql.lock"}, server.Keys("bucket"))
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package dlock
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive lock of an open lock file, it fails right away if the lock is held
+func tryLock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// releaseLock removes the lock file while the lock is still held and closes it, which releases the lock
+func releaseLock(f *os.File, name string) error {
+	os.Remove(name)
+	return f.Close()
+}
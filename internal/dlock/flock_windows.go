@@ -0,0 +1,23 @@
+//go:build windows
+
+package dlock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// tryLock takes an exclusive lock of an open lock file, it fails right away if the lock is held
+func tryLock(f *os.File) error {
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY,
+		0, 1, 0, &windows.Overlapped{})
+}
+
+// releaseLock closes the lock file, which releases the lock, and removes it. Windows can't remove an open file,
+// while another uploader that locked it in between keeps it open, so the removal fails and its lock stays valid.
+func releaseLock(f *os.File, name string) error {
+	err := f.Close()
+	os.Remove(name)
+	return err
+}
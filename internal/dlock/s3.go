@@ -0,0 +1,221 @@
+package dlock
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3 uses lock objects created with conditional writes (If-None-Match: *), only one replica can create the object.
+// Locks of crashed replicas expire after TTL, held locks are refreshed every TTL/3 so long uploads keep them.
+// Expired locks are taken over, refreshed and deleted only if the object is still the one last seen (If-Match).
+type S3 struct {
+	Bucket string
+	Prefix string
+	TTL    time.Duration
+
+	client *s3.S3
+	owner  string
+
+	mu   sync.Mutex
+	held map[string]*heldLock
+}
+
+// heldLock is a lock object written by this locker. The refresher is the only writer of etag and lost once the
+// lock is held, they are read after it stopped.
+type heldLock struct {
+	etag    string
+	lost    bool
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewS3 creates a locker with lock objects under prefix in bucket
+func NewS3(sess *session.Session, bucket, prefix string, ttl time.Duration) *S3 {
+	return &S3{
+		Bucket: bucket,
+		Prefix: strings.Trim(prefix, "/"),
+		TTL:    ttl,
+		client: s3.New(sess),
+		owner:  Owner(),
+		held:   map[string]*heldLock{},
+	}
+}
+
+func (l *S3) lockKey(file string) string {
+	return fmt.Sprintf("%s/%s.lock", l.Prefix, filepath.Base(file))
+}
+
+// Lock takes the lock for a file
+func (l *S3) Lock(file string) error {
+	key := l.lockKey(file)
+
+	etag, err := l.create(key)
+	if err == nil {
+		l.hold(key, etag)
+		return nil
+	}
+	if !isPreconditionFailed(err) {
+		return fmt.Errorf("failed to create lock object %q: %s", key, err.Error())
+	}
+
+	// Lock is held by someone, take it over only if it's expired. The expired object is overwritten only if it's
+	// unchanged, so of replicas taking it over at once only one gets it.
+	expiredETag, ok := l.expired(key)
+	if !ok {
+		return fmt.Errorf("file %q is locked by another uploader", file)
+	}
+	etag, err = l.put(key, "If-Match", expiredETag)
+	if isPreconditionFailed(err) {
+		return fmt.Errorf("file %q is locked by another uploader", file)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to take over expired lock object %q: %s", key, err.Error())
+	}
+	l.hold(key, etag)
+	return nil
+}
+
+// create creates lock object if it doesn't exist and returns its ETag
+func (l *S3) create(key string) (string, error) {
+	return l.put(key, "If-None-Match", "*")
+}
+
+// put writes the lock object with the current time under a conditional header and returns its ETag
+func (l *S3) put(key, header, value string) (string, error) {
+	body := fmt.Sprintf("%s %d", l.owner, time.Now().Unix())
+	req, out := l.client.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(l.Bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader(body),
+	})
+	req.HTTPRequest.Header.Set(header, value)
+	if err := req.Send(); err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.ETag), nil
+}
+
+// hold refreshes the lock object every TTL/3 until the lock is released. Refreshes are conditional on the ETag of
+// the last write, so a lock taken over by another replica is never overwritten. The lock is lost once a refresh
+// finds it changed or refreshes keep failing for TTL, as another replica may have taken it over by then.
+func (l *S3) hold(key, etag string) {
+	h := &heldLock{etag: etag, done: make(chan struct{}), stopped: make(chan struct{})}
+	l.mu.Lock()
+	old := l.held[key]
+	l.held[key] = h
+	l.mu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+
+	if l.TTL <= 0 {
+		close(h.stopped)
+		return
+	}
+	go func() {
+		defer close(h.stopped)
+		ticker := time.NewTicker(l.TTL / 3)
+		defer ticker.Stop()
+		written := time.Now()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-ticker.C:
+				refreshed, err := l.put(key, "If-Match", h.etag)
+				if err == nil {
+					h.etag, written = refreshed, time.Now()
+					continue
+				}
+				if isPreconditionFailed(err) || time.Since(written) >= l.TTL {
+					h.lost = true
+					return
+				}
+			}
+		}
+	}()
+}
+
+// stop stops refreshing the lock object and waits for the refresher to finish
+func (h *heldLock) stop() {
+	close(h.done)
+	<-h.stopped
+}
+
+// release stops refreshing the lock object, nil if the lock is not held
+func (l *S3) release(key string) *heldLock {
+	l.mu.Lock()
+	h, ok := l.held[key]
+	delete(l.held, key)
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	h.stop()
+	return h
+}
+
+// expired returns the ETag of the lock object if it's older than TTL
+func (l *S3) expired(key string) (string, bool) {
+	out, err := l.client.GetObject(&s3.GetObjectInput{Bucket: aws.String(l.Bucket), Key: aws.String(key)})
+	if err != nil {
+		return "", false
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return "", false
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 {
+		return "", false
+	}
+	created, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", false
+	}
+	return aws.StringValue(out.ETag), time.Since(time.Unix(created, 0)) > l.TTL
+}
+
+// Unlock releases the lock for a file. The lock object is deleted only if it's still the one this locker wrote,
+// a lock that was lost is left to the replica that took it over.
+func (l *S3) Unlock(file string) error {
+	key := l.lockKey(file)
+	h := l.release(key)
+	if h == nil {
+		return fmt.Errorf("lock object %q is not held", key)
+	}
+	if h.lost {
+		return fmt.Errorf("lock object %q was lost, it's not deleted", key)
+	}
+
+	req, _ := l.client.DeleteObjectRequest(&s3.DeleteObjectInput{Bucket: aws.String(l.Bucket), Key: aws.String(key)})
+	req.HTTPRequest.Header.Set("If-Match", h.etag)
+	if err := req.Send(); err != nil {
+		if isPreconditionFailed(err) {
+			return fmt.Errorf("lock object %q was taken over by another uploader, it's not deleted", key)
+		}
+		return err
+	}
+	return nil
+}
+
+// isPreconditionFailed checks if a conditional write failed because the object exists or was changed
+func isPreconditionFailed(err error) bool {
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() == 412 || reqErr.StatusCode() == 409
+	}
+	return false
+}
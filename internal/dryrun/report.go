@@ -0,0 +1,98 @@
+package dryrun
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+)
+
+// Entry is a file that would be uploaded
+type Entry struct {
+	Source       string
+	Key          string
+	Size         int64
+	UploadSize   int64
+	StorageClass string
+}
+
+// Report collects files processed in a dry-run. A nil Report does nothing.
+type Report struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+// Add adds a file to the report
+func (r *Report) Add(entry Entry) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries = append(r.entries, entry)
+}
+
+// Summary of a dry-run
+type Summary struct {
+	Files          int
+	Size           int64
+	UploadSize     int64
+	StorageClasses map[string]int
+}
+
+// Summary returns totals of all files
+func (r *Report) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	s := Summary{StorageClasses: map[string]int{}}
+	for _, e := range r.entries {
+		s.Files++
+		s.Size += e.Size
+		s.UploadSize += e.UploadSize
+		class := e.StorageClass
+		if class == "" {
+			class = "bucket default"
+		}
+		s.StorageClasses[class]++
+	}
+	return s
+}
+
+// Print writes all files and totals, upload time is estimated if bandwidth in bytes per second is known
+func (r *Report) Print(w io.Writer, bandwidth int64) {
+	r.mu.Lock()
+	entries := make([]Entry, len(r.entries))
+	copy(entries, r.entries)
+	r.mu.Unlock()
+
+	fmt.Fprintln(w, "Dry-run report:")
+	for _, e := range entries {
+		class := ""
+		if e.StorageClass != "" {
+			class = fmt.Sprintf(" [%s]", e.StorageClass)
+		}
+		fmt.Fprintf(w, "  %q (%s) -> %s (%s)%s\n", e.Source, utils.HumanizeBytes(e.Size, false), e.Key, utils.HumanizeBytes(e.UploadSize, false), class)
+	}
+
+	s := r.Summary()
+	fmt.Fprintf(w, "\nFiles: %d, source size: %s, upload size: %s\n", s.Files, utils.HumanizeBytes(s.Size, false), utils.HumanizeBytes(s.UploadSize, false))
+
+	classes := make([]string, 0, len(s.StorageClasses))
+	for class := range s.StorageClasses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "Storage class %s: %d files\n", class, s.StorageClasses[class])
+	}
+
+	if bandwidth > 0 {
+		estimate := time.Duration(float64(s.UploadSize) / float64(bandwidth) * float64(time.Second))
+		fmt.Fprintf(w, "Estimated upload time at %s: %s\n", utils.HumanizeBytes(bandwidth, true), estimate.Round(time.Second))
+	}
+}
@@ -0,0 +1,28 @@
+package dryrun
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReport(t *testing.T) {
+	r := &Report{}
+	r.Add(Entry{Source: "/data/a.sql", Key: "/backups/a.sql.tgz", Size: 3000000, UploadSize: 1000000})
+	r.Add(Entry{Source: "/data/b.tar", Key: "/backups/archives/b.tar", Size: 9000000, UploadSize: 9000000, StorageClass: "GLACIER"})
+
+	s := r.Summary()
+	assert.Equal(t, 2, s.Files)
+	assert.Equal(t, int64(12000000), s.Size)
+	assert.Equal(t, int64(10000000), s.UploadSize)
+	assert.Equal(t, map[string]int{"bucket default": 1, "GLACIER": 1}, s.StorageClasses)
+
+	var out bytes.Buffer
+	r.Print(&out, 1000000)
+	assert.Contains(t, out.String(), "Files: 2, source size: 12 MB, upload size: 10 MB")
+	assert.Contains(t, out.String(), "Estimated upload time at 1.0 MB/s: 10s")
+
+	var nilReport *Report
+	nilReport.Add(Entry{})
+}
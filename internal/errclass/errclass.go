@@ -0,0 +1,82 @@
+// Package errclass classifies errors of file uploads, so a failed file is retried, quarantined until it changes or
+// the uploader is stopped depending on the error. Unclassified errors are transient.
+package errclass
+
+import "errors"
+
+var (
+	// ErrTransient is a failure that could go away on its own, e.g. a network error, the file is retried later
+	ErrTransient = errors.New("transient error")
+	// ErrPermanent is a failure of the file itself that retries won't fix, e.g. an object too large for S3
+	ErrPermanent = errors.New("permanent error")
+	// ErrConfig is a failure of the configuration that fails every file, e.g. a missing bucket or tool
+	ErrConfig = errors.New("configuration error")
+)
+
+// Error classes, error metrics are labeled with them
+const (
+	ClassTransient = "transient"
+	ClassPermanent = "permanent"
+	ClassConfig    = "config"
+)
+
+// Classes are all error classes
+var Classes = []string{ClassTransient, ClassPermanent, ClassConfig}
+
+// classified keeps the message of the error, errors.Is matches both the error and its class
+type classified struct {
+	err   error
+	class error
+}
+
+func (e *classified) Error() string {
+	return e.err.Error()
+}
+
+func (e *classified) Unwrap() []error {
+	return []error{e.err, e.class}
+}
+
+func wrap(err, class error) error {
+	if err == nil {
+		return nil
+	}
+	return &classified{err: err, class: class}
+}
+
+// Transient marks the error as transient
+func Transient(err error) error {
+	return wrap(err, ErrTransient)
+}
+
+// Permanent marks the error as permanent
+func Permanent(err error) error {
+	return wrap(err, ErrPermanent)
+}
+
+// Config marks the error as a configuration error
+func Config(err error) error {
+	return wrap(err, ErrConfig)
+}
+
+// Inherit marks err with the class of cause, so the class isn't lost when cause is formatted into err
+func Inherit(err, cause error) error {
+	switch Class(cause) {
+	case ClassConfig:
+		return Config(err)
+	case ClassPermanent:
+		return Permanent(err)
+	}
+	return err
+}
+
+// Class returns the class of the error
+func Class(err error) string {
+	switch {
+	case errors.Is(err, ErrConfig):
+		return ClassConfig
+	case errors.Is(err, ErrPermanent):
+		return ClassPermanent
+	}
+	return ClassTransient
+}
@@ -0,0 +1,27 @@
+package errclass
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClass(t *testing.T) {
+	assert.Equal(t, ClassTransient, Class(errors.New("connection reset")))
+	assert.Equal(t, ClassTransient, Class(Transient(errors.New("connection reset"))))
+	assert.Equal(t, ClassConfig, Class(fmt.Errorf("failed to upload: %w", Config(errors.New("no such bucket")))))
+
+	// Classified errors keep their message and cause
+	err := Permanent(fmt.Errorf("file %q: %w", "big.csv", os.ErrInvalid))
+	assert.EqualError(t, err, `file "big.csv": invalid argument`)
+	assert.ErrorIs(t, err, os.ErrInvalid)
+	assert.ErrorIs(t, err, ErrPermanent)
+	assert.Nil(t, Permanent(nil))
+
+	// The class survives formatting the cause into a new error
+	assert.Equal(t, ClassPermanent, Class(Inherit(fmt.Errorf("failed to upload file, %v", err), err)))
+	assert.Equal(t, ClassTransient, Class(Inherit(errors.New("failed"), errors.New("timeout"))))
+}
@@ -0,0 +1,141 @@
+// Package failures keeps the last failed uploads, so they can be looked into without searching the logs
+package failures
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Failure is a failed attempt to upload a file or a group of files
+type Failure struct {
+	File     string    `json:"file"`
+	Error    string    `json:"error"`
+	Time     time.Time `json:"time"`
+	Attempts int       `json:"attempts"`
+}
+
+// List keeps the last failures, oldest ones are dropped when it's full. It is persisted to a JSON file if path is set.
+type List struct {
+	path  string
+	limit int
+
+	mu       sync.Mutex
+	failures []Failure
+	// Failed attempts in a row of files that haven't been uploaded since
+	attempts map[string]int
+}
+
+// Open loads the list from a file, empty path means the list is kept in memory only
+func Open(path string, limit int) (*List, error) {
+	l := &List{path: path, limit: limit, failures: []Failure{}, attempts: map[string]int{}}
+	if path == "" {
+		return l, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read failures file %q: %s", path, err.Error())
+	}
+	if err := json.Unmarshal(data, &l.failures); err != nil {
+		return nil, fmt.Errorf("failed to parse failures file %q: %s", path, err.Error())
+	}
+
+	l.trim()
+	for _, failure := range l.failures {
+		l.attempts[failure.File] = failure.Attempts
+	}
+	return l, nil
+}
+
+// Add records a failed upload of the file
+func (l *List) Add(file string, err error) error {
+	if l == nil || l.limit <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.attempts[file]++
+	l.failures = append(l.failures, Failure{File: file, Error: err.Error(), Time: time.Now(), Attempts: l.attempts[file]})
+	l.trim()
+	return l.save()
+}
+
+// Success resets the number of failed attempts of an uploaded file, its past failures stay in the list
+func (l *List) Success(file string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, file)
+}
+
+// All returns the failures, the latest one first
+func (l *List) All() []Failure {
+	if l == nil {
+		return []Failure{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	all := make([]Failure, len(l.failures))
+	for i, failure := range l.failures {
+		all[len(all)-1-i] = failure
+	}
+	return all
+}
+
+// Drop the oldest failures over the limit, must be called with the lock held.
+// Attempts are only counted for files in the list, so they don't pile up for files that are gone.
+func (l *List) trim() {
+	if len(l.failures) <= l.limit {
+		return
+	}
+	l.failures = append([]Failure{}, l.failures[len(l.failures)-l.limit:]...)
+
+	listed := map[string]bool{}
+	for _, failure := range l.failures {
+		listed[failure.File] = true
+	}
+	for file := range l.attempts {
+		if !listed[file] {
+			delete(l.attempts, file)
+		}
+	}
+}
+
+// Write the list to the file, must be called with the lock held
+func (l *List) save() error {
+	if l.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(l.failures, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), filepath.Base(l.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save failures file %q: %s", l.path, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save failures file %q: %s", l.path, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save failures file %q: %s", l.path, err.Error())
+	}
+
+	return os.Rename(tmp.Name(), l.path)
+}
@@ -0,0 +1,73 @@
+package failures
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "failures.json")
+
+	l, err := Open(path, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []Failure{}, l.All())
+
+	assert.Nil(t, l.Add("a.sql", errors.New("timeout")))
+	assert.Nil(t, l.Add("b.sql", errors.New("denied")))
+	assert.Nil(t, l.Add("a.sql", errors.New("timeout again")))
+
+	// The latest failure goes first, attempts are counted per file
+	all := l.All()
+	assert.Equal(t, 3, len(all))
+	assert.Equal(t, "a.sql", all[0].File)
+	assert.Equal(t, "timeout again", all[0].Error)
+	assert.Equal(t, 2, all[0].Attempts)
+	assert.Equal(t, 1, all[1].Attempts)
+
+	// Attempts start over after a successful upload
+	l.Success("a.sql")
+	assert.Nil(t, l.Add("a.sql", errors.New("timeout")))
+	assert.Equal(t, 1, l.All()[0].Attempts)
+
+	// The list survives reopening and is limited
+	l, err = Open(path, 2)
+	assert.Nil(t, err)
+	all = l.All()
+	assert.Equal(t, 2, len(all))
+	assert.Equal(t, "a.sql", all[0].File)
+	assert.Equal(t, "timeout again", all[1].Error)
+	assert.Nil(t, l.Add("a.sql", errors.New("timeout")))
+	assert.Equal(t, 2, l.All()[0].Attempts)
+
+	// Nil list and zero limit record nothing
+	var nilList *List
+	assert.Nil(t, nilList.Add("a.sql", errors.New("timeout")))
+	assert.Equal(t, []Failure{}, nilList.All())
+	l, err = Open("", 0)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Add("a.sql", errors.New("timeout")))
+	assert.Equal(t, []Failure{}, l.All())
+}
+
+func TestTally(t *testing.T) {
+	tally := NewTally()
+	assert.Nil(t, tally.Check(true, 0))
+
+	tally.Add("a.sql", nil)
+	tally.Add("b.sql", errors.New("timeout"))
+	tally.Add("c.sql", errors.New("timeout"))
+	tally.Add("c.sql", nil)
+	tally.Add("d.sql", nil)
+
+	// Files uploaded on a retry don't count as failed
+	uploaded, failed := tally.Counts()
+	assert.Equal(t, 3, uploaded)
+	assert.Equal(t, 1, failed)
+
+	assert.ErrorContains(t, tally.Check(true, 1), "1 of 4 files failed")
+	assert.Nil(t, tally.Check(false, 0.25))
+	assert.ErrorContains(t, tally.Check(false, 0.2), "error rate 0.25 is over 0.20")
+}
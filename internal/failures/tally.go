@@ -0,0 +1,55 @@
+package failures
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Tally counts files uploaded during a run and files whose last upload attempt failed, a file that
+// fails and is uploaded on a retry counts as uploaded
+type Tally struct {
+	mu       sync.Mutex
+	uploaded int
+	failing  map[string]bool
+}
+
+// NewTally creates an empty tally
+func NewTally() *Tally {
+	return &Tally{failing: map[string]bool{}}
+}
+
+// Add counts the result of an upload of the file
+func (t *Tally) Add(file string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		t.failing[file] = true
+		return
+	}
+	delete(t.failing, file)
+	t.uploaded++
+}
+
+// Counts returns the number of uploaded and failed files
+func (t *Tally) Counts() (uploaded, failed int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.uploaded, len(t.failing)
+}
+
+// Check fails if any file failed with failOnAny, or if the share of failed files is over maxErrorRate
+func (t *Tally) Check(failOnAny bool, maxErrorRate float64) error {
+	uploaded, failed := t.Counts()
+	if failed == 0 {
+		return nil
+	}
+	if failOnAny {
+		return fmt.Errorf("%d of %d files failed to upload", failed, uploaded+failed)
+	}
+	if rate := float64(failed) / float64(uploaded+failed); rate > maxErrorRate {
+		return fmt.Errorf("%d of %d files failed to upload, error rate %.2f is over %.2f", failed, uploaded+failed, rate, maxErrorRate)
+	}
+	return nil
+}
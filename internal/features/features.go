@@ -0,0 +1,221 @@
+package features
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Feature flag names
+const (
+	// UploadsEnabled pauses workers when set to false, files stay in the queue
+	UploadsEnabled = "uploads_enabled"
+	// VerifyEnabled skips checking uploaded objects before sources are deleted when set to false
+	VerifyEnabled = "verify_enabled"
+	// AlertsEnabled stops sending alerts to the webhook when set to false
+	AlertsEnabled = "alerts_enabled"
+)
+
+// Flags every registry has, a nil registry returns their defaults
+var builtin = []struct {
+	name string
+	def  interface{}
+	help string
+}{
+	{UploadsEnabled, true, "Workers take files from the queue and upload them"},
+	{VerifyEnabled, true, "Uploaded objects are checked before sources are deleted if -verify-before-delete is set"},
+	{AlertsEnabled, true, "Alerts are sent to -alert-webhook"},
+}
+
+// builtinDefault returns the default value of a flag every registry has, nil for other flags
+func builtinDefault(name string) interface{} {
+	for _, f := range builtin {
+		if f.name == name {
+			return f.def
+		}
+	}
+	return nil
+}
+
+// Flag is a runtime feature toggle or a tunable value, the value is either bool or float64
+type Flag struct {
+	Value   interface{} `json:"value"`
+	Default interface{} `json:"default"`
+	Help    string      `json:"help"`
+}
+
+// Registry keeps runtime feature flags, changed values are persisted to a JSON file if path is set
+type Registry struct {
+	path string
+
+	mu    sync.RWMutex
+	flags map[string]*Flag
+
+	// Persisted values of flags that are not defined yet
+	persisted map[string]interface{}
+}
+
+// New creates a registry with default flags and loads persisted values from path
+func New(path string) (*Registry, error) {
+	r := &Registry{path: path, flags: map[string]*Flag{}, persisted: map[string]interface{}{}}
+	for _, f := range builtin {
+		r.Define(f.name, f.def, f.help)
+	}
+
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read feature flags file %q: %s", path, err.Error())
+	}
+
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, fmt.Errorf("failed to parse feature flags file %q: %s", path, err.Error())
+	}
+
+	for name, value := range values {
+		if _, ok := r.flags[name]; !ok {
+			r.persisted[name] = value
+			continue
+		}
+		if err := r.set(name, value); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Define adds a flag with a default value, def must be bool or float64
+func (r *Registry) Define(name string, def interface{}, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.flags[name]; ok {
+		return
+	}
+
+	r.flags[name] = &Flag{Value: def, Default: def, Help: help}
+	if value, ok := r.persisted[name]; ok && r.validate(name, value) == nil {
+		r.flags[name].Value = value
+	}
+}
+
+// Bool returns a bool flag value, unknown flags are false
+func (r *Registry) Bool(name string) bool {
+	if r == nil {
+		value, _ := builtinDefault(name).(bool)
+		return value
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if flag, ok := r.flags[name]; ok {
+		value, _ := flag.Value.(bool)
+		return value
+	}
+	return false
+}
+
+// Float returns a float64 flag value, unknown flags are 0
+func (r *Registry) Float(name string) float64 {
+	if r == nil {
+		value, _ := builtinDefault(name).(float64)
+		return value
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if flag, ok := r.flags[name]; ok {
+		value, _ := flag.Value.(float64)
+		return value
+	}
+	return 0
+}
+
+// All returns a copy of all flags
+func (r *Registry) All() map[string]Flag {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	flags := map[string]Flag{}
+	for name, flag := range r.flags {
+		flags[name] = *flag
+	}
+	return flags
+}
+
+// Update sets new values of flags and persists them, nothing is changed if any of the values is invalid
+func (r *Registry) Update(values map[string]interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, value := range values {
+		if err := r.validate(name, value); err != nil {
+			return err
+		}
+	}
+
+	for name, value := range values {
+		r.flags[name].Value = value
+	}
+	return r.save()
+}
+
+// validate checks that a flag exists and the value has the same type as its default, must be called with the lock held
+func (r *Registry) validate(name string, value interface{}) error {
+	flag, ok := r.flags[name]
+	if !ok {
+		return fmt.Errorf("unknown feature flag %q", name)
+	}
+
+	if fmt.Sprintf("%T", value) != fmt.Sprintf("%T", flag.Default) {
+		return fmt.Errorf("feature flag %q must be %T, got %T", name, flag.Default, value)
+	}
+	return nil
+}
+
+// set sets a single flag value
+func (r *Registry) set(name string, value interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.validate(name, value); err != nil {
+		return err
+	}
+	r.flags[name].Value = value
+	return nil
+}
+
+// save persists changed values, must be called with the lock held
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	values := map[string]interface{}{}
+	for name, value := range r.persisted {
+		values[name] = value
+	}
+	for name, flag := range r.flags {
+		if flag.Value != flag.Default {
+			values[name] = flag.Value
+		}
+	}
+
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to save feature flags file %q: %s", r.path, err.Error())
+	}
+	return os.Rename(tmp, r.path)
+}
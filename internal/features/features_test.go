@@ -0,0 +1,42 @@
+package features
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+
+	r, err := New(path)
+	assert.Nil(t, err)
+	r.Define("sampling_rate", 1.0, "Sampling rate")
+	assert.True(t, r.Bool(UploadsEnabled))
+	assert.Equal(t, r.Float("sampling_rate"), 1.0)
+
+	assert.Nil(t, r.Update(map[string]interface{}{UploadsEnabled: false, "sampling_rate": 0.5}))
+	assert.False(t, r.Bool(UploadsEnabled))
+	assert.Equal(t, r.Float("sampling_rate"), 0.5)
+
+	// Invalid updates don't change anything
+	assert.NotNil(t, r.Update(map[string]interface{}{UploadsEnabled: true, "unknown": true}))
+	assert.NotNil(t, r.Update(map[string]interface{}{UploadsEnabled: "yes"}))
+	assert.False(t, r.Bool(UploadsEnabled))
+
+	// Values survive restarts
+	r, err = New(path)
+	assert.Nil(t, err)
+	assert.False(t, r.Bool(UploadsEnabled))
+	r.Define("sampling_rate", 1.0, "Sampling rate")
+	assert.Equal(t, r.Float("sampling_rate"), 0.5)
+	assert.True(t, r.Bool(VerifyEnabled))
+	assert.True(t, r.Bool(AlertsEnabled))
+
+	// Without a registry built-in flags have their defaults
+	var none *Registry
+	assert.True(t, none.Bool(VerifyEnabled))
+	assert.False(t, none.Bool("unknown"))
+	assert.Equal(t, 0.0, none.Float("sampling_rate"))
+}
@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+
+	"filippo.io/age"
+)
+
+// ParseAgeRecipients parses age recipients from a list of public keys and an identity file.
+// Recipients of the identities are used, the identities themselves are never used for encryption.
+func ParseAgeRecipients(keys []string, identityFile string) ([]age.Recipient, error) {
+	recipients := []age.Recipient{}
+
+	if len(keys) > 0 {
+		parsed, err := age.ParseRecipients(strings.NewReader(strings.Join(keys, "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age recipients: %s", err.Error())
+		}
+		recipients = append(recipients, parsed...)
+	}
+
+	if identityFile != "" {
+		f, err := os.Open(identityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open age identity file: %s", err.Error())
+		}
+		defer f.Close()
+
+		identities, err := age.ParseIdentities(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age identity file %q: %s", identityFile, err.Error())
+		}
+		for _, identity := range identities {
+			x25519, ok := identity.(*age.X25519Identity)
+			if !ok {
+				return nil, fmt.Errorf("unsupported identity type in age identity file %q", identityFile)
+			}
+			recipients = append(recipients, x25519.Recipient())
+		}
+	}
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("age encryption needs at least one recipient, use -age-recipients or -age-identity-file")
+	}
+
+	return recipients, nil
+}
+
+// encryptAge encrypts srcFile into encFile in-process with age, encryption stops when ctx is done
+func encryptAge(ctx context.Context, config cfg.AppConfig, encFile, srcFile string) error {
+	src, err := os.Open(srcFile)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(encFile)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	w, err := age.Encrypt(dst, config.AgeRecipients...)
+	if err != nil {
+		return fmt.Errorf("failed to start age encryption for %q: %s", srcFile, err.Error())
+	}
+
+	if _, err := io.Copy(w, contextReader{ctx: ctx, r: src}); err != nil {
+		return fmt.Errorf("failed to encrypt %q with age: %s", srcFile, err.Error())
+	}
+
+	// Close flushes the last chunk, the file is not decryptable without it
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to finish age encryption for %q: %s", srcFile, err.Error())
+	}
+	return dst.Close()
+}
+
+// contextReader fails reads once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,53 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// RequiredBinaries returns the list of external tools the configured pipeline depends on
+func RequiredBinaries(config cfg.AppConfig) []string {
+	binaries := []string{}
+
+	// The native engine compresses in the process
+	if config.Gzip && config.CompressEngine != CompressNative {
+		if config.Archive == ArchiveNone {
+			binaries = append(binaries, compressionPrograms[config.Compression])
+		} else {
+			binaries = append(binaries, "tar", compressionPrograms[config.Compression])
+		}
+	}
+
+	if config.Encrypt && config.EncryptEngine != "age" && config.EncryptEngine != "kms" {
+		binaries = append(binaries, "gpg")
+	}
+
+	return binaries
+}
+
+// CheckBinaries makes sure all external tools are installed and returns their versions
+func CheckBinaries(config cfg.AppConfig) (map[string]string, error) {
+	versions := map[string]string{}
+
+	binaries := RequiredBinaries(config)
+	if config.NoExec && len(binaries) > 0 {
+		return nil, fmt.Errorf("%s required by the current pipeline but external tools are disabled, use -compress-engine=native and -encrypt-engine=age or kms, or disable the stage that needs them", strings.Join(binaries, ", "))
+	}
+
+	for _, binary := range binaries {
+		path, err := lookPath(binary)
+		if err != nil {
+			return nil, fmt.Errorf("%q binary is required by the current pipeline but was not found in PATH, install it or disable the stage that needs it (-compression=none, -compress-engine=native, -encrypt-engine=age or -encrypt=false)", binary)
+		}
+
+		version, err := binaryVersion(path)
+		if err != nil {
+			return nil, fmt.Errorf("%q binary was found at %s but failed to report its version: %s", binary, path, err.Error())
+		}
+		versions[binary] = version
+	}
+
+	return versions, nil
+}
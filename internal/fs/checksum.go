@@ -0,0 +1,59 @@
+package fs
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// sumTracker keeps the checksum of every source file version, so the dedup check, the checksum sidecar and the
+// audit log of every attempt to upload it read the file only once
+type sumTracker struct {
+	mu   sync.Mutex
+	sums map[string]fileSum
+}
+
+// Checksum of a file with the given size and modification time
+type fileSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+var sums = sumTracker{sums: map[string]fileSum{}}
+
+// SourceSHA256 returns hex encoded SHA-256 checksum of a source file before compression and encryption, it's
+// computed again only when the file changes
+func SourceSHA256(config cfg.AppConfig, filename string) (string, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	name := WatchedFileName(config, filename)
+
+	sums.mu.Lock()
+	s, ok := sums.sums[name]
+	sums.mu.Unlock()
+	if ok && s.size == fi.Size() && s.modTime.Equal(fi.ModTime()) {
+		return s.sum, nil
+	}
+
+	// Files are hashed without the lock, workers hash different files at once
+	sum, err := FileSHA256(filename)
+	if err != nil {
+		return "", err
+	}
+	sums.mu.Lock()
+	sums.sums[name] = fileSum{size: fi.Size(), modTime: fi.ModTime(), sum: sum}
+	sums.mu.Unlock()
+	return sum, nil
+}
+
+// forgetSourceSum forgets the checksum of a deleted file
+func forgetSourceSum(config cfg.AppConfig, filename string) {
+	sums.mu.Lock()
+	defer sums.mu.Unlock()
+	delete(sums.sums, WatchedFileName(config, filename))
+}
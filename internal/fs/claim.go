@@ -0,0 +1,206 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Claim modes
+const (
+	// ClaimLock uses lock files, it works only for a single uploader process
+	ClaimLock = "lock"
+	// ClaimRename moves claimed files into a per-worker processing directory. Rename is atomic,
+	// so only one of uploader processes sharing the watch directory can claim a file.
+	ClaimRename = "rename"
+	// ClaimFlock uses flock(2) on lock files in a shared directory, e.g. on NFS
+	ClaimFlock = "flock"
+	// ClaimS3 uses lock objects in S3 created with conditional writes
+	ClaimS3 = "s3"
+)
+
+// processingDir returns the processing directory of a worker, .processing in the watched directory by default.
+// The instance ID is a part of it, so a restarted process recovers only files claimed by itself.
+func processingDir(config cfg.AppConfig, id int) string {
+	return filepath.Join(processingRoot(config), fmt.Sprintf("%s-%d", claimOwner(config), id))
+}
+
+// processingRoot returns the directory processing directories of all uploaders are created in
+func processingRoot(config cfg.AppConfig) string {
+	if config.ProcessingDir != "" {
+		return config.ProcessingDir
+	}
+	return filepath.Join(config.PathToWatch, ".processing")
+}
+
+// claimOwner returns the owner of processing directories, -instance-id or the host name without it. A stable
+// instance ID keeps claimed files recoverable when the host name changes on restart.
+func claimOwner(config cfg.AppConfig) string {
+	if config.InstanceID != "" {
+		return config.InstanceID
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// WatchedFileName returns the name a file has in the watched directory
+func WatchedFileName(config cfg.AppConfig, filename string) string {
+	return filepath.Join(config.PathToWatch, filepath.Base(filename))
+}
+
+// Claim claims files for exclusive processing by a worker and returns their new names.
+// Either all files are claimed or none of them.
+func Claim(config cfg.AppConfig, id int, files []string) ([]string, error) {
+	claimed, err := claim(config, id, files)
+	if err == nil {
+		inflight.add(claimed)
+	}
+	return claimed, err
+}
+
+func claim(config cfg.AppConfig, id int, files []string) ([]string, error) {
+	if config.ClaimMode == ClaimFlock || config.ClaimMode == ClaimS3 {
+		for i, file := range files {
+			if err := config.Locker.Lock(file); err != nil {
+				for _, locked := range files[:i] {
+					config.Locker.Unlock(locked)
+				}
+				return nil, err
+			}
+		}
+
+		// Another replica could have uploaded and deleted the files before we got the lock
+		for _, file := range files {
+			if _, err := os.Stat(file); err != nil {
+				Release(config, files)
+				return nil, fmt.Errorf("file %q is already processed: %s", file, err.Error())
+			}
+		}
+		return files, nil
+	}
+
+	if config.ClaimMode != ClaimRename {
+		for i, file := range files {
+			if err := Lock(file, id); err != nil {
+				for _, locked := range files[:i] {
+					UnLock(locked)
+				}
+				return nil, err
+			}
+		}
+		return files, nil
+	}
+
+	dir := processingDir(config, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	claimed := []string{}
+	for _, file := range files {
+		claimedFile := filepath.Join(dir, filepath.Base(file))
+		if err := renameClaimed(file, claimedFile); err != nil {
+			Release(config, claimed)
+			return nil, fmt.Errorf("failed to claim file %q: %s", file, err.Error())
+		}
+		claimed = append(claimed, claimedFile)
+	}
+	return claimed, nil
+}
+
+// renameClaimed moves a file into a processing directory. The target of a relative symlink is resolved against the
+// directory of the link first and the moved link is replaced with an absolute one, so it still points to the file.
+func renameClaimed(file, claimedFile string) error {
+	target, err := os.Readlink(file)
+	if err != nil || filepath.IsAbs(target) {
+		return os.Rename(file, claimedFile)
+	}
+
+	if err := os.Rename(file, claimedFile); err != nil {
+		return err
+	}
+	tmp := claimedFile + ".link"
+	if err = os.Symlink(filepath.Join(filepath.Dir(file), target), tmp); err == nil {
+		if err = os.Rename(tmp, claimedFile); err == nil {
+			return nil
+		}
+		os.Remove(tmp)
+	}
+	os.Rename(claimedFile, file)
+	return err
+}
+
+// Release releases claimed files, files that still exist are moved back to the watched directory to be retried.
+// Key suffixes of files that are gone are forgotten.
+func Release(config cfg.AppConfig, files []string) {
+	for _, file := range files {
+		inflight.remove(file)
+		if _, err := os.Lstat(file); os.IsNotExist(err) {
+			forgetKeySuffix(config, file)
+			forgetSourceSum(config, file)
+		}
+		if config.ClaimMode == ClaimFlock || config.ClaimMode == ClaimS3 {
+			if err := config.Locker.Unlock(file); err != nil {
+				config.Applog.Errorf("Failed to release lock for file %q: %s", file, err.Error())
+			}
+			continue
+		}
+
+		if config.ClaimMode != ClaimRename {
+			UnLock(file)
+			continue
+		}
+
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if err := os.Rename(file, WatchedFileName(config, file)); err != nil {
+			config.Applog.Errorf("Failed to release claimed file %q: %s", file, err.Error())
+		}
+	}
+}
+
+// RecoverClaims moves files left in processing directories of this instance after a crash back to the watched
+// directory. Directories of all workers are recovered, also of ones beyond the current number of workers.
+func RecoverClaims(config cfg.AppConfig) error {
+	if config.ClaimMode != ClaimRename {
+		return nil
+	}
+
+	dirs, err := os.ReadDir(processingRoot(config))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	prefix := claimOwner(config) + "-"
+	for _, d := range dirs {
+		suffix, ok := strings.CutPrefix(d.Name(), prefix)
+		if !ok || !d.IsDir() {
+			continue
+		}
+		id, err := strconv.Atoi(suffix)
+		if err != nil || id < 0 {
+			continue
+		}
+		dir := filepath.Join(processingRoot(config), d.Name())
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+
+		files := []string{}
+		for _, e := range entries {
+			files = append(files, filepath.Join(dir, e.Name()))
+		}
+		if len(files) > 0 {
+			config.Applog.Infof("Recovering %d files claimed by worker %d before restart", len(files), id)
+			Release(config, files)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+)
+
+// ContentSum returns SHA-256 checksum of a source file if uploads of identical files are skipped, empty otherwise
+func ContentSum(config cfg.AppConfig, filename string) (string, error) {
+	if config.DedupWindow <= 0 || config.State == nil {
+		return "", nil
+	}
+	return SourceSHA256(config, filename)
+}
+
+// contentKey keys uploaded contents by their destination, so the same content routed to another bucket, path or
+// URL is uploaded there too
+func contentKey(config cfg.AppConfig, sum string) string {
+	if config.HTTPURL != "" {
+		return fmt.Sprintf("%s %s", sum, config.HTTPURL)
+	}
+	return fmt.Sprintf("%s s3://%s%s", sum, config.S3bucket, config.S3path)
+}
+
+// UploadedContent returns an upload of the same content to the same destination within the dedup window
+func UploadedContent(config cfg.AppConfig, sum string) (state.Content, bool) {
+	if sum == "" {
+		return state.Content{}, false
+	}
+	content, ok := config.State.Content(contentKey(config, sum))
+	if !ok || content.UploadedAt.Before(time.Now().Add(-config.DedupWindow)) {
+		return state.Content{}, false
+	}
+	return content, true
+}
+
+// RecordContent remembers the content of an uploaded file, contents older than the dedup window are forgotten
+func RecordContent(config cfg.AppConfig, sum, filename string) error {
+	if sum == "" {
+		return nil
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+	key, err := ObjectKey(config, filename, PreparedFileName(config, filename))
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	return config.State.AddContent(contentKey(config, sum), state.Content{
+		File:       WatchedFileName(config, filename),
+		Key:        key,
+		Size:       fi.Size(),
+		UploadedAt: now,
+	}, now.Add(-config.DedupWindow))
+}
+
+// ForgetContent forgets an uploaded content, so an identical file is uploaded to the same destination again
+func ForgetContent(config cfg.AppConfig, sum string) error {
+	if sum == "" {
+		return nil
+	}
+	return config.State.DeleteContent(contentKey(config, sum))
+}
+
+// RemoveDuplicate deletes a file with already uploaded content sum or moves it to the dedup directory. Moved files
+// are prefixed with the time like trashed files, so duplicates with the same name don't overwrite each other.
+func RemoveDuplicate(config cfg.AppConfig, filename, sum string) error {
+	// The producer could have renamed, replaced or changed the file since it was hashed, only the content that was
+	// uploaded before is removed
+	target := inflight.currentName(filename)
+	if target == "" {
+		return DeleteSource(config, filename)
+	}
+	if current, err := SourceSHA256(config, target); err != nil || current != sum {
+		return fmt.Errorf("duplicate %q was changed while it was processed, it's kept to be uploaded", filename)
+	}
+	if config.DedupDir == "" {
+		return DeleteSource(config, filename)
+	}
+
+	if err := os.MkdirAll(config.DedupDir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(config.DedupDir, time.Now().UTC().Format(trashTimeFormat)+"-"+filepath.Base(target))
+	if err := os.Rename(target, dst); err != nil {
+		return fmt.Errorf("failed to move duplicate %q to %q: %s", target, dst, err.Error())
+	}
+
+	if config.State != nil {
+		config.State.Delete(WatchedFileName(config, filename))
+	}
+	forgetKeySuffix(config, filename)
+	forgetSourceSum(config, filename)
+	if err := DeleteKeyFile(config, filename); err != nil {
+		config.Applog.Errorf("Failed to delete key file of %q: %s", filename, err.Error())
+	}
+	if err := DeleteReadyMarker(config, filename); err != nil {
+		config.Applog.Errorf("Failed to delete ready marker of %q: %s", filename, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+)
+
+// What to do with a file found when the worker queue is full
+const (
+	// EnqueueBlock waits until a worker takes a file from the queue
+	EnqueueBlock = "block"
+	// EnqueueDrop leaves the file for the next scan
+	EnqueueDrop = "drop"
+	// EnqueueSpill records the file in the state file, it's queued first when there's space
+	EnqueueSpill = "spill"
+)
+
+// ValidateEnqueuePolicy checks the enqueue policy
+func ValidateEnqueuePolicy(policy string) error {
+	switch policy {
+	case EnqueueBlock, EnqueueDrop, EnqueueSpill:
+		return nil
+	}
+	return fmt.Errorf("unsupported enqueue policy %q, must be %s, %s or %s", policy, EnqueueBlock, EnqueueDrop, EnqueueSpill)
+}
+
+// enqueue queues a message according to the enqueue policy, it returns false if the message is not queued
+func enqueue(ctx context.Context, comm *queue.Queue, config cfg.AppConfig, msg cfg.Message) bool {
+	if config.EnqueuePolicy == EnqueueBlock {
+		return comm.PushWait(ctx, msg)
+	}
+	if comm.Push(msg) {
+		return true
+	}
+	config.Metrics.ChannelFullEvents.WithLabelValues().Inc()
+
+	// Without state there's nowhere to spill to, the file is left for the next scan
+	if config.EnqueuePolicy != EnqueueSpill || config.State == nil {
+		config.Metrics.EnqueueOverflow.WithLabelValues("dropped").Inc()
+		return false
+	}
+
+	if err := config.State.AddSpill(msg.File, state.Spill{Group: msg.Group, SpilledAt: time.Now()}); err != nil {
+		config.Applog.Errorf("Failed to spill %s from the full queue, it's left for the next scan: %s", GroupName(msg), err.Error())
+		config.Metrics.EnqueueOverflow.WithLabelValues("dropped").Inc()
+		return false
+	}
+	config.Applog.V(8).Infof("Queue is full, spilled %s to the state file", GroupName(msg))
+	config.Metrics.EnqueueOverflow.WithLabelValues("spilled").Inc()
+	return false
+}
+
+// requeueSpilled queues files spilled from the full queue while there's space, files that are gone are forgotten
+func requeueSpilled(comm *queue.Queue, config cfg.AppConfig) {
+	if config.State == nil {
+		return
+	}
+
+	for file, spill := range config.State.Spilled() {
+		if _, err := os.Lstat(file); err != nil {
+			config.State.DeleteSpill(file)
+			continue
+		}
+
+		msg := cfg.Message{File: file, Group: spill.Group}
+		setFileInfo(&msg)
+		if !comm.Push(msg) {
+			return
+		}
+		if err := config.State.DeleteSpill(file); err != nil {
+			config.Applog.Errorf("Failed to forget spilled %s: %s", GroupName(msg), err.Error())
+		}
+	}
+}
@@ -0,0 +1,222 @@
+//go:build !noexec
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+)
+
+// ExecSupported is true when the build can run external tools, builds with the noexec tag only use the native
+// compress engine and age or kms encryption
+const ExecSupported = true
+
+// encryptGPG encrypts a file with the gpg tool, gpg is killed when ctx is done
+func encryptGPG(ctx context.Context, config cfg.AppConfig, filename, encFile, srcFile string) error {
+	// Use external gpg tool to make sure we can decrypt easily using the same tool
+	cmd := exec.CommandContext(ctx, "gpg", gpgArgs(config, "0", encFile, srcFile)...)
+	if !IsAsymmetricEncryption(config) {
+		password, err := config.GpgPassword.Get()
+		if err != nil {
+			return fmt.Errorf("failed to get GPG password for %q: %s", filename, err.Error())
+		}
+		cmd.Stdin = strings.NewReader(password)
+	}
+	if output, err := cmd.CombinedOutput(); err != nil {
+		// Killed gpg may leave a partially written file behind
+		if ctx.Err() != nil {
+			return fmt.Errorf("gpg for %q cancelled: %s", filename, ctx.Err().Error())
+		}
+		// "gpg -c" always returns exit code 2, so we need to work that around by checking size of encrypted file
+		if fi, err := os.Stat(encFile); err == nil {
+			if fi.Size() > 0 {
+				// Encrypted file is not empty, we can exit
+				return nil
+			}
+		}
+		return execError(err, fmt.Errorf("error executing gpg CLI command for %q: %s: %s", filename, err.Error(), string(output)))
+	}
+	return nil
+}
+
+// encryptGPGStream encrypts a stream with the gpg tool. The stream goes through stdin, so the passphrase is passed
+// through another pipe.
+func encryptGPGStream(ctx context.Context, config cfg.AppConfig, in io.Reader, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, "gpg", gpgArgs(config, "3", "-", "-")...)
+	written := &countingWriter{w: out}
+	var stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = written, &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if !IsAsymmetricEncryption(config) {
+		password, err := config.GpgPassword.Get()
+		if err != nil {
+			return fmt.Errorf("failed to get GPG password: %s", err.Error())
+		}
+		passR, passW, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer passR.Close()
+		cmd.ExtraFiles = []*os.File{passR}
+		go func() {
+			io.WriteString(passW, password)
+			passW.Close()
+		}()
+	}
+
+	if err := cmd.Start(); err != nil {
+		return execError(err, fmt.Errorf("error executing gpg CLI command for stream: %s", err.Error()))
+	}
+
+	// Read errors of the stream are told apart from gpg not taking it
+	src := &errorReader{r: in}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdin, src)
+		stdin.Close()
+		copied <- err
+	}()
+	runErr := cmd.Wait()
+	copyErr := <-copied
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("gpg for stream cancelled: %s", ctx.Err().Error())
+	}
+	if src.err != nil {
+		return fmt.Errorf("failed to read stream for gpg: %s", src.err.Error())
+	}
+	if written.err != nil {
+		return fmt.Errorf("failed to write gpg output: %s", written.err.Error())
+	}
+	if runErr != nil {
+		// "gpg -c" returns exit code 2 even when it succeeds, the stream is encrypted if gpg took all of it and wrote
+		// the output
+		var exitErr *exec.ExitError
+		if errors.As(runErr, &exitErr) && exitErr.ExitCode() == 2 && copyErr == nil && written.n > 0 {
+			return nil
+		}
+		return execError(runErr, fmt.Errorf("error executing gpg CLI command for stream: %s: %s", runErr.Error(), stderr.String()))
+	}
+	if copyErr != nil {
+		return fmt.Errorf("failed to send stream to gpg: %s", copyErr.Error())
+	}
+	return nil
+}
+
+// execError marks err as a configuration error if the tool isn't installed, it would fail every file
+func execError(cause, err error) error {
+	if errors.Is(cause, exec.ErrNotFound) {
+		return errclass.Config(err)
+	}
+	return err
+}
+
+// countingWriter counts bytes written through it and keeps the first write error
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// errorReader keeps the first read error other than EOF
+type errorReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// compressTar packs a file into a tar archive with external tar and compressor tools, tar is killed when ctx is done
+func compressTar(ctx context.Context, config cfg.AppConfig, filename string) error {
+	file := filepath.Base(filename)
+	compressedFile := CompressedFileName(config, filename)
+
+	program := compressionPrograms[config.Compression]
+	if config.CompressionLevel > 0 {
+		program = fmt.Sprintf("%s -%d", program, config.CompressionLevel)
+	}
+
+	// Use external tar and compressor tools to make sure we can unpack easily, symlinks are archived as their targets
+	args := []string{"-I", program, "-cf", compressedFile, "-C", filepath.Dir(filename), file}
+	if config.FollowSymlinks {
+		args = append([]string{"-h"}, args...)
+	}
+	cmd := exec.CommandContext(ctx, "tar", args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("tar for %q cancelled: %s", filename, ctx.Err().Error())
+		}
+		return execError(err, fmt.Errorf("error executing tar CLI command with %s compression for %q: %s: %s", config.Compression, filename, err.Error(), string(output)))
+	}
+	return nil
+}
+
+// compressPlain compresses a file without a tar archive, the compressor writes to stdout as only gzip can be told
+// where to write its output. Symlinks are always compressed as their targets.
+func compressPlain(ctx context.Context, config cfg.AppConfig, filename string) error {
+	compressedFile := CompressedFileName(config, filename)
+	out, err := os.Create(compressedFile)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed file %q: %s", compressedFile, err.Error())
+	}
+	defer out.Close()
+
+	args := []string{"-c"}
+	if config.CompressionLevel > 0 {
+		args = append(args, fmt.Sprintf("-%d", config.CompressionLevel))
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, compressionPrograms[config.Compression], append(args, filename)...)
+	cmd.Stdout, cmd.Stderr = out, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s for %q cancelled: %s", config.Compression, filename, ctx.Err().Error())
+		}
+		return execError(err, fmt.Errorf("error executing %s CLI command for %q: %s: %s", config.Compression, filename, err.Error(), stderr.String()))
+	}
+	return out.Close()
+}
+
+// binaryVersion returns the first line of "<binary> --version" output
+func binaryVersion(path string) (string, error) {
+	output, err := exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(strings.SplitN(string(output), "\n", 2)[0]), nil
+}
+
+// lookPath finds an external tool in PATH
+func lookPath(binary string) (string, error) {
+	return exec.LookPath(binary)
+}
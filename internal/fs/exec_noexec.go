@@ -0,0 +1,44 @@
+//go:build noexec
+
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+)
+
+// ExecSupported is false in builds with the noexec tag, they never run external tools, so the binary can run
+// in an image without anything else in it
+const ExecSupported = false
+
+// errNoExec is a configuration error, the pipeline can't process any file with it
+var errNoExec = errclass.Config(errors.New("external tools are not supported by this build"))
+
+func encryptGPG(ctx context.Context, config cfg.AppConfig, filename, encFile, srcFile string) error {
+	return fmt.Errorf("failed to encrypt %q with gpg: %w", filename, errNoExec)
+}
+
+func encryptGPGStream(ctx context.Context, config cfg.AppConfig, in io.Reader, out io.Writer) error {
+	return fmt.Errorf("failed to encrypt stream with gpg: %w", errNoExec)
+}
+
+func compressTar(ctx context.Context, config cfg.AppConfig, filename string) error {
+	return fmt.Errorf("failed to compress %q with tar: %w", filename, errNoExec)
+}
+
+func compressPlain(ctx context.Context, config cfg.AppConfig, filename string) error {
+	return fmt.Errorf("failed to compress %q with %s: %w", filename, config.Compression, errNoExec)
+}
+
+func binaryVersion(path string) (string, error) {
+	return "", errNoExec
+}
+
+func lookPath(binary string) (string, error) {
+	return "", errNoExec
+}
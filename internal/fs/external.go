@@ -0,0 +1,108 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+)
+
+// ErrFileSkipped is returned by QueueFile for files that are never uploaded, reporting them again doesn't help
+var ErrFileSkipped = errors.New("file is skipped")
+
+// QueueFile queues a file reported by an external source, e.g. an SQS message, with the checks the directory
+// watcher does. The file must be in a watched directory. Files that are queued or being processed already are
+// not queued again and no error is returned, errors wrapping ErrFileSkipped are returned for files that are
+// never uploaded.
+func QueueFile(ctx context.Context, comm *queue.Queue, config cfg.AppConfig, file string) error {
+	file = filepath.Clean(file)
+	if !inWatchPath(config, file) {
+		return fmt.Errorf("%w: %q is not in a watched directory", ErrFileSkipped, file)
+	}
+	config = WatchPathConfig(config, file)
+
+	if config.Control.Draining() {
+		return fmt.Errorf("file %q is not queued while draining", file)
+	}
+	if tracker.isQueued(file) || IsInFlight(file) {
+		config.Applog.V(8).Infof("File %q is queued already", file)
+		return nil
+	}
+	if _, err := os.Lstat(file); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %q doesn't exist", ErrFileSkipped, file)
+	}
+
+	if IsIgnored(config, file) {
+		return fmt.Errorf("%w: %q matches %q", ErrFileSkipped, file, ignoredBy(config, file))
+	}
+	if !IsIncluded(config, file) {
+		return fmt.Errorf("%w: %q doesn't match include patterns", ErrFileSkipped, file)
+	}
+	if !IsReady(config, file) {
+		return fmt.Errorf("file %q is not ready: %s", file, notReadyReason(config))
+	}
+	if ok, reason := fileTypeAllowed(config, file); !ok {
+		return fmt.Errorf("%w: %q: %s", ErrFileSkipped, file, reason)
+	}
+	if ok, reason := sizeAllowed(config, file); !ok {
+		return fmt.Errorf("%w: %q: %s", ErrFileSkipped, file, reason)
+	}
+
+	msg := newMessage(file)
+	if !enqueue(ctx, comm, config, msg) {
+		return fmt.Errorf("file %q is not queued, the queue is full", file)
+	}
+	tracker.markQueued(file, messageID(msg))
+	return nil
+}
+
+// inWatchPath checks if the file is directly in one of the watched directories
+func inWatchPath(config cfg.AppConfig, file string) bool {
+	dir := filepath.Dir(file)
+	for _, watch := range config.WatchPaths {
+		if filepath.Clean(watch.Path) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// ReceiveFile writes a file received by an external source, e.g. an HTTP upload, into the first watched directory.
+// It's written to a hidden temporary file first, so watchers and scanners don't pick it up before it's complete,
+// and published with a hard link that fails if the name is taken, so files received at once never overwrite each
+// other. An error wrapping os.ErrExist is returned if a file of the name exists.
+func ReceiveFile(config cfg.AppConfig, name string, r io.Reader) (string, error) {
+	if name != filepath.Base(name) || name == "." || name == ".." || name == string(filepath.Separator) {
+		return "", fmt.Errorf("bad file name %q, it must not be a path", name)
+	}
+	file := filepath.Join(config.PathToWatch, name)
+	if _, err := os.Lstat(file); err == nil {
+		return "", fmt.Errorf("file %q: %w", file, os.ErrExist)
+	}
+
+	tmp, err := os.CreateTemp(config.PathToWatch, "."+name+".*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("failed to write %q: %w", file, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Link(tmp.Name(), file); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			return "", fmt.Errorf("file %q: %w", file, os.ErrExist)
+		}
+		return "", err
+	}
+	return file, nil
+}
@@ -0,0 +1,28 @@
+package fs
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// FIFOKey returns the key of stream number seq read from a FIFO at now. {time}, {seq}, {ulid}, {hostname} and
+// {instance} in the template are replaced, {seq} starts over on restart.
+func FIFOKey(config cfg.AppConfig, template, hostname string, now time.Time, seq int64) string {
+	ulid := ""
+	if strings.Contains(template, "{ulid}") {
+		suffixes.mu.Lock()
+		ulid = suffixes.newULID(now)
+		suffixes.mu.Unlock()
+	}
+
+	return strings.NewReplacer(
+		"{time}", now.UTC().Format("20060102T150405Z"),
+		"{seq}", fmt.Sprintf("%06d", seq),
+		"{ulid}", ulid,
+		"{hostname}", hostname,
+		"{instance}", config.InstanceID,
+	).Replace(template)
+}
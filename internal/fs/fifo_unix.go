@@ -0,0 +1,71 @@
+//go:build !windows
+
+package fs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// MakeFIFO creates the FIFO unless it exists, an existing path must be a FIFO
+func MakeFIFO(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if err := syscall.Mkfifo(path, 0600); err != nil {
+			return fmt.Errorf("failed to create FIFO %q: %s", path, err.Error())
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeNamedPipe == 0 {
+		return fmt.Errorf("%q exists and is not a FIFO", path)
+	}
+	return nil
+}
+
+// ReadFIFO passes streams written to the FIFO to handle until ctx is done. A stream lasts from the first writer
+// opening the FIFO until the last one closes it, writers that write nothing are skipped.
+func ReadFIFO(ctx context.Context, path string, handle func(r io.Reader)) error {
+	// Opening the FIFO blocks until there's a writer, the reader is woken up by opening it on exit
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-done:
+			return
+		case <-ctx.Done():
+		}
+		tick := time.NewTicker(100 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			if f, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+				f.Close()
+			}
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+
+	for ctx.Err() == nil {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open FIFO %q: %s", path, err.Error())
+		}
+
+		r := bufio.NewReader(f)
+		if _, err := r.Peek(1); err == nil && ctx.Err() == nil {
+			handle(r)
+		}
+		f.Close()
+	}
+	return nil
+}
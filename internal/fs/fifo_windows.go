@@ -0,0 +1,19 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+var errNoFIFO = errors.New("FIFOs are not supported on Windows")
+
+// MakeFIFO fails, Windows named pipes are not files
+func MakeFIFO(path string) error {
+	return errNoFIFO
+}
+
+// ReadFIFO fails, Windows named pipes are not files
+func ReadFIFO(ctx context.Context, path string, handle func(r io.Reader)) error {
+	return errNoFIFO
+}
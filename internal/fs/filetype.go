@@ -0,0 +1,60 @@
+package fs
+
+import (
+	"os"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// skippedFileType returns the type of a file that must not be uploaded or an empty string for regular files.
+// Reading fifos, sockets and devices can block tar or the upload forever. Symlinks are uploaded only with
+// -follow-symlinks and only if they point to a regular file.
+func skippedFileType(config cfg.AppConfig, filename string) string {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		// Let the worker deal with it
+		return ""
+	}
+
+	mode := fi.Mode()
+	if mode&os.ModeSymlink != 0 {
+		if !config.FollowSymlinks {
+			return "symlink"
+		}
+		if fi, err = os.Stat(filename); err != nil {
+			return "broken_symlink"
+		}
+		mode = fi.Mode()
+	}
+
+	switch {
+	case mode.IsRegular():
+		return ""
+	case mode.IsDir():
+		return "directory"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "irregular"
+	}
+}
+
+// fileTypeAllowed checks the file type, skipped files are counted by type
+func fileTypeAllowed(config cfg.AppConfig, filename string) (bool, string) {
+	fileType := skippedFileType(config, filename)
+	if fileType == "" {
+		return true, ""
+	}
+
+	if config.Metrics.FileSkippedType != nil {
+		config.Metrics.FileSkippedType.WithLabelValues(fileType).Inc()
+	}
+	if fileType == "symlink" {
+		return false, "symlink, -follow-symlinks is disabled"
+	}
+	return false, "not a regular file: " + fileType
+}
@@ -2,18 +2,26 @@ package fs
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
+	iofs "io/fs"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
 
 	"github.com/fsnotify/fsnotify"
 )
 
-const lockFilePrefix = "/tmp/s3-file-uploader.lock"
+// Lock files of -claim-mode=lock are kept in the temporary directory, /tmp unless $TMPDIR is set or %TEMP% on Windows
+var lockFilePrefix = filepath.Join(os.TempDir(), "s3-file-uploader.lock")
 
 // Check if fs event is the one we care about
 func isValidFsEvent(event fsnotify.Event) bool {
@@ -33,7 +41,7 @@ func isValidFsEvent(event fsnotify.Event) bool {
 	return false
 }
 
-func fsWatch(ctx context.Context, comm *chan cfg.Message, watcher *fsnotify.Watcher, config cfg.AppConfig) {
+func fsWatch(ctx context.Context, comm *queue.Queue, watcher *fsnotify.Watcher, config cfg.AppConfig) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -43,12 +51,53 @@ func fsWatch(ctx context.Context, comm *chan cfg.Message, watcher *fsnotify.Watc
 			if !ok {
 				return
 			}
-			if isValidFsEvent(event) {
-				config.Applog.Infof("Detected file: %q (%v)", event.Name, event.Op)
-				if len(*comm) < config.WorkersCannelSize {
-					*comm <- cfg.Message{File: event.Name}
-				} else {
-					config.Metrics.ChannelFullEvents.WithLabelValues().Inc()
+			if !isValidFsEvent(event) {
+				continue
+			}
+
+			// A queued file moved within the directory keeps its identity, the queue entry follows it.
+			// A file that is not queued anymore was processed, its identity can belong to a new file.
+			if id, ok := statIdentity(event.Name); ok {
+				if from, moved := tracker.movedFrom(event.Name, id); moved && comm.Contains(from) {
+					config.Applog.Infof("Detected move of queued file: %q -> %q", from, event.Name)
+					tracker.move(from, event.Name)
+					continue
+				} else if moved {
+					tracker.resolve(from)
+				}
+			}
+
+			if config.Control.IsControlFile(event.Name) || config.Control.Draining() {
+				continue
+			}
+
+			// Ready marker queues the file it belongs to
+			file := event.Name
+			fi, err := os.Lstat(file)
+			if IsReadyMarker(config, file) {
+				file = markedFileName(config, file)
+				if fi, err = os.Lstat(file); err != nil {
+					config.Applog.Warningf("Found ready marker %q without a file", event.Name)
+					continue
+				}
+			}
+			if err != nil {
+				// Gone since the event
+				continue
+			}
+
+			// Events go through the same checks as scanned files
+			if tracker.isQueued(file) || !uploadable(config, iofs.FileInfoToDirEntry(fi), file) {
+				continue
+			}
+			config.Applog.Infof("Detected file: %q (%v)", file, event.Op)
+			for _, msg := range watchedMessages(config, file) {
+				if tracker.isQueued(msg.File) {
+					continue
+				}
+				setFileInfo(&msg)
+				if enqueue(ctx, comm, config, msg) {
+					tracker.markQueued(msg.File, messageID(msg))
 				}
 			}
 		case err, ok := <-watcher.Errors:
@@ -60,28 +109,112 @@ func fsWatch(ctx context.Context, comm *chan cfg.Message, watcher *fsnotify.Watc
 	}
 }
 
-func fsScan(comm *chan cfg.Message, config cfg.AppConfig) {
-	entries, err := os.ReadDir(config.PathToWatch)
+// watchedMessages returns worker messages for a file found by the watcher. A member of a file group is queued with
+// the rest of the group once the group is complete in the directory.
+func watchedMessages(config cfg.AppConfig, file string) []cfg.Message {
+	if _, _, ok := matchFileGroup(config.FileGroups, file); !ok {
+		return []cfg.Message{{File: file}}
+	}
+
+	files, _, err := scanFiles(config, 0)
 	if err != nil {
-		config.Applog.Fatal(err)
+		config.Applog.Errorf("Failed to look for other members of the file group of %q: %s", file, err.Error())
+		return nil
+	}
+	for _, msg := range GroupMessages(config, files) {
+		if slices.Contains(msg.Group, file) {
+			return []cfg.Message{msg}
+		}
+	}
+	config.Applog.V(8).Infof("File %q is waiting for the rest of its file group", file)
+	return nil
+}
+
+// messageID returns the identity of the file of a message
+func messageID(msg cfg.Message) fileID {
+	return fileID{dev: msg.Dev, ino: msg.Ino}
+}
+
+func fsScan(ctx context.Context, comm *queue.Queue, config cfg.AppConfig) int {
+	// No new files while draining the queue
+	if config.Control.Draining() {
+		return 0
 	}
+	started := time.Now()
 
-	for _, e := range entries {
-		//config.Applog.Infof("Found file %q", e.Name())
-		filename := filepath.Join(config.PathToWatch, e.Name())
-		if IsLocked(filename) {
-			config.Applog.Infof("Found file %q but it's already being processed (lock detected)", filename)
-		} else {
-			*comm <- cfg.Message{File: filename}
+	// Files spilled from the full queue were found before the ones in this scan
+	requeueSpilled(comm, config)
+
+	// Network filesystems fail to list directories now and then, the directory is scanned again by the next scan
+	files, entries, err := scanFilesRetry(ctx, config)
+	config.Status.ScanDone(config.PathToWatch, len(files), entries, err)
+	if err != nil {
+		config.Applog.Errorf("Failed to scan %q, retrying on the next scan: %s", config.PathToWatch, err.Error())
+		return 0
+	}
+	if config.Metrics.DirectoryEntries != nil {
+		duration := time.Since(started).Seconds()
+		config.Metrics.DirectoryEntries.WithLabelValues().Set(float64(entries))
+		config.Metrics.ScanEntries.WithLabelValues().Add(float64(entries))
+		config.Metrics.ScanDuration.WithLabelValues().Set(duration)
+		config.Metrics.ScanFiles.WithLabelValues().Set(float64(len(files)))
+		if config.Metrics.HistScanDuration != nil {
+			config.Metrics.HistScanDuration.WithLabelValues().Observe(duration)
 		}
 	}
+
+	messages := GroupMessages(config, files)
+	for i := range messages {
+		setFileInfo(&messages[i])
+	}
+
+	// Files over the limit are left for the next scans, they are newer than the queued ones
+	for _, msg := range oldestMessages(messages, config.MaxFilesPerScan) {
+		if msg.Partial {
+			config.Applog.Warningf("Incomplete %s timed out after %s, uploading it as is", GroupName(msg), config.FileGroupTimeout)
+			config.Metrics.FileGroupPartial.WithLabelValues().Inc()
+		}
+
+		// Files left behind when the queue is full are picked up by the next scan
+		enqueue(ctx, comm, config, msg)
+	}
+	return len(files)
 }
 
-// ScanDirectory periodically scans the directory and sends files to process into the channel for workers
-func ScanDirectory(ctx context.Context, comm *chan cfg.Message, config cfg.AppConfig) {
-	tick := time.NewTicker(config.ScanInterval)
+// nextScanInterval returns the interval until the next scan. Scans run every -scan-interval while they find files,
+// the interval is doubled after every scan without files up to -scan-interval-max.
+func nextScanInterval(config cfg.AppConfig, current time.Duration, found int) time.Duration {
+	if found > 0 || config.ScanIntervalMax <= config.ScanInterval {
+		return config.ScanInterval
+	}
+	return min(current*2, config.ScanIntervalMax)
+}
+
+// newMessage creates a worker message for a file
+func newMessage(filename string) cfg.Message {
+	msg := cfg.Message{File: filename}
+	setFileInfo(&msg)
+	return msg
+}
+
+// setFileInfo sets file modification time and size used to order the queue, and identity of the file
+func setFileInfo(msg *cfg.Message) {
+	if fi, err := os.Stat(msg.File); err == nil {
+		msg.ModTime = fi.ModTime()
+		msg.Size = fi.Size()
+		id := identity(fi)
+		msg.Dev, msg.Ino = id.dev, id.ino
+	}
+}
+
+// ScanDirectory periodically scans the directory and sends files to process into the queue for workers, scans are
+// less frequent while the directory is idle with -scan-interval-max
+func ScanDirectory(ctx context.Context, comm *queue.Queue, config cfg.AppConfig) {
+	interval := config.ScanInterval
+	tick := time.NewTicker(interval)
 
 	config.Applog.Info("Directory scanner started")
+	beat(config)
 	// Keep fireing until we receive exit signal
 	for {
 		select {
@@ -92,14 +225,29 @@ func ScanDirectory(ctx context.Context, comm *chan cfg.Message, config cfg.AppCo
 		// Tick event
 		case <-tick.C:
 			//config.Applog.Info("Tick event")
-			fsScan(comm, config)
+			found := fsScan(ctx, comm, config)
+			if next := nextScanInterval(config, interval, found); next != interval {
+				config.Applog.V(8).Infof("Scan interval of %q changed to %s", config.PathToWatch, next)
+				interval = next
+				tick.Reset(interval)
+			}
+		// Scan requested by an operator
+		case <-config.ScanTrigger:
+			config.Applog.Info("Triggered directory scan")
+			found := fsScan(ctx, comm, config)
+			interval = nextScanInterval(config, interval, found)
+			tick.Reset(interval)
+		}
+		if config.Metrics.ScanInterval != nil {
+			config.Metrics.ScanInterval.WithLabelValues().Set(interval.Seconds())
 		}
+		beat(config)
 	}
 
 }
 
 // WatchDirectory uses fsnotify to watch directory for events
-func WatchDirectory(ctx context.Context, comm *chan cfg.Message, config cfg.AppConfig) {
+func WatchDirectory(ctx context.Context, comm *queue.Queue, config cfg.AppConfig) {
 	// Create new watcher.
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -116,80 +264,322 @@ func WatchDirectory(ctx context.Context, comm *chan cfg.Message, config cfg.AppC
 		config.Applog.Fatalf("Failed to watch %q path: %s", config.PathToWatch, err.Error())
 	}
 
-	// Watcher setup done, exiting
+	// Files spilled from the full queue are picked up as often as they would be by scans
+	spillTick := time.NewTicker(config.ScanInterval)
+	defer spillTick.Stop()
+
+	// Watcher setup done, scan only when an operator asks for it, e.g. after copying files instead of moving them
 	config.Applog.Infof("Started fsnotify watcher for %q path", config.PathToWatch)
-	<-ctx.Done()
-	config.Applog.Info("WatchDirectory function exiting")
+	beat(config)
+	for {
+		select {
+		case <-ctx.Done():
+			config.Applog.Info("WatchDirectory function exiting")
+			return
+		case <-spillTick.C:
+			requeueSpilled(comm, config)
+		case <-config.ScanTrigger:
+			config.Applog.Info("Triggered directory scan")
+			fsScan(ctx, comm, config)
+		}
+		beat(config)
+	}
 }
 
-// EncryptFile encrypts a file with gpg tool
-func EncryptFile(config cfg.AppConfig, filename string) error {
+// TriggerScan requests an immediate directory scan, it returns false if a scan is already pending
+func TriggerScan(config cfg.AppConfig) bool {
+	select {
+	case config.ScanTrigger <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// IsAsymmetricEncryption checks if files are encrypted to public keys instead of a shared passphrase
+func IsAsymmetricEncryption(config cfg.AppConfig) bool {
+	return len(config.GpgRecipients) > 0 || config.GpgPublicKeyFile != ""
+}
+
+// gpgArgs returns gpg CLI arguments for symmetric or public key encryption, the passphrase is read from
+// passphraseFD. "-" files are stdin and stdout.
+func gpgArgs(config cfg.AppConfig, passphraseFD, encFile, srcFile string) []string {
+	if !IsAsymmetricEncryption(config) {
+		// Passphrase is passed via a file descriptor to not leak it in the process list
+		return []string{"-c", "--batch", "--yes", "--passphrase-fd", passphraseFD, "-o", encFile, srcFile}
+	}
+
+	// Recipients are trusted explicitly by configuration, there is no web of trust on uploader nodes
+	args := []string{"-e", "--batch", "--yes", "--trust-model", "always"}
+	for _, recipient := range config.GpgRecipients {
+		args = append(args, "--recipient", recipient)
+	}
+	if config.GpgPublicKeyFile != "" {
+		args = append(args, "--recipient-file", config.GpgPublicKeyFile)
+	}
+	return append(args, "-o", encFile, srcFile)
+}
+
+// EncryptFile encrypts a file with gpg tool or age, encryption is killed when ctx is done
+func EncryptFile(ctx context.Context, config cfg.AppConfig, filename string) error {
 	if !config.Encrypt {
 		return nil
 	}
 
 	// Original command: gpg -c --verbose --batch --yes --passphrase $GPG_PASSWORD -o /data/enc/$f /data/sql/$f
-	file := filepath.Base(filename)
+	// Now the passphrase is sent to gpg stdin
 	srcFile := filename
-	if config.Gzip {
-		srcFile = filepath.Join(config.GzipDir, file+".tgz")
-	}
-	encFile := filepath.Join(config.EncryptDir, file+".tgz")
-
-	// Use external gpg tool to make sure we can decrypt easily using the same tool
-	cmd := exec.Command("gpg", "-c", "--batch", "--yes", "--passphrase", config.GpgPassword, "-o", encFile, srcFile)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		// "gpg -c" always returns exit code 2, so we need to work that around by checking size of encrypted file
-		if fi, err := os.Stat(encFile); err == nil {
-			if fi.Size() > 0 {
-				// Encrypted file is not empty, we can exit
-				return nil
-			}
-		}
-		return fmt.Errorf("error executing gpg CLI command for %q: %s: %s", filename, err.Error(), string(output))
+	if ShouldCompress(config, filename) {
+		srcFile = CompressedFileName(config, filename)
+	}
+	encFile := EncryptedFileName(config, filename)
+
+	if config.EncryptEngine == "age" {
+		return encryptAge(ctx, config, encFile, srcFile)
 	}
+	if config.EncryptEngine == "kms" {
+		return encryptKMS(ctx, config, encFile, srcFile)
+	}
+
+	return encryptGPG(ctx, config, filename, encFile, srcFile)
+}
+
+// Compression codecs and the compressor program used by tar for each of them
+var compressionPrograms = map[string]string{
+	"gzip": "gzip",
+	"zstd": "zstd",
+	"lz4":  "lz4",
+}
+
+// Archive formats
+const (
+	// ArchiveTar packs a file into a tar archive before compression
+	ArchiveTar = "tar"
+	// ArchiveNone compresses the file itself
+	ArchiveNone = "none"
+)
+
+// Archive file extensions for each compression codec
+var compressionExtensions = map[string]string{
+	"gzip": ".tgz",
+	"zstd": ".tar.zst",
+	"lz4":  ".tar.lz4",
+}
+
+// Extensions of plain compressed files without a tar archive
+var plainCompressionExtensions = map[string]string{
+	"gzip": ".gz",
+	"zstd": ".zst",
+	"lz4":  ".lz4",
+}
+
+// Max compression levels supported by each codec
+var compressionMaxLevels = map[string]int{
+	"gzip": 9,
+	"zstd": 19,
+	"lz4":  12,
+}
+
+// ValidateCompression checks compression codec and level
+func ValidateCompression(compression string, level int) error {
+	if compression == "none" {
+		return nil
+	}
+
+	maxLevel, ok := compressionMaxLevels[compression]
+	if !ok {
+		return fmt.Errorf("unsupported compression %q, must be one of: gzip, zstd, lz4, none", compression)
+	}
+
+	if level < 0 || level > maxLevel {
+		return fmt.Errorf("compression level for %s must be between 1 and %d, or 0 for the default", compression, maxLevel)
+	}
+
 	return nil
 }
 
-// GzipFile gzips a file
-func GzipFile(config cfg.AppConfig, filename string) error {
+// ValidateArchive checks the archive format
+func ValidateArchive(archive string) error {
+	if archive != ArchiveTar && archive != ArchiveNone {
+		return fmt.Errorf("unsupported archive format %q, must be %s or %s", archive, ArchiveTar, ArchiveNone)
+	}
+	return nil
+}
+
+// ParseExtensions parses a comma separated list of file extensions
+func ParseExtensions(list string) []string {
+	extensions := []string{}
+	for _, ext := range strings.Split(list, ",") {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions
+}
+
+// ShouldCompress checks if a file needs to be compressed, already compressed content is uploaded as is
+func ShouldCompress(config cfg.AppConfig, filename string) bool {
 	if !config.Gzip {
-		return nil
+		return false
+	}
+
+	name := strings.ToLower(filepath.Base(filename))
+	for _, ext := range config.NoCompressExtensions {
+		if strings.HasSuffix(name, ext) {
+			return false
+		}
+	}
+	return true
+}
+
+// FileCompression returns the compression codec that is used for a file
+func FileCompression(config cfg.AppConfig, filename string) string {
+	if !ShouldCompress(config, filename) {
+		return "none"
+	}
+	return config.Compression
+}
+
+// FileArchive returns the archive format that is used for a file, files that are not compressed are not archived
+func FileArchive(config cfg.AppConfig, filename string) string {
+	if !ShouldCompress(config, filename) || config.Archive == ArchiveNone {
+		return ArchiveNone
 	}
+	return ArchiveTar
+}
+
+// CompressedFileName returns the name of the temporary compressed file
+func CompressedFileName(config cfg.AppConfig, filename string) string {
+	file := filepath.Base(filename)
+	if config.Archive == ArchiveNone {
+		return filepath.Join(config.GzipDir, file+plainCompressionExtensions[config.Compression])
+	}
+	return filepath.Join(config.GzipDir, file+compressionExtensions[config.Compression])
+}
 
+// EncryptedFileName returns the name of the temporary encrypted file.
+// The suffix tells consumers how to decrypt the file unless legacy naming is enabled.
+func EncryptedFileName(config cfg.AppConfig, filename string) string {
 	file := filepath.Base(filename)
-	gzipFile := filepath.Join(config.GzipDir, file+".tgz")
+	if ShouldCompress(config, filename) {
+		file = filepath.Base(CompressedFileName(config, filename))
+	}
 
-	// Use external tar+gzip tool to make sure we can unpack easily
-	cmd := exec.Command("tar", "czf", gzipFile, "-C", config.PathToWatch, file)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("error executing tgz CLI command for %q: %s: %s", filename, err.Error(), string(output))
+	if config.LegacyKeyNames {
+		// Encrypted files were always named like compressed ones
+		if !ShouldCompress(config, filename) {
+			file += ".tgz"
+		}
+		return filepath.Join(config.EncryptDir, file)
 	}
-	return nil
+
+	if config.KeyIDInFilename && config.EncryptionKeyID != "" {
+		file += "." + config.EncryptionKeyID
+	}
+
+	switch config.EncryptEngine {
+	case "age":
+		file += ".age"
+	case "kms":
+		file += ".kms"
+	default:
+		file += ".gpg"
+	}
+	return filepath.Join(config.EncryptDir, file)
+}
+
+// CompressFile packs a file into a tar archive compressed with the configured codec, tar is killed when ctx is done
+func CompressFile(ctx context.Context, config cfg.AppConfig, filename string) error {
+	if !ShouldCompress(config, filename) {
+		return nil
+	}
+	if config.CompressEngine == CompressNative {
+		return compressNative(ctx, config, filename)
+	}
+	if config.Archive == ArchiveNone {
+		return compressPlain(ctx, config, filename)
+	}
+
+	return compressTar(ctx, config, filename)
+}
+
+// PreparedFileName returns the file that is actually uploaded after compression and encryption
+func PreparedFileName(config cfg.AppConfig, filename string) string {
+	realFile := filename
+
+	if ShouldCompress(config, filename) {
+		realFile = CompressedFileName(config, filename)
+	}
+
+	if config.Encrypt {
+		realFile = EncryptedFileName(config, filename)
+	}
+
+	return realFile
+}
+
+// FileSHA256 returns hex encoded SHA-256 checksum of a file
+func FileSHA256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ChecksumSuffix is added to object keys of checksum sidecars
+const ChecksumSuffix = ".sha256"
+
+// ChecksumSidecar returns the checksum of the source file in sha256sum format, so the file restored from the
+// uploaded object can be checked with sha256sum -c
+func ChecksumSidecar(config cfg.AppConfig, filename string) ([]byte, error) {
+	sum, err := SourceSHA256(config, filename)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("%s  %s\n", sum, filepath.Base(WatchedFileName(config, filename)))), nil
 }
 
 // DeleteFile deletes a file and all temporary ones (gzip and encrypted)
 func DeleteFile(config cfg.AppConfig, filename string) error {
-	file := filepath.Base(filename)
-	gzipFile := filepath.Join(config.GzipDir, file+".tgz")
-	encFile := filepath.Join(config.EncryptDir, file+".tgz")
+	if err := DeleteTempFiles(config, filename); err != nil {
+		return err
+	}
+	return DeleteSource(config, filename)
+}
+
+// DeleteTempFiles deletes temporary gzip and encrypted files
+func DeleteTempFiles(config cfg.AppConfig, filename string) error {
+	gzipFile := CompressedFileName(config, filename)
+	encFile := EncryptedFileName(config, filename)
 
-	if err := os.Remove(filename); err != nil {
-		if err := os.Remove(filename); err != nil {
+	if ShouldCompress(config, filename) {
+		if err := os.Remove(gzipFile); err != nil {
 			config.Applog.Error(err)
 			return err
 		}
 	}
 
-	if config.Gzip {
-		if err := os.Remove(gzipFile); err != nil {
+	if config.Encrypt {
+		if err := os.Remove(encFile); err != nil {
 			config.Applog.Error(err)
 			return err
 		}
 	}
 
-	if config.Encrypt {
-		if err := os.Remove(encFile); err != nil {
+	if config.Encrypt && config.EncryptEngine == "kms" {
+		if err := os.Remove(encFile + EnvelopeSuffix); err != nil {
 			config.Applog.Error(err)
 			return err
 		}
@@ -198,6 +588,126 @@ func DeleteFile(config cfg.AppConfig, filename string) error {
 	return nil
 }
 
+// DeleteSource deletes the source file or moves it into -trash-dir, making up to DeleteRetries attempts
+func DeleteSource(config cfg.AppConfig, filename string) error {
+	var err error
+
+	// The producer could have renamed or replaced the file while it was uploaded, only the uploaded file is deleted
+	target := inflight.currentName(filename)
+	if target == "" {
+		config.Applog.Warningf("File %q was replaced or deleted while it was processed, the new file is kept", filename)
+	} else if target != filename {
+		config.Applog.Infof("File %q was renamed to %q while it was processed", filename, target)
+	}
+
+	for attempt := 0; attempt <= config.DeleteRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(config.DeleteRetryDelay)
+		}
+
+		if config.TrashDir != "" {
+			err = moveToTrash(config, target)
+		} else {
+			err = removeFile(target)
+		}
+		if err == nil || os.IsNotExist(err) {
+			if config.State != nil {
+				config.State.Delete(WatchedFileName(config, filename))
+			}
+			forgetKeySuffix(config, filename)
+			forgetSourceSum(config, filename)
+			if err := DeleteKeyFile(config, filename); err != nil {
+				config.Applog.Errorf("Failed to delete key file of %q: %s", filename, err.Error())
+			}
+			if err := DeleteReadyMarker(config, filename); err != nil {
+				config.Applog.Errorf("Failed to delete ready marker of %q: %s", filename, err.Error())
+			}
+			return nil
+		}
+		config.Applog.Warningf("Failed to delete %q (attempt %d of %d): %s", filename, attempt+1, config.DeleteRetries+1, err.Error())
+	}
+
+	return err
+}
+
+// Quarantine records that a file was uploaded but can't be deleted, so it's not uploaded again until it changes.
+// State is kept by the name in the watched directory, claimed files are moved back there when released.
+func Quarantine(config cfg.AppConfig, filename string, reason error) error {
+	return quarantine(config, filename, state.StatusUndeletable, reason)
+}
+
+// QuarantineFailed records that a file failed with a permanent error, so it's not retried until it changes
+func QuarantineFailed(config cfg.AppConfig, filename string, reason error) error {
+	return quarantine(config, filename, state.StatusFailed, reason)
+}
+
+func quarantine(config cfg.AppConfig, filename, status string, reason error) error {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	// The file is uploaded again only when it changes, that version gets a new key suffix anyway
+	forgetKeySuffix(config, filename)
+	forgetSourceSum(config, filename)
+	return config.State.Set(WatchedFileName(config, filename), state.Entry{
+		Status:  status,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Error:   reason.Error(),
+	})
+}
+
+// IsQuarantined checks if a file was uploaded but couldn't be deleted or failed with a permanent error, and
+// hasn't changed since then
+func IsQuarantined(config cfg.AppConfig, filename string) bool {
+	return quarantineReason(config, filename) != ""
+}
+
+// quarantineReason returns why the file is quarantined, empty if it isn't
+func quarantineReason(config cfg.AppConfig, filename string) string {
+	if config.State == nil {
+		return ""
+	}
+
+	entry, ok := config.State.Get(WatchedFileName(config, filename))
+	if !ok || (entry.Status != state.StatusUndeletable && entry.Status != state.StatusFailed) {
+		return ""
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil || !entry.Matches(fi) {
+		return ""
+	}
+	if entry.Status == state.StatusFailed {
+		return "failed permanently: " + entry.Error
+	}
+	return "already uploaded but can't be deleted"
+}
+
+// ResumableUpload returns a multipart upload of the file that can be resumed, it needs the prepared file
+// to be left unchanged since the upload was started
+func ResumableUpload(config cfg.AppConfig, filename string) *state.Upload {
+	if !config.State.Persistent() {
+		return nil
+	}
+
+	entry, ok := config.State.Get(WatchedFileName(config, filename))
+	if !ok || entry.Status != state.StatusUploading || entry.Upload == nil {
+		return nil
+	}
+
+	source, err := os.Stat(filename)
+	if err != nil || !entry.Matches(source) {
+		return nil
+	}
+	prepared, err := os.Stat(entry.Upload.Prepared)
+	if err != nil || entry.Upload.Prepared != PreparedFileName(config, filename) || !entry.Upload.Matches(prepared) {
+		return nil
+	}
+	return entry.Upload
+}
+
 func getLockFileName(filename string) string {
 	file := filepath.Base(filename)
 	return fmt.Sprintf("%s.%s", lockFilePrefix, file)
@@ -233,3 +743,77 @@ func UnLock(filename string) error {
 	lockFile := getLockFileName(filename)
 	return os.Remove(lockFile)
 }
+
+// PlanAction is the action the next run would take for a file
+type PlanAction string
+
+const (
+	PlanUpload      PlanAction = "upload"
+	PlanSkip        PlanAction = "skip"
+	PlanQuarantined PlanAction = "quarantined"
+)
+
+// PlanEntry describes what would happen to a single directory entry
+type PlanEntry struct {
+	File   string
+	Action PlanAction
+	Reason string
+	Size   int64
+}
+
+// Plan compares the current state of the watched directory with the lock files
+// and returns what the next run would do with every entry, without touching anything
+func Plan(config cfg.AppConfig) ([]PlanEntry, error) {
+	entries, err := os.ReadDir(config.PathToWatch)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := []PlanEntry{}
+	for _, e := range entries {
+		filename := filepath.Join(config.PathToWatch, e.Name())
+		entry := PlanEntry{File: filename, Action: PlanSkip}
+
+		fi, err := e.Info()
+		if err != nil {
+			entry.Reason = err.Error()
+			plan = append(plan, entry)
+			continue
+		}
+		entry.Size = fi.Size()
+
+		fileType := skippedFileType(config, filename)
+		switch {
+		case fileType == "symlink":
+			entry.Reason = "symlink, -follow-symlinks is disabled"
+		case fileType != "":
+			entry.Reason = "not a regular file: " + fileType
+		case config.ExitOnFilename != "" && filename == config.ExitOnFilename:
+			entry.Reason = "exit-on-filename trigger"
+		case IsIgnored(config, filename):
+			entry.Reason = fmt.Sprintf("matches ignore pattern %q", ignoredBy(config, filename))
+		case !IsIncluded(config, filename):
+			entry.Reason = "doesn't match include patterns " + strings.Join(config.IncludePatterns, ", ")
+		case config.Control.IsControlFile(filename):
+			entry.Reason = "control file"
+		case IsKeyFile(config, filename):
+			entry.Reason = "custom S3 key file"
+		case IsReadyMarker(config, filename):
+			entry.Reason = "ready marker"
+		case !IsReady(config, filename):
+			entry.Reason = "not ready, " + notReadyReason(config)
+		case IsLocked(filename):
+			entry.Reason = "already being processed (lock detected)"
+		case IsQuarantined(config, filename):
+			entry.Action = PlanQuarantined
+			entry.Reason = quarantineReason(config, filename)
+		case !fileSizeAllowed(config, filename, fi.Size()):
+			_, entry.Reason = sizeAllowed(config, filename)
+		default:
+			entry.Action = PlanUpload
+		}
+		plan = append(plan, entry)
+	}
+
+	return plan, nil
+}
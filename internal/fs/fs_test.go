@@ -0,0 +1,1040 @@
+package fs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/secret"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+
+	"filippo.io/age"
+	"github.com/google/logger"
+	"github.com/klauspost/compress/zstd"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlan(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir, ExitOnFilename: filepath.Join(dir, "exit")}
+
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "dump.sql"), []byte("data"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "exit"), []byte{}, 0644))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "subdir"), 0755))
+
+	plan, err := Plan(config)
+	assert.Nil(t, err)
+	assert.Equal(t, len(plan), 3)
+
+	actions := map[string]PlanAction{}
+	for _, entry := range plan {
+		actions[filepath.Base(entry.File)] = entry.Action
+	}
+	assert.Equal(t, actions["dump.sql"], PlanUpload)
+	assert.Equal(t, actions["exit"], PlanSkip)
+	assert.Equal(t, actions["subdir"], PlanSkip)
+}
+
+func TestValidateCompression(t *testing.T) {
+	assert.Nil(t, ValidateCompression("gzip", 0))
+	assert.Nil(t, ValidateCompression("zstd", 19))
+	assert.Nil(t, ValidateCompression("none", 0))
+	assert.NotNil(t, ValidateCompression("zstd", 20))
+	assert.NotNil(t, ValidateCompression("gzip", -1))
+	assert.NotNil(t, ValidateCompression("bzip2", 0))
+}
+
+func TestCompressedFileName(t *testing.T) {
+	config := cfg.AppConfig{Gzip: true, Compression: "zstd", GzipDir: "/app/gzip", EncryptDir: "/app/enc"}
+	assert.Equal(t, CompressedFileName(config, "/app/tmp/dump.sql"), "/app/gzip/dump.sql.tar.zst")
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.tar.zst.gpg")
+
+	config.EncryptEngine = "age"
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.tar.zst.age")
+
+	config.EncryptEngine = "kms"
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.tar.zst.kms")
+	config.EncryptEngine = "age"
+
+	config.Gzip = false
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.age")
+
+	// Legacy names have the .tgz suffix even without compression
+	config.LegacyKeyNames = true
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.tgz")
+	config.Gzip, config.Compression = true, "gzip"
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.tgz")
+	config.Compression = "zstd"
+
+	config.Archive = ArchiveNone
+	assert.Equal(t, CompressedFileName(config, "/app/tmp/dump.sql"), "/app/gzip/dump.sql.zst")
+}
+
+func TestRequiredBinaries(t *testing.T) {
+	config := cfg.AppConfig{Gzip: true, Encrypt: true, Compression: "zstd"}
+	assert.Equal(t, RequiredBinaries(config), []string{"tar", "zstd", "gpg"})
+
+	config.Archive = ArchiveNone
+	assert.Equal(t, RequiredBinaries(config), []string{"zstd", "gpg"})
+
+	config.EncryptEngine = "kms"
+	assert.Equal(t, RequiredBinaries(config), []string{"zstd"})
+
+	config.CompressEngine = CompressNative
+	assert.Equal(t, len(RequiredBinaries(config)), 0)
+
+	// External tools are refused when they are disabled
+	config.NoExec = true
+	_, err := CheckBinaries(config)
+	assert.Nil(t, err)
+	config.EncryptEngine = "gpg"
+	_, err = CheckBinaries(config)
+	assert.ErrorContains(t, err, "gpg required by the current pipeline but external tools are disabled")
+	config.EncryptEngine = "kms"
+
+	config.Gzip = false
+	config.Encrypt = false
+	assert.Equal(t, len(RequiredBinaries(config)), 0)
+}
+
+func TestShouldCompress(t *testing.T) {
+	config := cfg.AppConfig{Gzip: true, Compression: "gzip", NoCompressExtensions: ParseExtensions(" .GZ, zip,,.mp4")}
+	assert.Equal(t, config.NoCompressExtensions, []string{".gz", ".zip", ".mp4"})
+
+	assert.True(t, ShouldCompress(config, "/app/tmp/dump.sql"))
+	assert.False(t, ShouldCompress(config, "/app/tmp/dump.sql.gz"))
+	assert.False(t, ShouldCompress(config, "/app/tmp/VIDEO.MP4"))
+	assert.Equal(t, FileCompression(config, "/app/tmp/dump.sql"), "gzip")
+	assert.Equal(t, FileCompression(config, "/app/tmp/archive.zip"), "none")
+
+	config.Gzip = false
+	assert.False(t, ShouldCompress(config, "/app/tmp/dump.sql"))
+}
+
+func TestGpgArgs(t *testing.T) {
+	config := cfg.AppConfig{GpgPassword: secret.Static("secret")}
+	assert.False(t, IsAsymmetricEncryption(config))
+	assert.Equal(t, gpgArgs(config, "0", "out", "in"), []string{"-c", "--batch", "--yes", "--passphrase-fd", "0", "-o", "out", "in"})
+
+	config.GpgRecipients = []string{"ops@example.com"}
+	config.GpgPublicKeyFile = "/keys/backup.asc"
+	assert.True(t, IsAsymmetricEncryption(config))
+	assert.Equal(t, gpgArgs(config, "0", "out", "in"), []string{"-e", "--batch", "--yes", "--trust-model", "always",
+		"--recipient", "ops@example.com", "--recipient-file", "/keys/backup.asc", "-o", "out", "in"})
+}
+
+func TestGroupMessages(t *testing.T) {
+	dir := t.TempDir()
+	groups, err := ParseFileGroups(".dat,.idx; .sql,.sql.sha256")
+	assert.Nil(t, err)
+	assert.Equal(t, groups, [][]string{{".dat", ".idx"}, {".sql", ".sql.sha256"}})
+
+	_, err = ParseFileGroups(".dat")
+	assert.NotNil(t, err)
+
+	files := []string{}
+	for _, name := range []string{"a.dat", "a.idx", "b.dat", "c.sql", "c.sql.sha256", "plain.txt"} {
+		file := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+		files = append(files, file)
+	}
+
+	config := cfg.AppConfig{FileGroups: groups, FileGroupTimeout: time.Hour}
+	messages := GroupMessages(config, files)
+	assert.Equal(t, messages, []cfg.Message{
+		{File: filepath.Join(dir, "plain.txt")},
+		{File: filepath.Join(dir, "a.dat"), Group: []string{filepath.Join(dir, "a.dat"), filepath.Join(dir, "a.idx")}},
+		{File: filepath.Join(dir, "c.sql"), Group: []string{filepath.Join(dir, "c.sql"), filepath.Join(dir, "c.sql.sha256")}},
+	})
+
+	// Incomplete group is sent once it times out
+	config.FileGroupTimeout = -time.Second
+	messages = GroupMessages(config, files)
+	assert.Equal(t, len(messages), 4)
+	assert.True(t, messages[2].Partial)
+	assert.Equal(t, messages[2].Group, []string{filepath.Join(dir, "b.dat")})
+}
+
+func TestEncryptAge(t *testing.T) {
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	identityFile := filepath.Join(dir, "key.txt")
+	assert.Nil(t, os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600))
+
+	recipients, err := ParseAgeRecipients([]string{identity.Recipient().String()}, identityFile)
+	assert.Nil(t, err)
+	assert.Equal(t, len(recipients), 2)
+
+	_, err = ParseAgeRecipients([]string{}, "")
+	assert.NotNil(t, err)
+
+	srcFile := filepath.Join(dir, "dump.sql")
+	encFile := filepath.Join(dir, "dump.sql.age")
+	assert.Nil(t, os.WriteFile(srcFile, []byte("data"), 0644))
+	assert.Nil(t, encryptAge(context.Background(), cfg.AppConfig{AgeRecipients: recipients}, encFile, srcFile))
+
+	f, err := os.Open(encFile)
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := age.Decrypt(f, identity)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, string(data), "data")
+
+	// Cancelled encryption fails instead of writing a truncated file
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = encryptAge(ctx, cfg.AppConfig{AgeRecipients: recipients}, encFile, srcFile)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+}
+
+func TestCompressFileCancelled(t *testing.T) {
+	if !ExecSupported {
+		t.Skip("external tools are not supported by this build")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+
+	config := cfg.AppConfig{PathToWatch: dir, GzipDir: t.TempDir(), Gzip: true, Compression: "gzip"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err := CompressFile(ctx, config, file)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "cancelled")
+}
+
+func TestCompressPlain(t *testing.T) {
+	if !ExecSupported {
+		t.Skip("external tools are not supported by this build")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("select 1;"), 0644))
+
+	config := cfg.AppConfig{PathToWatch: dir, GzipDir: t.TempDir(), Gzip: true, Compression: "gzip", CompressionLevel: 1, Archive: ArchiveNone}
+	assert.Nil(t, CompressFile(context.Background(), config, file))
+	assert.Equal(t, ArchiveNone, FileArchive(config, file))
+
+	// The compressed file is the file itself without a tar archive
+	f, err := os.Open(filepath.Join(config.GzipDir, "dump.sql.gz"))
+	assert.Nil(t, err)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "select 1;", string(data))
+}
+
+func TestCompressNative(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("select 1;"), 0644))
+
+	for _, compression := range []string{"gzip", "zstd"} {
+		config := cfg.AppConfig{PathToWatch: dir, GzipDir: t.TempDir(), Gzip: true, Compression: compression, CompressionLevel: 3, Archive: ArchiveTar, CompressEngine: CompressNative}
+		assert.Nil(t, CompressFile(context.Background(), config, file))
+
+		// The archive has the file under its base name, like external tar makes it
+		f, err := os.Open(CompressedFileName(config, file))
+		assert.Nil(t, err)
+		var r io.Reader
+		if compression == "gzip" {
+			r, err = gzip.NewReader(f)
+		} else {
+			r, err = zstd.NewReader(f)
+		}
+		assert.Nil(t, err)
+		tr := tar.NewReader(r)
+		header, err := tr.Next()
+		assert.Nil(t, err)
+		assert.Equal(t, "dump.sql", header.Name)
+		data, err := io.ReadAll(tr)
+		assert.Nil(t, err)
+		assert.Equal(t, "select 1;", string(data))
+		f.Close()
+
+		// Plain compressed files have no archive
+		config.Archive = ArchiveNone
+		assert.Nil(t, CompressFile(context.Background(), config, file))
+		f, err = os.Open(CompressedFileName(config, file))
+		assert.Nil(t, err)
+		if compression == "gzip" {
+			r, err = gzip.NewReader(f)
+		} else {
+			r, err = zstd.NewReader(f)
+		}
+		assert.Nil(t, err)
+		data, err = io.ReadAll(r)
+		assert.Nil(t, err)
+		assert.Equal(t, "select 1;", string(data))
+		f.Close()
+	}
+
+	config := cfg.AppConfig{PathToWatch: dir, GzipDir: t.TempDir(), Gzip: true, Compression: "gzip", CompressEngine: CompressNative}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorContains(t, CompressFile(ctx, config, file), "cancelled")
+
+	assert.NotNil(t, ValidateCompressEngine(CompressNative, "lz4"))
+	assert.Nil(t, ValidateCompressEngine(CompressExec, "lz4"))
+	assert.NotNil(t, ValidateCompressEngine("7z", "gzip"))
+}
+
+func TestPrepareStream(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	config := cfg.AppConfig{S3path: "/backups", Gzip: true, Compression: "zstd", Archive: ArchiveTar, Encrypt: true, EncryptEngine: "age",
+		AgeRecipients: []age.Recipient{identity.Recipient()}}
+
+	// Streams are never archived
+	key, err := StreamKey(config, "db/dump.sql")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/db/dump.sql.zst.age", key)
+	_, err = StreamKey(config, "../dump.sql")
+	assert.NotNil(t, err)
+
+	// Stream keys are sharded like file keys
+	sharded := config
+	sharded.KeyShardLevels = 2
+	key, err = StreamKey(sharded, "db/dump.sql")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/db/"+keyShard(2, "dump.sql.zst.age")+"/dump.sql.zst.age", key)
+	assert.Equal(t, "sha256/2", KeyShardScheme(sharded, key))
+
+	stream := PrepareStream(context.Background(), config, "db/dump.sql", strings.NewReader("select 1;"))
+	r, err := age.Decrypt(stream, identity)
+	assert.Nil(t, err)
+	zr, err := zstd.NewReader(r)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, "select 1;", string(data))
+
+	// Errors of the source fail the stream
+	_, err = io.ReadAll(PrepareStream(context.Background(), config, "dump.sql", iotest.ErrReader(errors.New("broken pipe"))))
+	assert.ErrorContains(t, err, "broken pipe")
+
+	assert.NotNil(t, ValidateStream(cfg.AppConfig{Encrypt: true, EncryptEngine: "kms"}))
+	assert.NotNil(t, ValidateStream(cfg.AppConfig{Gzip: true, Compression: "lz4"}))
+	assert.Nil(t, ValidateStream(config))
+}
+
+func TestFIFOKey(t *testing.T) {
+	config := cfg.AppConfig{InstanceID: "node1"}
+	now := time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC)
+	assert.Equal(t, "db/host-node1-20240501T123000Z-000042.sql", FIFOKey(config, "db/{hostname}-{instance}-{time}-{seq}.sql", "host", now, 42))
+	assert.Equal(t, 26, len(FIFOKey(config, "{ulid}", "host", now, 1)))
+}
+
+func TestResolveMove(t *testing.T) {
+	tracker.markQueued("/app/tmp/a", fileID{})
+	assert.True(t, tracker.isQueued("/app/tmp/a"))
+
+	tracker.move("/app/tmp/a", "/app/tmp/b")
+	tracker.move("/app/tmp/b", "/app/tmp/c")
+	assert.False(t, tracker.isQueued("/app/tmp/a"))
+	assert.True(t, tracker.isQueued("/app/tmp/c"))
+
+	assert.Equal(t, ResolveMove("/app/tmp/a"), "/app/tmp/c")
+	assert.False(t, tracker.isQueued("/app/tmp/c"))
+	assert.Equal(t, ResolveMove("/app/tmp/d"), "/app/tmp/d")
+}
+
+func TestQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	db, err := state.Open("")
+	assert.Nil(t, err)
+	config := cfg.AppConfig{PathToWatch: dir, State: db}
+
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+	assert.False(t, IsQuarantined(config, file))
+
+	assert.Nil(t, Quarantine(config, file, fmt.Errorf("operation not permitted")))
+	assert.True(t, IsQuarantined(config, file))
+
+	plan, err := Plan(config)
+	assert.Nil(t, err)
+	assert.Equal(t, plan[0].Action, PlanQuarantined)
+
+	// Changed file is uploaded again
+	assert.Nil(t, os.WriteFile(file, []byte("new data"), 0644))
+	assert.False(t, IsQuarantined(config, file))
+
+	// Files failed with a permanent error are skipped until they change too
+	assert.Nil(t, QuarantineFailed(config, file, fmt.Errorf("EntityTooLarge")))
+	assert.True(t, IsQuarantined(config, file))
+	plan, err = Plan(config)
+	assert.Nil(t, err)
+	assert.Equal(t, "failed permanently: EntityTooLarge", plan[0].Reason)
+}
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{
+		PathToWatch:    dir,
+		TrashDir:       filepath.Join(dir, ".trash"),
+		TrashRetention: time.Hour,
+		Applog:         logger.Init("test", false, false, io.Discard),
+	}
+
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+	assert.Nil(t, DeleteSource(config, file))
+	assert.NoFileExists(t, file)
+
+	// Files with the same name don't overwrite each other
+	assert.Nil(t, os.WriteFile(file, []byte("new data"), 0644))
+	assert.Nil(t, DeleteSource(config, file))
+	entries, err := os.ReadDir(config.TrashDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	trashed, ok := TrashedAt(entries[0].Name())
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), trashed, time.Minute)
+	assert.True(t, strings.HasSuffix(entries[0].Name(), "-dump.sql"))
+
+	// Files are purged after the retention, other files are left alone
+	old := filepath.Join(config.TrashDir, time.Now().Add(-2*time.Hour).UTC().Format(trashTimeFormat)+"-old.sql")
+	assert.Nil(t, os.WriteFile(old, []byte("old"), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(config.TrashDir, "notes.txt"), []byte("keep"), 0644))
+	dirs := KeptDirs(config)
+	assert.Len(t, dirs, 1)
+	purged, size, err := dirs[0].Purge()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, int64(16), size)
+	assert.NoFileExists(t, old)
+
+	// The oldest files are purged over the size cap, other files don't count against it
+	config.TrashMaxSize = 8
+	purged, size, err = KeptDirs(config)[0].Purge()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	assert.Equal(t, int64(12), size)
+	assert.NoFileExists(t, filepath.Join(config.TrashDir, entries[0].Name()))
+	assert.FileExists(t, filepath.Join(config.TrashDir, entries[1].Name()))
+	assert.FileExists(t, filepath.Join(config.TrashDir, "notes.txt"))
+
+	// Other files over the cap don't get trashed files purged
+	assert.Nil(t, os.WriteFile(filepath.Join(config.TrashDir, "large.bin"), make([]byte, 100), 0644))
+	purged, size, err = KeptDirs(config)[0].Purge()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged)
+	assert.Equal(t, int64(112), size)
+	assert.FileExists(t, filepath.Join(config.TrashDir, entries[1].Name()))
+}
+
+func TestDedupDirCaps(t *testing.T) {
+	config := cfg.AppConfig{DedupDir: t.TempDir(), DedupDirMaxAge: time.Hour, DedupDirMaxSize: 8}
+	names := map[string]string{}
+	for i, name := range []string{"old.sql", "a.sql", "b.sql", "c.sql"} {
+		moved := time.Now().Add(time.Duration(i-4) * time.Minute)
+		if name == "old.sql" {
+			moved = time.Now().Add(-2 * time.Hour)
+		}
+		names[name] = moved.UTC().Format(trashTimeFormat) + "-" + name
+		assert.Nil(t, os.WriteFile(filepath.Join(config.DedupDir, names[name]), []byte("data"), 0644))
+	}
+	// Files not moved there by the uploader are never purged and don't count against the cap
+	assert.Nil(t, os.WriteFile(filepath.Join(config.DedupDir, "notes.txt"), []byte("keep"), 0644))
+
+	dirs := KeptDirs(config)
+	assert.Len(t, dirs, 1)
+	assert.Equal(t, KeptDedup, dirs[0].Name)
+	purged, size, err := dirs[0].Purge()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, purged)
+	assert.Equal(t, int64(12), size)
+	assert.NoFileExists(t, filepath.Join(config.DedupDir, names["a.sql"]))
+	assert.FileExists(t, filepath.Join(config.DedupDir, names["b.sql"]))
+	assert.FileExists(t, filepath.Join(config.DedupDir, "notes.txt"))
+}
+
+func TestEncryptionKeyID(t *testing.T) {
+	config := cfg.AppConfig{Encrypt: true, EncryptEngine: "gpg", EncryptDir: "/app/enc", GpgPassword: secret.Static("secret")}
+	keyID, err := DefaultEncryptionKeyID(config)
+	assert.Nil(t, err)
+	assert.Equal(t, keyID, "")
+
+	config.GpgRecipients = []string{"b@example.com", "a@example.com"}
+	keyID, err = DefaultEncryptionKeyID(config)
+	assert.Nil(t, err)
+	assert.Equal(t, len(keyID), keyIDLength)
+
+	// Order of recipients doesn't matter
+	config.GpgRecipients = []string{"a@example.com", "b@example.com"}
+	sameKeyID, err := DefaultEncryptionKeyID(config)
+	assert.Nil(t, err)
+	assert.Equal(t, keyID, sameKeyID)
+
+	config.EncryptionKeyID = "k2024"
+	config.KeyIDInFilename = true
+	assert.Equal(t, EncryptedFileName(config, "/app/tmp/dump.sql"), "/app/enc/dump.sql.k2024.gpg")
+}
+
+func TestClaimRename(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir, ProcessingDir: filepath.Join(dir, ".processing"), ClaimMode: ClaimRename, Workers: 1}
+	config.Applog = logger.Init("test", false, false, io.Discard)
+
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+
+	claimed, err := Claim(config, 0, []string{file})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Dir(claimed[0]), processingDir(config, 0))
+	assert.NoFileExists(t, file)
+
+	// Second claim of the same file fails
+	_, err = Claim(config, 1, []string{file})
+	assert.NotNil(t, err)
+
+	// Claimed files are moved back after restart
+	assert.Nil(t, RecoverClaims(config))
+	assert.FileExists(t, file)
+	assert.NoFileExists(t, claimed[0])
+
+	// Files are claimed by the instance ID, also by workers beyond the current number of workers
+	config.InstanceID = "node1"
+	claimed, err = Claim(config, 3, []string{file})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, ".processing", "node1-3", "dump.sql"), claimed[0])
+	other := config
+	other.InstanceID = "node"
+	assert.Nil(t, RecoverClaims(other))
+	assert.FileExists(t, claimed[0])
+	assert.Nil(t, RecoverClaims(config))
+	assert.FileExists(t, file)
+	assert.NoFileExists(t, claimed[0])
+}
+
+func TestObjectKey(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir, S3path: "/backups", KeyOverride: true, KeyOverridePrefix: "/backups"}
+	file := filepath.Join(dir, "dump.sql")
+
+	key, err := ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, key, "/backups/dump.sql.tgz")
+
+	assert.Nil(t, os.WriteFile(file+".key", []byte("backups/db1/2024/dump.sql.tgz\n"), 0644))
+	assert.True(t, IsKeyFile(config, file+".key"))
+	key, err = ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, key, "/backups/db1/2024/dump.sql.tgz")
+
+	// Keys with and without the leading "/" are the same key
+	key, err = ValidateKeyOverride("/backups//db1/dump.sql.tgz", "backups")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/db1/dump.sql.tgz", key)
+
+	_, err = ValidateKeyOverride("other/dump.sql", "/backups")
+	assert.NotNil(t, err)
+	_, err = ValidateKeyOverride("backups/../other/dump.sql", "/backups")
+	assert.NotNil(t, err)
+	_, err = ValidateKeyOverride("backupsX/dump.sql", "/backups")
+	assert.NotNil(t, err)
+
+	// Custom keys are not sharded
+	config.KeyShardLevels = 2
+	assert.Equal(t, "", KeyShardScheme(config, key))
+
+	assert.Nil(t, DeleteKeyFile(config, file))
+	assert.NoFileExists(t, file+".key")
+
+	// Default keys are spread across prefixes from SHA-256 of the object name
+	key, err = ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/2d/8d/dump.sql.tgz", key)
+	assert.Equal(t, "sha256/2", KeyShardScheme(config, key))
+	assert.NotNil(t, ValidateKeyShardLevels(MaxKeyShardLevels+1))
+}
+
+func TestFileSizeRouting(t *testing.T) {
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small.sql")
+	big := filepath.Join(dir, "big.tar")
+	assert.Nil(t, os.WriteFile(small, make([]byte, 10), 0644))
+	assert.Nil(t, os.WriteFile(big, make([]byte, 1000), 0644))
+
+	config := cfg.AppConfig{PathToWatch: dir, S3path: "/backups", MinFileSize: 100, MaxFileSize: 500}
+	ok, reason := sizeAllowed(config, small)
+	assert.False(t, ok)
+	assert.Contains(t, reason, "-min-file-size")
+	ok, _ = sizeAllowed(config, big)
+	assert.False(t, ok)
+
+	// Exit trigger files are never filtered
+	config.ExitOnFilename = small
+	ok, _ = sizeAllowed(config, small)
+	assert.True(t, ok)
+
+	config = cfg.AppConfig{PathToWatch: dir, S3path: "/backups", LargeFileSize: 500, LargeFilePrefix: "archives", LargeFileStorageClass: "GLACIER"}
+	key, err := ObjectKey(config, big, big)
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/archives/big.tar", key)
+	assert.Equal(t, "GLACIER", StorageClass(config, big))
+
+	key, err = ObjectKey(config, small, small)
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/small.sql", key)
+	assert.Equal(t, "", StorageClass(config, small))
+}
+
+func TestTriggerScan(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+	config := cfg.AppConfig{
+		PathToWatch:  dir,
+		ScanInterval: time.Hour,
+		ScanTrigger:  make(chan struct{}, 1),
+		Applog:       logger.Init("test", false, false, io.Discard),
+	}
+
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ScanDirectory(ctx, comm, config)
+
+	assert.True(t, TriggerScan(config))
+	msg, ok := comm.Pop(ctx)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(dir, "file"), msg.File)
+
+	// Only one scan can be pending
+	config.ScanTrigger = make(chan struct{}, 1)
+	assert.True(t, TriggerScan(config))
+	assert.False(t, TriggerScan(config))
+}
+
+func TestNextScanInterval(t *testing.T) {
+	config := cfg.AppConfig{ScanInterval: time.Second}
+	assert.Equal(t, time.Second, nextScanInterval(config, time.Second, 0), "fixed without maximum")
+
+	config.ScanIntervalMax = 5 * time.Second
+	assert.Equal(t, 2*time.Second, nextScanInterval(config, time.Second, 0))
+	assert.Equal(t, 4*time.Second, nextScanInterval(config, 2*time.Second, 0))
+	assert.Equal(t, 5*time.Second, nextScanInterval(config, 4*time.Second, 0))
+	assert.Equal(t, 5*time.Second, nextScanInterval(config, 5*time.Second, 0))
+	assert.Equal(t, time.Second, nextScanInterval(config, 5*time.Second, 3), "files were found")
+}
+
+func TestScanFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{"new.sql": time.Hour, "old.sql": 3 * time.Hour, "mid.sql": 2 * time.Hour} {
+		file := filepath.Join(dir, name)
+		assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+		assert.Nil(t, os.Chtimes(file, now.Add(-age), now.Add(-age)))
+	}
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "subdir"), 0755))
+	config := cfg.AppConfig{PathToWatch: dir, Applog: logger.Init("test", false, false, io.Discard)}
+
+	// Oldest files go first, directories are counted but skipped
+	files, entries, err := scanFiles(config, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, entries)
+	assert.Equal(t, []string{filepath.Join(dir, "old.sql"), filepath.Join(dir, "mid.sql"), filepath.Join(dir, "new.sql")}, files)
+
+	files, _, err = scanFiles(config, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "old.sql"), filepath.Join(dir, "mid.sql")}, files)
+}
+
+func TestScanFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "gone")
+	config := cfg.AppConfig{
+		PathToWatch: dir,
+		Metrics:     metrics.InitMetrics("test", 1, []float64{1}),
+		Applog:      logger.Init("test", false, false, io.Discard),
+	}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+
+	// Failed scan is retried until ctx is done, the process keeps running
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, 0, fsScan(ctx, comm, config))
+	scanErrors := &dto.Metric{}
+	assert.Nil(t, config.Metrics.ScanErrors.WithLabelValues().Write(scanErrors))
+	assert.Equal(t, 1.0, scanErrors.GetCounter().GetValue())
+
+	assert.Nil(t, os.Mkdir(dir, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+	assert.Equal(t, 1, fsScan(context.Background(), comm, config))
+	entries := &dto.Metric{}
+	assert.Nil(t, config.Metrics.ScanEntries.WithLabelValues().Write(entries))
+	assert.Equal(t, 1.0, entries.GetCounter().GetValue())
+}
+
+func TestWatchPaths(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "paths.json")
+	assert.Nil(t, os.WriteFile(file, []byte(`[{"path": "/data/db/", "include": ["*.sql"], "prefix": "/db/"}, {"path": "/data/logs"}]`), 0644))
+	paths, err := LoadWatchPaths(file)
+	assert.Nil(t, err)
+	assert.Nil(t, ValidateWatchPaths(paths))
+	assert.ErrorContains(t, ValidateWatchPaths(append(paths, cfg.WatchPath{Path: "/data/db"})), "watched more than once")
+	assert.ErrorContains(t, ValidateWatchPaths([]cfg.WatchPath{{Path: "/data", Include: []string{"[a"}}}), "bad include pattern")
+
+	// Files of a watched directory get its prefix and include patterns
+	config := cfg.AppConfig{PathToWatch: "/data/logs", S3path: "/backups", KeyOverridePrefix: "/backups", WatchPaths: paths}
+	db := WatchPathConfig(config, "/data/db/dump.sql")
+	assert.Equal(t, "/data/db", db.PathToWatch)
+	assert.Equal(t, "/backups/db", db.S3path)
+	assert.Equal(t, "/backups/db", db.KeyOverridePrefix)
+	assert.True(t, IsIncluded(db, "/data/db/dump.sql"))
+	assert.False(t, IsIncluded(db, "/data/db/dump.log"))
+
+	logs := WatchPathConfig(config, "/data/logs/app.log")
+	assert.Equal(t, "/backups", logs.S3path)
+	assert.True(t, IsIncluded(logs, "/data/logs/app.log"))
+	assert.Equal(t, config, WatchPathConfig(config, "/other/file"))
+}
+
+func TestEnqueueSpill(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.sql", "b.sql"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte("data"), 0644))
+	}
+	db, err := state.Open("")
+	assert.Nil(t, err)
+	config := cfg.AppConfig{
+		EnqueuePolicy: EnqueueSpill,
+		State:         db,
+		Metrics:       metrics.InitMetrics("test", 1, []float64{1}),
+		Applog:        logger.Init("test", false, false, io.Discard),
+	}
+
+	comm, err := queue.New("mtime", 1)
+	assert.Nil(t, err)
+	assert.True(t, enqueue(context.Background(), comm, config, newMessage(filepath.Join(dir, "a.sql"))))
+	assert.False(t, enqueue(context.Background(), comm, config, newMessage(filepath.Join(dir, "b.sql"))))
+	assert.Equal(t, 1, len(db.Spilled()))
+
+	// Spilled file is queued once there's space and forgotten
+	_, ok := comm.Pop(context.Background())
+	assert.True(t, ok)
+	requeueSpilled(comm, config)
+	msg, ok := comm.Pop(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(dir, "b.sql"), msg.File)
+	assert.Empty(t, db.Spilled())
+
+	// Without state the file is dropped
+	config.State = nil
+	assert.True(t, enqueue(context.Background(), comm, config, newMessage(filepath.Join(dir, "a.sql"))))
+	assert.False(t, enqueue(context.Background(), comm, config, newMessage(filepath.Join(dir, "b.sql"))))
+}
+
+func TestIgnorePatterns(t *testing.T) {
+	patterns, err := ParseIgnorePatterns(DefaultIgnorePatterns)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{".*", "*~", "*.swp", "*.part", "*.tmp"}, patterns)
+	_, err = ParseIgnorePatterns("*.tmp,[")
+	assert.NotNil(t, err)
+
+	config := cfg.AppConfig{IgnorePatterns: patterns, ExitOnFilename: "/data/.exit"}
+	for _, file := range []string{"/data/.dump.sql.swp", "/data/dump.sql~", "/data/dump.sql.part", "/data/.hidden"} {
+		assert.True(t, IsIgnored(config, file), file)
+	}
+	assert.False(t, IsIgnored(config, "/data/dump.sql"))
+	assert.False(t, IsIgnored(config, "/data/.exit"))
+	assert.Equal(t, "*.tmp", ignoredBy(config, "/data/x.tmp"))
+
+	config.IgnorePatterns = nil
+	assert.False(t, IsIgnored(config, "/data/.hidden"))
+}
+
+func TestReadyMarker(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+	config := cfg.AppConfig{PathToWatch: dir, S3path: "/backups", ReadyMarker: ".done", Applog: logger.Init("test", false, false, io.Discard)}
+
+	assert.False(t, IsReady(config, file))
+	assert.True(t, IsReadyMarker(config, file+".done"))
+	assert.Nil(t, os.WriteFile(file+".done", nil, 0644))
+	assert.True(t, IsReady(config, file))
+	assert.Equal(t, file, markedFileName(config, file+".done"))
+
+	plan, err := Plan(config)
+	assert.Nil(t, err)
+	assert.Equal(t, PlanUpload, plan[0].Action)
+	assert.Equal(t, "ready marker", plan[1].Reason)
+
+	assert.Nil(t, DeleteSource(config, file))
+	assert.NoFileExists(t, file+".done")
+}
+
+func TestReadySuffix(t *testing.T) {
+	config := cfg.AppConfig{S3path: "/backups", ReadySuffix: ".ready", Gzip: true, Compression: "gzip", GzipDir: "/tmp/gzip"}
+
+	assert.False(t, IsReady(config, "/data/dump.sql"))
+	assert.True(t, IsReady(config, "/data/dump.sql.ready"))
+
+	key, err := ObjectKey(config, "/data/dump.sql.ready", CompressedFileName(config, "/data/dump.sql.ready"))
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/dump.sql.tgz", key)
+}
+
+func TestDedup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := state.Open("")
+	assert.Nil(t, err)
+	config := cfg.AppConfig{PathToWatch: dir, S3path: "/backups", State: db, Compression: "none"}
+
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+
+	// Dedup is disabled by default
+	sum, err := ContentSum(config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, "", sum)
+
+	config.DedupWindow = time.Hour
+	sum, err = ContentSum(config, file)
+	assert.Nil(t, err)
+	_, ok := UploadedContent(config, sum)
+	assert.False(t, ok)
+	assert.Nil(t, RecordContent(config, sum, file))
+
+	// The same content with another name is a duplicate
+	dup := filepath.Join(dir, "copy.sql")
+	assert.Nil(t, os.WriteFile(dup, []byte("data"), 0644))
+	sum, err = ContentSum(config, dup)
+	assert.Nil(t, err)
+	uploaded, ok := UploadedContent(config, sum)
+	assert.True(t, ok)
+	assert.Equal(t, file, uploaded.File)
+	assert.Equal(t, "/backups/dump.sql", uploaded.Key)
+
+	// Content uploaded to another destination is not a duplicate
+	routed := config
+	routed.S3bucket = "other"
+	_, ok = UploadedContent(routed, sum)
+	assert.False(t, ok)
+
+	// Duplicates with the same name are all kept in the dedup directory
+	config.DedupDir = filepath.Join(t.TempDir(), "dups")
+	assert.Nil(t, RemoveDuplicate(config, dup, sum))
+	assert.NoFileExists(t, dup)
+	assert.Nil(t, os.WriteFile(dup, []byte("data"), 0644))
+	assert.Nil(t, RemoveDuplicate(config, dup, sum))
+	kept, err := filepath.Glob(filepath.Join(config.DedupDir, "*-copy.sql"))
+	assert.Nil(t, err)
+	assert.Len(t, kept, 2)
+
+	// A duplicate replaced after it was hashed is kept
+	config.Applog = logger.Init("test", false, false, io.Discard)
+	assert.Nil(t, os.WriteFile(dup, []byte("data"), 0644))
+	claimed, err := Claim(config, 0, []string{dup})
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(dup+".new", []byte("new data"), 0644))
+	assert.Nil(t, os.Rename(dup+".new", dup))
+	assert.Nil(t, RemoveDuplicate(config, dup, sum))
+	assert.FileExists(t, dup)
+	Release(config, claimed)
+
+	// A duplicate changed in place after it was hashed is kept
+	assert.Nil(t, os.WriteFile(dup, []byte("more data"), 0644))
+	assert.NotNil(t, RemoveDuplicate(config, dup, sum))
+	assert.FileExists(t, dup)
+	kept, err = filepath.Glob(filepath.Join(config.DedupDir, "*-copy.sql"))
+	assert.Nil(t, err)
+	assert.Len(t, kept, 2)
+
+	assert.Nil(t, ForgetContent(config, sum))
+	_, ok = UploadedContent(config, sum)
+	assert.False(t, ok)
+}
+
+func TestRoutes(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "routes.json")
+	t.Setenv("DAV_TOKEN", "secret")
+	assert.Nil(t, os.WriteFile(path, []byte(`[
+		{"pattern": "*.sql", "destination": "s3://db-backups/sql/{instance}/"},
+		{"pattern": "*.log", "destination": "https://dav.example.com/logs", "headers": {"Authorization": "Bearer $DAV_TOKEN"}}
+	]`), 0644))
+	routes, err := LoadRoutes(path, "node1")
+	assert.Nil(t, err)
+
+	config := cfg.AppConfig{S3bucket: "default", S3path: "/backups", KeyOverridePrefix: "/backups", Routes: routes}
+	routed := RouteConfig(config, "/data/dump.sql")
+	assert.Equal(t, "db-backups", routed.S3bucket)
+	assert.Equal(t, "/sql/node1", routed.S3path)
+	assert.Equal(t, "/sql/node1", routed.KeyOverridePrefix)
+
+	routed = RouteConfig(config, "/data/app.log")
+	assert.Equal(t, "https://dav.example.com/logs", routed.HTTPURL)
+	assert.Equal(t, "/logs", routed.S3path)
+	assert.Equal(t, "Bearer secret", routed.HTTPHeaders["Authorization"])
+
+	routed = RouteConfig(config, "/data/image.png")
+	assert.Equal(t, "default", routed.S3bucket)
+	assert.Equal(t, "/backups", routed.S3path)
+
+	for _, bad := range []string{`[{"pattern": "[", "destination": "s3://b/p"}]`, `[{"pattern": "*", "destination": "s3://b"}]`,
+		`[{"pattern": "*", "destination": "ftp://host/p"}]`} {
+		assert.Nil(t, os.WriteFile(path, []byte(bad), 0644))
+		_, err = LoadRoutes(path, "node1")
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestKeySuffix(t *testing.T) {
+	assert.Equal(t, "dump-X.sql.tgz", addKeySuffix("dump.sql.tgz", "X"))
+	assert.Equal(t, ".env-X.tgz", addKeySuffix(".env.tgz", "X"))
+	assert.Equal(t, "dump-X", addKeySuffix("dump", "X"))
+	assert.NotNil(t, ValidateKeySuffix("random"))
+
+	// ULIDs stay sortable and unique when the clock goes backwards
+	tracker := suffixTracker{}
+	now := time.Now()
+	first := tracker.newULID(now)
+	second := tracker.newULID(now.Add(-time.Minute))
+	assert.Len(t, first, 26)
+	assert.Less(t, first, second)
+	assert.Less(t, second, tracker.newULID(now.Add(time.Millisecond)))
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, newUUID())
+
+	dir := t.TempDir()
+	db, err := state.Open(filepath.Join(dir, "state.json"))
+	assert.Nil(t, err)
+	config := cfg.AppConfig{PathToWatch: dir, S3path: "/backups", KeySuffix: KeySuffixCounter, State: db}
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+
+	// All uploads of the same file version use the same key
+	key, err := ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/dump-00000001.sql.tgz", key)
+	key, err = ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/dump-00000001.sql.tgz", key)
+
+	// Suffixes are persisted, the file keeps its key after a restart
+	suffixes.suffixes = map[string]fileSuffix{}
+	config.State, err = state.Open(filepath.Join(dir, "state.json"))
+	assert.Nil(t, err)
+	key, err = ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/dump-00000001.sql.tgz", key)
+
+	// A new file with the same name gets the next counter value, the counter is persisted
+	assert.Nil(t, DeleteSource(config, file))
+	assert.Nil(t, os.WriteFile(file, []byte("new data"), 0644))
+	key, err = ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Equal(t, "/backups/dump-00000002.sql.tgz", key)
+
+	// Suffixes are forgotten when files are quarantined or released after they are gone
+	assert.Nil(t, Quarantine(config, file, errors.New("permission denied")))
+	assert.NotContains(t, suffixes.suffixes, file)
+	_, err = ObjectKey(config, file, "/app/gzip/dump.sql.tgz")
+	assert.Nil(t, err)
+	assert.Contains(t, suffixes.suffixes, file)
+	assert.Nil(t, os.Remove(file))
+	Release(config, []string{file})
+	assert.NotContains(t, suffixes.suffixes, file)
+
+	db, err = state.Open(filepath.Join(dir, "state.json"))
+	assert.Nil(t, err)
+	n, err := db.NextCounter()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), n)
+}
+
+func TestSourceSHA256(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir}
+	file := filepath.Join(dir, "report.csv")
+	assert.Nil(t, os.WriteFile(file, []byte("a,b\n"), 0644))
+	modTime := time.Now().Add(-time.Hour)
+	assert.Nil(t, os.Chtimes(file, modTime, modTime))
+
+	sum, err := SourceSHA256(config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, "5be08c9684a1d25efcee09318204824278b08bbfb4aef973ffefd0b9d7478313", sum)
+
+	// The same file version isn't read again
+	assert.Nil(t, os.WriteFile(file, []byte("c,d\n"), 0644))
+	assert.Nil(t, os.Chtimes(file, modTime, modTime))
+	cached, err := SourceSHA256(config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, sum, cached)
+
+	// A changed file is hashed again
+	assert.Nil(t, os.Chtimes(file, time.Now(), time.Now()))
+	changed, err := SourceSHA256(config, file)
+	assert.Nil(t, err)
+	assert.NotEqual(t, sum, changed)
+
+	// Checksums are forgotten when files are deleted
+	assert.Nil(t, DeleteSource(config, file))
+	assert.NotContains(t, sums.sums, file)
+}
+
+// racingReader creates a file of the same name while the received file is written, like a concurrent upload
+type racingReader struct {
+	file string
+	done bool
+}
+
+func (r *racingReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+	r.done = true
+	if err := os.WriteFile(r.file, []byte("first"), 0644); err != nil {
+		return 0, err
+	}
+	return copy(p, "second"), nil
+}
+
+func TestReceiveFile(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir}
+
+	file, err := ReceiveFile(config, "report.csv", strings.NewReader("a,b\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "report.csv"), file)
+	_, err = ReceiveFile(config, "report.csv", strings.NewReader("c,d\n"))
+	assert.ErrorIs(t, err, os.ErrExist)
+	_, err = ReceiveFile(config, "../report.csv", strings.NewReader("c,d\n"))
+	assert.NotNil(t, err)
+
+	// A file received at the same time is not overwritten
+	racing := filepath.Join(dir, "racing.csv")
+	_, err = ReceiveFile(config, "racing.csv", &racingReader{file: racing})
+	assert.ErrorIs(t, err, os.ErrExist)
+	data, err := os.ReadFile(racing)
+	assert.Nil(t, err)
+	assert.Equal(t, "first", string(data))
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2, "temporary files are removed")
+}
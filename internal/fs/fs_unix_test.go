@@ -0,0 +1,232 @@
+//go:build !windows
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/secret"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkippedFileType(t *testing.T) {
+	if !ExecSupported {
+		t.Skip("external tools are not supported by this build")
+	}
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	assert.Nil(t, os.WriteFile(file, []byte("data"), 0644))
+	fifo := filepath.Join(dir, "fifo")
+	assert.Nil(t, syscall.Mkfifo(fifo, 0644))
+	link := filepath.Join(dir, "link")
+	assert.Nil(t, os.Symlink(file, link))
+	broken := filepath.Join(dir, "broken")
+	assert.Nil(t, os.Symlink(filepath.Join(dir, "missing"), broken))
+	dirLink := filepath.Join(dir, "dir")
+	assert.Nil(t, os.Symlink(t.TempDir(), dirLink))
+
+	config := cfg.AppConfig{}
+	assert.Equal(t, "", skippedFileType(config, file))
+	assert.Equal(t, "fifo", skippedFileType(config, fifo))
+	assert.Equal(t, "symlink", skippedFileType(config, link))
+	assert.Equal(t, "", skippedFileType(config, filepath.Join(dir, "missing")))
+
+	config.FollowSymlinks = true
+	assert.Equal(t, "", skippedFileType(config, link))
+	assert.Equal(t, "broken_symlink", skippedFileType(config, broken))
+	assert.Equal(t, "directory", skippedFileType(config, dirLink))
+
+	// Symlinks are archived as their targets
+	config.PathToWatch = dir
+	config.GzipDir = t.TempDir()
+	config.Gzip = true
+	config.Compression = "gzip"
+	assert.Nil(t, CompressFile(context.Background(), config, link))
+	out, err := exec.Command("tar", "-tvzf", CompressedFileName(config, link)).CombinedOutput()
+	assert.Nil(t, err)
+	assert.Regexp(t, `^-.* link\n$`, string(out))
+}
+
+func TestClaimRelativeSymlink(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir, ClaimMode: ClaimRename, Applog: logger.Init("test", false, false, io.Discard)}
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "data"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "data", "dump.sql"), []byte("data"), 0644))
+	link := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.Symlink("data/dump.sql", link))
+
+	// Relative links still point to the file after they are moved into the processing directory
+	claimed, err := Claim(config, 0, []string{link})
+	assert.Nil(t, err)
+	data, err := os.ReadFile(claimed[0])
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+
+	Release(config, claimed)
+	data, err = os.ReadFile(link)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestInflightRename(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{PathToWatch: dir, Applog: logger.Init("test", false, false, io.Discard)}
+	old, renamed := filepath.Join(dir, "dump.sql"), filepath.Join(dir, "dump.sql.1")
+	assert.Nil(t, os.WriteFile(old, []byte("data"), 0644))
+	msg := newMessage(old)
+
+	// A claimed file renamed by the producer isn't queued again and is deleted under the new name
+	inflight.add([]string{old})
+	assert.Nil(t, os.Rename(old, renamed))
+	assert.True(t, IsInFlight(renamed))
+	assert.Nil(t, DeleteSource(config, old))
+	assert.NoFileExists(t, renamed)
+	inflight.remove(old)
+
+	// A file replaced after it was queued is detected, the replacement is never deleted instead of it
+	assert.Nil(t, os.WriteFile(old, []byte("data"), 0644))
+	msg = newMessage(old)
+	inflight.add([]string{old})
+	assert.Nil(t, os.Rename(old, renamed))
+	assert.Nil(t, os.WriteFile(old, []byte("new"), 0644))
+	assert.True(t, Replaced(msg, old))
+	assert.False(t, Replaced(newMessage(old), old))
+	assert.False(t, IsInFlight(old))
+	assert.Nil(t, os.Remove(renamed))
+	assert.Nil(t, DeleteSource(config, old))
+	assert.FileExists(t, old)
+	inflight.remove(old)
+}
+
+func TestReadFIFO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fifo")
+	assert.Nil(t, MakeFIFO(path))
+	assert.Nil(t, MakeFIFO(path))
+	assert.NotNil(t, MakeFIFO(t.TempDir()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	streams := make(chan string, 2)
+	done := make(chan error)
+	go func() {
+		done <- ReadFIFO(ctx, path, func(r io.Reader) {
+			data, _ := io.ReadAll(r)
+			streams <- string(data)
+		})
+	}()
+
+	// Writers that write nothing don't make streams
+	for _, data := range []string{"", "select 1;", "select 2;"} {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		assert.Nil(t, err)
+		f.WriteString(data)
+		f.Close()
+		if data != "" {
+			assert.Equal(t, data, <-streams)
+		}
+	}
+
+	// The reader waiting for the next writer stops
+	cancel()
+	assert.Nil(t, <-done)
+	assert.Equal(t, 0, len(streams))
+}
+
+func TestWatchEvents(t *testing.T) {
+	dir := t.TempDir()
+	db, err := state.Open("")
+	assert.Nil(t, err)
+	groups, err := ParseFileGroups(".dat,.idx")
+	assert.Nil(t, err)
+	config := cfg.AppConfig{PathToWatch: dir, State: db, FileGroups: groups, FileGroupTimeout: time.Hour,
+		Applog: logger.Init("test", false, false, io.Discard)}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+
+	watcher, err := fsnotify.NewWatcher()
+	assert.Nil(t, err)
+	defer watcher.Close()
+	assert.Nil(t, watcher.Add(dir))
+	// Quarantined file is created before watching
+	quarantined := filepath.Join(dir, "quarantined.sql")
+	assert.Nil(t, os.WriteFile(quarantined, []byte("data"), 0644))
+	assert.Nil(t, Quarantine(config, quarantined, errors.New("operation not permitted")))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	go fsWatch(ctx, comm, watcher, config)
+
+	// Files are created elsewhere and moved into the directory
+	move := func(name string) {
+		src := filepath.Join(t.TempDir(), name)
+		assert.Nil(t, os.WriteFile(src, []byte("data"), 0644))
+		assert.Nil(t, os.Rename(src, filepath.Join(dir, name)))
+	}
+
+	move("dump.sql")
+	assert.Eventually(t, func() bool { return comm.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	// Moved queued file is not queued again under the new name
+	assert.Nil(t, os.Rename(filepath.Join(dir, "dump.sql"), filepath.Join(dir, "renamed.sql")))
+	assert.Eventually(t, func() bool { return tracker.isQueued(filepath.Join(dir, "renamed.sql")) }, time.Second, 10*time.Millisecond)
+
+	// Quarantined files are skipped like by scans, file groups are queued once complete
+	elsewhere := filepath.Join(t.TempDir(), "quarantined.sql")
+	assert.Nil(t, os.Rename(quarantined, elsewhere))
+	assert.Nil(t, os.Rename(elsewhere, quarantined))
+	move("a.dat")
+	move("a.idx")
+	assert.Eventually(t, func() bool { return comm.Len() == 2 }, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, comm.Len())
+
+	msg, _ := comm.Pop(ctx)
+	assert.Equal(t, filepath.Join(dir, "dump.sql"), msg.File)
+	assert.Equal(t, filepath.Join(dir, "renamed.sql"), ResolveMove(msg.File))
+	msg, _ = comm.Pop(ctx)
+	assert.Equal(t, []string{filepath.Join(dir, "a.dat"), filepath.Join(dir, "a.idx")}, msg.Group)
+}
+
+func TestEncryptGPGStreamExitCodes(t *testing.T) {
+	if !ExecSupported {
+		t.Skip("external tools are not supported by this build")
+	}
+	bin := t.TempDir()
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	fakeGPG := func(script string) {
+		assert.Nil(t, os.WriteFile(filepath.Join(bin, "gpg"), []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	}
+	config := cfg.AppConfig{GpgPassword: secret.Static("secret")}
+
+	// Exit code 2 of "gpg -c" is a success when gpg took the whole stream
+	fakeGPG("cat; exit 2")
+	var out bytes.Buffer
+	assert.Nil(t, encryptGPGStream(context.Background(), config, strings.NewReader("data"), &out))
+	assert.Equal(t, "data", out.String())
+
+	// Other failures are errors even if gpg wrote something
+	fakeGPG("cat; exit 1")
+	assert.NotNil(t, encryptGPGStream(context.Background(), config, strings.NewReader("data"), io.Discard))
+
+	// A broken stream fails the encryption whatever gpg returns
+	fakeGPG("cat; exit 2")
+	broken := io.MultiReader(strings.NewReader("data"), iotest.ErrReader(errors.New("compressor failed")))
+	err := encryptGPGStream(context.Background(), config, broken, io.Discard)
+	assert.ErrorContains(t, err, "compressor failed")
+}
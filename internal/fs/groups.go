@@ -0,0 +1,119 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// ParseFileGroups parses file group definitions like ".dat,.idx;.sql,.sql.sha256".
+// Files that share the same name stem and match all suffixes of a group are uploaded together.
+func ParseFileGroups(spec string) ([][]string, error) {
+	groups := [][]string{}
+
+	for _, g := range strings.Split(spec, ";") {
+		if strings.TrimSpace(g) == "" {
+			continue
+		}
+
+		group := ParseExtensions(g)
+		if len(group) < 2 {
+			return nil, fmt.Errorf("file group %q must have at least 2 suffixes", g)
+		}
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// matchFileGroup finds the group a file belongs to, the longest matching suffix wins
+func matchFileGroup(groups [][]string, name string) (string, int, bool) {
+	lowerName := strings.ToLower(name)
+	stem, index, suffixLen := "", 0, 0
+
+	for i, group := range groups {
+		for _, suffix := range group {
+			if len(suffix) > suffixLen && len(lowerName) > len(suffix) && strings.HasSuffix(lowerName, suffix) {
+				stem, index, suffixLen = name[:len(name)-len(suffix)], i, len(suffix)
+			}
+		}
+	}
+
+	return stem, index, suffixLen > 0
+}
+
+// GroupMessages builds worker messages for a list of files. Members of a file group are sent
+// in a single message once the group is complete, or once the newest member is older than
+// FileGroupTimeout, in which case the message is marked as partial.
+func GroupMessages(config cfg.AppConfig, files []string) []cfg.Message {
+	messages := []cfg.Message{}
+	groups := map[string][]string{}
+	keys := []string{}
+
+	for _, file := range files {
+		stem, index, ok := matchFileGroup(config.FileGroups, file)
+		if !ok {
+			messages = append(messages, cfg.Message{File: file})
+			continue
+		}
+
+		key := fmt.Sprintf("%d:%s", index, stem)
+		if _, exists := groups[key]; !exists {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], file)
+	}
+
+	for _, key := range keys {
+		members := groups[key]
+		sort.Strings(members)
+		_, index, _ := matchFileGroup(config.FileGroups, members[0])
+
+		if len(members) == len(config.FileGroups[index]) {
+			messages = append(messages, cfg.Message{File: members[0], Group: members})
+			continue
+		}
+
+		if groupAge(members) > config.FileGroupTimeout {
+			messages = append(messages, cfg.Message{File: members[0], Group: members, Partial: true})
+		}
+	}
+
+	return messages
+}
+
+// groupAge returns time since the newest group member was modified
+func groupAge(members []string) time.Duration {
+	var newest time.Time
+
+	for _, file := range members {
+		fi, err := os.Stat(file)
+		if err != nil {
+			// Something is going on with the file, let's wait for the next scan
+			return 0
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+
+	return time.Since(newest)
+}
+
+// GroupName returns a short description of a message for logging
+func GroupName(msg cfg.Message) string {
+	if len(msg.Group) == 0 {
+		return fmt.Sprintf("file %q", msg.File)
+	}
+
+	names := []string{}
+	for _, file := range msg.Group {
+		names = append(names, filepath.Base(file))
+	}
+	return fmt.Sprintf("file group %q", strings.Join(names, ", "))
+}
@@ -0,0 +1,124 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// fileID identifies a file by its device and inode, it stays the same when the file is renamed within the filesystem
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// statIdentity returns the identity of a file by its name
+func statIdentity(filename string) (fileID, bool) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileID{}, false
+	}
+	id := identity(fi)
+	return id, id != fileID{}
+}
+
+// inflightSet keeps identities of files claimed by workers, so a file renamed by its producer while it's processed
+// is neither queued again under the new name nor left behind when the old name is deleted
+type inflightSet struct {
+	mu     sync.Mutex
+	byID   map[fileID]string
+	byName map[string]fileID
+}
+
+var inflight = inflightSet{
+	byID:   map[fileID]string{},
+	byName: map[string]fileID{},
+}
+
+// add remembers identities of claimed files
+func (s *inflightSet) add(files []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, file := range files {
+		if id, ok := statIdentity(file); ok {
+			s.byID[id] = file
+			s.byName[file] = id
+		}
+	}
+}
+
+// remove forgets a released file
+func (s *inflightSet) remove(file string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if id, ok := s.byName[file]; ok {
+		delete(s.byID, id)
+		delete(s.byName, file)
+	}
+}
+
+// contains checks if the file is claimed by a worker under this or another name
+func (s *inflightSet) contains(file string) bool {
+	id, ok := statIdentity(file)
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok = s.byID[id]
+	return ok
+}
+
+// currentName returns the name a claimed file has now, it's looked up in the file's directory if the file was renamed.
+// It returns empty name if the file is gone, files that were never claimed keep their names.
+func (s *inflightSet) currentName(file string) string {
+	s.mu.Lock()
+	id, ok := s.byName[file]
+	s.mu.Unlock()
+	if !ok {
+		return file
+	}
+	if current, ok := statIdentity(file); ok && current == id {
+		return file
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(file))
+	if err != nil {
+		return file
+	}
+	for _, e := range entries {
+		name := filepath.Join(filepath.Dir(file), e.Name())
+		if current, ok := statIdentity(name); ok && current == id {
+			return name
+		}
+	}
+	return ""
+}
+
+// removeFile removes a file, empty name is a file that is already gone
+func removeFile(name string) error {
+	if name == "" {
+		return nil
+	}
+	return os.Remove(name)
+}
+
+// IsInFlight checks if a file is being processed by a worker, possibly under the name it had before a rename
+func IsInFlight(filename string) bool {
+	return inflight.contains(filename)
+}
+
+// Replaced checks if the claimed file is not the one that was queued, i.e. it was replaced with another file
+// of the same name in between
+func Replaced(msg cfg.Message, claimed string) bool {
+	if msg.Ino == 0 {
+		return false
+	}
+	id, ok := statIdentity(claimed)
+	return ok && id != fileID{dev: msg.Dev, ino: msg.Ino}
+}
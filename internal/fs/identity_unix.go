@@ -0,0 +1,17 @@
+//go:build !windows
+
+package fs
+
+import (
+	"os"
+	"syscall"
+)
+
+// identity returns the identity of a file, zero identity if the filesystem doesn't have inodes
+func identity(fi os.FileInfo) fileID {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}
+	}
+	return fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+}
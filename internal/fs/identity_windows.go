@@ -0,0 +1,11 @@
+//go:build windows
+
+package fs
+
+import "os"
+
+// identity returns zero identity, file info on Windows has no file index without opening the file,
+// so renamed files are not tracked
+func identity(fi os.FileInfo) fileID {
+	return fileID{}
+}
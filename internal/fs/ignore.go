@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// DefaultIgnorePatterns skips hidden files and temporary files of editors, rsync and downloads
+const DefaultIgnorePatterns = ".*,*~,*.swp,*.part,*.tmp"
+
+// ParseIgnorePatterns parses a comma separated list of shell patterns matched against file names
+func ParseIgnorePatterns(list string) ([]string, error) {
+	patterns := []string{}
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad ignore pattern %q: %s", pattern, err.Error())
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// ignoredBy returns the ignore pattern matching the file name, the exit trigger file is never ignored
+func ignoredBy(config cfg.AppConfig, filename string) string {
+	if config.ExitOnFilename != "" && filename == config.ExitOnFilename {
+		return ""
+	}
+
+	name := filepath.Base(filename)
+	for _, pattern := range config.IgnorePatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// IsIgnored checks if a file matches one of the ignore patterns
+func IsIgnored(config cfg.AppConfig, filename string) bool {
+	return ignoredBy(config, filename) != ""
+}
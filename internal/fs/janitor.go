@@ -0,0 +1,111 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Names of directories keeping local copies of files
+const (
+	KeptTrash = "trash"
+	KeptDedup = "dedup"
+)
+
+// KeptDir is a directory keeping local copies of files, e.g. -trash-dir. Files older than MaxAge are purged and
+// then the oldest files until they fit into MaxSize, zero disables the cap. Only files the uploader moved there
+// count against the cap, other files are never purged and would otherwise get every kept file purged.
+type KeptDir struct {
+	Name    string
+	Path    string
+	MaxSize int64
+	MaxAge  time.Duration
+
+	// keptAt returns the time a file was moved into the directory, files without it are never purged
+	keptAt func(name string, info os.FileInfo) (time.Time, bool)
+}
+
+// KeptDirs returns directories keeping local copies of files enabled in the config
+func KeptDirs(config cfg.AppConfig) []KeptDir {
+	dirs := []KeptDir{}
+	if config.TrashDir != "" {
+		dirs = append(dirs, KeptDir{
+			Name:    KeptTrash,
+			Path:    config.TrashDir,
+			MaxSize: config.TrashMaxSize,
+			MaxAge:  config.TrashRetention,
+			keptAt: func(name string, _ os.FileInfo) (time.Time, bool) {
+				return TrashedAt(name)
+			},
+		})
+	}
+	if config.DedupDir != "" {
+		// Duplicates are prefixed with the time they were moved like trashed files
+		dirs = append(dirs, KeptDir{
+			Name:    KeptDedup,
+			Path:    config.DedupDir,
+			MaxSize: config.DedupDirMaxSize,
+			MaxAge:  config.DedupDirMaxAge,
+			keptAt: func(name string, _ os.FileInfo) (time.Time, bool) {
+				return TrashedAt(name)
+			},
+		})
+	}
+	return dirs
+}
+
+// keptFile is a file in a kept directory
+type keptFile struct {
+	name   string
+	size   int64
+	keptAt time.Time
+}
+
+// Purge deletes expired files and then the oldest files over the size cap. Returns the number of deleted files
+// and the size of all files left in the directory, including ones it never purges.
+func (d KeptDir) Purge() (int, int64, error) {
+	entries, err := os.ReadDir(d.Path)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to read %s directory: %s", d.Name, err.Error())
+	}
+
+	var size, keptSize int64
+	files := []keptFile{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		size += info.Size()
+		if keptAt, ok := d.keptAt(e.Name(), info); ok {
+			files = append(files, keptFile{name: e.Name(), size: info.Size(), keptAt: keptAt})
+			keptSize += info.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].keptAt.Before(files[j].keptAt) })
+
+	purged := 0
+	for _, file := range files {
+		expired := d.MaxAge > 0 && time.Since(file.keptAt) >= d.MaxAge
+		if !expired && (d.MaxSize <= 0 || keptSize <= d.MaxSize) {
+			break
+		}
+		if err := os.Remove(filepath.Join(d.Path, file.name)); err != nil && !os.IsNotExist(err) {
+			return purged, size, fmt.Errorf("failed to purge %q from %s directory: %s", file.name, d.Name, err.Error())
+		}
+		size -= file.size
+		keptSize -= file.size
+		purged++
+	}
+	return purged, size, nil
+}
@@ -0,0 +1,51 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// keyIDLength is the number of hex characters of the public keys hash used as a key identifier
+const keyIDLength = 16
+
+// DefaultEncryptionKeyID derives key identifier from the public keys files are encrypted to.
+// There is no identifier for passphrase encryption, it must be set explicitly to not leak anything about the passphrase.
+func DefaultEncryptionKeyID(config cfg.AppConfig) (string, error) {
+	keys := []string{}
+
+	switch {
+	case config.EncryptEngine == "age":
+		for _, recipient := range config.AgeRecipients {
+			if s, ok := recipient.(fmt.Stringer); ok {
+				keys = append(keys, s.String())
+			}
+		}
+
+	case config.EncryptEngine == "kms":
+		keys = append(keys, config.KMSKeyID)
+
+	case IsAsymmetricEncryption(config):
+		keys = append(keys, config.GpgRecipients...)
+		if config.GpgPublicKeyFile != "" {
+			data, err := os.ReadFile(config.GpgPublicKeyFile)
+			if err != nil {
+				return "", err
+			}
+			keys = append(keys, string(data))
+		}
+	}
+
+	if len(keys) == 0 {
+		return "", nil
+	}
+
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:])[:keyIDLength], nil
+}
@@ -0,0 +1,93 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// keyFileSuffix is the suffix of companion files with a custom S3 key
+const keyFileSuffix = ".key"
+
+// IsKeyFile checks if a file is a companion file with a custom S3 key for another file
+func IsKeyFile(config cfg.AppConfig, filename string) bool {
+	return config.KeyOverride && strings.HasSuffix(filename, keyFileSuffix)
+}
+
+// keyFileName returns the name of the companion key file, it always stays in the watched directory
+func keyFileName(config cfg.AppConfig, filename string) string {
+	return WatchedFileName(config, filename) + keyFileSuffix
+}
+
+// ObjectKey returns S3 key for a file. uploadFile is the file that is actually uploaded (compressed/encrypted one).
+// Large files go under LargeFilePrefix if it's set, the ready suffix of the source file is not part of the key.
+// A producer can set the key by writing it into a companion file with the .key suffix, it must be under KeyOverridePrefix.
+// A unique suffix is added to default keys if enabled, a resumed upload keeps the key it was started with.
+// Default keys are spread across hash-derived prefixes with KeyShardLevels, e.g. /backups/ab/cd/dump.sql.tgz.
+func ObjectKey(config cfg.AppConfig, filename, uploadFile string) (string, error) {
+	name := stripReadySuffix(config, filepath.Base(filename), filepath.Base(uploadFile))
+	if config.KeySuffix != "" {
+		if upload := ResumableUpload(config, filename); upload != nil {
+			return upload.Key, nil
+		}
+		suffix, err := keySuffix(config, filename)
+		if err != nil {
+			return "", err
+		}
+		name = addKeySuffix(name, suffix)
+	}
+	prefix := config.S3path
+	if config.LargeFilePrefix != "" && IsLargeFile(config, filename) {
+		prefix = fmt.Sprintf("%s/%s", config.S3path, config.LargeFilePrefix)
+	}
+	if config.KeyShardLevels > 0 {
+		prefix = fmt.Sprintf("%s/%s", prefix, keyShard(config.KeyShardLevels, name))
+	}
+	defaultKey := fmt.Sprintf("%s/%s", prefix, name)
+	if !config.KeyOverride {
+		return defaultKey, nil
+	}
+
+	data, err := os.ReadFile(keyFileName(config, filename))
+	if os.IsNotExist(err) {
+		return defaultKey, nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to read key file for %q: %s", filename, err.Error())
+	}
+
+	return ValidateKeyOverride(strings.TrimSpace(string(data)), config.KeyOverridePrefix)
+}
+
+// ValidateKeyOverride makes sure a custom key is under the allowed prefix and doesn't escape it.
+// The key is returned with a leading "/" like default keys.
+func ValidateKeyOverride(key, prefix string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("custom key is empty")
+	}
+	if strings.Contains(key, "..") {
+		return "", fmt.Errorf("custom key %q must not contain \"..\"", key)
+	}
+
+	cleanKey := path.Clean("/" + key)
+	cleanPrefix := strings.Trim(prefix, "/")
+	if cleanPrefix != "" && !strings.HasPrefix(cleanKey, "/"+cleanPrefix+"/") {
+		return "", fmt.Errorf("custom key %q is not under the allowed prefix %q", key, cleanPrefix)
+	}
+	return cleanKey, nil
+}
+
+// DeleteKeyFile deletes the companion key file of an uploaded file
+func DeleteKeyFile(config cfg.AppConfig, filename string) error {
+	if !config.KeyOverride {
+		return nil
+	}
+
+	if err := os.Remove(keyFileName(config, filename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package fs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
+)
+
+// Content encryption of the S3 Encryption Client v2 format, the tag is appended to the ciphertext
+const (
+	kmsCEKAlgorithm = "AES/GCM/NoPadding"
+	kmsTagLength    = "128"
+	kmsIVSize       = 12
+	kmsKeySize      = 32
+	kmsTagSize      = 16
+)
+
+// KMSMaxFileSizeLimit is the largest file AES-GCM can encrypt with one IV
+const KMSMaxFileSizeLimit = (1<<32 - 2) * aes.BlockSize
+
+// EnvelopeSuffix is added to the encrypted file name for the file with its envelope, the envelope is uploaded
+// as object metadata
+const EnvelopeSuffix = ".envelope"
+
+// NewKMSClient creates a KMS client, the endpoint is resolved by the SDK unless it's set
+func NewKMSClient(config cfg.AppConfig) (kmsiface.KMSAPI, error) {
+	awsConfig := aws.NewConfig()
+	if config.KMSEndpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.KMSEndpoint)
+	}
+	if config.S3UseFIPS {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return kms.New(sess), nil
+}
+
+// encryptKMS encrypts srcFile into encFile with a data key generated by KMS for this file. The data key wrapped by
+// KMS, the IV and the algorithms are written to the envelope file in the format of the S3 Encryption Client v2,
+// so the object can be decrypted by S3 encryption clients. The whole file is encrypted in memory like the clients do,
+// so files over KMSMaxFileSize are refused and the memory is reserved from the buffer budget.
+func encryptKMS(ctx context.Context, config cfg.AppConfig, encFile, srcFile string) error {
+	fi, err := os.Stat(srcFile)
+	if err != nil {
+		return err
+	}
+	limit := config.KMSMaxFileSize
+	if limit <= 0 || limit > KMSMaxFileSizeLimit {
+		limit = KMSMaxFileSizeLimit
+	}
+	if fi.Size() > limit {
+		return errclass.Permanent(fmt.Errorf("%q is %d bytes, files over %d bytes can't be encrypted with -encrypt-engine=kms",
+			srcFile, fi.Size(), limit))
+	}
+
+	// The file is sealed in place, so the buffer is its size and the tag
+	reserved, err := config.BufferBudget.Acquire(ctx, fi.Size()+kmsTagSize)
+	if err != nil {
+		return err
+	}
+	defer config.BufferBudget.Release(reserved)
+
+	data, err := readFull(srcFile, fi.Size(), kmsTagSize)
+	if err != nil {
+		return err
+	}
+
+	generator := s3crypto.NewKMSContextKeyGenerator(config.KMS, config.KMSKeyID, s3crypto.MaterialDescription{})
+	cd, err := generator.GenerateCipherDataWithCEKAlg(ctx, kmsKeySize, kmsIVSize, kmsCEKAlgorithm)
+	if err != nil {
+		return fmt.Errorf("failed to generate KMS data key for %q: %s", srcFile, err.Error())
+	}
+
+	block, err := aes.NewCipher(cd.Key)
+	if err != nil {
+		return err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	matDesc, err := json.Marshal(cd.MaterialDescription)
+	if err != nil {
+		return err
+	}
+	envelope, err := json.Marshal(s3crypto.Envelope{
+		IV:                    base64.StdEncoding.EncodeToString(cd.IV),
+		CipherKey:             base64.StdEncoding.EncodeToString(cd.EncryptedKey),
+		MatDesc:               string(matDesc),
+		WrapAlg:               cd.WrapAlgorithm,
+		CEKAlg:                kmsCEKAlgorithm,
+		TagLen:                kmsTagLength,
+		UnencryptedContentLen: strconv.Itoa(len(data)),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(encFile+EnvelopeSuffix, envelope, 0600); err != nil {
+		return fmt.Errorf("failed to write envelope of %q: %s", srcFile, err.Error())
+	}
+	if err := os.WriteFile(encFile, gcm.Seal(data[:0], cd.IV, data, nil), 0600); err != nil {
+		return fmt.Errorf("failed to write file encrypted with KMS data key %q: %s", encFile, err.Error())
+	}
+	return nil
+}
+
+// readFull reads size bytes of a file into a buffer with extra capacity
+func readFull(filename string, size, extra int64) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, size, size+extra)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, fmt.Errorf("failed to read %q: %s", filename, err.Error())
+	}
+	return data, nil
+}
+
+// KMSEnvelope returns object metadata with the envelope of a file encrypted with a KMS data key
+func KMSEnvelope(config cfg.AppConfig, filename string) (map[string]string, error) {
+	data, err := os.ReadFile(EncryptedFileName(config, filename) + EnvelopeSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read envelope of %q: %s", filename, err.Error())
+	}
+
+	metadata := map[string]string{}
+	if err := json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse envelope of %q: %s", filename, err.Error())
+	}
+	return metadata, nil
+}
@@ -0,0 +1,10 @@
+package fs
+
+import (
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// beat records that the scanner or watcher of the watched path is running
+func beat(config cfg.AppConfig) {
+	config.Status.ScannerRan(config.PathToWatch)
+}
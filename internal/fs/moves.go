@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"os"
+	"sync"
+)
+
+// moveTracker keeps files that were sent to workers with their identities and where they were moved to since then.
+// A Create event of a file with the identity of a queued file that is gone under its name is a move of that file.
+type moveTracker struct {
+	mu     sync.Mutex
+	queued map[string]fileID
+	byID   map[fileID]string
+	moves  map[string]string
+}
+
+var tracker = moveTracker{
+	queued: map[string]fileID{},
+	byID:   map[fileID]string{},
+	moves:  map[string]string{},
+}
+
+// markQueued remembers a file that was sent to workers
+func (t *moveTracker) markQueued(file string, id fileID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queued[file] = id
+	if id != (fileID{}) {
+		t.byID[id] = file
+	}
+}
+
+// isQueued checks if a file was sent to workers and wasn't processed yet
+func (t *moveTracker) isQueued(file string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.queued[file]
+	return ok
+}
+
+// movedFrom returns the queued file that has the identity of file under another name that doesn't exist anymore
+func (t *moveTracker) movedFrom(file string, id fileID) (string, bool) {
+	if id == (fileID{}) {
+		return "", false
+	}
+	t.mu.Lock()
+	from, ok := t.byID[id]
+	t.mu.Unlock()
+	if !ok || from == file {
+		return "", false
+	}
+	if _, err := os.Lstat(from); err == nil {
+		return "", false
+	}
+	return from, true
+}
+
+// move records that a queued file was renamed, the queue entry now points to the new name
+func (t *moveTracker) move(from, to string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id := t.queued[from]
+	delete(t.queued, from)
+	t.queued[to] = id
+	if id != (fileID{}) {
+		t.byID[id] = to
+	}
+	t.moves[from] = to
+}
+
+// resolve returns the current name of a queued file and forgets about it
+func (t *moveTracker) resolve(file string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for {
+		to, ok := t.moves[file]
+		if !ok {
+			break
+		}
+		delete(t.moves, file)
+		file = to
+	}
+	if id, ok := t.queued[file]; ok && t.byID[id] == file {
+		delete(t.byID, id)
+	}
+	delete(t.queued, file)
+	return file
+}
+
+// ResolveMove returns the current name of a file from the queue, it changes if the file
+// was renamed within the watched directory after it was queued
+func ResolveMove(file string) string {
+	return tracker.resolve(file)
+}
@@ -0,0 +1,146 @@
+package fs
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression engines
+const (
+	// CompressExec runs external tar and compressor tools
+	CompressExec = "exec"
+	// CompressNative compresses in the process without external tools, lz4 is not supported
+	CompressNative = "native"
+)
+
+// DefaultCompressEngine returns the engine used unless it's configured, tar and compressors are usually not
+// installed on Windows hosts and can't be run when external tools are disabled
+func DefaultCompressEngine(noExec bool) string {
+	if noExec || runtime.GOOS == "windows" {
+		return CompressNative
+	}
+	return CompressExec
+}
+
+// ValidateCompressEngine checks the compression engine supports the codec
+func ValidateCompressEngine(engine, compression string) error {
+	switch engine {
+	case CompressExec:
+		return nil
+	case CompressNative:
+		if compression == "lz4" {
+			return fmt.Errorf("lz4 compression is only supported by the %s compress engine", CompressExec)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported compress engine %q, must be %s or %s", engine, CompressExec, CompressNative)
+}
+
+// compressNative packs a file into a tar archive, unless archives are disabled, and compresses it with Go
+// implementations of the codecs. The output is the same format the external tools produce.
+func compressNative(ctx context.Context, config cfg.AppConfig, filename string) error {
+	compressedFile := CompressedFileName(config, filename)
+	out, err := os.Create(compressedFile)
+	if err != nil {
+		return fmt.Errorf("failed to create compressed file %q: %s", compressedFile, err.Error())
+	}
+	defer out.Close()
+
+	w, err := nativeCompressor(out, config)
+	if err != nil {
+		return err
+	}
+	if config.Archive == ArchiveNone {
+		err = copyFile(ctx, w, filename)
+	} else {
+		err = writeTar(ctx, w, config, filename)
+	}
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%s for %q cancelled: %s", config.Compression, filename, ctx.Err().Error())
+		}
+		return fmt.Errorf("failed to compress %q with %s: %s", filename, config.Compression, err.Error())
+	}
+	return out.Close()
+}
+
+// nativeCompressor returns a writer compressing with the configured codec and level
+func nativeCompressor(w io.Writer, config cfg.AppConfig) (io.WriteCloser, error) {
+	switch config.Compression {
+	case "gzip":
+		level := gzip.DefaultCompression
+		if config.CompressionLevel > 0 {
+			level = config.CompressionLevel
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		level := zstd.SpeedDefault
+		if config.CompressionLevel > 0 {
+			level = zstd.EncoderLevelFromZstd(config.CompressionLevel)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	}
+	return nil, fmt.Errorf("%s compression is not supported by the %s compress engine", config.Compression, CompressNative)
+}
+
+// writeTar writes a tar archive with the file under its base name, like tar -C does. Symlinks are archived as
+// links unless they are followed.
+func writeTar(ctx context.Context, w io.Writer, config cfg.AppConfig, filename string) error {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		if config.FollowSymlinks {
+			info, err = os.Stat(filename)
+		} else {
+			link, err = os.Readlink(filename)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.Base(filename)
+
+	tw := tar.NewWriter(w)
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag == tar.TypeReg {
+		if err := copyFile(ctx, tw, filename); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// copyFile copies the file content, following symlinks, and stops when ctx is done
+func copyFile(ctx context.Context, w io.Writer, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, contextReader{ctx: ctx, r: f})
+	return err
+}
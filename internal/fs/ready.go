@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"os"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Producers can mark complete files in one of two ways to avoid races with slow writers:
+// write a companion marker file (FILE + ReadyMarker, e.g. dump.sql.done) or rename the file to FILE + ReadySuffix.
+
+// IsReadyMarker checks if a file is a ready marker of another file
+func IsReadyMarker(config cfg.AppConfig, filename string) bool {
+	return config.ReadyMarker != "" && strings.HasSuffix(filename, config.ReadyMarker)
+}
+
+// readyMarkerName returns the name of the ready marker, it always stays in the watched directory
+func readyMarkerName(config cfg.AppConfig, filename string) string {
+	return WatchedFileName(config, filename) + config.ReadyMarker
+}
+
+// markedFileName returns the file a ready marker belongs to
+func markedFileName(config cfg.AppConfig, marker string) string {
+	return strings.TrimSuffix(marker, config.ReadyMarker)
+}
+
+// IsReady checks if a producer has finished writing a file, the exit trigger file is always ready
+func IsReady(config cfg.AppConfig, filename string) bool {
+	if config.ExitOnFilename != "" && filename == config.ExitOnFilename {
+		return true
+	}
+	if config.ReadySuffix != "" && !strings.HasSuffix(filename, config.ReadySuffix) {
+		return false
+	}
+	if config.ReadyMarker != "" {
+		if _, err := os.Stat(readyMarkerName(config, filename)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// notReadyReason explains why a file is not ready
+func notReadyReason(config cfg.AppConfig) string {
+	if config.ReadySuffix != "" {
+		return "no ready suffix " + config.ReadySuffix
+	}
+	return "waiting for ready marker " + config.ReadyMarker
+}
+
+// stripReadySuffix removes the ready suffix of the source file from an uploaded file name
+func stripReadySuffix(config cfg.AppConfig, sourceName, name string) string {
+	if config.ReadySuffix == "" || !strings.HasSuffix(sourceName, config.ReadySuffix) {
+		return name
+	}
+	return strings.Replace(name, sourceName, strings.TrimSuffix(sourceName, config.ReadySuffix), 1)
+}
+
+// DeleteReadyMarker deletes the ready marker of an uploaded file
+func DeleteReadyMarker(config cfg.AppConfig, filename string) error {
+	if config.ReadyMarker == "" {
+		return nil
+	}
+
+	if err := os.Remove(readyMarkerName(config, filename)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package fs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// LoadRoutes reads routing rules from a JSON file with a list of {"pattern": "*.sql", "destination": "s3://bucket/path"}
+// objects. Destinations are s3:// URIs or http:// and https:// URLs uploaded to with PUT requests, the latter can
+// have their own "headers" instead of -http-headers. Environment variables in header values are expanded and
+// {instance} in destinations is replaced with the instance ID.
+func LoadRoutes(path, instanceID string) ([]cfg.Route, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read routes file %q: %s", path, err.Error())
+	}
+
+	routes := []cfg.Route{}
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, fmt.Errorf("failed to parse routes file %q: %s", path, err.Error())
+	}
+
+	for i, route := range routes {
+		if _, err := filepath.Match(route.Pattern, ""); err != nil || route.Pattern == "" {
+			return nil, fmt.Errorf("bad pattern %q of route %d", route.Pattern, i+1)
+		}
+
+		route.Destination = strings.ReplaceAll(route.Destination, "{instance}", instanceID)
+		routes[i].Destination = route.Destination
+		u, err := url.Parse(route.Destination)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("bad destination %q of route %d", route.Destination, i+1)
+		}
+		switch u.Scheme {
+		case "s3":
+			if strings.Trim(u.Path, "/") == "" {
+				return nil, fmt.Errorf("destination %q of route %d must contain bucket and path for backups", route.Destination, i+1)
+			}
+			routes[i].S3bucket, routes[i].S3path = u.Host, strings.TrimSuffix(u.Path, "/")
+		case "http", "https":
+			routes[i].HTTPURL, routes[i].S3path = route.Destination, strings.TrimSuffix(u.Path, "/")
+			for name, value := range route.Headers {
+				route.Headers[name] = os.ExpandEnv(value)
+			}
+		default:
+			return nil, fmt.Errorf("destination %q of route %d must be an s3://, http:// or https:// URL", route.Destination, i+1)
+		}
+	}
+	return routes, nil
+}
+
+// RouteConfig returns the config with the destination of the first route matching the file name, the default
+// destination is kept when no route matches
+func RouteConfig(config cfg.AppConfig, filename string) cfg.AppConfig {
+	name := filepath.Base(filename)
+	for _, route := range config.Routes {
+		if ok, _ := filepath.Match(route.Pattern, name); !ok {
+			continue
+		}
+
+		// Custom keys of routed files must be under the route path unless the prefix is set explicitly
+		if config.KeyOverridePrefix == config.S3path {
+			config.KeyOverridePrefix = route.S3path
+		}
+		config.S3bucket, config.S3path, config.HTTPURL = route.S3bucket, route.S3path, route.HTTPURL
+		if route.Headers != nil {
+			config.HTTPHeaders = route.Headers
+		}
+		return config
+	}
+	return config
+}
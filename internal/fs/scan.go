@@ -0,0 +1,152 @@
+package fs
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Number of directory entries read at once, a huge directory is never read into memory as a whole
+const scanBatchSize = 1024
+
+// Attempts to read the watched directory in a scan and the delay between them
+const (
+	scanAttempts   = 3
+	scanRetryDelay = time.Second
+)
+
+// scannedFile is a file found by a scan
+type scannedFile struct {
+	name    string
+	modTime time.Time
+}
+
+// newestFirst is a heap of scanned files with the newest one on top, it keeps the oldest files found so far
+type newestFirst []scannedFile
+
+func (h newestFirst) Len() int           { return len(h) }
+func (h newestFirst) Less(i, j int) bool { return h[i].modTime.After(h[j].modTime) }
+func (h newestFirst) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *newestFirst) Push(x any)        { *h = append(*h, x.(scannedFile)) }
+func (h *newestFirst) Pop() any {
+	old := *h
+	file := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return file
+}
+
+// scanFilesRetry scans the watched directory like scanFiles and tries again after transient failures, every failure
+// is counted in metrics
+func scanFilesRetry(ctx context.Context, config cfg.AppConfig) ([]string, int, error) {
+	for attempt := 1; ; attempt++ {
+		files, entries, err := scanFiles(config, config.MaxFilesPerScan)
+		if err == nil {
+			return files, entries, nil
+		}
+		if config.Metrics.ScanErrors != nil {
+			config.Metrics.ScanErrors.WithLabelValues().Inc()
+		}
+		if attempt == scanAttempts {
+			return nil, entries, err
+		}
+
+		config.Applog.Warningf("Failed to scan %q, retrying in %s: %s", config.PathToWatch, scanRetryDelay, err.Error())
+		select {
+		case <-ctx.Done():
+			return nil, entries, err
+		case <-time.After(scanRetryDelay):
+		}
+	}
+}
+
+// scanFiles reads the watched directory in batches and returns files to upload oldest first, along with the number
+// of directory entries. Only the limit oldest files are returned, groups are limited after they are formed,
+// so their members are never left for another scan. Zero limit returns all files.
+func scanFiles(config cfg.AppConfig, limit int) ([]string, int, error) {
+	dir, err := os.Open(config.PathToWatch)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer dir.Close()
+
+	bounded := limit > 0 && len(config.FileGroups) == 0
+	found := newestFirst{}
+	entries := 0
+	for {
+		batch, err := dir.ReadDir(scanBatchSize)
+		entries += len(batch)
+		for _, e := range batch {
+			filename := filepath.Join(config.PathToWatch, e.Name())
+			if !uploadable(config, e, filename) {
+				continue
+			}
+			fi, err := e.Info()
+			if err != nil {
+				// Gone since it was listed
+				continue
+			}
+
+			heap.Push(&found, scannedFile{name: filename, modTime: fi.ModTime()})
+			if bounded && found.Len() > limit {
+				heap.Pop(&found)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, entries, err
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].modTime.Equal(found[j].modTime) {
+			return found[i].name < found[j].name
+		}
+		return found[i].modTime.Before(found[j].modTime)
+	})
+	files := make([]string, len(found))
+	for i, file := range found {
+		files[i] = file.name
+	}
+	return files, entries, nil
+}
+
+// uploadable checks if a directory entry is a file ready to be uploaded
+func uploadable(config cfg.AppConfig, e os.DirEntry, filename string) bool {
+	if e.IsDir() || IsKeyFile(config, filename) || IsReadyMarker(config, filename) || config.Control.IsControlFile(filename) ||
+		IsIgnored(config, filename) || !IsIncluded(config, filename) {
+		return false
+	} else if !IsReady(config, filename) {
+		config.Applog.V(8).Infof("Found file %q but it's not ready: %s", filename, notReadyReason(config))
+	} else if ok, reason := fileTypeAllowed(config, filename); !ok {
+		config.Applog.V(8).Infof("Found file %q but it's skipped: %s", filename, reason)
+	} else if IsLocked(filename) {
+		config.Applog.Infof("Found file %q but it's already being processed (lock detected)", filename)
+	} else if IsInFlight(filename) {
+		config.Applog.V(8).Infof("Found file %q but it's being processed under another name", filename)
+	} else if IsQuarantined(config, filename) {
+		config.Applog.V(8).Infof("Found file %q but it's quarantined: %s", filename, quarantineReason(config, filename))
+	} else if ok, reason := sizeAllowed(config, filename); !ok {
+		config.Applog.V(8).Infof("Found file %q but it's skipped: %s", filename, reason)
+	} else {
+		return true
+	}
+	return false
+}
+
+// oldestMessages returns limit messages with the oldest files, zero limit returns all of them
+func oldestMessages(messages []cfg.Message, limit int) []cfg.Message {
+	if limit <= 0 || len(messages) <= limit {
+		return messages
+	}
+
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].ModTime.Before(messages[j].ModTime) })
+	return messages[:limit]
+}
@@ -0,0 +1,47 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// MaxKeyShardLevels is the maximum number of hash-derived prefix levels of object keys
+const MaxKeyShardLevels = 4
+
+// ValidateKeyShardLevels checks the number of hash-derived prefix levels
+func ValidateKeyShardLevels(levels int) error {
+	if levels < 0 || levels > MaxKeyShardLevels {
+		return fmt.Errorf("unsupported key shard levels %d, must be from 0 to %d", levels, MaxKeyShardLevels)
+	}
+	return nil
+}
+
+// keyShard returns hash-derived prefixes of an object name, two hex digits of its SHA-256 per level,
+// e.g. ab/cd for two levels. Each level spreads keys across 256 prefixes.
+func keyShard(levels int, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	digits := hex.EncodeToString(sum[:levels])
+	parts := make([]string, levels)
+	for i := range parts {
+		parts[i] = digits[2*i : 2*i+2]
+	}
+	return strings.Join(parts, "/")
+}
+
+// KeyShardScheme returns the shard scheme of a key for restore tooling, e.g. sha256/2 for a key with two prefix
+// levels derived from SHA-256 of the object name. Keys that are not sharded, e.g. custom keys, have no scheme.
+func KeyShardScheme(config cfg.AppConfig, key string) string {
+	if config.KeyShardLevels == 0 {
+		return ""
+	}
+	name := path.Base(key)
+	if !strings.HasSuffix(key, "/"+keyShard(config.KeyShardLevels, name)+"/"+name) {
+		return ""
+	}
+	return fmt.Sprintf("sha256/%d", config.KeyShardLevels)
+}
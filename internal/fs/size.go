@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+)
+
+// sizeAllowed checks a file against -min-file-size and -max-file-size and returns the reason if it's skipped
+func sizeAllowed(config cfg.AppConfig, filename string) (bool, string) {
+	if config.MinFileSize <= 0 && config.MaxFileSize <= 0 {
+		return true, ""
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		// Let the worker deal with it
+		return true, ""
+	}
+
+	if fileSizeAllowed(config, filename, fi.Size()) {
+		return true, ""
+	}
+	if fi.Size() < config.MinFileSize {
+		return false, fmt.Sprintf("smaller than -min-file-size %s", utils.HumanizeBytes(config.MinFileSize, false))
+	}
+	return false, fmt.Sprintf("larger than -max-file-size %s", utils.HumanizeBytes(config.MaxFileSize, false))
+}
+
+// fileSizeAllowed checks size limits, the exit trigger file is never filtered
+func fileSizeAllowed(config cfg.AppConfig, filename string, size int64) bool {
+	if config.ExitOnFilename != "" && filename == config.ExitOnFilename {
+		return true
+	}
+	if config.MinFileSize > 0 && size < config.MinFileSize {
+		return false
+	}
+	if config.MaxFileSize > 0 && size > config.MaxFileSize {
+		return false
+	}
+	return true
+}
+
+// IsLargeFile checks if a file is routed to the large files prefix and storage class
+func IsLargeFile(config cfg.AppConfig, filename string) bool {
+	if config.LargeFileSize <= 0 {
+		return false
+	}
+
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Size() >= config.LargeFileSize
+}
+
+// StorageClass returns S3 storage class for a file, empty string means the bucket default
+func StorageClass(config cfg.AppConfig, filename string) string {
+	if config.LargeFileStorageClass != "" && IsLargeFile(config, filename) {
+		return config.LargeFileStorageClass
+	}
+	return config.StorageClass
+}
@@ -0,0 +1,105 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+
+	"filippo.io/age"
+)
+
+// StreamConfig returns the config a stream is prepared with. Streams are compressed in the process without a tar
+// archive, as tar needs the size up front.
+func StreamConfig(config cfg.AppConfig) cfg.AppConfig {
+	config.Archive = ArchiveNone
+	config.CompressEngine = CompressNative
+	return config
+}
+
+// ValidateStream checks that a stream can be prepared with the config, kms encrypts whole files in memory
+func ValidateStream(config cfg.AppConfig) error {
+	if config.Gzip {
+		if err := ValidateCompressEngine(CompressNative, config.Compression); err != nil {
+			return err
+		}
+	}
+	if config.Encrypt && config.EncryptEngine == "kms" {
+		return fmt.Errorf("kms encryption is not supported for streams, use gpg or age")
+	}
+	return nil
+}
+
+// StreamKey returns the object key of a stream named name under the S3 path, extensions of compression and
+// encryption are added to the name like they are to file names. Hash-derived prefixes of -key-shard-levels go right
+// before the file name, so restore tooling finds them where they are in file keys.
+func StreamKey(config cfg.AppConfig, name string) (string, error) {
+	clean := path.Clean("/" + name)[1:]
+	if clean == "" || clean != name {
+		return "", fmt.Errorf("stream key %q must be a relative path without . or .. elements", name)
+	}
+
+	config = StreamConfig(config)
+	dir, base := path.Dir(name), filepath.Base(PreparedFileName(config, name))
+	if config.KeyShardLevels > 0 {
+		dir = path.Join(dir, keyShard(config.KeyShardLevels, base))
+	}
+	return fmt.Sprintf("%s/%s", config.S3path, path.Join(dir, base)), nil
+}
+
+// PrepareStream compresses and encrypts the stream named name, the returned reader fails with errors of the
+// stages. Stages stop when ctx is done.
+func PrepareStream(ctx context.Context, config cfg.AppConfig, name string, in io.Reader) io.Reader {
+	config = StreamConfig(config)
+	out := io.Reader(contextReader{ctx: ctx, r: in})
+
+	if ShouldCompress(config, name) {
+		src := out
+		out = streamStage(func(w io.Writer) error {
+			cw, err := nativeCompressor(w, config)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(cw, src); err != nil {
+				return fmt.Errorf("failed to compress stream with %s: %s", config.Compression, err.Error())
+			}
+			return cw.Close()
+		})
+	}
+
+	if config.Encrypt {
+		src := out
+		out = streamStage(func(w io.Writer) error {
+			if config.EncryptEngine == "age" {
+				return encryptAgeStream(config, src, w)
+			}
+			return encryptGPGStream(ctx, config, src, w)
+		})
+	}
+
+	return out
+}
+
+// streamStage runs fn in a goroutine writing to the returned reader, errors of fn are returned by the reader
+func streamStage(fn func(w io.Writer) error) io.Reader {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(fn(w))
+	}()
+	return r
+}
+
+// encryptAgeStream encrypts the stream with age
+func encryptAgeStream(config cfg.AppConfig, in io.Reader, out io.Writer) error {
+	w, err := age.Encrypt(out, config.AgeRecipients...)
+	if err != nil {
+		return fmt.Errorf("failed to start age encryption: %s", err.Error())
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		return fmt.Errorf("failed to encrypt stream with age: %s", err.Error())
+	}
+	return w.Close()
+}
@@ -0,0 +1,170 @@
+package fs
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Unique key suffixes
+const (
+	// KeySuffixULID is a time-sortable ULID, it stays monotonic when the clock goes backwards
+	KeySuffixULID = "ulid"
+	// KeySuffixUUID is a random UUID v4
+	KeySuffixUUID = "uuid"
+	// KeySuffixCounter is a counter persisted in the state file
+	KeySuffixCounter = "counter"
+)
+
+// Crockford's base32 alphabet used by ULIDs
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ValidateKeySuffix checks the unique key suffix kind, empty means no suffix
+func ValidateKeySuffix(kind string) error {
+	switch kind {
+	case "", KeySuffixULID, KeySuffixUUID, KeySuffixCounter:
+		return nil
+	}
+	return fmt.Errorf("unsupported key suffix %q, must be %s, %s or %s", kind, KeySuffixULID, KeySuffixUUID, KeySuffixCounter)
+}
+
+// suffixTracker keeps the suffix of every file version, so all attempts to upload it use the same key
+type suffixTracker struct {
+	mu       sync.Mutex
+	suffixes map[string]fileSuffix
+
+	// Last ULID, the next one within the same millisecond or after a clock step back increments it
+	lastTime uint64
+	lastHigh uint16
+	lastLow  uint64
+}
+
+// Suffix of a file with the given size and modification time
+type fileSuffix struct {
+	size    int64
+	modTime time.Time
+	suffix  string
+}
+
+var suffixes = suffixTracker{suffixes: map[string]fileSuffix{}}
+
+// keySuffix returns the unique suffix of the file, a new one is generated when the file changes. Suffixes are
+// recorded in the state, so a file keeps its key after a restart until it's deleted.
+func keySuffix(config cfg.AppConfig, filename string) (string, error) {
+	if config.KeySuffix == "" {
+		return "", nil
+	}
+
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return "", err
+	}
+	name := WatchedFileName(config, filename)
+
+	suffixes.mu.Lock()
+	defer suffixes.mu.Unlock()
+
+	if s, ok := suffixes.suffixes[name]; ok && s.size == fi.Size() && s.modTime.Equal(fi.ModTime()) {
+		return s.suffix, nil
+	}
+	if config.State != nil {
+		if entry, ok := config.State.Get(name); ok && entry.KeySuffix != "" && entry.Matches(fi) {
+			suffixes.suffixes[name] = fileSuffix{size: fi.Size(), modTime: fi.ModTime(), suffix: entry.KeySuffix}
+			return entry.KeySuffix, nil
+		}
+	}
+
+	var suffix string
+	switch config.KeySuffix {
+	case KeySuffixULID:
+		suffix = suffixes.newULID(time.Now())
+	case KeySuffixUUID:
+		suffix = newUUID()
+	case KeySuffixCounter:
+		n, err := config.State.NextCounter()
+		if err != nil {
+			return "", fmt.Errorf("failed to increment key suffix counter: %s", err.Error())
+		}
+		suffix = fmt.Sprintf("%08d", n)
+	}
+	if config.State != nil {
+		if err := config.State.SetKeySuffix(name, fi.Size(), fi.ModTime(), suffix); err != nil {
+			return "", fmt.Errorf("failed to record key suffix: %s", err.Error())
+		}
+	}
+	suffixes.suffixes[name] = fileSuffix{size: fi.Size(), modTime: fi.ModTime(), suffix: suffix}
+	return suffix, nil
+}
+
+// forgetKeySuffix forgets the suffix of a deleted file
+func forgetKeySuffix(config cfg.AppConfig, filename string) {
+	suffixes.mu.Lock()
+	defer suffixes.mu.Unlock()
+	name := WatchedFileName(config, filename)
+	delete(suffixes.suffixes, name)
+	if config.State != nil {
+		if err := config.State.DeleteKeySuffix(name); err != nil {
+			config.Applog.Errorf("Failed to forget key suffix of %q: %s", filename, err.Error())
+		}
+	}
+}
+
+// addKeySuffix inserts the suffix before the first extension of the name, so restored files keep their type
+func addKeySuffix(name, suffix string) string {
+	if suffix == "" {
+		return name
+	}
+	if len(name) > 1 {
+		if i := strings.Index(name[1:], "."); i >= 0 {
+			return name[:i+1] + "-" + suffix + name[i+1:]
+		}
+	}
+	return name + "-" + suffix
+}
+
+// newULID generates a ULID, must be called with the lock held. The time part never goes backwards,
+// so suffixes stay sortable and unique when the clock is adjusted.
+func (t *suffixTracker) newULID(now time.Time) string {
+	ms := uint64(now.UnixMilli())
+	if ms <= t.lastTime {
+		ms = t.lastTime
+		t.lastLow++
+		if t.lastLow == 0 {
+			t.lastHigh++
+		}
+	} else {
+		var entropy [10]byte
+		rand.Read(entropy[:])
+		t.lastHigh = binary.BigEndian.Uint16(entropy[:2])
+		t.lastLow = binary.BigEndian.Uint64(entropy[2:])
+	}
+	t.lastTime = ms
+
+	var id [26]byte
+	for i := 9; i >= 0; i-- {
+		id[i] = ulidAlphabet[ms&31]
+		ms >>= 5
+	}
+	high, low := t.lastHigh, t.lastLow
+	for i := 25; i >= 10; i-- {
+		id[i] = ulidAlphabet[low&31]
+		low = low>>5 | uint64(high&31)<<59
+		high >>= 5
+	}
+	return string(id[:])
+}
+
+// newUUID generates a random UUID v4
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
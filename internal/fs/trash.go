@@ -0,0 +1,41 @@
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// trashTimeFormat prefixes names of files in the trash with the time they were moved there, so files with the same
+// name don't overwrite each other and are purged by that time instead of their modification time
+const trashTimeFormat = "20060102T150405.000000000Z"
+
+// moveToTrash moves an uploaded source file into the trash directory instead of deleting it
+func moveToTrash(config cfg.AppConfig, name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := os.MkdirAll(config.TrashDir, 0755); err != nil {
+		return err
+	}
+
+	dst := filepath.Join(config.TrashDir, time.Now().UTC().Format(trashTimeFormat)+"-"+filepath.Base(name))
+	if err := os.Rename(name, dst); err != nil {
+		return err
+	}
+	config.Applog.Infof("File %q moved to trash %q", name, dst)
+	return nil
+}
+
+// TrashedAt returns the time a file in the trash directory was moved there, false if it's not a trashed file
+func TrashedAt(name string) (time.Time, bool) {
+	prefix, _, ok := strings.Cut(filepath.Base(name), "-")
+	if !ok {
+		return time.Time{}, false
+	}
+	trashed, err := time.Parse(trashTimeFormat, prefix)
+	return trashed, err == nil
+}
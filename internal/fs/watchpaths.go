@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+)
+
+// LoadWatchPaths reads watched directories from a JSON file with a list of {"path": "/data/db", "include": ["*.sql"],
+// "prefix": "db"} objects, include patterns and prefix are optional
+func LoadWatchPaths(path string) ([]cfg.WatchPath, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watch paths file %q: %s", path, err.Error())
+	}
+
+	paths := []cfg.WatchPath{}
+	if err := json.Unmarshal(data, &paths); err != nil {
+		return nil, fmt.Errorf("failed to parse watch paths file %q: %s", path, err.Error())
+	}
+	return paths, nil
+}
+
+// ValidateWatchPaths checks that every directory is watched once and include patterns are valid
+func ValidateWatchPaths(paths []cfg.WatchPath) error {
+	seen := map[string]bool{}
+	for i, watch := range paths {
+		if watch.Path == "" {
+			return fmt.Errorf("path of watched directory %d is empty", i+1)
+		}
+		path := filepath.Clean(watch.Path)
+		if seen[path] {
+			return fmt.Errorf("directory %q is watched more than once", watch.Path)
+		}
+		seen[path] = true
+
+		for _, pattern := range watch.Include {
+			if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+				return fmt.Errorf("bad include pattern %q of watched directory %q", pattern, watch.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// WatchConfig returns the config for files of a watched directory. Its prefix is added to the S3 path,
+// custom keys must be under it too unless the prefix is set explicitly.
+func WatchConfig(config cfg.AppConfig, watch cfg.WatchPath) cfg.AppConfig {
+	config.PathToWatch = filepath.Clean(watch.Path)
+	config.IncludePatterns = watch.Include
+
+	if prefix := strings.Trim(watch.Prefix, "/"); prefix != "" {
+		if config.KeyOverridePrefix == config.S3path {
+			config.KeyOverridePrefix = config.S3path + "/" + prefix
+		}
+		config.S3path = config.S3path + "/" + prefix
+	}
+	return config
+}
+
+// WatchPathConfig returns the config of the watched directory the file is in, the config is returned as is
+// for files in other directories
+func WatchPathConfig(config cfg.AppConfig, filename string) cfg.AppConfig {
+	dir := filepath.Dir(filename)
+	for _, watch := range config.WatchPaths {
+		if filepath.Clean(watch.Path) == dir {
+			return WatchConfig(config, watch)
+		}
+	}
+	return config
+}
+
+// IsIncluded checks if a file matches one of the include patterns of its watched directory, all files are included
+// without patterns
+func IsIncluded(config cfg.AppConfig, filename string) bool {
+	if len(config.IncludePatterns) == 0 {
+		return true
+	}
+
+	name := filepath.Base(filename)
+	for _, pattern := range config.IncludePatterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchDirectories runs a scanner, or an inotify watcher with -watch, for every watched directory. All of them
+// feed the same queue, scans requested with TriggerScan are run in every directory.
+func WatchDirectories(ctx context.Context, comm *queue.Queue, config cfg.AppConfig) {
+	var wg sync.WaitGroup
+	triggers := []chan struct{}{}
+
+	for _, watch := range config.WatchPaths {
+		watchConfig := WatchConfig(config, watch)
+		watchConfig.ScanTrigger = make(chan struct{}, 1)
+		triggers = append(triggers, watchConfig.ScanTrigger)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if config.Watch {
+				WatchDirectory(ctx, comm, watchConfig)
+			} else {
+				ScanDirectory(ctx, comm, watchConfig)
+			}
+		}()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-config.ScanTrigger:
+			for _, trigger := range triggers {
+				select {
+				case trigger <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}
+}
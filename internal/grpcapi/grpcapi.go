@@ -0,0 +1,236 @@
+// Package grpcapi serves the gRPC API of the uploader next to the HTTP server, so platform tooling can queue files,
+// read the status and pause or drain the uploader with a typed client. The service is defined in
+// uploaderpb/uploader.proto.
+package grpcapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/grpcapi/uploaderpb"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Service implements the Uploader gRPC service
+type Service struct {
+	uploaderpb.UnimplementedUploaderServer
+
+	config  cfg.AppConfig
+	comm    *queue.Queue
+	status  func() cfg.AppStatus
+	maxSize int64
+}
+
+// errTooLarge is returned while reading a stream upload larger than the size limit
+var errTooLarge = errors.New("file is too large")
+
+// New creates the service for the worker queue, status returns a snapshot of the uploader status. Files sent with
+// StreamUpload may have at most maxSize bytes, 0 means no limit.
+func New(config cfg.AppConfig, comm *queue.Queue, status func() cfg.AppStatus, maxSize int64) *Service {
+	return &Service{config: config, comm: comm, status: status, maxSize: maxSize}
+}
+
+// NewServer creates a gRPC server with the service. Calls need HTTP basic auth credentials in the authorization
+// metadata if auth is set, format: user:password.
+func NewServer(s *Service, auth string, opts ...grpc.ServerOption) *grpc.Server {
+	if auth != "" {
+		opts = append(opts,
+			grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+				if err := checkAuth(ctx, auth); err != nil {
+					return nil, err
+				}
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				if err := checkAuth(ss.Context(), auth); err != nil {
+					return err
+				}
+				return handler(srv, ss)
+			}),
+		)
+	}
+
+	server := grpc.NewServer(opts...)
+	uploaderpb.RegisterUploaderServer(server, s)
+	return server
+}
+
+// checkAuth checks basic auth credentials in the authorization metadata
+func checkAuth(ctx context.Context, auth string) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		encoded, ok := strings.CutPrefix(value, "Basic ")
+		if !ok {
+			continue
+		}
+		creds, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil && subtle.ConstantTimeCompare(creds, []byte(auth)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+// Enqueue queues a file in a watched directory
+func (s *Service) Enqueue(ctx context.Context, req *uploaderpb.EnqueueRequest) (*uploaderpb.EnqueueResponse, error) {
+	if err := fs.QueueFile(ctx, s.comm, s.config, req.GetPath()); err != nil {
+		return nil, queueError(err)
+	}
+	s.config.Applog.Infof("File %q queued via gRPC", req.GetPath())
+	return &uploaderpb.EnqueueResponse{}, nil
+}
+
+// Status returns a snapshot of the uploader status
+func (s *Service) Status(context.Context, *uploaderpb.StatusRequest) (*uploaderpb.StatusResponse, error) {
+	st := s.status()
+	resp := &uploaderpb.StatusResponse{
+		Instance:   st.Instance,
+		Version:    st.Version,
+		Started:    timestamppb.New(st.Started),
+		QueueDepth: int64(st.QueueDepth),
+		Paused:     st.Paused,
+		Draining:   st.Draining,
+		Circuit:    st.Circuit,
+	}
+	for _, w := range st.Workers {
+		resp.Workers = append(resp.Workers, &uploaderpb.WorkerStatus{
+			Id:               int32(w.ID),
+			Running:          w.Running,
+			File:             w.File,
+			Phase:            w.Phase,
+			PhaseStarted:     timestamppb.New(w.PhaseStarted),
+			FilesProcessed:   w.FilesProcessed,
+			FilesFailed:      w.FilesFailed,
+			BytesUploaded:    w.BytesUploaded,
+			LastError:        w.LastError,
+			UploadDoneBytes:  w.UploadDone,
+			UploadTotalBytes: w.UploadTotal,
+		})
+	}
+	return resp, nil
+}
+
+// Pause pauses or resumes uploads with the pause control file
+func (s *Service) Pause(_ context.Context, req *uploaderpb.PauseRequest) (*uploaderpb.PauseResponse, error) {
+	if s.config.Control == nil {
+		return nil, status.Error(codes.FailedPrecondition, "pausing needs -control-files")
+	}
+	if err := s.config.Control.Pause(req.GetPaused()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update pause file: %s", err.Error())
+	}
+	s.config.Applog.Infof("Uploads paused via gRPC: %t", req.GetPaused())
+	return &uploaderpb.PauseResponse{Paused: req.GetPaused()}, nil
+}
+
+// Drain stops queueing new files, the uploader exits once queued files are uploaded
+func (s *Service) Drain(context.Context, *uploaderpb.DrainRequest) (*uploaderpb.DrainResponse, error) {
+	if s.config.Control == nil {
+		return nil, status.Error(codes.FailedPrecondition, "draining needs -control-files")
+	}
+	s.config.Control.Drain()
+	s.config.Applog.Info("Draining the queue via gRPC")
+	return &uploaderpb.DrainResponse{}, nil
+}
+
+// StreamUpload writes a file sent in chunks into the first watched directory and queues it. Files that can't be
+// queued right away are left for the directory scanner.
+func (s *Service) StreamUpload(stream grpc.ClientStreamingServer[uploaderpb.StreamUploadRequest, uploaderpb.StreamUploadResponse]) error {
+	if s.config.Control.Draining() {
+		return status.Error(codes.Unavailable, "uploader is draining, no new files are accepted")
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if first.GetName() == "" {
+		return status.Error(codes.InvalidArgument, "first message must have the file name")
+	}
+
+	var reader io.Reader = &streamReader{stream: stream, buf: first.GetData()}
+	if s.maxSize > 0 {
+		// One byte more than the limit is read to tell a file of exactly the limit from a larger one
+		reader = &sizeLimitReader{limited: &io.LimitedReader{R: reader, N: s.maxSize + 1}}
+	}
+	file, err := fs.ReceiveFile(s.config, first.GetName(), reader)
+	if err != nil {
+		if ctxErr := stream.Context().Err(); ctxErr != nil {
+			return status.FromContextError(ctxErr).Err()
+		}
+		if errors.Is(err, errTooLarge) {
+			return status.Errorf(codes.ResourceExhausted, "file is larger than %s", utils.HumanizeBytes(s.maxSize, false))
+		}
+		if errors.Is(err, os.ErrExist) {
+			return status.Error(codes.AlreadyExists, err.Error())
+		}
+		return status.Errorf(codes.InvalidArgument, "failed to receive file: %s", err.Error())
+	}
+
+	resp := &uploaderpb.StreamUploadResponse{Path: file, Status: "queued"}
+	err = fs.QueueFile(stream.Context(), s.comm, s.config, file)
+	if errors.Is(err, fs.ErrFileSkipped) {
+		// Nothing would ever upload the file
+		os.Remove(file)
+		return queueError(err)
+	}
+	if err != nil {
+		s.config.Applog.Infof("File %q received via gRPC is left for the directory scanner: %s", file, err.Error())
+		resp.Status = "stored"
+	}
+	s.config.Applog.Infof("File %q received via gRPC: %s", file, resp.Status)
+	return stream.SendAndClose(resp)
+}
+
+// queueError converts an error of fs.QueueFile to a gRPC status
+func queueError(err error) error {
+	if errors.Is(err, fs.ErrFileSkipped) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+// streamReader reads data of the stream messages
+type streamReader struct {
+	stream grpc.ClientStreamingServer[uploaderpb.StreamUploadRequest, uploaderpb.StreamUploadResponse]
+	buf    []byte
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		msg, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.buf = msg.GetData()
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// sizeLimitReader fails with errTooLarge once the limited reader reached its limit, so the partly received file is
+// never published
+type sizeLimitReader struct {
+	limited *io.LimitedReader
+}
+
+func (r *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := r.limited.Read(p)
+	if r.limited.N <= 0 {
+		return n, errTooLarge
+	}
+	return n, err
+}
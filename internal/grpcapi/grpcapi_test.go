@@ -0,0 +1,179 @@
+package grpcapi
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/control"
+	"github.com/impossiblecloud/s3-file-uploader/internal/grpcapi/uploaderpb"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dial starts a server with the service on an in-memory listener and returns a client of it
+func dial(t *testing.T, s *Service, auth string) uploaderpb.UploaderClient {
+	lis := bufconn.Listen(1 << 20)
+	server := NewServer(s, auth)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.Nil(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return uploaderpb.NewUploaderClient(conn)
+}
+
+func TestService(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{
+		PathToWatch:    dir,
+		WatchPaths:     []cfg.WatchPath{{Path: dir}},
+		IgnorePatterns: []string{".*", "*.tmp"},
+		Metrics:        metrics.InitMetrics("test", 10, nil),
+		Applog:         logger.Init("test", false, false, io.Discard),
+	}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+	started := time.Now()
+	client := dial(t, New(config, comm, func() cfg.AppStatus {
+		return cfg.AppStatus{Instance: "node1", Started: started, QueueDepth: comm.Len(),
+			Workers: []cfg.WorkerStatus{{ID: 0, Running: true, Phase: cfg.PhaseIdle}}}
+	}, 0), "")
+	ctx := context.Background()
+
+	file := filepath.Join(dir, "local.csv")
+	assert.Nil(t, os.WriteFile(file, []byte("local"), 0644))
+	_, err = client.Enqueue(ctx, &uploaderpb.EnqueueRequest{Path: file})
+	assert.Nil(t, err)
+	_, err = client.Enqueue(ctx, &uploaderpb.EnqueueRequest{Path: "/etc/passwd"})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// File is sent in chunks
+	stream, err := client.StreamUpload(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Name: "streamed.csv", Data: []byte("a,b\n")}))
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Data: []byte("c,d\n")}))
+	resp, err := stream.CloseAndRecv()
+	assert.Nil(t, err)
+	assert.Equal(t, "queued", resp.GetStatus())
+	data, err := os.ReadFile(filepath.Join(dir, "streamed.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b\nc,d\n", string(data))
+
+	stream, err = client.StreamUpload(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Name: "../escape.csv"}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	st, err := client.Status(ctx, &uploaderpb.StatusRequest{})
+	assert.Nil(t, err)
+	assert.Equal(t, "node1", st.GetInstance())
+	assert.Equal(t, int64(2), st.GetQueueDepth())
+	assert.Equal(t, started.Unix(), st.GetStarted().AsTime().Unix())
+	assert.Len(t, st.GetWorkers(), 1)
+
+	// Pause and drain need control files
+	_, err = client.Pause(ctx, &uploaderpb.PauseRequest{Paused: true})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.Drain(ctx, &uploaderpb.DrainRequest{})
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
+
+func TestServiceMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{
+		PathToWatch: dir,
+		WatchPaths:  []cfg.WatchPath{{Path: dir}},
+		Metrics:     metrics.InitMetrics("test", 10, nil),
+		Applog:      logger.Init("test", false, false, io.Discard),
+	}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+	client := dial(t, New(config, comm, nil, 8), "")
+	ctx := context.Background()
+
+	// File of exactly the limit is accepted
+	stream, err := client.StreamUpload(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Name: "fits.csv", Data: []byte("a,b\n")}))
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Data: []byte("c,d\n")}))
+	_, err = stream.CloseAndRecv()
+	assert.Nil(t, err)
+
+	// Larger file is rejected and nothing is left in the watched directory
+	stream, err = client.StreamUpload(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Name: "large.csv", Data: []byte("a,b\n")}))
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Data: []byte("c,d\ne")}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "fits.csv", entries[0].Name())
+}
+
+func TestServiceControl(t *testing.T) {
+	dir := t.TempDir()
+	config := cfg.AppConfig{
+		PathToWatch: dir,
+		WatchPaths:  []cfg.WatchPath{{Path: dir}},
+		Control:     control.New(dir),
+		Applog:      logger.Init("test", false, false, io.Discard),
+	}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+	client := dial(t, New(config, comm, nil, 0), "admin:secret")
+
+	// Calls need credentials
+	_, err = client.Pause(context.Background(), &uploaderpb.PauseRequest{Paused: true})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret")))
+	resp, err := client.Pause(ctx, &uploaderpb.PauseRequest{Paused: true})
+	assert.Nil(t, err)
+	assert.True(t, resp.GetPaused())
+	assert.True(t, config.Control.Paused())
+
+	// Pause file keeps the state
+	changed, err := config.Control.Check()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.True(t, config.Control.Paused())
+
+	_, err = client.Pause(ctx, &uploaderpb.PauseRequest{Paused: false})
+	assert.Nil(t, err)
+	assert.False(t, config.Control.Paused())
+	_, err = os.Stat(filepath.Join(dir, control.PauseFile))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = client.Drain(ctx, &uploaderpb.DrainRequest{})
+	assert.Nil(t, err)
+	assert.True(t, config.Control.Draining())
+
+	stream, err := client.StreamUpload(ctx)
+	assert.Nil(t, err)
+	assert.Nil(t, stream.Send(&uploaderpb.StreamUploadRequest{Name: "late.csv"}))
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
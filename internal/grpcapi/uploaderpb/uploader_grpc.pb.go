@@ -0,0 +1,267 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: uploader.proto
+
+package uploaderpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Uploader_Enqueue_FullMethodName      = "/uploader.v1.Uploader/Enqueue"
+	Uploader_Status_FullMethodName       = "/uploader.v1.Uploader/Status"
+	Uploader_Pause_FullMethodName        = "/uploader.v1.Uploader/Pause"
+	Uploader_Drain_FullMethodName        = "/uploader.v1.Uploader/Drain"
+	Uploader_StreamUpload_FullMethodName = "/uploader.v1.Uploader/StreamUpload"
+)
+
+// UploaderClient is the client API for Uploader service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UploaderClient interface {
+	Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*EnqueueResponse, error)
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseResponse, error)
+	Drain(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error)
+	StreamUpload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StreamUploadRequest, StreamUploadResponse], error)
+}
+
+type uploaderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUploaderClient(cc grpc.ClientConnInterface) UploaderClient {
+	return &uploaderClient{cc}
+}
+
+func (c *uploaderClient) Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*EnqueueResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(EnqueueResponse)
+	err := c.cc.Invoke(ctx, Uploader_Enqueue_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *uploaderClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatusResponse)
+	err := c.cc.Invoke(ctx, Uploader_Status_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *uploaderClient) Pause(ctx context.Context, in *PauseRequest, opts ...grpc.CallOption) (*PauseResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PauseResponse)
+	err := c.cc.Invoke(ctx, Uploader_Pause_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *uploaderClient) Drain(ctx context.Context, in *DrainRequest, opts ...grpc.CallOption) (*DrainResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DrainResponse)
+	err := c.cc.Invoke(ctx, Uploader_Drain_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *uploaderClient) StreamUpload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[StreamUploadRequest, StreamUploadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Uploader_ServiceDesc.Streams[0], Uploader_StreamUpload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[StreamUploadRequest, StreamUploadResponse]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Uploader_StreamUploadClient = grpc.ClientStreamingClient[StreamUploadRequest, StreamUploadResponse]
+
+// UploaderServer is the server API for Uploader service.
+// All implementations must embed UnimplementedUploaderServer
+// for forward compatibility.
+type UploaderServer interface {
+	Enqueue(context.Context, *EnqueueRequest) (*EnqueueResponse, error)
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+	Pause(context.Context, *PauseRequest) (*PauseResponse, error)
+	Drain(context.Context, *DrainRequest) (*DrainResponse, error)
+	StreamUpload(grpc.ClientStreamingServer[StreamUploadRequest, StreamUploadResponse]) error
+	mustEmbedUnimplementedUploaderServer()
+}
+
+// UnimplementedUploaderServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedUploaderServer struct{}
+
+func (UnimplementedUploaderServer) Enqueue(context.Context, *EnqueueRequest) (*EnqueueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Enqueue not implemented")
+}
+func (UnimplementedUploaderServer) Status(context.Context, *StatusRequest) (*StatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
+}
+func (UnimplementedUploaderServer) Pause(context.Context, *PauseRequest) (*PauseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Pause not implemented")
+}
+func (UnimplementedUploaderServer) Drain(context.Context, *DrainRequest) (*DrainResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Drain not implemented")
+}
+func (UnimplementedUploaderServer) StreamUpload(grpc.ClientStreamingServer[StreamUploadRequest, StreamUploadResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method StreamUpload not implemented")
+}
+func (UnimplementedUploaderServer) mustEmbedUnimplementedUploaderServer() {}
+func (UnimplementedUploaderServer) testEmbeddedByValue()                  {}
+
+// UnsafeUploaderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UploaderServer will
+// result in compilation errors.
+type UnsafeUploaderServer interface {
+	mustEmbedUnimplementedUploaderServer()
+}
+
+func RegisterUploaderServer(s grpc.ServiceRegistrar, srv UploaderServer) {
+	// If the following call pancis, it indicates UnimplementedUploaderServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Uploader_ServiceDesc, srv)
+}
+
+func _Uploader_Enqueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnqueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UploaderServer).Enqueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Uploader_Enqueue_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UploaderServer).Enqueue(ctx, req.(*EnqueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Uploader_Status_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UploaderServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Uploader_Status_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UploaderServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Uploader_Pause_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PauseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UploaderServer).Pause(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Uploader_Pause_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UploaderServer).Pause(ctx, req.(*PauseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Uploader_Drain_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DrainRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UploaderServer).Drain(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Uploader_Drain_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UploaderServer).Drain(ctx, req.(*DrainRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Uploader_StreamUpload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UploaderServer).StreamUpload(&grpc.GenericServerStream[StreamUploadRequest, StreamUploadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Uploader_StreamUploadServer = grpc.ClientStreamingServer[StreamUploadRequest, StreamUploadResponse]
+
+// Uploader_ServiceDesc is the grpc.ServiceDesc for Uploader service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Uploader_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "uploader.v1.Uploader",
+	HandlerType: (*UploaderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Enqueue",
+			Handler:    _Uploader_Enqueue_Handler,
+		},
+		{
+			MethodName: "Status",
+			Handler:    _Uploader_Status_Handler,
+		},
+		{
+			MethodName: "Pause",
+			Handler:    _Uploader_Pause_Handler,
+		},
+		{
+			MethodName: "Drain",
+			Handler:    _Uploader_Drain_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamUpload",
+			Handler:       _Uploader_StreamUpload_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "uploader.proto",
+}
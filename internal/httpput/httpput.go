@@ -0,0 +1,137 @@
+// Package httpput uploads processed files with plain HTTP(S) PUT requests to WebDAV, artifact servers and other
+// endpoints that accept PUT, as an alternative to S3
+package httpput
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/progress"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
+)
+
+// Client uploads files to the -http-url endpoint
+type Client struct {
+	Sender cfg.SenderClient
+}
+
+// NewClient creates a client sending requests with the sender HTTP client
+func NewClient(sender cfg.SenderClient) *Client {
+	return &Client{Sender: sender}
+}
+
+// Close closes idle connections of the client
+func (client *Client) Close() {
+	client.Sender.HttpClient.CloseIdleConnections()
+}
+
+// ObjectURL returns the URL a file is uploaded to, the object key replaces the path of the endpoint URL as the
+// key already starts with it
+func ObjectURL(config cfg.AppConfig, key string) (string, error) {
+	u, err := url.Parse(config.HTTPURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = key
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// UploadFile uploads a prepared file with a PUT request, the upload is aborted when ctx is done
+func (client *Client) UploadFile(ctx context.Context, config cfg.AppConfig, filename string) (int64, error) {
+	if config.Encrypt && config.EncryptEngine == "kms" {
+		return 0, errclass.Config(fmt.Errorf("files encrypted with KMS data keys can't be uploaded to %s, their envelope is kept in S3 object metadata", config.HTTPURL))
+	}
+	realFile := fs.PreparedFileName(config, filename)
+
+	key, err := fs.ObjectKey(config, filename, realFile)
+	if err != nil {
+		return 0, err
+	}
+	target, err := ObjectURL(config, key)
+	if err != nil {
+		return 0, err
+	}
+
+	fi, err := os.Stat(realFile)
+	if err != nil {
+		config.Applog.Error(err)
+		return 0, err
+	}
+
+	f, err := os.Open(realFile)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open file %q, %v", realFile, err)
+	}
+	defer f.Close()
+
+	// Throttle reading from the file if upload rate is limited
+	var body io.Reader = f
+	if config.UploadLimiter != nil {
+		body = ratelimit.NewReader(f, config.UploadLimiter)
+	}
+
+	tracker := progress.Start(config.Progress, realFile, fi.Size())
+	defer tracker.Stop()
+
+	if err := client.put(ctx, config, target, tracker.Reader(body), fi.Size(), "application/octet-stream"); err != nil {
+		return 0, errclass.Inherit(fmt.Errorf("failed to upload file, %v", err), err)
+	}
+	config.Applog.Infof("File uploaded to: %s\n", target)
+
+	if config.ChecksumSidecar {
+		body, err := fs.ChecksumSidecar(config, filename)
+		if err != nil {
+			return 0, fmt.Errorf("failed to checksum %q: %s", filename, err.Error())
+		}
+		if err := client.put(ctx, config, target+fs.ChecksumSuffix, bytes.NewReader(body), int64(len(body)), "text/plain"); err != nil {
+			return 0, fmt.Errorf("failed to upload checksum, %v", err)
+		}
+	}
+	return fi.Size(), nil
+}
+
+// Send a PUT request with the body of size bytes to the target URL
+func (client *Client) put(ctx context.Context, config cfg.AppConfig, target string, body io.Reader, size int64, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", contentType)
+	for name, value := range config.HTTPHeaders {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Sender.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return statusError(resp.StatusCode, fmt.Errorf("%s responded with %s: %s", target, resp.Status, string(msg)))
+	}
+	return nil
+}
+
+// statusError classifies an error response, credentials and the endpoint are wrong for every file while some
+// files are refused for good
+func statusError(code int, err error) error {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusMethodNotAllowed:
+		return errclass.Config(err)
+	case http.StatusRequestEntityTooLarge, http.StatusRequestURITooLong:
+		return errclass.Permanent(err)
+	}
+	return err
+}
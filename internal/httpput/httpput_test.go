@@ -0,0 +1,68 @@
+package httpput
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadFile(t *testing.T) {
+	var path, auth, body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		path, auth, body = r.URL.Path, r.Header.Get("Authorization"), string(data)
+		if auth != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("backup"), 0644))
+
+	config := cfg.AppConfig{
+		Applog:      logger.Init("test", false, false, io.Discard),
+		PathToWatch: dir,
+		HTTPURL:     server.URL + "/dav/backups",
+		S3path:      "/dav/backups",
+		HTTPHeaders: map[string]string{"Authorization": "Bearer secret"},
+	}
+	client := NewClient(cfg.SenderClient{HttpClient: server.Client()})
+	defer client.Close()
+
+	n, err := client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(6), n)
+	assert.Equal(t, "/dav/backups/dump.sql", path)
+	assert.Equal(t, "backup", body)
+
+	// Checksum of the source file is uploaded next to it
+	config.ChecksumSidecar = true
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, "/dav/backups/dump.sql.sha256", path)
+	assert.Equal(t, "54d00d867758cef816bc4685f58e327b949712b07ebd17c3485f3ffc9e9f5133  dump.sql\n", body)
+
+	// Rejected uploads fail with the response status, wrong credentials fail every file
+	config.HTTPHeaders = nil
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.ErrorContains(t, err, "401 Unauthorized")
+	assert.ErrorIs(t, err, errclass.ErrConfig)
+}
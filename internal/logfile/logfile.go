@@ -0,0 +1,147 @@
+// Package logfile writes logs to a file rotated by size. Rotated files get .1, .2 and so on suffixes, .1 being the
+// newest one, and the oldest ones over the limit or the age are removed.
+package logfile
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Rotation limits the size of the file and the rotated files kept
+type Rotation struct {
+	// MaxSize rotates the file before a write would grow it over this, 0 disables rotation
+	MaxSize int64
+	// MaxBackups is the number of rotated files kept
+	MaxBackups int
+	// MaxAge removes rotated files modified longer ago than this, 0 keeps them regardless of age
+	MaxAge time.Duration
+}
+
+// File appends to a file and rotates it, it's safe for concurrent use. A single write is never split between files.
+type File struct {
+	path     string
+	rotation Rotation
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens the file for appending
+func Open(path string, rotation Rotation) (*File, error) {
+	f := &File{path: path, rotation: rotation}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	f.removeExpired()
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("failed to open %q: %s", f.path, err.Error())
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open %q: %s", f.path, err.Error())
+	}
+	f.file, f.size = file, fi.Size()
+	return nil
+}
+
+// Write appends p to the file. Data is never dropped because of a failed rotation, it's appended to the current
+// file and the rotation error is returned.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("%q is closed", f.path)
+	}
+	var rotateErr error
+	if f.rotation.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.rotation.MaxSize {
+		rotateErr = f.rotate()
+		if f.file == nil {
+			if err := f.open(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, fmt.Errorf("failed to write %q: %s", f.path, err.Error())
+	}
+	return n, rotateErr
+}
+
+// Sync commits written data to disk
+func (f *File) Sync() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return fmt.Errorf("%q is closed", f.path)
+	}
+	return f.file.Sync()
+}
+
+// Shift rotated files and start a new one, must be called with the lock held
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close %q: %s", f.path, err.Error())
+	}
+	f.file = nil
+
+	// The oldest file is replaced, the file itself is removed if no rotated files are kept
+	for i := f.rotation.MaxBackups - 1; i >= 0; i-- {
+		from := f.path
+		if i > 0 {
+			from = rotatedName(f.path, i)
+		}
+		if err := os.Rename(from, rotatedName(f.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate %q: %s", f.path, err.Error())
+		}
+	}
+	if f.rotation.MaxBackups <= 0 {
+		if err := os.Remove(f.path); err != nil {
+			return fmt.Errorf("failed to rotate %q: %s", f.path, err.Error())
+		}
+	}
+	f.removeExpired()
+	return f.open()
+}
+
+// Remove rotated files over the age limit, older files have higher numbers
+func (f *File) removeExpired() {
+	if f.rotation.MaxAge <= 0 {
+		return
+	}
+	for i := 1; i <= f.rotation.MaxBackups; i++ {
+		name := rotatedName(f.path, i)
+		if fi, err := os.Stat(name); err == nil && time.Since(fi.ModTime()) > f.rotation.MaxAge {
+			os.Remove(name)
+		}
+	}
+}
+
+func rotatedName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Close closes the file, nothing can be written after that
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,54 @@
+package logfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploader.log")
+	assert.Nil(t, os.WriteFile(path, []byte("old\n"), 0640))
+
+	// A file holds 2 lines of 4 bytes, the line it already has counts too, 2 rotated files are kept
+	f, err := Open(path, Rotation{MaxSize: 8, MaxBackups: 2})
+	assert.Nil(t, err)
+	for _, line := range []string{"aaa\n", "bbb\n", "ccc\n", "ddd\n", "eee\n"} {
+		n, err := f.Write([]byte(line))
+		assert.Nil(t, err)
+		assert.Equal(t, 4, n)
+	}
+	assert.Nil(t, f.Sync())
+	assert.Nil(t, f.Close())
+	_, err = f.Write([]byte("late\n"))
+	assert.NotNil(t, err)
+
+	for name, content := range map[string]string{path: "ddd\neee\n", path + ".1": "bbb\nccc\n", path + ".2": "old\naaa\n"} {
+		data, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.Equal(t, content, string(data))
+	}
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uploader.log")
+	for _, name := range []string{path + ".1", path + ".2"} {
+		assert.Nil(t, os.WriteFile(name, []byte("old\n"), 0640))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(t, os.Chtimes(path+".2", old, old))
+
+	// Rotated files over the age are removed on open
+	f, err := Open(path, Rotation{MaxSize: 100, MaxBackups: 5, MaxAge: 24 * time.Hour})
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = os.Stat(path + ".1")
+	assert.Nil(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.True(t, os.IsNotExist(err))
+}
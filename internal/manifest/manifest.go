@@ -0,0 +1,290 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Supported manifest formats
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+// Entry describes an uploaded file. KeyShard is the scheme of hash-derived key prefixes for restore tooling, e.g.
+// sha256/2 for a key with ab/cd/ prefixes from SHA-256 of the object name, empty if the key is not sharded.
+type Entry struct {
+	Key             string    `json:"key"`
+	Source          string    `json:"source"`
+	Size            int64     `json:"size"`
+	UploadedSize    int64     `json:"uploaded_size"`
+	SHA256          string    `json:"sha256"`
+	Compression     string    `json:"compression"`
+	Encryption      string    `json:"encryption"`
+	EncryptionKeyID string    `json:"encryption_key_id,omitempty"`
+	KeyShard        string    `json:"key_shard,omitempty"`
+	UploadedAt      time.Time `json:"uploaded_at"`
+}
+
+// Manifest collects entries of uploaded files until they are written to S3. Entries are appended to a spool file
+// if it's set, so a crash doesn't lose them, and kept in memory otherwise. A nil Manifest does nothing.
+type Manifest struct {
+	Format string
+
+	spool      string
+	maxEntries int
+
+	// send is held from Take until the taken entries are committed or restored
+	send sync.Mutex
+
+	mu      sync.Mutex
+	entries []Entry
+	// Number of entries taken from the spool file and the size of the lines they were read from
+	spooled     int
+	spooledSize int64
+}
+
+// New creates a manifest in the given format. Entries are spooled to the file if spool is set, at most maxEntries
+// entries are kept in memory and written in a single manifest.
+func New(format, spool string, maxEntries int) (*Manifest, error) {
+	if format != FormatJSON && format != FormatCSV {
+		return nil, fmt.Errorf("unsupported manifest format %q, must be %s or %s", format, FormatJSON, FormatCSV)
+	}
+	if maxEntries <= 0 {
+		return nil, fmt.Errorf("max number of manifest entries must be positive")
+	}
+	m := &Manifest{Format: format, spool: spool, maxEntries: maxEntries}
+	if spool != "" {
+		if err := m.repairSpool(); err != nil {
+			return nil, fmt.Errorf("failed to open manifest spool %q: %s", spool, err.Error())
+		}
+	}
+	return m, nil
+}
+
+// Add adds an uploaded file. If it can't be spooled, it's kept in memory and an error is returned.
+func (m *Manifest) Add(entry Entry) error {
+	if m == nil {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	if m.spool != "" {
+		if err = m.appendSpool(entry); err == nil {
+			return nil
+		}
+		err = fmt.Errorf("failed to write manifest spool, the entry is kept in memory: %s", err.Error())
+	}
+	m.entries = append(m.entries, entry)
+	if m.trim() > 0 && err == nil {
+		err = fmt.Errorf("more than %d manifest entries are waiting to be written, the oldest one is dropped", m.maxEntries)
+	}
+	return err
+}
+
+// Take returns up to the max number of collected entries, spooled ones first. If any are returned, Commit or Restore
+// must be called once they are written or failed to be written, Take waits for that until then.
+func (m *Manifest) Take() ([]Entry, error) {
+	m.send.Lock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var entries []Entry
+	if m.spool != "" {
+		var err error
+		entries, m.spooledSize, err = m.readSpool()
+		if err != nil {
+			m.send.Unlock()
+			return nil, fmt.Errorf("failed to read manifest spool %q: %s", m.spool, err.Error())
+		}
+		m.spooled = len(entries)
+	}
+
+	n := min(len(m.entries), m.maxEntries-len(entries))
+	entries = append(entries, m.entries[:n]...)
+	m.entries = m.entries[n:]
+	if len(entries) == 0 {
+		m.send.Unlock()
+	}
+	return entries, nil
+}
+
+// Commit removes written entries taken from the spool file
+func (m *Manifest) Commit() error {
+	defer m.send.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.spooled == 0 {
+		return nil
+	}
+	err := m.truncateSpool(m.spooledSize)
+	m.spooled, m.spooledSize = 0, 0
+	return err
+}
+
+// Restore puts back entries that failed to be written so they are included next time, spooled ones stay in the spool
+// file. It returns the number of the oldest entries dropped to keep the max number of them in memory.
+func (m *Manifest) Restore(entries []Entry) int {
+	defer m.send.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = append(entries[m.spooled:], m.entries...)
+	m.spooled, m.spooledSize = 0, 0
+	return m.trim()
+}
+
+// trim drops the oldest entries over the max number of them, must be called with the lock held
+func (m *Manifest) trim() int {
+	dropped := len(m.entries) - m.maxEntries
+	if dropped <= 0 {
+		return 0
+	}
+	m.entries = m.entries[dropped:]
+	return dropped
+}
+
+// repairSpool ends the spool file with a new line, so an entry cut by a crash doesn't spoil the next one
+func (m *Manifest) repairSpool() error {
+	f, err := os.OpenFile(m.spool, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	if _, err := f.ReadAt(last, fi.Size()-1); err != nil {
+		return err
+	}
+	if last[0] != '\n' {
+		_, err = f.WriteAt([]byte("\n"), fi.Size())
+	}
+	return err
+}
+
+// appendSpool appends an entry to the spool file as a JSON line, must be called with the lock held
+func (m *Manifest) appendSpool(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(m.spool, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readSpool reads up to the max number of entries from the spool file and returns the size of the lines they were
+// read from. Lines cut by a crash are skipped. Must be called with the lock held.
+func (m *Manifest) readSpool() ([]Entry, int64, error) {
+	f, err := os.Open(m.spool)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	} else if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	var size int64
+	r := bufio.NewReader(f)
+	for len(entries) < m.maxEntries {
+		line, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, 0, err
+		}
+		size += int64(len(line))
+
+		var entry Entry
+		if json.Unmarshal(line, &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, size, nil
+}
+
+// truncateSpool removes the given number of bytes from the start of the spool file, must be called with the lock held
+func (m *Manifest) truncateSpool(size int64) error {
+	f, err := os.Open(m.spool)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() <= size {
+		return os.Remove(m.spool)
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.spool), filepath.Base(m.spool)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, f); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.spool)
+}
+
+// Encode encodes entries in the manifest format
+func (m *Manifest) Encode(entries []Entry) ([]byte, error) {
+	if m.Format == FormatJSON {
+		return json.MarshalIndent(entries, "", "  ")
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write([]string{"key", "source", "size", "uploaded_size", "sha256", "compression", "encryption", "encryption_key_id", "key_shard", "uploaded_at"})
+	for _, e := range entries {
+		w.Write([]string{
+			e.Key,
+			e.Source,
+			strconv.FormatInt(e.Size, 10),
+			strconv.FormatInt(e.UploadedSize, 10),
+			e.SHA256,
+			e.Compression,
+			e.Encryption,
+			e.EncryptionKeyID,
+			e.KeyShard,
+			e.UploadedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
@@ -0,0 +1,115 @@
+package manifest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestManifest(t *testing.T) {
+	_, err := New("xml", "", 10)
+	assert.NotNil(t, err)
+	_, err = New(FormatCSV, "", 0)
+	assert.NotNil(t, err)
+
+	m, err := New(FormatCSV, "", 10)
+	assert.Nil(t, err)
+
+	uploaded := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	m.Add(Entry{Key: "/backups/a.sql.tgz.gpg", Source: "/data/a.sql", Size: 100, UploadedSize: 40, SHA256: "abc", Compression: "gzip", Encryption: "gpg", UploadedAt: uploaded})
+	m.Add(Entry{Key: "/backups/b.sql.tgz.gpg", Source: "/data/b.sql", Size: 10, UploadedSize: 5, SHA256: "def", Compression: "gzip", Encryption: "gpg", UploadedAt: uploaded})
+
+	entries, err := m.Take()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Nil(t, m.Commit())
+	taken, err := m.Take()
+	assert.Nil(t, err)
+	assert.Empty(t, taken)
+
+	data, err := m.Encode(entries)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+	assert.Equal(t, "/backups/a.sql.tgz.gpg,/data/a.sql,100,40,abc,gzip,gpg,,,2024-05-01T10:00:00Z", lines[1])
+
+	// Failed writes are retried with the next manifest
+	assert.Nil(t, m.Add(entries[0]))
+	taken, err = m.Take()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, m.Restore(taken))
+	assert.Nil(t, m.Add(entries[1]))
+	m.Format = FormatJSON
+	taken, err = m.Take()
+	assert.Nil(t, err)
+	data, err = m.Encode(taken)
+	assert.Nil(t, err)
+	var decoded []Entry
+	assert.Nil(t, json.Unmarshal(data, &decoded))
+	assert.Equal(t, entries, decoded)
+
+	// Only the newest entries are kept in memory while writes fail
+	assert.Equal(t, 0, m.Restore(taken))
+	m.maxEntries = 1
+	assert.NotNil(t, m.Add(entries[0]))
+	taken, err = m.Take()
+	assert.Nil(t, err)
+	assert.Equal(t, []Entry{entries[0]}, taken)
+	assert.Nil(t, m.Commit())
+
+	var nilManifest *Manifest
+	assert.Nil(t, nilManifest.Add(entries[0]))
+}
+
+func TestManifestSpool(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "manifest.spool")
+	m, err := New(FormatJSON, spool, 2)
+	assert.Nil(t, err)
+
+	uploaded := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	entries := []Entry{
+		{Key: "/backups/a.sql", Source: "/data/a.sql", UploadedAt: uploaded},
+		{Key: "/backups/b.sql", Source: "/data/b.sql", UploadedAt: uploaded},
+		{Key: "/backups/c.sql", Source: "/data/c.sql", UploadedAt: uploaded},
+	}
+	for _, entry := range entries {
+		assert.Nil(t, m.Add(entry))
+	}
+	assert.Empty(t, m.entries)
+
+	// Entries survive a crash, an entry cut by it is skipped
+	f, err := os.OpenFile(spool, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.Nil(t, err)
+	_, err = f.WriteString(`{"key": "/backups/cut`)
+	assert.Nil(t, err)
+	f.Close()
+	m, err = New(FormatJSON, spool, 2)
+	assert.Nil(t, err)
+	extra := Entry{Key: "/backups/d.sql", Source: "/data/d.sql", UploadedAt: uploaded}
+	assert.Nil(t, m.Add(extra))
+
+	// Failed writes keep entries spooled, manifests are written in batches of the max size
+	taken, err := m.Take()
+	assert.Nil(t, err)
+	assert.Equal(t, entries[:2], taken)
+	assert.Equal(t, 0, m.Restore(taken))
+	taken, err = m.Take()
+	assert.Nil(t, err)
+	assert.Equal(t, entries[:2], taken)
+	assert.Nil(t, m.Commit())
+	taken, err = m.Take()
+	assert.Nil(t, err)
+	assert.Equal(t, []Entry{entries[2], extra}, taken)
+	assert.Nil(t, m.Commit())
+
+	_, err = os.Stat(spool)
+	assert.True(t, os.IsNotExist(err))
+	taken, err = m.Take()
+	assert.Nil(t, err)
+	assert.Empty(t, taken)
+}
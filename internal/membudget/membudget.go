@@ -0,0 +1,80 @@
+// Package membudget limits bytes used by all workers together, e.g. memory of upload buffers or files in flight.
+// It's a weighted semaphore: an upload reserves bytes before it starts and waits while the budget is exhausted.
+package membudget
+
+import (
+	"context"
+	"sync"
+)
+
+// Budget is a memory budget in bytes, nil budget is unlimited
+type Budget struct {
+	limit int64
+
+	mu      sync.Mutex
+	used    int64
+	changed chan struct{}
+}
+
+// New creates a budget of limit bytes
+func New(limit int64) *Budget {
+	return &Budget{limit: limit, changed: make(chan struct{})}
+}
+
+// Acquire reserves n bytes waiting until they are available or ctx is done. Requests larger than the whole
+// budget are reduced to it, so they wait for all other uploads instead of waiting forever.
+// It returns the number of reserved bytes that must be released later.
+func (b *Budget) Acquire(ctx context.Context, n int64) (int64, error) {
+	if b == nil || n <= 0 {
+		return 0, nil
+	}
+	n = min(n, b.limit)
+
+	for {
+		b.mu.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mu.Unlock()
+			return n, nil
+		}
+		changed := b.changed
+		b.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// Release returns n bytes to the budget and wakes up waiting uploads
+func (b *Budget) Release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used -= n
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// Used returns the number of reserved bytes
+func (b *Budget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+// Limit returns the budget size in bytes
+func (b *Budget) Limit() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.limit
+}
@@ -0,0 +1,51 @@
+package membudget
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBudget(t *testing.T) {
+	b := New(100)
+
+	n, err := b.Acquire(context.Background(), 60)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(60), n)
+	assert.Equal(t, int64(60), b.Used())
+
+	// Waits until there is enough memory
+	acquired := make(chan int64)
+	go func() {
+		n, _ := b.Acquire(context.Background(), 50)
+		acquired <- n
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired over the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.Release(60)
+	assert.Equal(t, int64(50), <-acquired)
+
+	// Gives up when the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = b.Acquire(ctx, 60)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// Requests over the whole budget wait for everything else to be released
+	b.Release(50)
+	n, err = b.Acquire(context.Background(), 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), n)
+
+	// Nil budget is unlimited
+	var unlimited *Budget
+	n, err = unlimited.Acquire(context.Background(), 1000)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), n)
+	unlimited.Release(n)
+}
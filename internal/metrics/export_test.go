@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func testRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	promauto.With(registry).NewCounterVec(prometheus.CounterOpts{Name: "files_total"}, []string{"compression"}).WithLabelValues("gzip").Add(3)
+	hist := promauto.With(registry).NewHistogram(prometheus.HistogramOpts{Name: "duration_seconds", Buckets: []float64{1, 10}})
+	hist.Observe(0.5)
+	hist.Observe(5)
+	hist.Observe(50)
+	return registry
+}
+
+func TestRemoteWrite(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		data, _ := io.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, data)
+	}))
+	defer server.Close()
+
+	rw := &RemoteWrite{URL: server.URL, Gatherer: testRegistry(), Labels: map[string]string{"job": "app"}}
+	assert.Nil(t, rw.Push(context.Background()))
+
+	// 1 counter + 3 buckets, sum and count of the histogram
+	count := 0
+	for len(body) > 0 {
+		num, typ, n := protowire.ConsumeTag(body)
+		assert.Equal(t, protowire.Number(1), num)
+		body = body[n:]
+		n = protowire.ConsumeFieldValue(num, typ, body)
+		assert.Greater(t, n, 0)
+		body = body[n:]
+		count++
+	}
+	assert.Equal(t, 6, count)
+
+	families, _ := testRegistry().Gather()
+	all := flattenFamilies(families, map[string]string{"job": "app"})
+	assert.Contains(t, all, series{labels: map[string]string{"__name__": "duration_seconds_bucket", "job": "app", "le": "10"}, value: 2})
+	assert.Contains(t, all, series{labels: map[string]string{"__name__": "files_total", "job": "app", "compression": "gzip"}, value: 3})
+}
+
+func TestOTLP(t *testing.T) {
+	var req otlpRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+	}))
+	defer server.Close()
+
+	o := &OTLP{URL: server.URL, Gatherer: testRegistry(), ServiceName: "app", Started: time.Now()}
+	assert.Nil(t, o.Push(context.Background()))
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, "duration_seconds", metrics[0].Name)
+	assert.Equal(t, []string{"1", "1", "1"}, metrics[0].Histogram.DataPoints[0].BucketCounts)
+	assert.Equal(t, []float64{1, 10}, metrics[0].Histogram.DataPoints[0].ExplicitBounds)
+	assert.Equal(t, 3.0, metrics[1].Sum.DataPoints[0].AsDouble)
+	assert.True(t, metrics[1].Sum.IsMonotonic)
+
+	// Non-finite values are skipped instead of failing the whole push
+	registry := testRegistry()
+	promauto.With(registry).NewGauge(prometheus.GaugeOpts{Name: "ratio"}).Set(math.NaN())
+	promauto.With(registry).NewSummary(prometheus.SummaryOpts{Name: "latency_seconds", Objectives: map[float64]float64{0.5: 0.05}})
+	o.Gatherer = registry
+	assert.Nil(t, o.Push(context.Background()))
+	metrics = req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	assert.Len(t, metrics, 3)
+	assert.Equal(t, "latency_seconds", metrics[2].Name)
+	assert.Empty(t, metrics[2].Summary.DataPoints[0].QuantileValues)
+
+	assert.Equal(t, "http://collector:4318/v1/metrics", OTLPMetricsURL("http://collector:4318"))
+	assert.Equal(t, "http://collector:4318/otlp/v1/metrics", OTLPMetricsURL("http://collector:4318/otlp/v1/metrics"))
+}
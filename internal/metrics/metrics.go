@@ -1,6 +1,8 @@
 package metrics
 
 import (
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -12,20 +14,59 @@ type AppMetrics struct {
 
 	// Counters
 	ChannelFullEvents *prometheus.CounterVec
+	EnqueueOverflow   *prometheus.CounterVec
 	FileSendCount     *prometheus.CounterVec
 	FileOrigBytesSum  *prometheus.CounterVec
 	FileSendBytesSum  *prometheus.CounterVec
 	FileSendErrors    *prometheus.CounterVec
 	FileSendSuccess   *prometheus.CounterVec
+	FileCompression   *prometheus.CounterVec
+	FileGroupPartial  *prometheus.CounterVec
+	FileUndeletable   *prometheus.CounterVec
+	KeptFilesPurged   *prometheus.CounterVec
+	FileReplaced      *prometheus.CounterVec
+	FileSkippedType   *prometheus.CounterVec
+	FileTimeouts      *prometheus.CounterVec
+	WorkerPanics      *prometheus.CounterVec
+	S3Throttled       *prometheus.CounterVec
+	FileDedupHits     *prometheus.CounterVec
+	ObjectsVerified   *prometheus.CounterVec
+	ObjectsRequeued   *prometheus.CounterVec
+	SyntheticFiles    *prometheus.CounterVec
+	SQSMessages       *prometheus.CounterVec
+	IngestedFiles     *prometheus.CounterVec
+	NoIdleWorkers     *prometheus.CounterVec
+	ScanEntries       *prometheus.CounterVec
+	ScanErrors        *prometheus.CounterVec
 
 	// Gauges
 	ConfigWorkers       *prometheus.GaugeVec
 	ChannelLength       *prometheus.GaugeVec
 	ChannelConfigLength *prometheus.GaugeVec
 	Config              *prometheus.GaugeVec
+	RateLimiterTokens   *prometheus.GaugeVec
+	WorkersBusy         *prometheus.GaugeVec
+	WorkersIdle         *prometheus.GaugeVec
+	WorkersSaturation   *prometheus.GaugeVec
+	CircuitState        *prometheus.GaugeVec
+	BufferMemory        *prometheus.GaugeVec
+	KeptDirSize         *prometheus.GaugeVec
+	DirectoryEntries    *prometheus.GaugeVec
+	ScanDuration        *prometheus.GaugeVec
+	ScanFiles           *prometheus.GaugeVec
+	ScanInterval        *prometheus.GaugeVec
+	InflightBytes       *prometheus.GaugeVec
+	StageQueued         *prometheus.GaugeVec
+	StageBusy           *prometheus.GaugeVec
+	UploadProgress      *prometheus.GaugeVec
+	UploadRate          *prometheus.GaugeVec
+	Throughput          *prometheus.GaugeVec
+	Throughput1m        *prometheus.GaugeVec
+	Throughput5m        *prometheus.GaugeVec
 
-	// Historgams
+	// Historgams, nil when InitMetrics gets no buckets
 	HistFileSendDuration *prometheus.HistogramVec
+	HistScanDuration     *prometheus.HistogramVec
 }
 
 func InitMetrics(version string, workersCannelSize int, secondsDurationBuckets []float64) AppMetrics {
@@ -89,22 +130,44 @@ func InitMetrics(version string, workersCannelSize int, secondsDurationBuckets [
 			Namespace: "s3_file_uploader",
 			Subsystem: "uploads",
 			Name:      "errors_total",
-			Help:      "The total number of errors when sending requests",
+			Help:      "The total number of errors when sending requests by error class: transient, permanent or config",
 		},
-		[]string{},
+		[]string{"class"},
 	)
 
-	am.HistFileSendDuration = promauto.With(am.Registry).NewHistogramVec(
-		prometheus.HistogramOpts{
+	am.FileCompression = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
 			Namespace: "s3_file_uploader",
-			Subsystem: "uploads",
-			Name:      "hist_duration_seconds",
-			Help:      "Histogram distribution of request durations, in seconds",
-			Buckets:   secondsDurationBuckets,
+			Subsystem: "files",
+			Name:      "compression_total",
+			Help:      "The total number of uploaded files by compression codec, \"none\" means compression was skipped",
 		},
-		[]string{},
+		[]string{"compression"},
 	)
 
+	if secondsDurationBuckets != nil {
+		am.HistFileSendDuration = promauto.With(am.Registry).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "s3_file_uploader",
+				Subsystem: "uploads",
+				Name:      "hist_duration_seconds",
+				Help:      "Histogram distribution of request durations, in seconds",
+				Buckets:   secondsDurationBuckets,
+			},
+			[]string{},
+		)
+		am.HistScanDuration = promauto.With(am.Registry).NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "s3_file_uploader",
+				Subsystem: "scanner",
+				Name:      "hist_duration_seconds",
+				Help:      "Histogram distribution of directory scan durations, in seconds",
+				Buckets:   secondsDurationBuckets,
+			},
+			[]string{},
+		)
+	}
+
 	// App health metrics
 	am.ConfigWorkers = promauto.With(am.Registry).NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -136,6 +199,216 @@ func InitMetrics(version string, workersCannelSize int, secondsDurationBuckets [
 		[]string{},
 	)
 
+	am.RateLimiterTokens = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "rate_limiter_tokens",
+			Help:      "Number of bytes available in the upload rate limiter bucket, negative when uploads are waiting",
+		},
+		[]string{},
+	)
+
+	am.WorkersBusy = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "workers_busy",
+			Help:      "Number of workers processing a file",
+		},
+		[]string{},
+	)
+
+	am.WorkersIdle = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "workers_idle",
+			Help:      "Number of workers waiting for a file",
+		},
+		[]string{},
+	)
+
+	am.WorkersSaturation = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "workers_saturation_ratio",
+			Help:      "Ratio of busy workers to all workers, from 0 to 1",
+		},
+		[]string{},
+	)
+
+	am.CircuitState = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "circuit_breaker_state",
+			Help:      "S3 upload circuit breaker state: 0 closed, 1 open, 2 half-open",
+		},
+		[]string{},
+	)
+
+	am.BufferMemory = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "buffer_memory_bytes",
+			Help:      "Memory reserved for buffered upload parts within -max-buffer-memory",
+		},
+		[]string{},
+	)
+
+	am.DirectoryEntries = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "files",
+			Name:      "directory_entries",
+			Help:      "Number of entries in the watched directory at the last scan",
+		},
+		[]string{},
+	)
+
+	am.ScanDuration = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "scanner",
+			Name:      "last_duration_seconds",
+			Help:      "Duration of the last directory scan",
+		},
+		[]string{},
+	)
+
+	am.ScanEntries = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "scanner",
+			Name:      "entries_seen_total",
+			Help:      "The total number of directory entries seen by directory scans",
+		},
+		[]string{},
+	)
+
+	am.ScanErrors = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "scanner",
+			Name:      "errors_total",
+			Help:      "The total number of failed attempts to read the watched directory, scans are retried",
+		},
+		[]string{},
+	)
+
+	am.ScanFiles = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "scanner",
+			Name:      "last_files_found",
+			Help:      "Number of files to upload found by the last directory scan",
+		},
+		[]string{},
+	)
+
+	am.ScanInterval = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "scanner",
+			Name:      "interval_seconds",
+			Help:      "Current directory scan interval, it grows up to -scan-interval-max while scans find no files",
+		},
+		[]string{},
+	)
+
+	am.InflightBytes = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "inflight_bytes",
+			Help:      "Size of files being compressed, encrypted and uploaded within -max-inflight-bytes",
+		},
+		[]string{},
+	)
+
+	am.StageQueued = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "stage_queue_length",
+			Help:      "Number of files waiting for a worker of the pipeline stage",
+		},
+		[]string{"stage"},
+	)
+
+	am.StageBusy = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "stage_workers_busy",
+			Help:      "Number of workers of the pipeline stage processing a file",
+		},
+		[]string{"stage"},
+	)
+
+	am.UploadProgress = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "upload_progress_ratio",
+			Help:      "Uploaded part of the large file a worker is uploading, from 0 to 1, 0 when it uploads none",
+		},
+		[]string{"worker"},
+	)
+
+	am.UploadRate = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "upload_bytes_per_second",
+			Help:      "Average upload rate of the large file a worker is uploading",
+		},
+		[]string{"worker"},
+	)
+
+	am.Throughput = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "uploads",
+			Name:      "bytes_per_second",
+			Help:      "Upload rate of all workers since the previous metrics update",
+		},
+		[]string{},
+	)
+
+	am.Throughput1m = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "uploads",
+			Name:      "bytes_per_second_1m",
+			Help:      "Upload rate of all workers, exponential moving average over 1 minute",
+		},
+		[]string{},
+	)
+
+	am.Throughput5m = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "uploads",
+			Name:      "bytes_per_second_5m",
+			Help:      "Upload rate of all workers, exponential moving average over 5 minutes",
+		},
+		[]string{},
+	)
+
+	am.NoIdleWorkers = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "no_idle_worker_intervals_total",
+			Help:      "Number of metrics update intervals when all workers were busy",
+		},
+		[]string{},
+	)
+
 	am.ChannelFullEvents = promauto.With(am.Registry).NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "s3_file_uploader",
@@ -146,14 +419,181 @@ func InitMetrics(version string, workersCannelSize int, secondsDurationBuckets [
 		[]string{},
 	)
 
+	am.EnqueueOverflow = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "enqueue_overflow_total",
+			Help:      "Number of files that didn't fit into the full worker queue by -enqueue-policy action: dropped or spilled",
+		},
+		[]string{"action"},
+	)
+
+	am.FileGroupPartial = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "runtime",
+			Name:      "file_groups_partial_total",
+			Help:      "Number of incomplete file groups uploaded after the group timeout",
+		},
+		[]string{},
+	)
+
+	am.FileUndeletable = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "files",
+			Name:      "undeletable_total",
+			Help:      "The total number of uploaded files that could not be deleted and were quarantined",
+		},
+		[]string{},
+	)
+
+	am.KeptFilesPurged = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "kept",
+			Name:      "purged_files_total",
+			Help:      "The total number of files deleted from -trash-dir or -dedup-dir over their age or size caps",
+		},
+		[]string{"dir"},
+	)
+
+	am.KeptDirSize = promauto.With(am.Registry).NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "kept",
+			Name:      "dir_size_bytes",
+			Help:      "Size of files kept in -trash-dir or -dedup-dir",
+		},
+		[]string{"dir"},
+	)
+
+	am.FileReplaced = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "files",
+			Name:      "replaced_total",
+			Help:      "The total number of queued files replaced with another file of the same name before they were claimed",
+		},
+		[]string{},
+	)
+
+	am.FileTimeouts = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "files",
+			Name:      "timeouts_total",
+			Help:      "The total number of files cancelled after -per-file-timeout, they are retried later",
+		},
+		[]string{},
+	)
+
+	am.WorkerPanics = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "workers",
+			Name:      "panics_total",
+			Help:      "The total number of panics recovered while processing files, the files are retried later",
+		},
+		[]string{},
+	)
+
+	am.S3Throttled = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "s3",
+			Name:      "requests_throttled_total",
+			Help:      "The total number of S3 requests throttled with 503 SlowDown or similar responses, they are retried with -s3-slowdown-delay backoff",
+		},
+		[]string{"operation"},
+	)
+
+	am.FileDedupHits = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "files",
+			Name:      "dedup_hits_total",
+			Help:      "The total number of files not uploaded because the same content was uploaded within -dedup-window",
+		},
+		[]string{},
+	)
+
+	am.ObjectsVerified = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "s3",
+			Name:      "objects_verified_total",
+			Help:      "The total number of uploaded objects checked by the reconciler, \"mismatch\" means the object is missing or has another size or ETag",
+		},
+		[]string{"result"},
+	)
+
+	am.ObjectsRequeued = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "s3",
+			Name:      "objects_requeued_total",
+			Help:      "The total number of mismatched objects whose source files are uploaded again",
+		},
+		[]string{},
+	)
+
+	am.FileSkippedType = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "files",
+			Name:      "skipped_type_total",
+			Help:      "The total number of times symlinks and special files (fifos, sockets, devices) were skipped when found",
+		},
+		[]string{"type"},
+	)
+
+	am.SyntheticFiles = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "synthetic",
+			Name:      "files_total",
+			Help:      "The total number of files generated by the synthetic producer",
+		},
+		[]string{},
+	)
+
+	am.SQSMessages = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "sqs",
+			Name:      "messages_total",
+			Help:      "The total number of SQS messages received by result: queued, skipped or failed. Failed messages are received again",
+		},
+		[]string{"result"},
+	)
+
+	am.IngestedFiles = promauto.With(am.Registry).NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "s3_file_uploader",
+			Subsystem: "ingest",
+			Name:      "files_total",
+			Help:      "The total number of files uploaded to /api/v1/ingest by status: queued, stored for the directory scanner or rejected",
+		},
+		[]string{"status"},
+	)
+
 	am.Config.WithLabelValues(version).Set(1)
 	am.ChannelConfigLength.WithLabelValues().Set(float64(workersCannelSize))
 	am.ChannelLength.WithLabelValues().Set(float64(0))
+	am.CircuitState.WithLabelValues().Set(float64(0))
 	am.ChannelFullEvents.WithLabelValues().Add(0)
+	am.FileGroupPartial.WithLabelValues().Add(0)
+	am.FileUndeletable.WithLabelValues().Add(0)
+	am.NoIdleWorkers.WithLabelValues().Add(0)
+	am.ScanErrors.WithLabelValues().Add(0)
 
 	am.FileSendCount.WithLabelValues().Add(0)
 	am.FileSendBytesSum.WithLabelValues().Add(0)
-	am.FileSendErrors.WithLabelValues().Add(0)
+	for _, class := range errclass.Classes {
+		am.FileSendErrors.WithLabelValues(class).Add(0)
+	}
 	am.FileSendSuccess.WithLabelValues().Add(0)
 
 	am.Registry.MustRegister()
@@ -0,0 +1,278 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// OTLP pushes metrics to an OpenTelemetry collector or backend with OTLP/HTTP JSON encoding
+type OTLP struct {
+	URL         string
+	Gatherer    prometheus.Gatherer
+	ServiceName string
+	Attributes  map[string]string
+	Client      HTTPDoer
+
+	// Start of cumulative counters and histograms
+	Started time.Time
+}
+
+// OTLP JSON messages, 64-bit integers are encoded as strings
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpMetric struct {
+	Name      string         `json:"name"`
+	Unit      string         `json:"unit,omitempty"`
+	Gauge     *otlpData      `json:"gauge,omitempty"`
+	Sum       *otlpSum       `json:"sum,omitempty"`
+	Histogram *otlpHistogram `json:"histogram,omitempty"`
+	Summary   *otlpSummary   `json:"summary,omitempty"`
+}
+
+type otlpData struct {
+	DataPoints []otlpNumberPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberPoint `json:"dataPoints"`
+	AggregationTemporality int               `json:"aggregationTemporality"`
+	IsMonotonic            bool              `json:"isMonotonic"`
+}
+
+type otlpNumberPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsDouble          float64        `json:"asDouble"`
+}
+
+type otlpHistogram struct {
+	DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+	AggregationTemporality int                  `json:"aggregationTemporality"`
+}
+
+type otlpHistogramPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	Count             string         `json:"count"`
+	Sum               float64        `json:"sum"`
+	BucketCounts      []string       `json:"bucketCounts"`
+	ExplicitBounds    []float64      `json:"explicitBounds"`
+}
+
+type otlpSummary struct {
+	DataPoints []otlpSummaryPoint `json:"dataPoints"`
+}
+
+type otlpSummaryPoint struct {
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	Count          string         `json:"count"`
+	Sum            float64        `json:"sum"`
+	QuantileValues []otlpQuantile `json:"quantileValues"`
+}
+
+type otlpQuantile struct {
+	Quantile float64 `json:"quantile"`
+	Value    float64 `json:"value"`
+}
+
+// Cumulative aggregation temporality
+const otlpCumulative = 2
+
+// Push sends current values of all metrics
+func (o *OTLP) Push(ctx context.Context) error {
+	families, err := o.Gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %s", err.Error())
+	}
+
+	body, err := json.Marshal(o.request(families, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to encode metrics: %s", err.Error())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, OTLPMetricsURL(o.URL), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return doPush(o.Client, req)
+}
+
+// OTLPMetricsURL adds the default /v1/metrics path to a collector URL without a path
+func OTLPMetricsURL(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Path != "" && u.Path != "/") {
+		return endpoint
+	}
+	u.Path = "/v1/metrics"
+	return u.String()
+}
+
+// Convert metric families to an OTLP export request. JSON has no NaN or infinity, so data points with such values
+// are skipped, quantiles of summaries without observations are NaN.
+func (o *OTLP) request(families []*dto.MetricFamily, now time.Time) otlpRequest {
+	nowNano := strconv.FormatInt(now.UnixNano(), 10)
+	startNano := strconv.FormatInt(o.Started.UnixNano(), 10)
+
+	resource := otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": o.ServiceName})}
+	resource.Attributes = append(resource.Attributes, otlpAttributes(o.Attributes)...)
+
+	var metrics []otlpMetric
+	for _, mf := range families {
+		metric := otlpMetric{Name: mf.GetName()}
+
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			attrs := otlpAttributes(labels)
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				if !finite(m.GetCounter().GetValue()) {
+					continue
+				}
+				if metric.Sum == nil {
+					metric.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+				}
+				metric.Sum.DataPoints = append(metric.Sum.DataPoints, otlpNumberPoint{
+					Attributes: attrs, StartTimeUnixNano: startNano, TimeUnixNano: nowNano, AsDouble: m.GetCounter().GetValue(),
+				})
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				if !finite(h.GetSampleSum()) {
+					continue
+				}
+				if metric.Histogram == nil {
+					metric.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative}
+				}
+				point := otlpHistogramPoint{
+					Attributes:        attrs,
+					StartTimeUnixNano: startNano,
+					TimeUnixNano:      nowNano,
+					Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+					Sum:               h.GetSampleSum(),
+					ExplicitBounds:    []float64{},
+				}
+
+				// OTLP bucket counts are per bucket, Prometheus ones are cumulative. The +Inf bucket is implicit in OTLP.
+				var prev uint64
+				for _, b := range h.GetBucket() {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						break
+					}
+					point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+					point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-prev, 10))
+					prev = b.GetCumulativeCount()
+				}
+				point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-prev, 10))
+				metric.Histogram.DataPoints = append(metric.Histogram.DataPoints, point)
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				if !finite(s.GetSampleSum()) {
+					continue
+				}
+				if metric.Summary == nil {
+					metric.Summary = &otlpSummary{}
+				}
+				point := otlpSummaryPoint{
+					Attributes:     attrs,
+					TimeUnixNano:   nowNano,
+					Count:          strconv.FormatUint(s.GetSampleCount(), 10),
+					Sum:            s.GetSampleSum(),
+					QuantileValues: []otlpQuantile{},
+				}
+				for _, q := range s.GetQuantile() {
+					if !finite(q.GetValue()) {
+						continue
+					}
+					point.QuantileValues = append(point.QuantileValues, otlpQuantile{Quantile: q.GetQuantile(), Value: q.GetValue()})
+				}
+				metric.Summary.DataPoints = append(metric.Summary.DataPoints, point)
+			default:
+				value := m.GetGauge().GetValue()
+				if mf.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				if !finite(value) {
+					continue
+				}
+				if metric.Gauge == nil {
+					metric.Gauge = &otlpData{}
+				}
+				metric.Gauge.DataPoints = append(metric.Gauge.DataPoints, otlpNumberPoint{
+					Attributes: attrs, TimeUnixNano: nowNano, AsDouble: value,
+				})
+			}
+		}
+		if metric.Gauge == nil && metric.Sum == nil && metric.Histogram == nil && metric.Summary == nil {
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource:     resource,
+		ScopeMetrics: []otlpScopeMetrics{{Scope: otlpScope{Name: "s3_file_uploader"}, Metrics: metrics}},
+	}}}
+}
+
+// Check if a value can be encoded in JSON
+func finite(v float64) bool {
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+// Convert labels to OTLP attributes sorted by name
+func otlpAttributes(labels map[string]string) []otlpKeyValue {
+	attrs := make([]otlpKeyValue, 0, len(labels))
+	for k, v := range labels {
+		attrs = append(attrs, otlpKeyValue{Key: k, Value: otlpAnyValue{StringValue: v}})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].Key < attrs[j].Key })
+	return attrs
+}
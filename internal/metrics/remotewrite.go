@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// HTTPDoer sends HTTP requests, it's used to add auth to exporter requests
+type HTTPDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// RemoteWrite pushes metrics with Prometheus remote-write protocol (v1), e.g. to Mimir or Grafana Cloud
+type RemoteWrite struct {
+	URL      string
+	Gatherer prometheus.Gatherer
+	Labels   map[string]string
+	Client   HTTPDoer
+}
+
+// Remote-write time series
+type series struct {
+	labels map[string]string
+	value  float64
+}
+
+// Push sends current values of all metrics
+func (rw *RemoteWrite) Push(ctx context.Context) error {
+	families, err := rw.Gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %s", err.Error())
+	}
+
+	body := snappy.Encode(nil, encodeWriteRequest(flattenFamilies(families, rw.Labels), time.Now()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, rw.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	return doPush(rw.Client, req)
+}
+
+// Send a push request and check the response
+func doPush(client HTTPDoer, req *http.Request) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status code %d from %s: %s", resp.StatusCode, req.URL.String(), string(msg))
+	}
+	return nil
+}
+
+// Convert metric families to flat series the way Prometheus exposes them, e.g. histograms become _bucket, _sum and _count
+func flattenFamilies(families []*dto.MetricFamily, extraLabels map[string]string) []series {
+	var result []series
+
+	for _, mf := range families {
+		name := mf.GetName()
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for k, v := range extraLabels {
+				labels[k] = v
+			}
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+
+			add := func(name string, value float64, extra ...string) {
+				l := map[string]string{"__name__": name}
+				for k, v := range labels {
+					l[k] = v
+				}
+				for i := 0; i+1 < len(extra); i += 2 {
+					l[extra[i]] = extra[i+1]
+				}
+				result = append(result, series{labels: l, value: value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.GetGauge().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.GetBucket() {
+					add(name+"_bucket", float64(b.GetCumulativeCount()), "le", formatFloat(b.GetUpperBound()))
+				}
+				add(name+"_bucket", float64(h.GetSampleCount()), "le", "+Inf")
+				add(name+"_sum", h.GetSampleSum())
+				add(name+"_count", float64(h.GetSampleCount()))
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.GetQuantile() {
+					add(name, q.GetValue(), "quantile", formatFloat(q.GetQuantile()))
+				}
+				add(name+"_sum", s.GetSampleSum())
+				add(name+"_count", float64(s.GetSampleCount()))
+			default:
+				add(name, m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return result
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Encode prometheus.WriteRequest protobuf message:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label        { string name = 1; string value = 2; }
+//	Sample       { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(all []series, now time.Time) []byte {
+	var buf []byte
+	for _, s := range all {
+		var ts []byte
+
+		// Labels must be sorted by name
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, s.labels[name])
+			ts = protowire.AppendTag(ts, 1, protowire.BytesType)
+			ts = protowire.AppendBytes(ts, label)
+		}
+
+		var sample []byte
+		sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+		sample = protowire.AppendFixed64(sample, math.Float64bits(s.value))
+		sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+		sample = protowire.AppendVarint(sample, uint64(now.UnixMilli()))
+		ts = protowire.AppendTag(ts, 2, protowire.BytesType)
+		ts = protowire.AppendBytes(ts, sample)
+
+		buf = protowire.AppendTag(buf, 1, protowire.BytesType)
+		buf = protowire.AppendBytes(buf, ts)
+	}
+	return buf
+}
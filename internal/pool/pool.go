@@ -0,0 +1,146 @@
+// Package pool runs stages of the upload workers, e.g. compression, on separate pools of goroutines.
+// The number of jobs running at once is limited by the pool size, while workers that don't wait for
+// a job keep going with other stages.
+package pool
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// Stages a file goes through after it's scanned and claimed by a worker
+const (
+	StageCompress = "compress"
+	StageEncrypt  = "encrypt"
+	StageUpload   = "upload"
+	StageCleanup  = "cleanup"
+)
+
+// Pipeline has a pool for every stage, a nil pool runs its stage in the worker
+type Pipeline struct {
+	Compress *Pool
+	Encrypt  *Pool
+	Upload   *Pool
+	Cleanup  *Pool
+}
+
+// Stages returns pools by stage name
+func (p Pipeline) Stages() map[string]*Pool {
+	return map[string]*Pool{
+		StageCompress: p.Compress,
+		StageEncrypt:  p.Encrypt,
+		StageUpload:   p.Upload,
+		StageCleanup:  p.Cleanup,
+	}
+}
+
+// Close closes pools of all stages
+func (p Pipeline) Close() {
+	for _, stage := range p.Stages() {
+		stage.Close()
+	}
+}
+
+// Pool runs jobs submitted from a queue, nil pool runs jobs in the calling goroutine
+type Pool struct {
+	jobs    chan job
+	queued  atomic.Int64
+	running atomic.Int64
+	stopped sync.WaitGroup
+}
+
+type job struct {
+	run  func() error
+	done chan error
+}
+
+// PanicError is a panic of a job. The pool worker recovers from it and Run panics with it in the calling
+// goroutine, so the caller can recover from panics of its jobs.
+type PanicError struct {
+	Value any
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// New starts a pool of workers
+func New(workers int) *Pool {
+	p := &Pool{jobs: make(chan job)}
+	for i := 0; i < workers; i++ {
+		p.stopped.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Run queues the job and waits for a pool worker to run it. A job that hasn't started when ctx is done is
+// dropped, a running job is waited for, it should stop on its own when ctx is done.
+func (p *Pool) Run(ctx context.Context, run func() error) error {
+	if p == nil {
+		return run()
+	}
+
+	j := job{run: run, done: make(chan error, 1)}
+	p.queued.Add(1)
+	select {
+	case p.jobs <- j:
+		p.queued.Add(-1)
+	case <-ctx.Done():
+		p.queued.Add(-1)
+		return ctx.Err()
+	}
+	err := <-j.done
+	if pe, ok := err.(*PanicError); ok {
+		panic(pe)
+	}
+	return err
+}
+
+// Queued returns the number of jobs waiting for a worker
+func (p *Pool) Queued() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.queued.Load()
+}
+
+// Running returns the number of jobs being run
+func (p *Pool) Running() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.running.Load()
+}
+
+// Close stops the workers once the running jobs are done, no jobs can be run after that
+func (p *Pool) Close() {
+	if p == nil {
+		return
+	}
+	close(p.jobs)
+	p.stopped.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.stopped.Done()
+
+	for j := range p.jobs {
+		p.running.Add(1)
+		j.done <- runJob(j.run)
+		p.running.Add(-1)
+	}
+}
+
+func runJob(run func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return run()
+}
@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool(t *testing.T) {
+	// Nil pool runs jobs right away
+	var p *Pool
+	assert.EqualError(t, p.Run(context.Background(), func() error { return errors.New("failed") }), "failed")
+
+	p = New(2)
+	defer p.Close()
+
+	// No more than 2 jobs run at once
+	var running, maxRunning atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, p.Run(context.Background(), func() error {
+				n := running.Add(1)
+				for {
+					m := maxRunning.Load()
+					if n <= m || maxRunning.CompareAndSwap(m, n) {
+						break
+					}
+				}
+				time.Sleep(20 * time.Millisecond)
+				running.Add(-1)
+				return nil
+			}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(2), maxRunning.Load())
+	assert.Equal(t, int64(0), p.Queued())
+
+	// Jobs waiting for a worker are dropped when the context is done
+	release := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go p.Run(context.Background(), func() error { <-release; return nil })
+	}
+	assert.Eventually(t, func() bool { return p.Running() == 2 }, time.Second, time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ran := false
+	assert.ErrorIs(t, p.Run(ctx, func() error { ran = true; return nil }), context.DeadlineExceeded)
+	assert.False(t, ran)
+	close(release)
+}
+
+func TestPoolPanic(t *testing.T) {
+	p := New(1)
+	defer p.Close()
+
+	// Panic of a job is passed to the caller, the pool worker keeps running
+	assert.PanicsWithError(t, "panic: malformed path", func() {
+		p.Run(context.Background(), func() error { panic("malformed path") })
+	})
+	assert.Nil(t, p.Run(context.Background(), func() error { return nil }))
+}
+
+func TestPipeline(t *testing.T) {
+	pipeline := Pipeline{Upload: New(1)}
+	stages := pipeline.Stages()
+	assert.Equal(t, 4, len(stages))
+	assert.Nil(t, stages[StageCompress])
+	assert.Equal(t, pipeline.Upload, stages[StageUpload])
+
+	// Stages without a pool run in the calling goroutine, closing skips them
+	assert.Nil(t, stages[StageCleanup].Run(context.Background(), func() error { return nil }))
+	pipeline.Close()
+}
@@ -0,0 +1,191 @@
+// Package progress tracks bytes read from upload bodies of large files and reports how fast the upload moves,
+// so a long upload that is stuck can be told apart from one that is just big. It also measures the total upload
+// throughput of all files.
+package progress
+
+import (
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+
+	"github.com/google/logger"
+)
+
+// How often progress is reported, log lines are written every Config.Interval
+const reportInterval = time.Second
+
+// Config of progress reporting
+type Config struct {
+	// Files smaller than this are not tracked, 0 disables tracking
+	MinSize int64
+	// Progress is logged this often
+	Interval time.Duration
+	Log      *logger.Logger
+
+	// Report is called every second with uploaded bytes, the file size and the average rate in bytes per second
+	Report func(done, total int64, rate float64)
+
+	// Meter counts bytes of all uploads regardless of their size, nil disables it
+	Meter *Meter
+}
+
+// Tracker counts bytes of an upload, nil tracker counts nothing
+type Tracker struct {
+	config  Config
+	name    string
+	total   int64
+	started time.Time
+	done    atomic.Int64
+	skipped atomic.Int64
+
+	stop    chan struct{}
+	stopped sync.WaitGroup
+}
+
+// Start tracks an upload of total bytes, its progress is reported if it's large enough.
+// The tracker must be stopped when the upload ends.
+func Start(config Config, name string, total int64) *Tracker {
+	large := config.MinSize > 0 && total >= config.MinSize
+	if !large && config.Meter == nil {
+		return nil
+	}
+
+	t := &Tracker{config: config, name: name, total: total, started: time.Now()}
+	if large {
+		t.stop = make(chan struct{})
+		t.stopped.Add(1)
+		go t.run()
+	}
+	return t
+}
+
+// Reader returns a reader counting bytes read from r
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{r: r, t: t}
+}
+
+// Add counts uploaded bytes, e.g. completed parts of a multipart upload
+func (t *Tracker) Add(n int64) {
+	if t == nil {
+		return
+	}
+	t.done.Add(n)
+	t.config.Meter.Add(n)
+}
+
+// Skip counts bytes uploaded before the tracker started, e.g. parts uploaded before a restart.
+// They are not included in the upload rate.
+func (t *Tracker) Skip(n int64) {
+	if t == nil {
+		return
+	}
+	t.done.Add(n)
+	t.skipped.Add(n)
+}
+
+// Stop stops reporting
+func (t *Tracker) Stop() {
+	if t == nil || t.stop == nil {
+		return
+	}
+	close(t.stop)
+	t.stopped.Wait()
+}
+
+// Done returns the number of counted bytes
+func (t *Tracker) Done() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.done.Load()
+}
+
+func (t *Tracker) run() {
+	defer t.stopped.Done()
+
+	tick := time.NewTicker(reportInterval)
+	defer tick.Stop()
+	lastLog := t.started
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-tick.C:
+			done := min(t.done.Load(), t.total)
+			rate := float64(done-t.skipped.Load()) / now.Sub(t.started).Seconds()
+			if t.config.Report != nil {
+				t.config.Report(done, t.total, rate)
+			}
+			if t.config.Log != nil && t.config.Interval > 0 && now.Sub(lastLog) >= t.config.Interval {
+				lastLog = now
+				t.config.Log.Infof("Uploading %q: %.1f%%, %s of %s, %s", t.name, float64(done)*100/float64(t.total),
+					utils.HumanizeBytes(done, false), utils.HumanizeBytes(t.total, false), utils.HumanizeBytes(int64(rate), true))
+			}
+		}
+	}
+}
+
+// Reader counting read bytes
+type reader struct {
+	r io.Reader
+	t *Tracker
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.t.Add(int64(n))
+	return n, err
+}
+
+// Meter measures the total upload rate of all workers
+type Meter struct {
+	bytes atomic.Int64
+
+	mu         sync.Mutex
+	lastBytes  int64
+	lastUpdate time.Time
+	rate       float64
+	avg1m      float64
+	avg5m      float64
+}
+
+// NewMeter creates a meter, rates are measured from now
+func NewMeter() *Meter {
+	return &Meter{lastUpdate: time.Now()}
+}
+
+// Add counts uploaded bytes
+func (m *Meter) Add(n int64) {
+	if m == nil {
+		return
+	}
+	m.bytes.Add(n)
+}
+
+// Update measures the rate since the previous update and updates the 1 and 5 minute exponential moving averages.
+// It returns the current rate and the averages in bytes per second.
+func (m *Meter) Update(now time.Time) (rate, avg1m, avg5m float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	elapsed := now.Sub(m.lastUpdate).Seconds()
+	if elapsed <= 0 {
+		return m.rate, m.avg1m, m.avg5m
+	}
+	bytes := m.bytes.Load()
+	m.rate = float64(bytes-m.lastBytes) / elapsed
+	m.lastBytes, m.lastUpdate = bytes, now
+
+	// Same as load averages, older rates decay by e every window
+	m.avg1m += (1 - math.Exp(-elapsed/time.Minute.Seconds())) * (m.rate - m.avg1m)
+	m.avg5m += (1 - math.Exp(-elapsed/(5*time.Minute).Seconds())) * (m.rate - m.avg5m)
+	return m.rate, m.avg1m, m.avg5m
+}
@@ -0,0 +1,67 @@
+package progress
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracker(t *testing.T) {
+	// Small files and disabled reporting aren't tracked, nil trackers are safe to use
+	assert.Nil(t, Start(Config{MinSize: 100}, "small", 99))
+	assert.Nil(t, Start(Config{}, "disabled", 1000))
+
+	var tracker *Tracker
+	r := bytes.NewReader([]byte("data"))
+	assert.Equal(t, io.Reader(r), tracker.Reader(r))
+	tracker.Add(10)
+	tracker.Skip(10)
+	tracker.Stop()
+	assert.Equal(t, int64(0), tracker.Done())
+
+	var reported atomic.Int64
+	tracker = Start(Config{MinSize: 100, Report: func(done, total int64, rate float64) {
+		assert.Equal(t, int64(1000), total)
+		reported.Store(done)
+	}}, "large", 1000)
+	assert.NotNil(t, tracker)
+
+	n, err := io.Copy(io.Discard, tracker.Reader(bytes.NewReader(make([]byte, 300))))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), n)
+	tracker.Add(200)
+	tracker.Skip(100)
+	assert.Equal(t, int64(600), tracker.Done())
+
+	assert.Eventually(t, func() bool { return reported.Load() == 600 }, 3*time.Second, 100*time.Millisecond)
+	tracker.Stop()
+}
+
+func TestMeter(t *testing.T) {
+	meter := NewMeter()
+	start := meter.lastUpdate
+
+	// Bytes of small files are counted by the meter too
+	tracker := Start(Config{MinSize: 1000, Meter: meter}, "small", 100)
+	assert.NotNil(t, tracker)
+	tracker.Add(100)
+	tracker.Skip(50)
+	tracker.Stop()
+	meter.Add(100)
+
+	rate, avg1m, avg5m := meter.Update(start.Add(2 * time.Second))
+	assert.Equal(t, 100.0, rate)
+	assert.InDelta(t, 100*(1-math.Exp(-2.0/60)), avg1m, 0.001)
+	assert.Less(t, avg5m, avg1m)
+
+	// Averages decay when nothing is uploaded
+	rate, avg1m, _ = meter.Update(start.Add(time.Minute))
+	assert.Equal(t, 0.0, rate)
+	assert.Less(t, avg1m, 100*(1-math.Exp(-2.0/60)))
+	assert.Greater(t, avg1m, 0.0)
+}
@@ -0,0 +1,244 @@
+package queue
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Queue orders messages for workers by priority. A file is queued only once until it's taken by a worker,
+// so periodic scans don't pile up duplicates of files waiting in the queue.
+type Queue struct {
+	mu       sync.Mutex
+	items    items
+	queued   map[string]bool
+	capacity int
+	closed   bool
+	// inflight counts messages taken with Pop that are not done yet
+	inflight int
+
+	// notify wakes up a waiting worker when a message is pushed
+	notify chan struct{}
+	// space wakes up a waiting producer when a message is taken
+	space chan struct{}
+}
+
+// items implements heap.Interface
+type items struct {
+	messages []cfg.Message
+	less     func(a, b cfg.Message) bool
+}
+
+func (it items) Len() int           { return len(it.messages) }
+func (it items) Less(i, j int) bool { return it.less(it.messages[i], it.messages[j]) }
+func (it items) Swap(i, j int)      { it.messages[i], it.messages[j] = it.messages[j], it.messages[i] }
+
+func (it *items) Push(x any) {
+	it.messages = append(it.messages, x.(cfg.Message))
+}
+
+func (it *items) Pop() any {
+	n := len(it.messages)
+	msg := it.messages[n-1]
+	it.messages = it.messages[:n-1]
+	return msg
+}
+
+// Ordering functions, ties are broken by file name to keep the order stable
+var orders = map[string]func(a, b cfg.Message) bool{
+	// Oldest first
+	"mtime": func(a, b cfg.Message) bool {
+		if a.ModTime.Equal(b.ModTime) {
+			return a.File < b.File
+		}
+		return a.ModTime.Before(b.ModTime)
+	},
+	// Smallest first
+	"size": func(a, b cfg.Message) bool {
+		if a.Size == b.Size {
+			return a.File < b.File
+		}
+		return a.Size < b.Size
+	},
+}
+
+// New creates a queue with the given order (mtime or size) and max number of messages
+func New(order string, capacity int) (*Queue, error) {
+	less, ok := orders[order]
+	if !ok {
+		return nil, fmt.Errorf("unsupported queue order %q, must be mtime or size", order)
+	}
+
+	return &Queue{
+		items:    items{less: less},
+		queued:   map[string]bool{},
+		capacity: capacity,
+		notify:   make(chan struct{}, 1),
+		space:    make(chan struct{}, 1),
+	}, nil
+}
+
+// Push adds a message to the queue. It returns false if the queue is full or closed.
+// Message for a file that is already queued is ignored.
+func (q *Queue) Push(msg cfg.Message) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed || q.items.Len() >= q.capacity {
+		return false
+	}
+	q.push(msg)
+	return true
+}
+
+// PushWait adds a message to the queue, waiting for a worker to take a message while the queue is full.
+// It returns false if the queue is closed or context is cancelled before the message is queued.
+func (q *Queue) PushWait(ctx context.Context, msg cfg.Message) bool {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return false
+		}
+
+		if q.items.Len() < q.capacity {
+			q.push(msg)
+
+			// Let other producers know there's more space
+			if q.items.Len() < q.capacity {
+				q.signal(q.space)
+			}
+			q.mu.Unlock()
+			return true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-q.space:
+		}
+	}
+}
+
+// push adds a message that is not queued yet, must be called with the lock held
+func (q *Queue) push(msg cfg.Message) {
+	if q.queued[msg.File] {
+		return
+	}
+
+	if msg.Queued.IsZero() {
+		msg.Queued = time.Now()
+	}
+	q.queued[msg.File] = true
+	heap.Push(&q.items, msg)
+	q.wakeUp()
+}
+
+// Pop waits for the message with the highest priority. It returns false when context is cancelled or the queue is closed.
+// The message is in flight until Done is called.
+func (q *Queue) Pop(ctx context.Context) (cfg.Message, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return cfg.Message{}, false
+		}
+
+		if q.items.Len() > 0 {
+			msg := heap.Pop(&q.items).(cfg.Message)
+			delete(q.queued, msg.File)
+			q.inflight++
+
+			// Let other workers know there's more work
+			if q.items.Len() > 0 {
+				q.wakeUp()
+			}
+			q.signal(q.space)
+			q.mu.Unlock()
+			return msg, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return cfg.Message{}, false
+		case <-q.notify:
+		}
+	}
+}
+
+// wakeUp notifies a waiting worker, must be called with the lock held
+func (q *Queue) wakeUp() {
+	q.signal(q.notify)
+}
+
+// signal notifies one waiting goroutine, must be called with the lock held
+func (q *Queue) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Done marks a message taken with Pop as processed
+func (q *Queue) Done() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inflight--
+}
+
+// Idle checks if there are no queued messages and no messages in flight
+func (q *Queue) Idle() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.items.Len() == 0 && q.inflight == 0
+}
+
+// Len returns the number of queued messages
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.items.Len()
+}
+
+// Contains checks if a message for the file is queued
+func (q *Queue) Contains(file string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued[file]
+}
+
+// Oldest returns the time the longest waiting message was queued, zero time if the queue is empty. Modification
+// times are not used, files copied with their original times would look old right away.
+func (q *Queue) Oldest() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var oldest time.Time
+	for _, msg := range q.items.messages {
+		if oldest.IsZero() || msg.Queued.Before(oldest) {
+			oldest = msg.Queued
+		}
+	}
+	return oldest
+}
+
+// Cap returns the max number of queued messages
+func (q *Queue) Cap() int {
+	return q.capacity
+}
+
+// Close stops the queue, waiting workers are released
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	close(q.notify)
+	close(q.space)
+}
@@ -0,0 +1,128 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueueOrder(t *testing.T) {
+	now := time.Now()
+	messages := []cfg.Message{
+		{File: "new", ModTime: now, Size: 1},
+		{File: "old", ModTime: now.Add(-time.Hour), Size: 3},
+		{File: "mid", ModTime: now.Add(-time.Minute), Size: 2},
+	}
+
+	for order, expected := range map[string][]string{
+		"mtime": {"old", "mid", "new"},
+		"size":  {"new", "mid", "old"},
+	} {
+		q, err := New(order, 10)
+		assert.Nil(t, err)
+		for _, msg := range messages {
+			assert.True(t, q.Push(msg))
+		}
+
+		// Duplicates are ignored
+		assert.True(t, q.Push(messages[0]))
+		assert.Equal(t, q.Len(), 3)
+		assert.True(t, q.Contains("old"))
+		assert.False(t, q.Contains("other"))
+
+		files := []string{}
+		for range messages {
+			msg, ok := q.Pop(context.Background())
+			assert.True(t, ok)
+			files = append(files, msg.File)
+		}
+		assert.Equal(t, files, expected, order)
+	}
+
+	_, err := New("random", 10)
+	assert.NotNil(t, err)
+}
+
+func TestQueueCapacityAndClose(t *testing.T) {
+	q, err := New("mtime", 1)
+	assert.Nil(t, err)
+	assert.True(t, q.Push(cfg.Message{File: "a"}))
+	assert.False(t, q.Push(cfg.Message{File: "b"}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, ok := q.Pop(ctx)
+	assert.True(t, ok)
+
+	// Pop waits until context is cancelled
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, ok = q.Pop(ctx)
+	assert.False(t, ok)
+
+	q.Close()
+	_, ok = q.Pop(context.Background())
+	assert.False(t, ok)
+	assert.False(t, q.Push(cfg.Message{File: "c"}))
+}
+
+func TestPushWait(t *testing.T) {
+	q, err := New("mtime", 1)
+	assert.Nil(t, err)
+	assert.True(t, q.PushWait(context.Background(), cfg.Message{File: "a"}))
+
+	// Producer waits until a worker takes a message
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Pop(context.Background())
+	}()
+	assert.True(t, q.PushWait(context.Background(), cfg.Message{File: "b"}))
+	msg, ok := q.Pop(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, "b", msg.File)
+
+	// Producer gives up when context is cancelled or the queue is closed
+	assert.True(t, q.Push(cfg.Message{File: "c"}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.False(t, q.PushWait(ctx, cfg.Message{File: "d"}))
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.Close()
+	}()
+	assert.False(t, q.PushWait(context.Background(), cfg.Message{File: "d"}))
+}
+
+func TestOldest(t *testing.T) {
+	q, err := New("size", 10)
+	assert.Nil(t, err)
+	assert.True(t, q.Oldest().IsZero())
+
+	// Files are as old as they have been queued, not by their modification time
+	now := time.Now()
+	q.Push(cfg.Message{File: "a", Size: 1, ModTime: now.Add(-2 * time.Hour)})
+	assert.WithinDuration(t, time.Now(), q.Oldest(), time.Minute)
+	q.Push(cfg.Message{File: "b", Size: 2, ModTime: now, Queued: now.Add(-time.Hour)})
+	assert.Equal(t, now.Add(-time.Hour), q.Oldest())
+}
+
+func TestIdle(t *testing.T) {
+	q, err := New("mtime", 10)
+	assert.Nil(t, err)
+	assert.True(t, q.Idle())
+
+	// Taken message keeps the queue busy until it's done
+	q.Push(cfg.Message{File: "a"})
+	assert.False(t, q.Idle())
+	_, ok := q.Pop(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, 0, q.Len())
+	assert.False(t, q.Idle())
+	q.Done()
+	assert.True(t, q.Idle())
+}
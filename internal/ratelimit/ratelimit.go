@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiter shared between workers, one token is one byte
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter for rate bytes per second, burst is the bucket size.
+// Short bursts of small files up to the bucket size are not delayed at all. Zero rate means no limit.
+func NewLimiter(rate, burst int64) *Limiter {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	return &Limiter{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// SetRate changes the rate and the bucket size, e.g. for a bandwidth schedule. Zero rate means no limit.
+func (l *Limiter) SetRate(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = float64(rate)
+	l.burst = float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the current rate in bytes per second, zero means no limit
+func (l *Limiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int64(l.rate)
+}
+
+// refill adds tokens for the time passed since the last call, must be called with the lock held
+func (l *Limiter) refill(now time.Time) {
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// WaitN blocks until n tokens are taken from the bucket
+func (l *Limiter) WaitN(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill(time.Now())
+
+	// Take tokens right away, going into debt makes concurrent callers queue up fairly
+	l.tokens -= float64(n)
+	wait := time.Duration(0)
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Tokens returns the current number of tokens in the bucket, negative value means callers are waiting
+func (l *Limiter) Tokens() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	return l.tokens
+}
+
+// Burst returns the bucket size
+func (l *Limiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return int(l.burst)
+}
+
+// Reader is an io.Reader throttled by a limiter
+type Reader struct {
+	reader  io.Reader
+	limiter *Limiter
+}
+
+// NewReader wraps reader with a limiter. Readers that can be read at offsets, e.g. files, stay io.ReaderAt and
+// io.Seeker, so the S3 uploader reads parts of them in place instead of buffering the parts in memory.
+func NewReader(reader io.Reader, limiter *Limiter) io.Reader {
+	r := &Reader{reader: reader, limiter: limiter}
+	if at, ok := reader.(readerAtSeeker); ok {
+		return &seekReader{Reader: r, at: at}
+	}
+	return r
+}
+
+// Read reads at most burst bytes at once and waits for tokens for the bytes read
+func (r *Reader) Read(p []byte) (int, error) {
+	if burst := r.limiter.Burst(); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.limiter.WaitN(n)
+	}
+	return n, err
+}
+
+type readerAtSeeker interface {
+	io.ReaderAt
+	io.Seeker
+}
+
+// seekReader is a Reader that can also be read at offsets, all reads are throttled
+type seekReader struct {
+	*Reader
+	at readerAtSeeker
+}
+
+// ReadAt reads at most burst bytes from the underlying reader at once and waits for tokens for the bytes read
+func (r *seekReader) ReadAt(p []byte, off int64) (int, error) {
+	read := 0
+	for read < len(p) {
+		chunk := p[read:]
+		if burst := r.limiter.Burst(); burst > 0 && len(chunk) > burst {
+			chunk = chunk[:burst]
+		}
+
+		n, err := r.at.ReadAt(chunk, off+int64(read))
+		if n > 0 {
+			r.limiter.WaitN(n)
+		}
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// Seek sets the offset of the next Read
+func (r *seekReader) Seek(offset int64, whence int) (int64, error) {
+	return r.at.Seek(offset, whence)
+}
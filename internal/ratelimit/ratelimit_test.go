@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiterBurst(t *testing.T) {
+	limiter := NewLimiter(1000, 5000)
+	assert.Equal(t, limiter.Burst(), 5000)
+
+	// Burst is not delayed
+	started := time.Now()
+	limiter.WaitN(5000)
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+
+	// Empty bucket waits for refill
+	started = time.Now()
+	limiter.WaitN(200)
+	assert.GreaterOrEqual(t, time.Since(started), 150*time.Millisecond)
+	assert.Less(t, limiter.Tokens(), float64(100))
+}
+
+func TestReader(t *testing.T) {
+	data := bytes.Repeat([]byte("a"), 3000)
+	limiter := NewLimiter(1000000, 1000)
+
+	out, err := io.ReadAll(NewReader(bytes.NewReader(data), limiter))
+	assert.Nil(t, err)
+	assert.Equal(t, out, data)
+	assert.Equal(t, NewLimiter(100, 0).Burst(), 100)
+
+	// Files can still be read at offsets, so uploaders don't buffer parts
+	reader := NewReader(bytes.NewReader(data), limiter)
+	at, ok := reader.(io.ReaderAt)
+	assert.True(t, ok)
+	_, ok = reader.(io.Seeker)
+	assert.True(t, ok)
+	part := make([]byte, 2500)
+	n, err := at.ReadAt(part, 400)
+	assert.Nil(t, err)
+	assert.Equal(t, 2500, n)
+	assert.Equal(t, data[400:2900], part)
+	n, err = at.ReadAt(part, 1000)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 2000, n)
+
+	_, ok = NewReader(io.LimitReader(bytes.NewReader(data), 10), limiter).(io.ReaderAt)
+	assert.False(t, ok)
+}
+
+func TestSetRate(t *testing.T) {
+	limiter := NewLimiter(1000, 1000)
+	limiter.WaitN(1000)
+
+	// No limit
+	limiter.SetRate(0, 0)
+	assert.Equal(t, limiter.Rate(), int64(0))
+	started := time.Now()
+	limiter.WaitN(1000000)
+	assert.Less(t, time.Since(started), 100*time.Millisecond)
+
+	// Limited again, the bucket doesn't keep debt from the unlimited period
+	limiter.SetRate(1000, 500)
+	assert.Equal(t, limiter.Burst(), 500)
+	assert.LessOrEqual(t, limiter.Tokens(), float64(500))
+	assert.Greater(t, limiter.Tokens(), float64(-1))
+}
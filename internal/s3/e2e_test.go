@@ -0,0 +1,494 @@
+//go:build e2e
+
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/membudget"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/s3mock"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3crypto"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/google/logger"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+// Config for uploads to the mock server without compression and encryption
+func e2eConfig(t *testing.T, server *s3mock.Server) cfg.AppConfig {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	return cfg.AppConfig{
+		Applog:       logger.Init("test", false, false, io.Discard),
+		PathToWatch:  t.TempDir(),
+		S3bucket:     "bucket",
+		S3path:       "/backups",
+		S3Endpoint:   server.URL,
+		Compression:  "none",
+		S3MaxRetries: -1,
+	}
+}
+
+func writeFile(t *testing.T, config cfg.AppConfig, name string, data []byte) string {
+	file := filepath.Join(config.PathToWatch, name)
+	assert.Nil(t, os.WriteFile(file, data, 0644))
+	return file
+}
+
+func TestE2EUploadFile(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.StorageClass = "STANDARD_IA"
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	assert.Nil(t, client.CheckBucket(context.Background(), config))
+
+	file := writeFile(t, config, "dump.sql", []byte("select 1;"))
+	size, err := client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(9), size)
+
+	obj, ok := server.Object("bucket", "backups/dump.sql")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("select 1;"), obj.Data)
+	assert.Equal(t, "STANDARD_IA", obj.StorageClass)
+	format, err := ParseFormat(aws.StringMap(obj.Metadata))
+	assert.Nil(t, err)
+	assert.Equal(t, FormatVersion, format.Version)
+
+	config.S3bucket = "missing"
+	assert.NotNil(t, client.CheckBucket(context.Background(), config))
+}
+
+func TestE2EMultipartUpload(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.S3PartSize = s3manager.MinUploadPartSize
+	config.S3Concurrency = 2
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	file := writeFile(t, config, "big.bin", data)
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+
+	obj, ok := server.Object("bucket", "backups/big.bin")
+	assert.True(t, ok)
+	assert.Equal(t, 4, obj.Parts)
+
+	// Object matches the local file checksum
+	sum := sha256.Sum256(obj.Data)
+	local, err := fs.FileSHA256(file)
+	assert.Nil(t, err)
+	assert.Equal(t, local, hex.EncodeToString(sum[:]))
+	assert.Equal(t, 0, server.Uploads())
+}
+
+func TestE2EUploadStream(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.S3PartSize = s3manager.MinUploadPartSize
+	config.BufferBudget = membudget.New(1 << 30)
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+
+	// The stream has no size, it's uploaded in parts as it's read
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	key, err := fs.StreamKey(config, "db/dump.sql")
+	assert.Nil(t, err)
+	size, err := client.UploadStream(context.Background(), config, "dump.sql", key, io.MultiReader(bytes.NewReader(data)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), size)
+	assert.Equal(t, int64(0), config.BufferBudget.Used())
+
+	obj, ok := server.Object("bucket", "backups/db/dump.sql")
+	assert.True(t, ok)
+	assert.Equal(t, 4, obj.Parts)
+	assert.Equal(t, data, obj.Data)
+}
+
+func TestE2EBufferBudget(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.S3PartSize = s3manager.MinUploadPartSize
+
+	// Rate limited body is buffered, the upload gets the whole budget smaller than it needs
+	config.UploadLimiter = ratelimit.NewLimiter(1<<30, 0)
+	config.BufferBudget = membudget.New(1 << 20)
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "big.bin", bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), config.BufferBudget.Used())
+	obj, ok := server.Object("bucket", "backups/big.bin")
+	assert.True(t, ok)
+	assert.Equal(t, 4, obj.Parts)
+}
+
+func TestE2ERetries(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+
+	// Transient errors are retried by the SDK
+	server.FailNext(2)
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "retried", []byte("data")))
+	assert.Nil(t, err)
+	_, ok := server.Object("bucket", "backups/retried")
+	assert.True(t, ok)
+	assert.Equal(t, 3, server.Requests())
+
+	// Upload fails when retries are exhausted
+	server.FailNext(100)
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "failed", []byte("data")))
+	assert.NotNil(t, err)
+	_, ok = server.Object("bucket", "backups/failed")
+	assert.False(t, ok)
+}
+
+func TestE2EResumeUpload(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.S3PartSize = s3manager.MinUploadPartSize
+	config.S3Concurrency = 1
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	var err error
+	config.State, err = state.Open(stateFile)
+	assert.Nil(t, err)
+
+	data := bytes.Repeat([]byte("0123456789abcdef"), 1024*1024)
+	file := writeFile(t, config, "big.bin", data)
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+
+	// Parts uploaded before the failure are kept in the state
+	server.FailPart(3)
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.NotNil(t, err)
+	upload := fs.ResumableUpload(config, file)
+	assert.NotNil(t, upload)
+	assert.Len(t, upload.Parts, 2)
+	assert.Equal(t, 1, server.Uploads())
+
+	// Only missing parts are uploaded after a restart
+	config.State, err = state.Open(stateFile)
+	assert.Nil(t, err)
+	server.FailPart(0)
+	requests := server.Requests()
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, server.Requests()-requests)
+
+	obj, ok := server.Object("bucket", "backups/big.bin")
+	assert.True(t, ok)
+	assert.Equal(t, data, obj.Data)
+	assert.Equal(t, 4, obj.Parts)
+	assert.Equal(t, 0, server.Uploads())
+	assert.Nil(t, fs.ResumableUpload(config, file))
+}
+
+func TestE2EAbortStaleUploads(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.State, _ = state.Open("")
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	for _, key := range []string{"backups/stale", "other/upload"} {
+		_, err := client.Uploader.S3.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+			Bucket: aws.String("bucket"),
+			Key:    aws.String(key),
+		})
+		assert.Nil(t, err)
+	}
+
+	// Recent uploads are kept
+	aborted, err := client.AbortStaleUploads(context.Background(), config, time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, aborted)
+
+	// Uploads outside of the S3 path are not touched
+	aborted, err = client.AbortStaleUploads(context.Background(), config, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, aborted)
+	assert.Equal(t, 1, server.Uploads())
+}
+
+func TestE2ESlowDown(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.Metrics = metrics.InitMetrics("test", 1, []float64{1})
+	config.S3SlowDownDelay = time.Millisecond
+	config.S3SlowDownMax = 10 * time.Millisecond
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+
+	// Throttled requests are retried and counted
+	server.ThrottleNext(2)
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "throttled", []byte("data")))
+	assert.Nil(t, err)
+	throttled := &dto.Metric{}
+	assert.Nil(t, config.Metrics.S3Throttled.WithLabelValues("PutObject").Write(throttled))
+	assert.Equal(t, 2.0, throttled.GetCounter().GetValue())
+
+	// Exhausted retries are reported as throttling
+	config.S3MaxRetries = 1
+	client, err = NewClient(config)
+	assert.Nil(t, err)
+	server.ThrottleNext(2)
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "failed", []byte("data")))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "S3 is throttling requests")
+}
+
+func TestE2EReconcile(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.State, _ = state.Open("")
+	config.ReconcileWindow = time.Hour
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+
+	// Uploads are recorded only when reconciliation is enabled
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "unchecked", []byte("data")))
+	assert.Nil(t, err)
+	assert.Empty(t, config.State.Objects())
+	config.ReconcileInterval = time.Minute
+	for _, name := range []string{"intact", "corrupted", "lost"} {
+		_, err := client.UploadFile(context.Background(), config, writeFile(t, config, name, []byte("data")))
+		assert.Nil(t, err)
+	}
+
+	verified, mismatches, err := client.Reconcile(context.Background(), config)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, verified)
+	assert.Empty(t, mismatches)
+
+	// Objects changed or deleted by the provider don't match
+	server.Store("bucket", "backups/corrupted", []byte("dat4"))
+	_, err = client.Uploader.S3.DeleteObject(&awss3.DeleteObjectInput{Bucket: aws.String("bucket"), Key: aws.String("backups/lost")})
+	assert.Nil(t, err)
+
+	verified, mismatches, err = client.Reconcile(context.Background(), config)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, verified)
+	assert.Len(t, mismatches, 2)
+	assert.Equal(t, "/backups/corrupted", mismatches[0].Key)
+	assert.Contains(t, mismatches[0].Reason, "ETag")
+	assert.Equal(t, filepath.Join(config.PathToWatch, "corrupted"), mismatches[0].Source)
+	assert.Equal(t, "/backups/lost", mismatches[1].Key)
+	assert.Equal(t, "object is missing", mismatches[1].Reason)
+}
+
+func TestE2EVerifyBeforeDelete(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.VerifyBeforeDelete = true
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	_, err = client.UploadFile(context.Background(), config, writeFile(t, config, "verified", []byte("data")))
+	assert.Nil(t, err)
+	// Upload and HeadObject
+	assert.Equal(t, 2, server.Requests())
+
+	// Objects that are missing or differ from the uploaded file fail the upload
+	err = client.verifyUploaded(context.Background(), config, "backups/lost", 4)
+	assert.ErrorContains(t, err, "is missing in the bucket")
+	server.Store("bucket", "backups/truncated", []byte("da"))
+	err = client.verifyUploaded(context.Background(), config, "backups/truncated", 4)
+	assert.ErrorContains(t, err, "has 2 bytes instead of 4")
+}
+
+func TestE2EObjectLock(t *testing.T) {
+	server := s3mock.New("bucket", "locked")
+	defer server.Close()
+	server.EnableObjectLock("locked")
+	config := e2eConfig(t, server)
+	config.ObjectLockMode = awss3.ObjectLockModeCompliance
+	config.RetentionDays = 30
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	assert.ErrorContains(t, client.CheckObjectLock(context.Background(), config), "object lock is not enabled")
+
+	// Uploads with retention are refused by buckets without object lock
+	file := writeFile(t, config, "dump.sql", []byte("select 1;"))
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.NotNil(t, err)
+
+	config.S3bucket = "locked"
+	assert.Nil(t, client.CheckObjectLock(context.Background(), config))
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+
+	obj, ok := server.Object("locked", "backups/dump.sql")
+	assert.True(t, ok)
+	assert.Equal(t, awss3.ObjectLockModeCompliance, obj.LockMode)
+	assert.WithinDuration(t, time.Now().AddDate(0, 0, 30), obj.LockRetainUntil, time.Minute)
+}
+
+func TestE2EExpiryTag(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.ExpiryTagDays = 30
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	file := writeFile(t, config, "dump.sql", []byte("select 1;"))
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+	obj, ok := server.Object("bucket", "backups/dump.sql")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"expire-after": "30d"}, obj.Tags)
+
+	assert.ErrorContains(t, client.CheckLifecycle(context.Background(), config), "has no lifecycle rules")
+
+	rule := `<LifecycleConfiguration><Rule><ID>expire</ID><Status>Enabled</Status>
+		<Filter><Tag><Key>expire-after</Key><Value>30d</Value></Tag></Filter><Expiration><Days>%d</Days></Expiration>
+		</Rule></LifecycleConfiguration>`
+	server.SetLifecycle("bucket", fmt.Sprintf(rule, 7))
+	assert.ErrorContains(t, client.CheckLifecycle(context.Background(), config), "after 7 days")
+	server.SetLifecycle("bucket", fmt.Sprintf(rule, 30))
+	assert.Nil(t, client.CheckLifecycle(context.Background(), config))
+
+	config.ExpiryTagDays = 90
+	assert.ErrorContains(t, client.CheckLifecycle(context.Background(), config), "no enabled lifecycle rule")
+}
+
+func TestE2EHeartbeat(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+
+	// Heartbeat object is overwritten every time
+	assert.Nil(t, client.UploadHeartbeat(config, "heartbeats/node1.json", []byte(`{"uploaded":1}`)))
+	assert.Nil(t, client.UploadHeartbeat(config, "heartbeats/node1.json", []byte(`{"uploaded":2}`)))
+	obj, ok := server.Object("bucket", "backups/heartbeats/node1.json")
+	assert.True(t, ok)
+	assert.Equal(t, `{"uploaded":2}`, string(obj.Data))
+}
+
+func TestE2EChecksumSidecar(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.ChecksumSidecar = true
+	config.ExpiryTagDays = 7
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	file := writeFile(t, config, "dump.sql", []byte("select 1;"))
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+
+	// Sidecar is in sha256sum format and expires with the object
+	sum, err := fs.FileSHA256(file)
+	assert.Nil(t, err)
+	obj, ok := server.Object("bucket", "backups/dump.sql.sha256")
+	assert.True(t, ok)
+	assert.Equal(t, sum+"  dump.sql\n", string(obj.Data))
+	assert.Equal(t, map[string]string{"expire-after": "7d"}, obj.Tags)
+}
+
+// KMS that wraps data keys by prefixing them
+type fakeKMS struct {
+	kmsiface.KMSAPI
+}
+
+func (fakeKMS) GenerateDataKeyWithContext(ctx aws.Context, input *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	key := bytes.Repeat([]byte{7}, 32)
+	return &kms.GenerateDataKeyOutput{KeyId: input.KeyId, Plaintext: key, CiphertextBlob: append([]byte("wrapped:"), key...)}, nil
+}
+
+func (fakeKMS) DecryptWithContext(ctx aws.Context, input *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: bytes.TrimPrefix(input.CiphertextBlob, []byte("wrapped:"))}, nil
+}
+
+func TestE2EKMSEncryption(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	config := e2eConfig(t, server)
+	config.Encrypt = true
+	config.EncryptEngine = "kms"
+	config.EncryptDir = t.TempDir()
+	config.KMSKeyID = "alias/backups"
+	config.KMS = fakeKMS{}
+
+	data := []byte("select 1;")
+	file := writeFile(t, config, "dump.sql", data)
+	assert.Nil(t, fs.EncryptFile(context.Background(), config, file))
+
+	client, err := NewClient(config)
+	assert.Nil(t, err)
+	_, err = client.UploadFile(context.Background(), config, file)
+	assert.Nil(t, err)
+
+	// S3 encryption client decrypts the object with the envelope from metadata
+	sess, err := NewSession(config)
+	assert.Nil(t, err)
+	registry := s3crypto.NewCryptoRegistry()
+	assert.Nil(t, s3crypto.RegisterKMSContextWrapWithAnyCMK(registry, fakeKMS{}))
+	assert.Nil(t, s3crypto.RegisterAESGCMContentCipher(registry))
+	decrypter, err := s3crypto.NewDecryptionClientV2(sess, registry)
+	assert.Nil(t, err)
+	out, err := decrypter.GetObject(&awss3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("backups/dump.sql.kms")})
+	assert.Nil(t, err)
+	plaintext, err := io.ReadAll(out.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, data, plaintext)
+
+	assert.Nil(t, fs.DeleteTempFiles(config, file))
+
+	// Files over the cap are refused as they are encrypted in memory
+	config.KMSMaxFileSize = 4
+	err = fs.EncryptFile(context.Background(), config, file)
+	assert.ErrorIs(t, err, errclass.ErrPermanent)
+}
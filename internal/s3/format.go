@@ -0,0 +1,106 @@
+package s3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// FormatVersion is the version of the pipeline format (archive, compression, encryption, naming scheme) of uploaded
+// objects. Version 1 objects were uploaded before the format was stamped into metadata: tar+gzip, gpg symmetric,
+// legacy names. Version 2 objects have no archive in metadata, compressed ones are always tar archives.
+const FormatVersion = 3
+
+// Object naming schemes
+const (
+	NamingLegacy = "legacy"
+	NamingSuffix = "suffix"
+	NamingKeyID  = "key-id"
+)
+
+// Format describes how an uploaded object was produced
+type Format struct {
+	Version     int
+	Archive     string
+	Compression string
+	Encryption  string
+	Naming      string
+}
+
+// NewFormat returns format of an object uploaded with the current config
+func NewFormat(config cfg.AppConfig, filename string) Format {
+	format := Format{
+		Version:     FormatVersion,
+		Archive:     fs.FileArchive(config, filename),
+		Compression: fs.FileCompression(config, filename),
+		Encryption:  "none",
+		Naming:      NamingSuffix,
+	}
+
+	if config.Encrypt {
+		format.Encryption = config.EncryptEngine
+	}
+
+	if config.LegacyKeyNames {
+		format.Naming = NamingLegacy
+	} else if config.KeyIDInFilename {
+		format.Naming = NamingKeyID
+	}
+
+	return format
+}
+
+// Metadata returns S3 object metadata with the format
+func (f Format) Metadata() map[string]*string {
+	return map[string]*string{
+		"format-version": aws.String(strconv.Itoa(f.Version)),
+		"archive":        aws.String(f.Archive),
+		"compression":    aws.String(f.Compression),
+		"encryption":     aws.String(f.Encryption),
+		"naming":         aws.String(f.Naming),
+	}
+}
+
+// ParseFormat reads format from S3 object metadata. Objects without a format version are treated as version 1,
+// objects from a newer version of the tool are refused as we don't know how to restore them.
+func ParseFormat(metadata map[string]*string) (Format, error) {
+	// S3 returns canonicalized metadata keys, e.g. Format-Version
+	values := map[string]string{}
+	for k, v := range metadata {
+		values[strings.ToLower(k)] = aws.StringValue(v)
+	}
+
+	version, ok := values["format-version"]
+	if !ok {
+		return Format{Version: 1, Archive: fs.ArchiveTar, Compression: "gzip", Encryption: "gpg", Naming: NamingLegacy}, nil
+	}
+
+	format := Format{
+		Archive:     values["archive"],
+		Compression: values["compression"],
+		Encryption:  values["encryption"],
+		Naming:      values["naming"],
+	}
+
+	var err error
+	format.Version, err = strconv.Atoi(version)
+	if err != nil {
+		return Format{}, fmt.Errorf("invalid format version %q", version)
+	}
+	if format.Version > FormatVersion {
+		return Format{}, fmt.Errorf("object format version %d is newer than supported version %d, upgrade s3-file-uploader", format.Version, FormatVersion)
+	}
+	if format.Archive == "" {
+		format.Archive = fs.ArchiveTar
+		if format.Compression == "none" {
+			format.Archive = fs.ArchiveNone
+		}
+	}
+
+	return format, nil
+}
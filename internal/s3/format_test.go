@@ -0,0 +1,39 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	config := cfg.AppConfig{Gzip: true, Compression: "zstd", Encrypt: true, EncryptEngine: "age", KeyIDInFilename: true}
+	format := NewFormat(config, "/data/dump.sql")
+	assert.Equal(t, Format{Version: FormatVersion, Archive: "tar", Compression: "zstd", Encryption: "age", Naming: NamingKeyID}, format)
+
+	// S3 returns canonicalized metadata keys
+	metadata := format.Metadata()
+	metadata["Format-Version"] = metadata["format-version"]
+	delete(metadata, "format-version")
+	parsed, err := ParseFormat(metadata)
+	assert.Nil(t, err)
+	assert.Equal(t, format, parsed)
+
+	parsed, err = ParseFormat(map[string]*string{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, parsed.Version)
+
+	// Compressed version 2 objects are tar archives
+	parsed, err = ParseFormat(map[string]*string{"format-version": aws.String("2"), "compression": aws.String("gzip")})
+	assert.Nil(t, err)
+	assert.Equal(t, "tar", parsed.Archive)
+
+	config.Archive = "none"
+	assert.Equal(t, "none", NewFormat(config, "/data/dump.sql").Archive)
+
+	_, err = ParseFormat(map[string]*string{"format-version": aws.String("99")})
+	assert.NotNil(t, err)
+}
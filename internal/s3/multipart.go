@@ -0,0 +1,311 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/progress"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Resumable uploads are used for multipart uploads when the state is persisted. Every uploaded part is recorded
+// in the state, so an uploader restarted in the middle of a large file uploads only the missing parts.
+func resumable(config cfg.AppConfig, size int64) bool {
+	return config.State.Persistent() && size > partSize(config, size)
+}
+
+// Part size of a multipart upload, it's increased for huge files to fit into the S3 parts limit like the SDK does
+func partSize(config cfg.AppConfig, size int64) int64 {
+	partSize := config.S3PartSize
+	if partSize == 0 {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/s3manager.MaxUploadParts + 1
+	}
+	return partSize
+}
+
+// Number of parts of a file uploaded in parallel
+func concurrency(config cfg.AppConfig) int {
+	if config.S3Concurrency == 0 {
+		return s3manager.DefaultUploadConcurrency
+	}
+	return config.S3Concurrency
+}
+
+// Memory buffered by an upload. The SDK keeps up to concurrency+1 parts in memory when the body can't be read
+// at offsets, resumable uploads read every part being uploaded into memory.
+func bufferMemory(config cfg.AppConfig, size int64, buffered bool) int64 {
+	if !buffered {
+		return 0
+	}
+	return min(size, partSize(config, size)*int64(concurrency(config)+1))
+}
+
+// Upload realFile with a multipart upload resumed from the state if there is one
+func (client *Client) uploadResumable(ctx context.Context, config cfg.AppConfig, filename, realFile string, input *s3manager.UploadInput,
+	tracker *progress.Tracker) (*s3manager.UploadOutput, error) {
+	source, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	prepared, err := os.Stat(realFile)
+	if err != nil {
+		return nil, err
+	}
+	stateKey := fs.WatchedFileName(config, filename)
+
+	upload := fs.ResumableUpload(config, filename)
+	if upload != nil && upload.Key != aws.StringValue(input.Key) {
+		client.abortUpload(ctx, config, upload)
+		upload = nil
+	}
+	if upload != nil {
+		config.Applog.Infof("Resuming upload of %q, %d parts are already uploaded", filename, len(upload.Parts))
+		for _, part := range upload.Parts {
+			tracker.Skip(partLength(upload, part.Number))
+		}
+	} else {
+		if entry, ok := config.State.Get(stateKey); ok && entry.Upload != nil {
+			// The file was changed since the upload was started
+			client.abortUpload(ctx, config, entry.Upload)
+		}
+
+		created, err := client.Uploader.S3.CreateMultipartUploadWithContext(ctx, &awss3.CreateMultipartUploadInput{
+			Bucket:       input.Bucket,
+			Key:          input.Key,
+			Metadata:     input.Metadata,
+			StorageClass: input.StorageClass,
+			Tagging:      input.Tagging,
+
+			ObjectLockMode:            input.ObjectLockMode,
+			ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		})
+		if err != nil {
+			return nil, classify(err, fmt.Errorf("failed to start multipart upload: %s", err.Error()))
+		}
+		upload = &state.Upload{
+			Key:             aws.StringValue(input.Key),
+			UploadID:        aws.StringValue(created.UploadId),
+			Prepared:        realFile,
+			PreparedSize:    prepared.Size(),
+			PreparedModTime: prepared.ModTime(),
+			PartSize:        partSize(config, prepared.Size()),
+		}
+	}
+
+	// Parts are recorded by a single goroutine at a time, the state is saved after each of them. The key suffix of
+	// the file is kept.
+	var keySuffix string
+	if entry, ok := config.State.Get(stateKey); ok && entry.Matches(source) {
+		keySuffix = entry.KeySuffix
+	}
+	var mu sync.Mutex
+	record := func(part *state.Part) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if part != nil {
+			upload.Parts = append(upload.Parts, *part)
+		}
+		return config.State.Set(stateKey, state.Entry{
+			Status:    state.StatusUploading,
+			Size:      source.Size(),
+			ModTime:   source.ModTime(),
+			KeySuffix: keySuffix,
+			Upload:    upload,
+		})
+	}
+	if err := record(nil); err != nil {
+		return nil, err
+	}
+
+	if err := client.uploadParts(ctx, config, upload, record, tracker); err != nil {
+		if isNoSuchUpload(err) {
+			// The upload was aborted in S3, start over next time
+			config.State.DeleteUpload(stateKey)
+		}
+		return nil, classify(err, fmt.Errorf("failed to upload parts, %d of them are uploaded and kept for a retry: %s", len(upload.Parts), err.Error()))
+	}
+
+	parts := slices.Clone(upload.Parts)
+	slices.SortFunc(parts, func(a, b state.Part) int { return int(a.Number - b.Number) })
+	completed := []*awss3.CompletedPart{}
+	for _, part := range parts {
+		completed = append(completed, &awss3.CompletedPart{PartNumber: aws.Int64(part.Number), ETag: aws.String(part.ETag)})
+	}
+	result, err := client.Uploader.S3.CompleteMultipartUploadWithContext(ctx, &awss3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(upload.UploadID),
+		MultipartUpload: &awss3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		if isNoSuchUpload(err) {
+			config.State.DeleteUpload(stateKey)
+		}
+		return nil, classify(err, fmt.Errorf("failed to complete multipart upload: %s", err.Error()))
+	}
+
+	if err := config.State.DeleteUpload(stateKey); err != nil {
+		config.Applog.Errorf("Failed to forget completed upload of %q: %s", filename, err.Error())
+	}
+	return &s3manager.UploadOutput{Location: aws.StringValue(result.Location), ETag: result.ETag, UploadID: upload.UploadID}, nil
+}
+
+// Upload missing parts in parallel, the first error cancels the rest of them
+func (client *Client) uploadParts(ctx context.Context, config cfg.AppConfig, upload *state.Upload, record func(*state.Part) error,
+	tracker *progress.Tracker) error {
+	f, err := os.Open(upload.Prepared)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	uploaded := map[int64]bool{}
+	for _, part := range upload.Parts {
+		uploaded[part.Number] = true
+	}
+	numbers := make(chan int64)
+	go func() {
+		defer close(numbers)
+		for n := int64(1); (n-1)*upload.PartSize < upload.PreparedSize; n++ {
+			if !uploaded[n] {
+				numbers <- n
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for i := 0; i < concurrency(config); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range numbers {
+				if ctx.Err() != nil {
+					continue
+				}
+				part, err := client.uploadPart(ctx, config, upload, f, n)
+				if err == nil {
+					tracker.Add(partLength(upload, n))
+					err = record(part)
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Upload a single part, it's read into memory first so the rate limit applies once and the SDK can retry it
+func (client *Client) uploadPart(ctx context.Context, config cfg.AppConfig, upload *state.Upload, f *os.File, n int64) (*state.Part, error) {
+	var body io.Reader = io.NewSectionReader(f, (n-1)*upload.PartSize, partLength(upload, n))
+	if config.UploadLimiter != nil {
+		body = ratelimit.NewReader(body, config.UploadLimiter)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read part %d of %q: %s", n, upload.Prepared, err.Error())
+	}
+
+	result, err := client.Uploader.S3.UploadPartWithContext(ctx, &awss3.UploadPartInput{
+		Bucket:     aws.String(config.S3bucket),
+		Key:        aws.String(upload.Key),
+		UploadId:   aws.String(upload.UploadID),
+		PartNumber: aws.Int64(n),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &state.Part{Number: n, ETag: aws.StringValue(result.ETag)}, nil
+}
+
+// Size of the part n of an upload, the last one is shorter
+func partLength(upload *state.Upload, n int64) int64 {
+	offset := (n - 1) * upload.PartSize
+	return min(upload.PartSize, upload.PreparedSize-offset)
+}
+
+// Abort a multipart upload that can't be resumed, errors are only logged as stale uploads are cleaned up later
+func (client *Client) abortUpload(ctx context.Context, config cfg.AppConfig, upload *state.Upload) {
+	_, err := client.Uploader.S3.AbortMultipartUploadWithContext(ctx, &awss3.AbortMultipartUploadInput{
+		Bucket:   aws.String(config.S3bucket),
+		Key:      aws.String(upload.Key),
+		UploadId: aws.String(upload.UploadID),
+	})
+	if err != nil && !isNoSuchUpload(err) {
+		config.Applog.Warningf("Failed to abort multipart upload %q of %q: %s", upload.UploadID, upload.Key, err.Error())
+	}
+}
+
+// Check if an SDK error means the multipart upload doesn't exist anymore
+func isNoSuchUpload(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == awss3.ErrCodeNoSuchUpload
+}
+
+// AbortStaleUploads aborts multipart uploads under the S3 path that were started before olderThan ago and
+// can't be resumed from the state. Parts of abandoned uploads are stored and billed until they are aborted.
+func (client *Client) AbortStaleUploads(ctx context.Context, config cfg.AppConfig, olderThan time.Duration) (int, error) {
+	resumable := config.State.UploadIDs()
+	prefix := strings.TrimPrefix(config.S3path, "/")
+	deadline := time.Now().Add(-olderThan)
+
+	stale := []*awss3.MultipartUpload{}
+	err := client.Uploader.S3.ListMultipartUploadsPagesWithContext(ctx, &awss3.ListMultipartUploadsInput{
+		Bucket: aws.String(config.S3bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *awss3.ListMultipartUploadsOutput, last bool) bool {
+		for _, upload := range page.Uploads {
+			if !resumable[aws.StringValue(upload.UploadId)] && aws.TimeValue(upload.Initiated).Before(deadline) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list multipart uploads: %s", err.Error())
+	}
+
+	aborted := 0
+	for _, upload := range stale {
+		_, err := client.Uploader.S3.AbortMultipartUploadWithContext(ctx, &awss3.AbortMultipartUploadInput{
+			Bucket:   aws.String(config.S3bucket),
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if err != nil && !isNoSuchUpload(err) {
+			return aborted, fmt.Errorf("failed to abort multipart upload %q of %q: %s", aws.StringValue(upload.UploadId),
+				aws.StringValue(upload.Key), err.Error())
+		}
+		aborted++
+	}
+	return aborted, nil
+}
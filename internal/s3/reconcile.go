@@ -0,0 +1,67 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Mismatch is an uploaded object that is missing in the bucket or differs from the uploaded file
+type Mismatch struct {
+	Key    string
+	Source string
+	Reason string
+}
+
+// Reconcile checks that objects uploaded within the reconcile window are still in the bucket with the same size
+// and ETag. It returns the number of verified objects and mismatches, objects that can't be checked because of
+// request errors are checked again next time.
+func (client *Client) Reconcile(ctx context.Context, config cfg.AppConfig) (int, []Mismatch, error) {
+	objects := config.State.Objects()
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	verified := 0
+	mismatches := []Mismatch{}
+	for _, key := range keys {
+		object := objects[key]
+		// Objects recorded before routes were supported are in the default bucket
+		bucket := object.Bucket
+		if bucket == "" {
+			bucket = config.S3bucket
+		}
+		head, err := client.Uploader.S3.HeadObjectWithContext(ctx, &awss3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+			mismatches = append(mismatches, Mismatch{Key: key, Source: object.Source, Reason: "object is missing"})
+			continue
+		}
+		if err != nil {
+			return verified, mismatches, fmt.Errorf("failed to check object %q: %s", key, err.Error())
+		}
+
+		switch {
+		case aws.Int64Value(head.ContentLength) != object.Size:
+			mismatches = append(mismatches, Mismatch{Key: key, Source: object.Source,
+				Reason: fmt.Sprintf("size is %d instead of %d", aws.Int64Value(head.ContentLength), object.Size)})
+		case object.ETag != "" && aws.StringValue(head.ETag) != object.ETag:
+			mismatches = append(mismatches, Mismatch{Key: key, Source: object.Source,
+				Reason: fmt.Sprintf("ETag is %s instead of %s", aws.StringValue(head.ETag), object.ETag)})
+		default:
+			verified++
+		}
+	}
+	return verified, mismatches, nil
+}
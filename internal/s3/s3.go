@@ -1,18 +1,38 @@
 package s3
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
+	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/dryrun"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+	"github.com/impossiblecloud/s3-file-uploader/internal/features"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/manifest"
+	"github.com/impossiblecloud/s3-file-uploader/internal/progress"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
 	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
@@ -22,23 +42,8 @@ import (
 type Client struct {
 	Session  *session.Session
 	Uploader *s3manager.Uploader
-}
-
-func getRealSourceFileName(config cfg.AppConfig, filename string) string {
-	file := filepath.Base(filename)
-	gzipFile := filepath.Join(config.GzipDir, file+".tgz")
-	encFile := filepath.Join(config.EncryptDir, file+".tgz")
-	realFile := filename
-
-	if config.Gzip {
-		realFile = gzipFile
-	}
-
-	if config.Encrypt {
-		realFile = encFile
-	}
-
-	return realFile
+	// S3 is the service client of Uploader, reused by bucket checks
+	S3 *awss3.S3
 }
 
 func copy(src, dst string) (int64, error) {
@@ -66,9 +71,12 @@ func copy(src, dst string) (int64, error) {
 	return nBytes, err
 }
 
-// FakeUploadFile is used for testing
-func FakeUploadFile(config cfg.AppConfig, filename string) (int64, error) {
-	realFile := getRealSourceFileName(config, filename)
+// FakeUploadFile is used for testing, files are added to the dry-run report
+func FakeUploadFile(ctx context.Context, config cfg.AppConfig, filename string) (int64, error) {
+	realFile := fs.PreparedFileName(config, filename)
+	if config.DryRunSkipPipeline {
+		realFile = filename
+	}
 
 	fi, err := os.Stat(realFile)
 	if err != nil {
@@ -76,9 +84,30 @@ func FakeUploadFile(config cfg.AppConfig, filename string) (int64, error) {
 		return 0, err
 	}
 
-	// Simulate random upload time by sleeping for a random duration
+	source, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	key, err := fs.ObjectKey(config, filename, fs.PreparedFileName(config, filename))
+	if err != nil {
+		return 0, err
+	}
+
+	// Simulate random upload time by sleeping for a random duration, cancelled uploads are not reported
 	sleepSec := rand.IntN(10) + 5
-	time.Sleep(time.Duration(sleepSec) * time.Second)
+	select {
+	case <-time.After(time.Duration(sleepSec) * time.Second):
+	case <-ctx.Done():
+		return 0, fmt.Errorf("fake upload of %q cancelled: %s", filename, ctx.Err().Error())
+	}
+
+	config.DryRunReport.Add(dryrun.Entry{
+		Source:       fs.WatchedFileName(config, filename),
+		Key:          key,
+		Size:         source.Size(),
+		UploadSize:   fi.Size(),
+		StorageClass: fs.StorageClass(config, filename),
+	})
 
 	config.Applog.Infof("FAKE UPLOAD TO S3: %q file, size %s", realFile, utils.HumanizeBytes(fi.Size(), false))
 	return fi.Size(), nil
@@ -86,7 +115,7 @@ func FakeUploadFile(config cfg.AppConfig, filename string) (int64, error) {
 
 // CopyFile is used for testing, it copies to /var/tmp
 func CopyFile(config cfg.AppConfig, filename string) (int64, error) {
-	realFile := getRealSourceFileName(config, filename)
+	realFile := fs.PreparedFileName(config, filename)
 
 	fi, err := os.Stat(realFile)
 	if err != nil {
@@ -107,32 +136,302 @@ func CopyFile(config cfg.AppConfig, filename string) (int64, error) {
 	return fi.Size(), nil
 }
 
+// NewSession creates an AWS session, a custom endpoint is used with path-style addressing for S3-compatible storage.
+// Requests are retried with a longer backoff when S3 asks to slow down, throttled responses are counted in metrics.
+func NewSession(config cfg.AppConfig) (*session.Session, error) {
+	awsConfig := aws.NewConfig()
+	if config.S3Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(config.S3Endpoint).WithS3ForcePathStyle(true)
+	}
+	// Accelerated and dual-stack endpoints are resolved by the SDK for the bucket region
+	if config.S3Accelerate {
+		awsConfig = awsConfig.WithS3UseAccelerate(true)
+	}
+	if config.S3DualStack {
+		awsConfig.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+	}
+	if config.S3UseFIPS {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+
+	retryer := awsclient.DefaultRetryer{
+		NumMaxRetries:    config.S3MaxRetries,
+		MinThrottleDelay: config.S3SlowDownDelay,
+		MaxThrottleDelay: config.S3SlowDownMax,
+	}
+	if retryer.NumMaxRetries < 0 {
+		retryer.NumMaxRetries = awsclient.DefaultRetryerMaxNumRetries
+	}
+	awsConfig.Retryer = retryer
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	// Requests to requester-pays buckets are refused unless the requester agrees to pay for them. The session is
+	// shared with KMS, SQS and other clients, so only S3 requests get the header.
+	if config.S3RequesterPays {
+		sess.Handlers.Build.PushBack(func(r *request.Request) {
+			if r.ClientInfo.ServiceName == awss3.ServiceName {
+				r.HTTPRequest.Header.Set("X-Amz-Request-Payer", awss3.RequestPayerRequester)
+			}
+		})
+	}
+	sess.Handlers.CompleteAttempt.PushBack(func(r *request.Request) {
+		if r.Error != nil && r.IsErrorThrottle() && config.Metrics.S3Throttled != nil {
+			config.Metrics.S3Throttled.WithLabelValues(r.Operation.Name).Inc()
+		}
+	})
+	return sess, nil
+}
+
+// IsThrottled checks if a request failed because S3 asked to slow down and retries were exhausted
+func IsThrottled(err error) bool {
+	for err != nil {
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		if aerr.Code() == "SlowDown" || request.IsErrorThrottle(aerr) {
+			return true
+		}
+		if failure, ok := aerr.(awserr.RequestFailure); ok {
+			switch failure.StatusCode() {
+			case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+				return true
+			}
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
+
+// S3 error codes of failures retries won't fix, configuration errors fail every file
+var (
+	configErrorCodes = map[string]bool{
+		"AccessDenied":                 true,
+		"AllAccessDisabled":            true,
+		"AuthorizationHeaderMalformed": true,
+		"InvalidAccessKeyId":           true,
+		"InvalidBucketName":            true,
+		"NoCredentialProviders":        true,
+		"NoSuchBucket":                 true,
+		"PermanentRedirect":            true,
+		"SignatureDoesNotMatch":        true,
+	}
+	permanentErrorCodes = map[string]bool{
+		"EntityTooLarge":  true,
+		"KeyTooLongError": true,
+	}
+)
+
+// classify marks err with the class of the S3 error cause, errors with other codes keep the class of cause
+func classify(cause, err error) error {
+	var aerr awserr.Error
+	if !errors.As(cause, &aerr) {
+		return errclass.Inherit(err, cause)
+	}
+	for e := error(aerr); e != nil; {
+		next, ok := e.(awserr.Error)
+		if !ok {
+			break
+		}
+		switch {
+		case configErrorCodes[next.Code()]:
+			return errclass.Config(err)
+		case permanentErrorCodes[next.Code()]:
+			return errclass.Permanent(err)
+		}
+		e = next.OrigErr()
+	}
+	return errclass.Inherit(err, cause)
+}
+
 // NewClient initializes a new s3 client
 func NewClient(config cfg.AppConfig) (*Client, error) {
 
 	// The session the S3 Uploader will use
-	session := session.Must(session.NewSession())
+	session, err := NewSession(config)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create an uploader with the session and default options
-	uploader := s3manager.NewUploader(session)
+	// Create an uploader with a service client of the session, multipart options default to SDK values
+	service := awss3.New(session)
+	uploader := s3manager.NewUploaderWithClient(service, func(u *s3manager.Uploader) {
+		if config.S3PartSize > 0 {
+			u.PartSize = config.S3PartSize
+		}
+		if config.S3Concurrency > 0 {
+			u.Concurrency = config.S3Concurrency
+		}
+	})
 
 	client := Client{
 		Session:  session,
 		Uploader: uploader,
+		S3:       service,
 	}
 
 	return &client, nil
 }
 
+// ValidateRegion checks that the region of the session is known to the SDK when FIPS endpoints are required or the
+// region is in the GovCloud partition, where a mistyped region silently resolves to an endpoint that doesn't exist.
+// It returns the resolved S3 endpoint, empty when the region isn't checked.
+func ValidateRegion(config cfg.AppConfig) (string, error) {
+	sess, err := NewSession(config)
+	if err != nil {
+		return "", err
+	}
+	region := aws.StringValue(sess.Config.Region)
+	if !config.S3UseFIPS && !strings.HasPrefix(region, "us-gov-") {
+		return "", nil
+	}
+	if region == "" {
+		return "", fmt.Errorf("AWS region is not set, it's required for FIPS endpoints")
+	}
+
+	partition, ok := endpoints.PartitionForRegion(endpoints.DefaultPartitions(), region)
+	if !ok {
+		return "", fmt.Errorf("unknown AWS region %q", region)
+	}
+	if _, known := partition.Regions()[region]; !known {
+		return "", fmt.Errorf("unknown AWS region %q in partition %s", region, partition.ID())
+	}
+	resolved, err := partition.EndpointFor(awss3.EndpointsID, region, endpoints.StrictMatchingOption, func(o *endpoints.Options) {
+		if config.S3UseFIPS {
+			o.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+		}
+		if config.S3DualStack {
+			o.UseDualStackEndpoint = endpoints.DualStackEndpointStateEnabled
+		}
+	})
+	if err != nil {
+		return "", fmt.Errorf("S3 has no such endpoint in region %q of partition %s: %s", region, partition.ID(), err.Error())
+	}
+	return resolved.URL, nil
+}
+
+// ValidateStorageClass checks that S3 supports the storage class, empty class means the bucket default
+func ValidateStorageClass(class string) error {
+	if class != "" && !slices.Contains(awss3.StorageClass_Values(), class) {
+		return fmt.Errorf("unsupported S3 storage class %q, must be one of: %s", class, strings.Join(awss3.StorageClass_Values(), ", "))
+	}
+	return nil
+}
+
+// ValidatePartSize checks multipart upload part size, zero means the SDK default
+func ValidatePartSize(size int64) error {
+	if size != 0 && size < s3manager.MinUploadPartSize {
+		return fmt.Errorf("S3 part size must be at least %s", utils.HumanizeBytes(s3manager.MinUploadPartSize, false))
+	}
+	return nil
+}
+
+// ValidateObjectLockMode checks the object lock mode of uploaded objects, empty mode means no retention
+func ValidateObjectLockMode(mode string) error {
+	if mode != "" && !slices.Contains(awss3.ObjectLockMode_Values(), mode) {
+		return fmt.Errorf("unsupported object lock mode %q, must be one of: %s", mode, strings.Join(awss3.ObjectLockMode_Values(), ", "))
+	}
+	return nil
+}
+
+// CheckObjectLock checks that object lock is enabled on the bucket, uploads with retention fail otherwise
+func (client *Client) CheckObjectLock(ctx context.Context, config cfg.AppConfig) error {
+	result, err := client.S3.GetObjectLockConfigurationWithContext(ctx, &awss3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(config.S3bucket),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ObjectLockConfigurationNotFoundError" {
+		return fmt.Errorf("object lock is not enabled on bucket %q", config.S3bucket)
+	}
+	if err != nil {
+		return err
+	}
+	if result.ObjectLockConfiguration == nil || aws.StringValue(result.ObjectLockConfiguration.ObjectLockEnabled) != awss3.ObjectLockEnabledEnabled {
+		return fmt.Errorf("object lock is not enabled on bucket %q", config.S3bucket)
+	}
+	return nil
+}
+
+// ExpiryTagKey is the tag bucket lifecycle rules match to expire uploaded objects
+const ExpiryTagKey = "expire-after"
+
+// ExpiryTagValue returns the expiry tag value for the number of days, e.g. 30d
+func ExpiryTagValue(days int) string {
+	return fmt.Sprintf("%dd", days)
+}
+
+// CheckLifecycle checks that an enabled lifecycle rule of the bucket expires objects with the expiry tag
+// after the same number of days
+func (client *Client) CheckLifecycle(ctx context.Context, config cfg.AppConfig) error {
+	result, err := client.S3.GetBucketLifecycleConfigurationWithContext(ctx, &awss3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(config.S3bucket),
+	})
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchLifecycleConfiguration" {
+		return fmt.Errorf("bucket %q has no lifecycle rules", config.S3bucket)
+	}
+	if err != nil {
+		return err
+	}
+
+	value := ExpiryTagValue(config.ExpiryTagDays)
+	for _, rule := range result.Rules {
+		if aws.StringValue(rule.Status) != awss3.ExpirationStatusEnabled || rule.Expiration == nil || rule.Filter == nil {
+			continue
+		}
+		tags := []*awss3.Tag{rule.Filter.Tag}
+		if rule.Filter.And != nil {
+			tags = rule.Filter.And.Tags
+		}
+		for _, tag := range tags {
+			if tag == nil || aws.StringValue(tag.Key) != ExpiryTagKey || aws.StringValue(tag.Value) != value {
+				continue
+			}
+			if days := aws.Int64Value(rule.Expiration.Days); days != int64(config.ExpiryTagDays) {
+				return fmt.Errorf("lifecycle rule %q of bucket %q expires objects tagged %s=%s after %d days", aws.StringValue(rule.ID),
+					config.S3bucket, ExpiryTagKey, value, days)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("bucket %q has no enabled lifecycle rule expiring objects tagged %s=%s", config.S3bucket, ExpiryTagKey, value)
+}
+
+// Retention date of uploaded objects, either fixed or -retention-days from now
+func retainUntil(config cfg.AppConfig) *time.Time {
+	if config.RetentionDays > 0 {
+		return aws.Time(time.Now().AddDate(0, 0, config.RetentionDays).UTC())
+	}
+	return aws.Time(config.RetainUntil.UTC())
+}
+
+// CheckBucket checks that the bucket exists and is accessible with the configured credentials
+func (client *Client) CheckBucket(ctx context.Context, config cfg.AppConfig) error {
+	_, err := client.S3.HeadBucketWithContext(ctx, &awss3.HeadBucketInput{
+		Bucket: aws.String(config.S3bucket),
+	})
+	return err
+}
+
 // Close closes s3 client
 func (client *Client) Close() {
 	// Nothing to do here yet
 }
 
 // UploadFile uploads a file to s3
-func (client *Client) UploadFile(config cfg.AppConfig, filename string) (int64, error) {
-	realFile := getRealSourceFileName(config, filename)
+func (client *Client) UploadFile(ctx context.Context, config cfg.AppConfig, filename string) (int64, error) {
+	realFile := fs.PreparedFileName(config, filename)
 
+	key, err := fs.ObjectKey(config, filename, realFile)
+	if err != nil {
+		return 0, err
+	}
+	return client.UploadPrepared(ctx, config, filename, realFile, key)
+}
+
+// UploadPrepared uploads realFile prepared from the filename source file to the key, the upload is aborted when ctx is done
+func (client *Client) UploadPrepared(ctx context.Context, config cfg.AppConfig, filename, realFile, key string) (int64, error) {
 	fi, err := os.Stat(realFile)
 	if err != nil {
 		config.Applog.Error(err)
@@ -145,16 +444,302 @@ func (client *Client) UploadFile(config cfg.AppConfig, filename string) (int64,
 	}
 	defer f.Close()
 
+	// Throttle reading from the file if upload rate is limited
+	var body io.Reader = f
+	if config.UploadLimiter != nil {
+		body = ratelimit.NewReader(f, config.UploadLimiter)
+	}
+
+	metadata := NewFormat(config, filename).Metadata()
+	if config.Encrypt && config.EncryptionKeyID != "" {
+		metadata["encryption-key-id"] = aws.String(config.EncryptionKeyID)
+	}
+	// S3 encryption clients find the wrapped data key in the envelope
+	if config.Encrypt && config.EncryptEngine == "kms" {
+		envelope, err := fs.KMSEnvelope(config, filename)
+		if err != nil {
+			return 0, err
+		}
+		for name, value := range envelope {
+			metadata[name] = aws.String(value)
+		}
+	}
+
 	// Upload the file to S3.
-	key := fmt.Sprintf("%s/%s", config.S3path, filepath.Base(realFile))
-	result, err := client.Uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(config.S3bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: metadata,
+	}
+	if storageClass := fs.StorageClass(config, filename); storageClass != "" {
+		input.StorageClass = aws.String(storageClass)
+	}
+	if config.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(config.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = retainUntil(config)
+	}
+	if config.ExpiryTagDays > 0 {
+		input.Tagging = aws.String(url.Values{ExpiryTagKey: {ExpiryTagValue(config.ExpiryTagDays)}}.Encode())
+	}
+	// Wait for memory of buffered parts to be available within the budget shared by all workers
+	resume := resumable(config, fi.Size())
+	reserved, err := config.BufferBudget.Acquire(ctx, bufferMemory(config, fi.Size(), resume))
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for upload buffer memory: %s", err.Error())
+	}
+	defer config.BufferBudget.Release(reserved)
+
+	tracker := progress.Start(config.Progress, realFile, fi.Size())
+	defer tracker.Stop()
+
+	var result *s3manager.UploadOutput
+	if resume {
+		result, err = client.uploadResumable(ctx, config, filename, realFile, input, tracker)
+	} else {
+		result, err = client.Uploader.UploadWithContext(ctx, input, trackParts(tracker))
+	}
+	if IsThrottled(err) {
+		return 0, fmt.Errorf("failed to upload file, S3 is throttling requests and retries are exhausted: %v", err)
+	}
+	if err != nil {
+		return 0, classify(err, fmt.Errorf("failed to upload file, %v", err))
+	}
+	config.Applog.Infof("File uploaded to: %s\n", result.Location)
+
+	// The source is deleted after the upload, make sure the bucket really has the object first
+	if config.VerifyBeforeDelete && config.Features.Bool(features.VerifyEnabled) {
+		if err := client.verifyUploaded(ctx, config, key, fi.Size()); err != nil {
+			return 0, err
+		}
+	}
+
+	if config.ChecksumSidecar {
+		if err := client.uploadChecksum(ctx, config, filename, input); err != nil {
+			return 0, err
+		}
+	}
+
+	// Every record sweeps and saves the objects journal, it's kept only when the reconciler reads it
+	if config.ReconcileInterval > 0 && config.ReconcileWindow > 0 && config.State != nil {
+		now := time.Now()
+		err := config.State.AddObject(key, state.Object{
+			Bucket:     config.S3bucket,
+			Source:     fs.WatchedFileName(config, filename),
+			Size:       fi.Size(),
+			ETag:       aws.StringValue(result.ETag),
+			UploadedAt: now,
+		}, now.Add(-config.ReconcileWindow))
+		if err != nil {
+			config.Applog.Errorf("Failed to record uploaded %q for reconciliation: %s", key, err.Error())
+		}
+	}
+
+	if config.Manifest != nil {
+		if err := addManifestEntry(config, filename, realFile, key, fi.Size()); err != nil {
+			config.Applog.Errorf("Failed to add %q to the upload manifest: %s", filename, err.Error())
+		}
+	}
+	return fi.Size(), nil
+}
+
+// UploadStream uploads a stream of unknown size prepared from the filename source to the key. Parts are buffered
+// in memory as they are read, so the stream can't be larger than 10000 parts of -s3-part-size.
+func (client *Client) UploadStream(ctx context.Context, config cfg.AppConfig, filename, key string, stream io.Reader) (int64, error) {
+	counter := &countingReader{r: stream}
+	var body io.Reader = counter
+	if config.UploadLimiter != nil {
+		body = ratelimit.NewReader(body, config.UploadLimiter)
+	}
+
+	metadata := NewFormat(config, filename).Metadata()
+	if config.Encrypt && config.EncryptionKeyID != "" {
+		metadata["encryption-key-id"] = aws.String(config.EncryptionKeyID)
+	}
+
+	input := &s3manager.UploadInput{
+		Bucket:   aws.String(config.S3bucket),
+		Key:      aws.String(key),
+		Body:     body,
+		Metadata: metadata,
+	}
+	if config.StorageClass != "" {
+		input.StorageClass = aws.String(config.StorageClass)
+	}
+	if config.ObjectLockMode != "" {
+		input.ObjectLockMode = aws.String(config.ObjectLockMode)
+		input.ObjectLockRetainUntilDate = retainUntil(config)
+	}
+	if config.ExpiryTagDays > 0 {
+		input.Tagging = aws.String(url.Values{ExpiryTagKey: {ExpiryTagValue(config.ExpiryTagDays)}}.Encode())
+	}
+	reserved, err := config.BufferBudget.Acquire(ctx, partSize(config, 0)*int64(concurrency(config)+1))
+	if err != nil {
+		return 0, fmt.Errorf("failed to wait for upload buffer memory: %s", err.Error())
+	}
+	defer config.BufferBudget.Release(reserved)
+
+	result, err := client.Uploader.UploadWithContext(ctx, input)
+	if IsThrottled(err) {
+		return 0, fmt.Errorf("failed to upload stream, S3 is throttling requests and retries are exhausted: %v", err)
+	}
+	if err != nil {
+		return 0, classify(err, fmt.Errorf("failed to upload stream, %v", err))
+	}
+	config.Applog.Infof("Stream uploaded to: %s\n", result.Location)
+	return counter.n, nil
+}
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Upload checksum of the source file next to the object, it's retained and expires with the object
+func (client *Client) uploadChecksum(ctx context.Context, config cfg.AppConfig, filename string, input *s3manager.UploadInput) error {
+	body, err := fs.ChecksumSidecar(config, filename)
+	if err != nil {
+		return fmt.Errorf("failed to checksum %q: %s", filename, err.Error())
+	}
+
+	_, err = client.Uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket:                    input.Bucket,
+		Key:                       aws.String(aws.StringValue(input.Key) + fs.ChecksumSuffix),
+		Body:                      bytes.NewReader(body),
+		ContentType:               aws.String("text/plain"),
+		ObjectLockMode:            input.ObjectLockMode,
+		ObjectLockRetainUntilDate: input.ObjectLockRetainUntilDate,
+		Tagging:                   input.Tagging,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload checksum, %v", err)
+	}
+	return nil
+}
+
+// verifyUploaded checks with HeadObject that the uploaded object exists and has the size of the uploaded file
+func (client *Client) verifyUploaded(ctx context.Context, config cfg.AppConfig, key string, size int64) error {
+	head, err := client.Uploader.S3.HeadObjectWithContext(ctx, &awss3.HeadObjectInput{
 		Bucket: aws.String(config.S3bucket),
 		Key:    aws.String(key),
-		Body:   f,
 	})
+	if failure, ok := err.(awserr.RequestFailure); ok && failure.StatusCode() == http.StatusNotFound {
+		return fmt.Errorf("uploaded object %q is missing in the bucket", key)
+	}
 	if err != nil {
-		return 0, fmt.Errorf("failed to upload file, %v", err)
+		return fmt.Errorf("failed to verify uploaded object %q: %s", key, err.Error())
 	}
-	config.Applog.Infof("File uploaded to: %s\n", aws.StringValue(&result.Location))
-	return fi.Size(), nil
+	if aws.Int64Value(head.ContentLength) != size {
+		return fmt.Errorf("uploaded object %q has %d bytes instead of %d", key, aws.Int64Value(head.ContentLength), size)
+	}
+	return nil
+}
+
+// Count bytes of uploaded parts, the body isn't wrapped as the SDK reads seekable bodies at offsets and more than once
+func trackParts(tracker *progress.Tracker) func(*s3manager.Uploader) {
+	return func(u *s3manager.Uploader) {
+		if tracker == nil {
+			return
+		}
+		// The uploader is a copy, but its options may share the backing array with the client's uploader
+		u.RequestOptions = append(u.RequestOptions[:len(u.RequestOptions):len(u.RequestOptions)], func(r *request.Request) {
+			r.Handlers.Complete.PushBack(func(r *request.Request) {
+				if r.Error == nil && (r.Operation.Name == "PutObject" || r.Operation.Name == "UploadPart") {
+					tracker.Add(r.HTTPRequest.ContentLength)
+				}
+			})
+		})
+	}
+}
+
+// Add an uploaded file to the upload manifest
+func addManifestEntry(config cfg.AppConfig, filename, realFile, key string, uploadedSize int64) error {
+	source, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	checksum, err := fs.FileSHA256(realFile)
+	if err != nil {
+		return err
+	}
+
+	format := NewFormat(config, filename)
+	entry := manifest.Entry{
+		Key:          key,
+		Source:       fs.WatchedFileName(config, filename),
+		Size:         source.Size(),
+		UploadedSize: uploadedSize,
+		SHA256:       checksum,
+		Compression:  format.Compression,
+		Encryption:   format.Encryption,
+		KeyShard:     fs.KeyShardScheme(config, key),
+		UploadedAt:   time.Now(),
+	}
+	if config.Encrypt {
+		entry.EncryptionKeyID = config.EncryptionKeyID
+	}
+
+	return config.Manifest.Add(entry)
+}
+
+// UploadManifest writes collected manifest entries to the bucket, entries are kept for the next attempt on failure
+func (client *Client) UploadManifest(config cfg.AppConfig) error {
+	entries, err := config.Manifest.Take()
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	body, err := config.Manifest.Encode(entries)
+	if err != nil {
+		restoreManifest(config, entries)
+		return err
+	}
+
+	name := fmt.Sprintf("%s-%s.%s", time.Now().UTC().Format("20060102T150405Z"), config.InstanceID, config.Manifest.Format)
+	key := fmt.Sprintf("%s/%s/%s", config.S3path, config.ManifestPrefix, name)
+
+	_, err = client.Uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(config.S3bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(body),
+	})
+	if err != nil {
+		restoreManifest(config, entries)
+		return fmt.Errorf("failed to upload manifest, %v", err)
+	}
+
+	config.Applog.Infof("Upload manifest with %d files written to %s", len(entries), key)
+	if err := config.Manifest.Commit(); err != nil {
+		config.Applog.Errorf("Failed to remove written entries from the manifest spool, they are written again: %s", err.Error())
+	}
+	return nil
+}
+
+// Put back manifest entries that failed to be written
+func restoreManifest(config cfg.AppConfig, entries []manifest.Entry) {
+	if dropped := config.Manifest.Restore(entries); dropped > 0 {
+		config.Applog.Warningf("Too many upload manifest entries are waiting to be written, %d oldest ones are dropped", dropped)
+	}
+}
+
+// UploadHeartbeat writes the status JSON to the key under the S3 path, the object is overwritten every time
+func (client *Client) UploadHeartbeat(config cfg.AppConfig, key string, body []byte) error {
+	_, err := client.Uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(config.S3bucket),
+		Key:         aws.String(fmt.Sprintf("%s/%s", config.S3path, key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload heartbeat, %v", err)
+	}
+	return nil
 }
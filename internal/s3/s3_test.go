@@ -0,0 +1,110 @@
+package s3
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/kms"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionEndpoints(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	for _, tc := range []struct {
+		config cfg.AppConfig
+		host   string
+	}{
+		{cfg.AppConfig{}, "bucket.s3.eu-west-1.amazonaws.com"},
+		{cfg.AppConfig{S3Accelerate: true}, "bucket.s3-accelerate.amazonaws.com"},
+		{cfg.AppConfig{S3DualStack: true}, "bucket.s3.dualstack.eu-west-1.amazonaws.com"},
+		{cfg.AppConfig{S3Accelerate: true, S3DualStack: true}, "bucket.s3-accelerate.dualstack.amazonaws.com"},
+	} {
+		sess, err := NewSession(tc.config)
+		assert.Nil(t, err)
+		req, _ := awss3.New(sess).PutObjectRequest(&awss3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+		assert.Nil(t, req.Build())
+		assert.Equal(t, tc.host, req.HTTPRequest.URL.Host)
+	}
+}
+
+func TestValidateRegion(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+
+	t.Setenv("AWS_REGION", "eu-west-1")
+	endpoint, err := ValidateRegion(cfg.AppConfig{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", endpoint)
+
+	t.Setenv("AWS_REGION", "us-gov-west-1")
+	endpoint, err = ValidateRegion(cfg.AppConfig{S3UseFIPS: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://s3-fips.us-gov-west-1.amazonaws.com", endpoint)
+
+	sess, err := NewSession(cfg.AppConfig{S3UseFIPS: true})
+	assert.Nil(t, err)
+	req, _ := awss3.New(sess).PutObjectRequest(&awss3.PutObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+	assert.Nil(t, req.Build())
+	assert.Equal(t, "bucket.s3-fips.us-gov-west-1.amazonaws.com", req.HTTPRequest.URL.Host)
+
+	t.Setenv("AWS_REGION", "us-gov-west1")
+	_, err = ValidateRegion(cfg.AppConfig{})
+	assert.ErrorContains(t, err, "unknown AWS region")
+}
+
+func TestRequesterPays(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	for _, requesterPays := range []bool{false, true} {
+		sess, err := NewSession(cfg.AppConfig{S3RequesterPays: requesterPays})
+		assert.Nil(t, err)
+		req, _ := awss3.New(sess).HeadObjectRequest(&awss3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("key")})
+		assert.Nil(t, req.Build())
+		assert.Equal(t, requesterPays, req.HTTPRequest.Header.Get("X-Amz-Request-Payer") == "requester")
+
+		// Other services sharing the session don't get the header
+		kmsReq, _ := kms.New(sess).DescribeKeyRequest(&kms.DescribeKeyInput{KeyId: aws.String("key")})
+		assert.Nil(t, kmsReq.Build())
+		assert.Equal(t, "", kmsReq.HTTPRequest.Header.Get("X-Amz-Request-Payer"))
+	}
+}
+
+func TestMaxRetries(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "eu-west-1")
+
+	// 0 disables retries, negative keeps the SDK default
+	for retries, expected := range map[int]int{-1: awsclient.DefaultRetryerMaxNumRetries, 0: 0, 5: 5} {
+		sess, err := NewSession(cfg.AppConfig{S3MaxRetries: retries})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, sess.Config.Retryer.(awsclient.DefaultRetryer).MaxRetries())
+	}
+}
+
+func TestClassify(t *testing.T) {
+	// Multipart upload failures keep the S3 error as their cause
+	cause := awserr.New("MultipartUpload", "upload multipart failed", awserr.New("NoSuchBucket", "The specified bucket does not exist", nil))
+	err := classify(cause, fmt.Errorf("failed to upload file, %v", cause))
+	assert.Equal(t, errclass.ClassConfig, errclass.Class(err))
+	assert.ErrorContains(t, err, "NoSuchBucket")
+
+	cause = awserr.NewRequestFailure(awserr.New("EntityTooLarge", "Your proposed upload exceeds the maximum allowed size", nil), 400, "id")
+	assert.Equal(t, errclass.ClassPermanent, errclass.Class(classify(cause, errors.New("failed"))))
+
+	cause = awserr.New("RequestError", "send request failed", errors.New("connection reset by peer"))
+	assert.Equal(t, errclass.ClassTransient, errclass.Class(classify(cause, errors.New("failed"))))
+}
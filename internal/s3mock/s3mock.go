@@ -0,0 +1,549 @@
+// Package s3mock is an in-memory S3 compatible server for tests. It supports path-style bucket addressing,
+// PutObject, multipart uploads, GetObject, HeadObject, DeleteObject, HeadBucket, ListMultipartUploads and
+// GetObjectLockConfiguration and GetBucketLifecycleConfiguration, stores object tags, checks Content-MD5 and payload SHA256 headers and can fail requests to test retries.
+package s3mock
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object is a stored object
+type Object struct {
+	Data         []byte
+	ETag         string
+	Metadata     map[string]string
+	StorageClass string
+	Parts        int
+	Modified     time.Time
+	Tags         map[string]string
+
+	// Object lock retention
+	LockMode        string
+	LockRetainUntil time.Time
+}
+
+type multipartUpload struct {
+	bucket    string
+	key       string
+	metadata  map[string]string
+	class     string
+	parts     map[int][]byte
+	initiated time.Time
+	lockMode  string
+	lockUntil time.Time
+	tags      map[string]string
+}
+
+// Server is a mock S3 server
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	buckets  map[string]map[string]Object
+	locked   map[string]bool
+	rules    map[string]string
+	uploads  map[string]*multipartUpload
+	nextID   int
+	failures int
+	throttle int
+	failPart int
+	requests int
+}
+
+// New starts a server with empty buckets
+func New(buckets ...string) *Server {
+	s := &Server{
+		buckets: make(map[string]map[string]Object),
+		locked:  make(map[string]bool),
+		rules:   make(map[string]string),
+		uploads: make(map[string]*multipartUpload),
+	}
+	for _, bucket := range buckets {
+		s.buckets[bucket] = make(map[string]Object)
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// EnableObjectLock enables object lock on a bucket, objects can be uploaded with retention only to such buckets
+func (s *Server) EnableObjectLock(bucket string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locked[bucket] = true
+}
+
+// SetLifecycle sets the lifecycle configuration XML of a bucket returned by GetBucketLifecycleConfiguration
+func (s *Server) SetLifecycle(bucket, config string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[bucket] = config
+}
+
+// FailNext makes the next n requests fail with 500 Internal Server Error
+func (s *Server) FailNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = n
+}
+
+// ThrottleNext makes the next n requests fail with 503 SlowDown
+func (s *Server) ThrottleNext(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.throttle = n
+}
+
+// FailPart makes uploads of a multipart upload part with number n fail with 500 Internal Server Error, 0 stops failing
+func (s *Server) FailPart(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failPart = n
+}
+
+// Requests returns the number of handled requests including failed ones
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Object returns a stored object
+func (s *Server) Object(bucket, key string) (Object, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.buckets[bucket][key]
+	return obj, ok
+}
+
+// Store puts an object into a bucket bypassing the API, e.g. to simulate objects changed by the provider
+func (s *Server) Store(bucket, key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[bucket][key] = Object{Data: data, ETag: etag(data), Modified: time.Now()}
+}
+
+// Keys returns sorted keys of all objects in a bucket
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := []string{}
+	for key := range s.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// Uploads returns the number of unfinished multipart uploads
+func (s *Server) Uploads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.uploads)
+}
+
+// S3 error response
+type errorResponse struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(errorResponse{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests++
+	if s.failures > 0 {
+		s.failures--
+		io.Copy(io.Discard, r.Body)
+		writeError(w, http.StatusInternalServerError, "InternalError", "injected failure")
+		return
+	}
+	if s.throttle > 0 {
+		s.throttle--
+		io.Copy(io.Discard, r.Body)
+		writeError(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	objects, ok := s.buckets[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchBucket", "bucket does not exist")
+		return
+	}
+
+	query := r.URL.Query()
+	switch {
+	case key == "" && r.Method == http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case key == "" && r.Method == http.MethodGet && query.Has("uploads"):
+		s.listMultipartUploads(w, bucket, query.Get("prefix"))
+	case key == "" && r.Method == http.MethodGet && query.Has("object-lock"):
+		s.getObjectLockConfiguration(w, bucket)
+	case key == "" && r.Method == http.MethodGet && query.Has("lifecycle"):
+		s.getBucketLifecycleConfiguration(w, bucket)
+	case key == "":
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "bucket operations are not supported")
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.createMultipartUpload(w, r, bucket, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		s.uploadPart(w, r, query.Get("uploadId"), query.Get("partNumber"))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		s.completeMultipartUpload(w, r, objects, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		s.putObject(w, r, objects, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		obj, ok := objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey", "object does not exist")
+			return
+		}
+		for k, v := range obj.Metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Header().Set("ETag", obj.ETag)
+		w.Header().Set("Last-Modified", obj.Modified.UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Length", strconv.Itoa(len(obj.Data)))
+		if r.Method == http.MethodGet {
+			w.Write(obj.Data)
+		}
+	case r.Method == http.MethodDelete:
+		// Conditional delete used by S3 lock objects
+		if match := r.Header.Get("If-Match"); match != "" {
+			if obj, exists := objects[key]; !exists || obj.ETag != match {
+				writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "object was changed")
+				return
+			}
+		}
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented", "operation is not supported")
+	}
+}
+
+// Read request body and verify its checksums
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return nil, false
+	}
+
+	if want := r.Header.Get("Content-MD5"); want != "" {
+		sum := md5.Sum(data)
+		if base64.StdEncoding.EncodeToString(sum[:]) != want {
+			writeError(w, http.StatusBadRequest, "BadDigest", "Content-MD5 does not match the body")
+			return nil, false
+		}
+	}
+	if want := r.Header.Get("X-Amz-Content-Sha256"); want != "" && !strings.HasPrefix(want, "UNSIGNED") && !strings.HasPrefix(want, "STREAMING") {
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != want {
+			writeError(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "payload SHA256 does not match the body")
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// User metadata from x-amz-meta-* headers
+func metadata(r *http.Request) map[string]string {
+	meta := make(map[string]string)
+	for name, values := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") && len(values) > 0 {
+			meta[strings.ToLower(strings.TrimPrefix(strings.ToLower(name), "x-amz-meta-"))] = values[0]
+		}
+	}
+	return meta
+}
+
+// Object tags from the x-amz-tagging header
+func tags(r *http.Request) map[string]string {
+	values, _ := url.ParseQuery(r.Header.Get("X-Amz-Tagging"))
+	tags := make(map[string]string)
+	for k, v := range values {
+		tags[k] = v[0]
+	}
+	return tags
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return fmt.Sprintf("%q", hex.EncodeToString(sum[:]))
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, objects map[string]Object, key string) {
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Conditional write used by S3 lock objects
+	if r.Header.Get("If-None-Match") == "*" {
+		if _, exists := objects[key]; exists {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "object already exists")
+			return
+		}
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		if obj, exists := objects[key]; !exists || obj.ETag != match {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed", "object was changed")
+			return
+		}
+	}
+
+	mode, until, ok := s.objectLock(w, r, bucketOf(r))
+	if !ok {
+		return
+	}
+	if mode != "" && r.Header.Get("Content-MD5") == "" {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Content-MD5 HTTP header is required for Put Object requests with Object Lock parameters")
+		return
+	}
+
+	obj := Object{
+		Data:            data,
+		ETag:            etag(data),
+		Metadata:        metadata(r),
+		StorageClass:    r.Header.Get("X-Amz-Storage-Class"),
+		Modified:        time.Now(),
+		Tags:            tags(r),
+		LockMode:        mode,
+		LockRetainUntil: until,
+	}
+	objects[key] = obj
+	w.Header().Set("ETag", obj.ETag)
+	w.WriteHeader(http.StatusOK)
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	mode, until, ok := s.objectLock(w, r, bucket)
+	if !ok {
+		return
+	}
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.uploads[id] = &multipartUpload{
+		bucket:    bucket,
+		key:       key,
+		metadata:  metadata(r),
+		class:     r.Header.Get("X-Amz-Storage-Class"),
+		parts:     make(map[int][]byte),
+		initiated: time.Now(),
+		lockMode:  mode,
+		lockUntil: until,
+		tags:      tags(r),
+	}
+	writeXML(w, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: id})
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, id, partNumber string) {
+	upload, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		return
+	}
+	n, err := strconv.Atoi(partNumber)
+	if err != nil || n < 1 {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "bad part number")
+		return
+	}
+	if n == s.failPart {
+		io.Copy(io.Discard, r.Body)
+		writeError(w, http.StatusInternalServerError, "InternalError", "injected part failure")
+		return
+	}
+
+	data, ok := readBody(w, r)
+	if !ok {
+		return
+	}
+	upload.parts[n] = data
+	w.Header().Set("ETag", etag(data))
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, objects map[string]Object, id string) {
+	upload, ok := s.uploads[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload", "upload does not exist")
+		return
+	}
+
+	var req completeMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+	if len(req.Parts) == 0 {
+		writeError(w, http.StatusBadRequest, "MalformedXML", "no parts")
+		return
+	}
+
+	// Object ETag is MD5 of part MD5s with the number of parts like in S3
+	var data, sums bytes.Buffer
+	for i, part := range req.Parts {
+		body, ok := upload.parts[part.PartNumber]
+		if !ok || part.ETag != etag(body) || (i > 0 && part.PartNumber <= req.Parts[i-1].PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart", fmt.Sprintf("bad part %d", part.PartNumber))
+			return
+		}
+		data.Write(body)
+		sum := md5.Sum(body)
+		sums.Write(sum[:])
+	}
+	sum := md5.Sum(sums.Bytes())
+
+	obj := Object{
+		Data:            data.Bytes(),
+		ETag:            fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(sum[:]), len(req.Parts)),
+		Metadata:        upload.metadata,
+		StorageClass:    upload.class,
+		Parts:           len(req.Parts),
+		Modified:        time.Now(),
+		Tags:            upload.tags,
+		LockMode:        upload.lockMode,
+		LockRetainUntil: upload.lockUntil,
+	}
+	objects[upload.key] = obj
+	delete(s.uploads, id)
+
+	writeXML(w, completeMultipartUploadResult{
+		Location: fmt.Sprintf("%s/%s/%s", s.URL, upload.bucket, upload.key),
+		Bucket:   upload.bucket,
+		Key:      upload.key,
+		ETag:     obj.ETag,
+	})
+}
+
+type listedUpload struct {
+	Key       string    `xml:"Key"`
+	UploadID  string    `xml:"UploadId"`
+	Initiated time.Time `xml:"Initiated"`
+}
+
+type listMultipartUploadsResult struct {
+	XMLName     xml.Name       `xml:"ListMultipartUploadsResult"`
+	Bucket      string         `xml:"Bucket"`
+	Prefix      string         `xml:"Prefix"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Uploads     []listedUpload `xml:"Upload"`
+}
+
+func (s *Server) listMultipartUploads(w http.ResponseWriter, bucket, prefix string) {
+	ids := []string{}
+	for id, upload := range s.uploads {
+		if upload.bucket == bucket && strings.HasPrefix(upload.key, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+
+	result := listMultipartUploadsResult{Bucket: bucket, Prefix: prefix}
+	for _, id := range ids {
+		result.Uploads = append(result.Uploads, listedUpload{s.uploads[id].key, id, s.uploads[id].initiated})
+	}
+	writeXML(w, result)
+}
+
+// Bucket name of a path-style request
+func bucketOf(r *http.Request) string {
+	bucket, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	return bucket
+}
+
+// Object lock retention headers of an upload, they are refused for buckets without object lock
+func (s *Server) objectLock(w http.ResponseWriter, r *http.Request, bucket string) (string, time.Time, bool) {
+	mode := r.Header.Get("X-Amz-Object-Lock-Mode")
+	if mode == "" {
+		return "", time.Time{}, true
+	}
+	if !s.locked[bucket] {
+		writeError(w, http.StatusBadRequest, "InvalidRequest", "Bucket is missing Object Lock Configuration")
+		return "", time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339, r.Header.Get("X-Amz-Object-Lock-Retain-Until-Date"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "InvalidArgument", "bad retain until date")
+		return "", time.Time{}, false
+	}
+	return mode, until, true
+}
+
+type objectLockConfiguration struct {
+	XMLName           xml.Name `xml:"ObjectLockConfiguration"`
+	ObjectLockEnabled string   `xml:"ObjectLockEnabled"`
+}
+
+func (s *Server) getObjectLockConfiguration(w http.ResponseWriter, bucket string) {
+	if !s.locked[bucket] {
+		writeError(w, http.StatusNotFound, "ObjectLockConfigurationNotFoundError", "Object Lock configuration does not exist for this bucket")
+		return
+	}
+	writeXML(w, objectLockConfiguration{ObjectLockEnabled: "Enabled"})
+}
+
+func (s *Server) getBucketLifecycleConfiguration(w http.ResponseWriter, bucket string) {
+	config, ok := s.rules[bucket]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchLifecycleConfiguration", "The lifecycle configuration does not exist")
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(w, config)
+}
@@ -0,0 +1,122 @@
+package s3mock
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/stretchr/testify/assert"
+)
+
+func newSession(t *testing.T, s *Server) *session.Session {
+	sess, err := session.NewSession(aws.NewConfig().
+		WithEndpoint(s.URL).
+		WithS3ForcePathStyle(true).
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("test", "test", "")))
+	assert.Nil(t, err)
+	return sess
+}
+
+func TestPutGetObject(t *testing.T) {
+	s := New("bucket")
+	defer s.Close()
+	client := s3.New(newSession(t, s))
+
+	_, err := client.PutObject(&s3.PutObjectInput{
+		Bucket:       aws.String("bucket"),
+		Key:          aws.String("path/file"),
+		Body:         bytes.NewReader([]byte("data")),
+		Metadata:     map[string]*string{"Format": aws.String("2")},
+		StorageClass: aws.String("STANDARD_IA"),
+	})
+	assert.Nil(t, err)
+
+	obj, ok := s.Object("bucket", "path/file")
+	assert.True(t, ok)
+	assert.Equal(t, []byte("data"), obj.Data)
+	assert.Equal(t, "2", obj.Metadata["format"])
+	assert.Equal(t, "STANDARD_IA", obj.StorageClass)
+	assert.Equal(t, []string{"path/file"}, s.Keys("bucket"))
+
+	out, err := client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("path/file")})
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(out.Body)
+	assert.Equal(t, []byte("data"), data)
+
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("missing")})
+	assert.NotNil(t, err)
+	_, err = client.GetObject(&s3.GetObjectInput{Bucket: aws.String("bucket"), Key: aws.String("missing")})
+	assert.NotNil(t, err)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	s := New("bucket")
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 1100*1024)
+	uploader := s3manager.NewUploader(newSession(t, s), func(u *s3manager.Uploader) {
+		u.PartSize = s3manager.MinUploadPartSize
+	})
+	_, err := uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String("bucket"),
+		Key:    aws.String("big"),
+		Body:   bytes.NewReader(data),
+	})
+	assert.Nil(t, err)
+
+	obj, ok := s.Object("bucket", "big")
+	assert.True(t, ok)
+	assert.Equal(t, 3, obj.Parts)
+	assert.Equal(t, data, obj.Data)
+	assert.Regexp(t, `^"[0-9a-f]{32}-3"$`, obj.ETag)
+	assert.Equal(t, 0, s.Uploads())
+}
+
+func TestChecksums(t *testing.T) {
+	s := New("bucket")
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodPut, s.URL+"/bucket/file", bytes.NewReader([]byte("data")))
+	req.Header.Set("Content-MD5", "AAAAAAAAAAAAAAAAAAAAAA==")
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req, _ = http.NewRequest(http.MethodPut, s.URL+"/bucket/file", bytes.NewReader([]byte("data")))
+	req.Header.Set("X-Amz-Content-Sha256", "0000")
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, ok := s.Object("bucket", "file")
+	assert.False(t, ok)
+}
+
+func TestFailNextAndConditionalWrite(t *testing.T) {
+	s := New("bucket")
+	defer s.Close()
+
+	put := func() int {
+		req, _ := http.NewRequest(http.MethodPut, s.URL+"/bucket/lock", bytes.NewReader([]byte("owner")))
+		req.Header.Set("If-None-Match", "*")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	s.FailNext(1)
+	assert.Equal(t, http.StatusInternalServerError, put())
+	assert.Equal(t, http.StatusOK, put())
+	assert.Equal(t, http.StatusPreconditionFailed, put())
+	assert.Equal(t, 3, s.Requests())
+}
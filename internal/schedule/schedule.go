@@ -0,0 +1,120 @@
+package schedule
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+)
+
+// Window is a daily time window like 22:00-06:00, it can wrap around midnight. A nil Window is always open.
+type Window struct {
+	// Minutes since midnight
+	Start int
+	End   int
+
+	Location *time.Location
+}
+
+// ParseWindow parses a window in HH:MM-HH:MM format in the given location
+func ParseWindow(window string, location *time.Location) (*Window, error) {
+	start, end, ok := strings.Cut(strings.TrimSpace(window), "-")
+	if !ok {
+		return nil, fmt.Errorf("bad time window %q, must be HH:MM-HH:MM", window)
+	}
+
+	w := &Window{Location: location}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return nil, fmt.Errorf("bad time window %q: %s", window, err.Error())
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return nil, fmt.Errorf("bad time window %q: %s", window, err.Error())
+	}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("bad time window %q: start and end are the same", window)
+	}
+	return w, nil
+}
+
+// Parse HH:MM into minutes since midnight, 24:00 is allowed as the end of a day
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(clock))
+	if err == nil {
+		return t.Hour()*60 + t.Minute(), nil
+	}
+	if strings.TrimSpace(clock) == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, fmt.Errorf("bad time %q, must be HH:MM", clock)
+}
+
+// Contains checks if the window is open at the given time
+func (w *Window) Contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+
+	if w.Location != nil {
+		t = t.In(w.Location)
+	}
+	minute := t.Hour()*60 + t.Minute()
+
+	if w.Start < w.End {
+		return minute >= w.Start && minute < w.End
+	}
+	// Wraps around midnight
+	return minute >= w.Start || minute < w.End
+}
+
+// String returns the window in HH:MM-HH:MM format
+func (w *Window) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+// Rate is a bandwidth limit in bytes per second during a time window, zero means no limit
+type Rate struct {
+	Window *Window
+	Rate   int64
+}
+
+// RateSchedule is a list of bandwidth limits by time of day, the first matching window wins
+type RateSchedule []Rate
+
+// ParseRateSchedule parses comma separated window=rate pairs, e.g. "08:00-20:00=5MB,20:00-08:00=0"
+func ParseRateSchedule(schedule string, location *time.Location) (RateSchedule, error) {
+	var result RateSchedule
+	for _, item := range strings.Split(schedule, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		window, rate, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad rate schedule item %q, must be HH:MM-HH:MM=RATE", item)
+		}
+
+		w, err := ParseWindow(window, location)
+		if err != nil {
+			return nil, err
+		}
+		r, err := utils.ParseBytes(strings.TrimSuffix(strings.TrimSpace(rate), "/s"))
+		if err != nil {
+			return nil, fmt.Errorf("bad rate in rate schedule item %q: %s", item, err.Error())
+		}
+		result = append(result, Rate{Window: w, Rate: r})
+	}
+	return result, nil
+}
+
+// RateAt returns the rate at the given time, fallback is used outside of all windows
+func (rs RateSchedule) RateAt(t time.Time, fallback int64) int64 {
+	for _, r := range rs {
+		if r.Window.Contains(t) {
+			return r.Rate
+		}
+	}
+	return fallback
+}
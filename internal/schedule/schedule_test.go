@@ -0,0 +1,59 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindow(t *testing.T) {
+	at := func(clock string) time.Time {
+		tm, _ := time.Parse("15:04", clock)
+		return time.Date(2024, 5, 1, tm.Hour(), tm.Minute(), 0, 0, time.UTC)
+	}
+
+	night, err := ParseWindow("22:00-06:00", time.UTC)
+	assert.Nil(t, err)
+	assert.True(t, night.Contains(at("23:30")))
+	assert.True(t, night.Contains(at("05:59")))
+	assert.False(t, night.Contains(at("06:00")))
+	assert.False(t, night.Contains(at("12:00")))
+	assert.Equal(t, "22:00-06:00", night.String())
+
+	day, err := ParseWindow("08:00-24:00", time.UTC)
+	assert.Nil(t, err)
+	assert.True(t, day.Contains(at("23:59")))
+	assert.False(t, day.Contains(at("07:00")))
+
+	// 08:00 UTC is 10:00 in Berlin in summer
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	assert.Nil(t, err)
+	morning, err := ParseWindow("09:00-11:00", berlin)
+	assert.Nil(t, err)
+	assert.True(t, morning.Contains(at("08:00")))
+
+	for _, bad := range []string{"22:00", "25:00-06:00", "10:00-10:00", "ab-cd"} {
+		_, err := ParseWindow(bad, time.UTC)
+		assert.NotNil(t, err, bad)
+	}
+
+	var always *Window
+	assert.True(t, always.Contains(at("12:00")))
+}
+
+func TestRateSchedule(t *testing.T) {
+	rs, err := ParseRateSchedule("08:00-20:00=5MB/s, 20:00-22:00=0", time.UTC)
+	assert.Nil(t, err)
+	assert.Len(t, rs, 2)
+
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, int64(5000000), rs.RateAt(day, 100))
+	assert.Equal(t, int64(0), rs.RateAt(day.Add(9*time.Hour), 100))
+	assert.Equal(t, int64(100), rs.RateAt(day.Add(11*time.Hour), 100))
+
+	_, err = ParseRateSchedule("08:00-20:00", time.UTC)
+	assert.NotNil(t, err)
+	_, err = ParseRateSchedule("08:00-20:00=fast", time.UTC)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,42 @@
+package secret
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+)
+
+// NewAWSSecretsManager creates a provider for a secret stored in AWS Secrets Manager.
+// ref is a secret ID or ARN, "id#key" reads a single key of a JSON secret.
+func NewAWSSecretsManager(ref string, refresh time.Duration) (Provider, error) {
+	id, key := splitRef(ref)
+	if id == "" {
+		return nil, fmt.Errorf("empty AWS Secrets Manager secret id")
+	}
+
+	client := secretsmanager.New(session.Must(session.NewSession()))
+
+	r := &remote{
+		refresh: refresh,
+		fetch: func() (string, error) {
+			out, err := client.GetSecretValue(&secretsmanager.GetSecretValueInput{SecretId: aws.String(id)})
+			if err != nil {
+				return "", fmt.Errorf("failed to read AWS Secrets Manager secret %q: %s", id, err.Error())
+			}
+
+			value := aws.StringValue(out.SecretString)
+			if key == "" {
+				return value, nil
+			}
+			return jsonField([]byte(value), key)
+		},
+	}
+
+	if _, err := r.Get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
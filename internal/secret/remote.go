@@ -0,0 +1,71 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remote caches a secret fetched from a remote secrets store and re-fetches it every refresh interval
+type remote struct {
+	fetch   func() (string, error)
+	refresh time.Duration
+
+	mu        sync.Mutex
+	value     string
+	fetchedAt time.Time
+}
+
+// Get returns the cached secret, when re-fetching fails the last known value is kept
+// so a secrets store outage doesn't stop uploads
+func (r *remote) Get() (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.value != "" && time.Since(r.fetchedAt) < r.refresh {
+		return r.value, nil
+	}
+
+	value, err := r.fetch()
+	if err != nil {
+		if r.value != "" {
+			return r.value, nil
+		}
+		return "", err
+	}
+	if value == "" {
+		return "", fmt.Errorf("secret is empty")
+	}
+
+	r.value = value
+	r.fetchedAt = time.Now()
+	return r.value, nil
+}
+
+// splitRef splits secret reference like "path#key" into path and key
+func splitRef(ref string) (string, string) {
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		return ref[:i], ref[i+1:]
+	}
+	return ref, ""
+}
+
+// jsonField extracts a string field from a JSON object
+func jsonField(data []byte, key string) (string, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", fmt.Errorf("failed to parse secret as JSON: %s", err.Error())
+	}
+	return stringField(fields, key)
+}
+
+// stringField returns a string field from a decoded JSON object
+func stringField(fields map[string]interface{}, key string) (string, error) {
+	value, ok := fields[key].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string field %q", key)
+	}
+	return value, nil
+}
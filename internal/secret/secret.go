@@ -0,0 +1,74 @@
+package secret
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider returns the current value of a secret, implementations pick up rotated secrets
+type Provider interface {
+	Get() (string, error)
+}
+
+// Static is a secret that never changes, e.g. read from an env variable
+type Static string
+
+// Get returns the secret value
+func (s Static) Get() (string, error) {
+	if s == "" {
+		return "", fmt.Errorf("secret is empty")
+	}
+	return string(s), nil
+}
+
+// File is a secret stored in a file, e.g. a Kubernetes secret mount.
+// The file is re-read when its modification time changes, so rotated secrets are picked up without a restart.
+type File struct {
+	Path string
+
+	mu      sync.Mutex
+	value   string
+	modTime time.Time
+}
+
+// NewFile creates a new file secret and reads it for the first time
+func NewFile(path string) (*File, error) {
+	f := &File{Path: path}
+	if _, err := f.Get(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get returns the secret value, re-reading the file if it was changed
+func (f *File) Get() (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fi, err := os.Stat(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat secret file %q: %s", f.Path, err.Error())
+	}
+
+	if f.value != "" && fi.ModTime().Equal(f.modTime) {
+		return f.value, nil
+	}
+
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret file %q: %s", f.Path, err.Error())
+	}
+
+	// Trailing newline is almost always an artifact of how the file was created
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", fmt.Errorf("secret file %q is empty", f.Path)
+	}
+
+	f.value = value
+	f.modTime = fi.ModTime()
+	return f.value, nil
+}
@@ -0,0 +1,71 @@
+package secret
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "password")
+	assert.Nil(t, os.WriteFile(path, []byte("first\n"), 0600))
+
+	f, err := NewFile(path)
+	assert.Nil(t, err)
+	value, err := f.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "first")
+
+	// Rotated secret is picked up
+	assert.Nil(t, os.WriteFile(path, []byte("second"), 0600))
+	assert.Nil(t, os.Chtimes(path, time.Now().Add(time.Minute), time.Now().Add(time.Minute)))
+	value, err = f.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "second")
+
+	assert.Nil(t, os.WriteFile(path, []byte{}, 0600))
+	_, err = NewFile(path)
+	assert.NotNil(t, err)
+}
+
+func TestVault(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/backups":
+			fmt.Fprint(w, `{"data": {"data": {"gpg_password": "v2-password"}}}`)
+		case "/v1/kv/backups":
+			fmt.Fprint(w, `{"data": {"gpg_password": "v1-password"}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	provider, err := NewVault(server.URL, Static("token"), "secret/data/backups#gpg_password", time.Minute)
+	assert.Nil(t, err)
+	value, err := provider.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "v2-password")
+
+	provider, err = NewVault(server.URL, Static("token"), "kv/backups#gpg_password", time.Minute)
+	assert.Nil(t, err)
+	value, err = provider.Get()
+	assert.Nil(t, err)
+	assert.Equal(t, value, "v1-password")
+
+	_, err = NewVault(server.URL, Static("bad-token"), "kv/backups#gpg_password", time.Minute)
+	assert.NotNil(t, err)
+
+	_, err = NewVault(server.URL, Static("token"), "kv/backups", time.Minute)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,71 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NewVault creates a provider for a secret stored in HashiCorp Vault KV engine.
+// ref is "path#key", e.g. "secret/data/backups#gpg_password", both KV v1 and v2 responses are supported.
+func NewVault(addr string, token Provider, ref string, refresh time.Duration) (Provider, error) {
+	path, key := splitRef(ref)
+	if path == "" || key == "" {
+		return nil, fmt.Errorf("vault secret reference %q must be in the \"path#key\" format", ref)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	url := fmt.Sprintf("%s/v1/%s", strings.TrimRight(addr, "/"), strings.TrimLeft(path, "/"))
+
+	r := &remote{
+		refresh: refresh,
+		fetch: func() (string, error) {
+			return fetchVault(client, url, token, key)
+		},
+	}
+
+	if _, err := r.Get(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fetchVault reads a single key of a Vault secret
+func fetchVault(client *http.Client, url string, token Provider, key string) (string, error) {
+	tokenValue, err := token.Get()
+	if err != nil {
+		return "", fmt.Errorf("failed to get vault token: %s", err.Error())
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", tokenValue)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read vault secret %q: %s", url, err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to read vault secret %q: HTTP %d", url, resp.StatusCode)
+	}
+
+	body := struct {
+		Data map[string]interface{} `json:"data"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to parse vault response for %q: %s", url, err.Error())
+	}
+
+	// KV v2 engine wraps secret data into another "data" object
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	return stringField(data, key)
+}
@@ -0,0 +1,367 @@
+// Package sqssource queues files named by messages of an SQS queue, for producers that notify about new files
+// instead of waiting for the directory scanner. A message names a local file in a watched directory or a URL,
+// e.g. a pre-signed one, the file is downloaded into the first watched directory. Messages are deleted once the
+// file is queued, failed messages are received again after the visibility timeout and end up in the dead-letter
+// queue of the redrive policy. Messages stay invisible while their files are downloaded. Only https URLs of
+// allowed hosts are downloaded, a marker of every download keeps a redelivered message from downloading its file
+// again or taking another file of the same name for it.
+package sqssource
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	// Long polling wait of ReceiveMessage, the maximum SQS allows
+	waitTimeSeconds = 20
+	// Messages received at once, the maximum SQS allows
+	maxMessages = 10
+	// Delay before receiving again after SQS failed
+	retryDelay = 5 * time.Second
+	// Limit of a download, a stalled server doesn't block other messages forever
+	downloadTimeout = time.Hour
+	// Messages being downloaded are kept invisible for this long, it's extended every visibilityExtendInterval
+	visibilityTimeout        = 2 * time.Minute
+	visibilityExtendInterval = 30 * time.Second
+	// Redirects followed by a download, every one must be to an allowed host
+	maxRedirects = 10
+	// Download markers are kept in this directory of the first watched directory, scanners skip directories
+	markerDir = ".sqs-downloads"
+	// Markers are kept as long as SQS keeps messages at most, they are purged every markerPurgeInterval
+	markerRetention     = 14 * 24 * time.Hour
+	markerPurgeInterval = time.Hour
+)
+
+// Region of queue URLs like https://sqs.eu-central-1.amazonaws.com/123456789012/uploads
+var queueURLRegion = regexp.MustCompile(`^sqs[.-](?:fips-)?([a-z0-9-]+)\.amazonaws\.com`)
+
+// Message names a file to upload. Message bodies are JSON objects, {"path": "/data/file"} or {"url": "https://...",
+// "name": "file"}, or a plain path or URL. Downloaded files are named after the last element of the URL path
+// unless the name is set.
+type Message struct {
+	Path string `json:"path,omitempty"`
+	URL  string `json:"url,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// ParseMessage parses a message body
+func ParseMessage(body string) (Message, error) {
+	body = strings.TrimSpace(body)
+	msg := Message{}
+	switch {
+	case strings.HasPrefix(body, "{"):
+		if err := json.Unmarshal([]byte(body), &msg); err != nil {
+			return msg, fmt.Errorf("failed to parse message: %s", err.Error())
+		}
+	case strings.HasPrefix(body, "http://") || strings.HasPrefix(body, "https://"):
+		msg.URL = body
+	default:
+		msg.Path = body
+	}
+
+	if (msg.Path == "") == (msg.URL == "") {
+		return msg, fmt.Errorf("message must have either a path or a url")
+	}
+	if msg.URL != "" && msg.Name == "" {
+		u, err := url.Parse(msg.URL)
+		if err != nil {
+			// Errors have the URL, pre-signed ones must not be logged
+			return msg, fmt.Errorf("bad url in message")
+		}
+		msg.Name = path.Base(u.Path)
+	}
+	if msg.URL != "" && (msg.Name != filepath.Base(msg.Name) || msg.Name == "." || msg.Name == ".." || msg.Name == string(filepath.Separator)) {
+		return msg, fmt.Errorf("bad file name %q, it must not be a path", msg.Name)
+	}
+	return msg, nil
+}
+
+// ParseHosts parses a comma separated list of shell patterns of host names, e.g. *.s3.eu-central-1.amazonaws.com
+func ParseHosts(list string) ([]string, error) {
+	hosts := []string{}
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad host pattern %q: %s", pattern, err.Error())
+		}
+		hosts = append(hosts, strings.ToLower(pattern))
+	}
+	return hosts, nil
+}
+
+// Source receives messages of an SQS queue
+type Source struct {
+	QueueURL string
+	// Patterns of hosts files may be downloaded from, no URL is downloaded when it's empty
+	AllowedHosts []string
+
+	client sqsiface.SQSAPI
+	http   *http.Client
+	// How often visibility of a message is extended while its file is downloaded, zero doesn't extend it
+	extendEvery time.Duration
+}
+
+// New creates a source of the queue, the region is taken from the queue URL of AWS queues. Files are downloaded only
+// from https URLs of allowedHosts, redirects included.
+func New(config cfg.AppConfig, queueURL string, allowedHosts []string) (*Source, error) {
+	awsConfig := aws.NewConfig()
+	if m := queueURLRegion.FindStringSubmatch(strings.TrimPrefix(queueURL, "https://")); m != nil {
+		awsConfig = awsConfig.WithRegion(m[1])
+	}
+	if config.S3UseFIPS {
+		awsConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	s := &Source{
+		QueueURL:     queueURL,
+		AllowedHosts: allowedHosts,
+		client:       sqs.New(sess),
+		extendEvery:  visibilityExtendInterval,
+	}
+	s.http = &http.Client{
+		Timeout: downloadTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return s.checkURL(req.URL)
+		},
+	}
+	return s, nil
+}
+
+// checkURL checks that a file may be downloaded from the URL, errors don't have the URL as pre-signed ones must
+// not be logged
+func (s *Source) checkURL(u *url.URL) error {
+	if u.Scheme != "https" {
+		return fmt.Errorf("only https URLs are downloaded, got %s", u.Scheme)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range s.AllowedHosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("host %q is not allowed", host)
+}
+
+// Run receives messages and queues files they name until ctx is done. No messages are received while draining.
+func (s *Source) Run(ctx context.Context, comm *queue.Queue, config cfg.AppConfig) {
+	config.Applog.Infof("Receiving files to upload from SQS queue %q", s.QueueURL)
+	var purged time.Time
+	for {
+		if time.Since(purged) >= markerPurgeInterval {
+			purgeMarkers(config)
+			purged = time.Now()
+		}
+		if config.Control.Draining() {
+			if !sleep(ctx, retryDelay) {
+				break
+			}
+			continue
+		}
+
+		out, err := s.client.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(s.QueueURL),
+			MaxNumberOfMessages: aws.Int64(maxMessages),
+			WaitTimeSeconds:     aws.Int64(waitTimeSeconds),
+		})
+		if ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			config.Applog.Errorf("Failed to receive messages from SQS queue %q: %s", s.QueueURL, err.Error())
+			if !sleep(ctx, retryDelay) {
+				break
+			}
+			continue
+		}
+
+		for _, m := range out.Messages {
+			s.process(ctx, comm, config, m)
+		}
+	}
+	config.Applog.Info("SQS source exiting")
+}
+
+// process queues the file of a message and deletes the message unless it has to be received again
+func (s *Source) process(ctx context.Context, comm *queue.Queue, config cfg.AppConfig, m *sqs.Message) {
+	id := aws.StringValue(m.MessageId)
+	err := s.handle(ctx, comm, config, m)
+	switch {
+	case err == nil:
+		config.Metrics.SQSMessages.WithLabelValues("queued").Inc()
+	case errors.Is(err, fs.ErrFileSkipped):
+		config.Applog.Warningf("Skipping SQS message %s: %s", id, err.Error())
+		config.Metrics.SQSMessages.WithLabelValues("skipped").Inc()
+	default:
+		config.Applog.Errorf("Failed to process SQS message %s, it's received again: %s", id, err.Error())
+		config.Metrics.SQSMessages.WithLabelValues("failed").Inc()
+		return
+	}
+
+	if _, err := s.client.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(s.QueueURL),
+		ReceiptHandle: m.ReceiptHandle,
+	}); err != nil {
+		config.Applog.Errorf("Failed to delete SQS message %s, it's received again: %s", id, err.Error())
+	}
+}
+
+// handle queues the file named by the message body, URLs are downloaded first
+func (s *Source) handle(ctx context.Context, comm *queue.Queue, config cfg.AppConfig, m *sqs.Message) error {
+	msg, err := ParseMessage(aws.StringValue(m.Body))
+	if err != nil {
+		return err
+	}
+
+	file := msg.Path
+	if msg.URL != "" {
+		stop := s.keepInvisible(ctx, config, m)
+		file, err = s.fetch(ctx, config, msg, markerName(config, m))
+		stop()
+		if err != nil {
+			return err
+		}
+	}
+	return fs.QueueFile(ctx, comm, config, file)
+}
+
+// markerName returns the marker of the download of the message's file, redeliveries have the same message ID
+func markerName(config cfg.AppConfig, m *sqs.Message) string {
+	return filepath.Join(config.PathToWatch, markerDir, fmt.Sprintf("%x", sha256.Sum256([]byte(aws.StringValue(m.MessageId)))))
+}
+
+// purgeMarkers deletes markers older than SQS keeps messages
+func purgeMarkers(config cfg.AppConfig) {
+	dir := filepath.Join(config.PathToWatch, markerDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > markerRetention {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// keepInvisible extends visibility of the message until the returned function is called, so a long download
+// isn't received again by another consumer
+func (s *Source) keepInvisible(ctx context.Context, config cfg.AppConfig, m *sqs.Message) func() {
+	if s.extendEvery <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(s.extendEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := s.client.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(s.QueueURL),
+					ReceiptHandle:     m.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(int64(visibilityTimeout / time.Second)),
+				}); err != nil {
+					config.Applog.Warningf("Failed to extend visibility of SQS message %s: %s", aws.StringValue(m.MessageId), err.Error())
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// fetch downloads the file of the message into the first watched directory and marks it downloaded. A file of the
+// name that wasn't downloaded for the message is never taken for it, the message fails until the file is gone.
+func (s *Source) fetch(ctx context.Context, config cfg.AppConfig, msg Message, marker string) (string, error) {
+	if name, err := os.ReadFile(marker); err == nil {
+		// Downloaded by an earlier delivery of the message, it's gone if it was uploaded already
+		return filepath.Join(config.PathToWatch, filepath.Base(string(name))), nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, msg.URL, nil)
+	if err != nil {
+		return "", fmt.Errorf("bad url of %q", msg.Name)
+	}
+	if err := s.checkURL(req.URL); err != nil {
+		return "", fmt.Errorf("%q is not downloaded: %s", msg.Name, err.Error())
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		// Errors have the URL, pre-signed ones must not be logged
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return "", fmt.Errorf("failed to download %q: %s", msg.Name, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %q: %s", msg.Name, resp.Status)
+	}
+
+	file, err := fs.ReceiveFile(config, msg.Name, resp.Body)
+	if err != nil {
+		return "", err
+	}
+	config.Applog.Infof("Downloaded %q from SQS message", file)
+
+	// Without the marker a redelivery fails while the file exists and downloads it again once it's uploaded
+	err = os.MkdirAll(filepath.Dir(marker), 0755)
+	if err == nil {
+		err = os.WriteFile(marker, []byte(msg.Name), 0644)
+	}
+	if err != nil {
+		config.Applog.Warningf("Failed to mark %q downloaded: %s", file, err.Error())
+	}
+	return file, nil
+}
+
+// sleep waits for d, it returns false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
@@ -0,0 +1,174 @@
+package sqssource
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSQS records deleted messages and messages kept invisible
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	deleted []string
+
+	mu       sync.Mutex
+	extended []string
+}
+
+func (f *fakeSQS) DeleteMessageWithContext(_ aws.Context, in *sqs.DeleteMessageInput, _ ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	f.deleted = append(f.deleted, aws.StringValue(in.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibilityWithContext(_ aws.Context, in *sqs.ChangeMessageVisibilityInput, _ ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.extended = append(f.extended, aws.StringValue(in.ReceiptHandle))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func TestParseMessage(t *testing.T) {
+	msg, err := ParseMessage("/data/file.csv\n")
+	assert.Nil(t, err)
+	assert.Equal(t, Message{Path: "/data/file.csv"}, msg)
+
+	msg, err = ParseMessage("https://bucket.s3.amazonaws.com/exports/file.csv?X-Amz-Signature=abc")
+	assert.Nil(t, err)
+	assert.Equal(t, "file.csv", msg.Name)
+
+	msg, err = ParseMessage(`{"url": "https://example.com/download?id=1", "name": "report.pdf"}`)
+	assert.Nil(t, err)
+	assert.Equal(t, "report.pdf", msg.Name)
+
+	_, err = ParseMessage(`{"url": "https://example.com/a", "name": "../report.pdf"}`)
+	assert.NotNil(t, err)
+	_, err = ParseMessage(`{"path": "/data/a", "url": "https://example.com/a"}`)
+	assert.NotNil(t, err)
+	_, err = ParseMessage(`{}`)
+	assert.NotNil(t, err)
+	_, err = ParseMessage("https://example.com/")
+	assert.NotNil(t, err)
+
+	hosts, err := ParseHosts(" *.S3.amazonaws.com, downloads.example.com,")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"*.s3.amazonaws.com", "downloads.example.com"}, hosts)
+	_, err = ParseHosts("[")
+	assert.NotNil(t, err)
+}
+
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	var mu sync.Mutex
+	downloads := map[string]int{}
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		downloads[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/exports/remote.csv", "/exports/other.csv":
+			io.WriteString(w, "remote data")
+		case "/exports/slow.csv":
+			time.Sleep(200 * time.Millisecond)
+			io.WriteString(w, "slow data")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	config := cfg.AppConfig{
+		PathToWatch:    dir,
+		WatchPaths:     []cfg.WatchPath{{Path: dir}},
+		IgnorePatterns: []string{".*", "*.tmp"},
+		Metrics:        metrics.InitMetrics("test", 10, nil),
+		Applog:         logger.Init("test", false, false, io.Discard),
+	}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+	client := &fakeSQS{}
+	source := &Source{QueueURL: "https://sqs.eu-central-1.amazonaws.com/1/uploads", AllowedHosts: []string{"127.0.0.*"}, client: client,
+		http: server.Client(), extendEvery: 50 * time.Millisecond}
+
+	local := filepath.Join(dir, "local.csv")
+	assert.Nil(t, os.WriteFile(local, []byte("local data"), 0644))
+	ignored := filepath.Join(dir, "partial.tmp")
+	assert.Nil(t, os.WriteFile(ignored, []byte("partial"), 0644))
+
+	process := func(handle, body string) {
+		source.process(context.Background(), comm, config, &sqs.Message{
+			MessageId:     aws.String(handle),
+			ReceiptHandle: aws.String(handle),
+			Body:          aws.String(body),
+		})
+	}
+	process("local", local)
+	process("remote", server.URL+"/exports/remote.csv")
+	process("ignored", `{"path": "`+ignored+`"}`)
+	process("outside", "/etc/passwd")
+	process("missing", server.URL+"/exports/missing.csv")
+	process("bad", "{")
+
+	// Failed messages are left for redelivery
+	assert.Equal(t, []string{"local", "remote", "ignored", "outside"}, client.deleted)
+	assert.Equal(t, 2, comm.Len())
+
+	data, err := os.ReadFile(filepath.Join(dir, "remote.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "remote data", string(data))
+	_, err = os.Stat(filepath.Join(dir, "missing.csv"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Redelivered message doesn't queue the file again
+	process("local", local)
+	assert.Equal(t, 2, comm.Len())
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4, "temporary files of downloads are removed, only the marker directory is added")
+
+	// Redelivered download isn't downloaded again, also after its file was uploaded
+	process("remote", server.URL+"/exports/remote.csv")
+	assert.Nil(t, os.Remove(filepath.Join(dir, "remote.csv")))
+	process("remote", server.URL+"/exports/remote.csv")
+	assert.Equal(t, 1, downloads["/exports/remote.csv"])
+	assert.Equal(t, []string{"local", "remote", "ignored", "outside", "local", "remote", "remote"}, client.deleted)
+
+	// Another file of the same name is never taken for a download
+	other := filepath.Join(dir, "other.csv")
+	assert.Nil(t, os.WriteFile(other, []byte("other data"), 0644))
+	process("other", server.URL+"/exports/other.csv")
+	assert.Equal(t, "remote", client.deleted[len(client.deleted)-1])
+	data, err = os.ReadFile(other)
+	assert.Nil(t, err)
+	assert.Equal(t, "other data", string(data))
+
+	// Only https URLs of allowed hosts are downloaded
+	process("plain", "http://"+strings.TrimPrefix(server.URL, "https://")+"/exports/remote.csv")
+	process("metadata", "https://169.254.169.254/latest/meta-data/")
+	assert.Equal(t, "remote", client.deleted[len(client.deleted)-1])
+	assert.Equal(t, 1, downloads["/exports/remote.csv"])
+
+	// Messages are kept invisible while their files are downloaded
+	process("slow", server.URL+"/exports/slow.csv")
+	assert.Equal(t, "slow", client.deleted[len(client.deleted)-1])
+	assert.Contains(t, client.extended, "slow")
+	assert.NotContains(t, client.extended, "local")
+}
@@ -0,0 +1,405 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// File statuses
+const (
+	// StatusUndeletable means the file was uploaded but the source could not be deleted
+	StatusUndeletable = "undeletable"
+	// StatusFailed means the file failed with a permanent error, it's not retried until it changes
+	StatusFailed = "failed"
+	// StatusUploading means a multipart upload of the file is in progress and can be resumed
+	StatusUploading = "uploading"
+	// StatusNamed means only the unique key suffix of the file is recorded, so the file keeps its key after a restart
+	StatusNamed = "named"
+)
+
+// Entry is a state of a single source file
+type Entry struct {
+	Status    string    `json:"status"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Error     string    `json:"error,omitempty"`
+	KeySuffix string    `json:"key_suffix,omitempty"`
+	Upload    *Upload   `json:"upload,omitempty"`
+}
+
+// Upload is a multipart upload of a prepared file, parts are recorded once S3 has them
+type Upload struct {
+	Key             string    `json:"key"`
+	UploadID        string    `json:"upload_id"`
+	Prepared        string    `json:"prepared"`
+	PreparedSize    int64     `json:"prepared_size"`
+	PreparedModTime time.Time `json:"prepared_mod_time"`
+	PartSize        int64     `json:"part_size"`
+	Parts           []Part    `json:"parts"`
+}
+
+// Part is an uploaded part of a multipart upload
+type Part struct {
+	Number int64  `json:"number"`
+	ETag   string `json:"etag"`
+}
+
+// Matches checks if the upload was started for the prepared file with the given size and modification time
+func (u *Upload) Matches(fi os.FileInfo) bool {
+	return u.PreparedSize == fi.Size() && u.PreparedModTime.Equal(fi.ModTime())
+}
+
+// Matches checks if the entry still describes the file with the given size and modification time
+func (e Entry) Matches(fi os.FileInfo) bool {
+	return e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime())
+}
+
+// Content is an uploaded file content, it's used to skip uploads of identical files
+type Content struct {
+	File       string    `json:"file"`
+	Key        string    `json:"key"`
+	Size       int64     `json:"size"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Object is an uploaded object, it's checked against the bucket to detect objects lost or corrupted by the provider
+type Object struct {
+	Bucket     string    `json:"bucket,omitempty"`
+	Source     string    `json:"source"`
+	Size       int64     `json:"size"`
+	ETag       string    `json:"etag"`
+	UploadedAt time.Time `json:"uploaded_at"`
+}
+
+// Spill is a file or a group of files that didn't fit into the full queue, it's queued again when there's space
+type Spill struct {
+	Group     []string  `json:"group,omitempty"`
+	SpilledAt time.Time `json:"spilled_at"`
+}
+
+// DB keeps state of files between scans. It is persisted to a JSON file if path is set.
+type DB struct {
+	path string
+
+	mu       sync.Mutex
+	entries  map[string]Entry
+	contents map[string]Content
+	objects  map[string]Object
+	spilled  map[string]Spill
+	counter  uint64
+}
+
+// State file contents, files used to be the only top-level object
+type stateFile struct {
+	Files    map[string]Entry   `json:"files"`
+	Contents map[string]Content `json:"contents,omitempty"`
+	Objects  map[string]Object  `json:"objects,omitempty"`
+	Spilled  map[string]Spill   `json:"spilled,omitempty"`
+	Counter  uint64             `json:"counter,omitempty"`
+}
+
+// Open loads the state DB from a file, empty path means the state is kept in memory only
+func Open(path string) (*DB, error) {
+	db := &DB{path: path, entries: map[string]Entry{}, contents: map[string]Content{}, objects: map[string]Object{},
+		spilled: map[string]Spill{}}
+	if path == "" {
+		return db, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return db, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read state file %q: %s", path, err.Error())
+	}
+
+	var objects map[string]json.RawMessage
+	if err := json.Unmarshal(data, &objects); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %q: %s", path, err.Error())
+	}
+
+	// Files are keyed by absolute paths, so "files" is never a file in the old format
+	if _, ok := objects["files"]; !ok {
+		err = json.Unmarshal(data, &db.entries)
+	} else {
+		state := stateFile{}
+		if err = json.Unmarshal(data, &state); err == nil {
+			db.entries = state.Files
+			if state.Contents != nil {
+				db.contents = state.Contents
+			}
+			if state.Objects != nil {
+				db.objects = state.Objects
+			}
+			if state.Spilled != nil {
+				db.spilled = state.Spilled
+			}
+			db.counter = state.Counter
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse state file %q: %s", path, err.Error())
+	}
+	if db.entries == nil {
+		db.entries = map[string]Entry{}
+	}
+	return db, nil
+}
+
+// Get returns the state of a file
+func (db *DB) Get(file string) (Entry, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.entries[file]
+	return entry, ok
+}
+
+// Set updates the state of a file
+func (db *DB) Set(file string, entry Entry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry.UpdatedAt = time.Now()
+	db.entries[file] = entry
+	return db.save()
+}
+
+// Persistent checks if the state survives restarts
+func (db *DB) Persistent() bool {
+	return db != nil && db.path != ""
+}
+
+// UploadIDs returns IDs of multipart uploads that can be resumed
+func (db *DB) UploadIDs() map[string]bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ids := map[string]bool{}
+	for _, entry := range db.entries {
+		if entry.Upload != nil {
+			ids[entry.Upload.UploadID] = true
+		}
+	}
+	return ids
+}
+
+// Content returns an uploaded content by its checksum
+func (db *DB) Content(sum string) (Content, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	content, ok := db.contents[sum]
+	return content, ok
+}
+
+// AddContent records an uploaded content by its checksum and forgets contents uploaded before the given time
+func (db *DB) AddContent(sum string, content Content, before time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for old, c := range db.contents {
+		if c.UploadedAt.Before(before) {
+			delete(db.contents, old)
+		}
+	}
+	db.contents[sum] = content
+	return db.save()
+}
+
+// DeleteContent forgets an uploaded content, so an identical file is uploaded again
+func (db *DB) DeleteContent(sum string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.contents[sum]; !ok {
+		return nil
+	}
+	delete(db.contents, sum)
+	return db.save()
+}
+
+// AddObject records an uploaded object by its key and forgets objects uploaded before the given time
+func (db *DB) AddObject(key string, object Object, before time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for old, o := range db.objects {
+		if o.UploadedAt.Before(before) {
+			delete(db.objects, old)
+		}
+	}
+	db.objects[key] = object
+	return db.save()
+}
+
+// Objects returns recorded uploaded objects by their keys
+func (db *DB) Objects() map[string]Object {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	objects := make(map[string]Object, len(db.objects))
+	for key, object := range db.objects {
+		objects[key] = object
+	}
+	return objects
+}
+
+// NextCounter increments and returns the counter of unique key suffixes, it never returns the same value twice
+// for a persistent state
+func (db *DB) NextCounter() (uint64, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.counter++
+	if err := db.save(); err != nil {
+		db.counter--
+		return 0, err
+	}
+	return db.counter, nil
+}
+
+// DeleteObject forgets an uploaded object
+func (db *DB) DeleteObject(key string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.objects[key]; !ok {
+		return nil
+	}
+	delete(db.objects, key)
+	return db.save()
+}
+
+// AddSpill records a file or a group of files that didn't fit into the queue
+func (db *DB) AddSpill(file string, spill Spill) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.spilled[file] = spill
+	return db.save()
+}
+
+// Spilled returns files that didn't fit into the queue
+func (db *DB) Spilled() map[string]Spill {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	spilled := make(map[string]Spill, len(db.spilled))
+	for file, spill := range db.spilled {
+		spilled[file] = spill
+	}
+	return spilled
+}
+
+// DeleteSpill forgets a spilled file once it's queued again
+func (db *DB) DeleteSpill(file string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.spilled[file]; !ok {
+		return nil
+	}
+	delete(db.spilled, file)
+	return db.save()
+}
+
+// SetKeySuffix records the unique key suffix of a file version. The entry of an older version is replaced, its
+// multipart upload is kept until it's aborted.
+func (db *DB) SetKeySuffix(file string, size int64, modTime time.Time, suffix string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.entries[file]
+	if !ok || entry.Size != size || !entry.ModTime.Equal(modTime) {
+		entry = Entry{Status: StatusNamed, Size: size, ModTime: modTime, Upload: entry.Upload}
+	}
+	entry.KeySuffix = suffix
+	entry.UpdatedAt = time.Now()
+	db.entries[file] = entry
+	return db.save()
+}
+
+// DeleteKeySuffix forgets the unique key suffix of a file, the rest of its state is kept
+func (db *DB) DeleteKeySuffix(file string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.entries[file]
+	if !ok || entry.KeySuffix == "" {
+		return nil
+	}
+	if entry.Status == StatusNamed && entry.Upload == nil {
+		delete(db.entries, file)
+	} else {
+		entry.KeySuffix = ""
+		db.entries[file] = entry
+	}
+	return db.save()
+}
+
+// DeleteUpload forgets the multipart upload of a file. The key suffix is kept until the file is deleted, so a file
+// uploaded again after a crash gets the same key.
+func (db *DB) DeleteUpload(file string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	entry, ok := db.entries[file]
+	if !ok {
+		return nil
+	}
+	if entry.KeySuffix == "" {
+		delete(db.entries, file)
+	} else {
+		db.entries[file] = Entry{Status: StatusNamed, Size: entry.Size, ModTime: entry.ModTime, UpdatedAt: time.Now(),
+			KeySuffix: entry.KeySuffix}
+	}
+	return db.save()
+}
+
+// Delete forgets about a file
+func (db *DB) Delete(file string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if _, ok := db.entries[file]; !ok {
+		return nil
+	}
+	delete(db.entries, file)
+	return db.save()
+}
+
+// save writes the state to a temporary file and renames it, so the state file is never half written.
+// Must be called with the lock held.
+func (db *DB) save() error {
+	if db.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(stateFile{Files: db.entries, Contents: db.contents, Objects: db.objects, Spilled: db.spilled,
+		Counter: db.counter}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(db.path), filepath.Base(db.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to save state file %q: %s", db.path, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save state file %q: %s", db.path, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save state file %q: %s", db.path, err.Error())
+	}
+
+	return os.Rename(tmp.Name(), db.path)
+}
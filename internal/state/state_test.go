@@ -0,0 +1,114 @@
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDB(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	source := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(source, []byte("data"), 0644))
+	fi, err := os.Stat(source)
+	assert.Nil(t, err)
+
+	db, err := Open(path)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set(source, Entry{Status: StatusUndeletable, Size: fi.Size(), ModTime: fi.ModTime()}))
+
+	// State survives reopening
+	db, err = Open(path)
+	assert.Nil(t, err)
+	entry, ok := db.Get(source)
+	assert.True(t, ok)
+	assert.Equal(t, entry.Status, StatusUndeletable)
+	assert.True(t, entry.Matches(fi))
+
+	assert.Nil(t, db.Delete(source))
+	_, ok = db.Get(source)
+	assert.False(t, ok)
+
+	// Multipart upload state survives reopening
+	upload := &Upload{Key: "dump.sql", UploadID: "1", PreparedSize: fi.Size(), PreparedModTime: fi.ModTime(), PartSize: 5,
+		Parts: []Part{{Number: 1, ETag: "\"etag\""}}}
+	assert.Nil(t, db.Set(source, Entry{Status: StatusUploading, Upload: upload}))
+	db, err = Open(path)
+	assert.Nil(t, err)
+	assert.True(t, db.Persistent())
+	entry, ok = db.Get(source)
+	assert.True(t, ok)
+	assert.True(t, entry.Upload.Matches(fi))
+	assert.Equal(t, upload.Parts, entry.Upload.Parts)
+	assert.Equal(t, map[string]bool{"1": true}, db.UploadIDs())
+
+	// Key suffix outlives the completed upload and is gone with the file
+	assert.Nil(t, db.Set(source, Entry{Status: StatusUploading, Size: fi.Size(), ModTime: fi.ModTime(), Upload: upload}))
+	assert.Nil(t, db.SetKeySuffix(source, fi.Size(), fi.ModTime(), "X"))
+	entry, _ = db.Get(source)
+	assert.Equal(t, StatusUploading, entry.Status)
+	assert.Equal(t, "X", entry.KeySuffix)
+	assert.Nil(t, db.DeleteUpload(source))
+	db, err = Open(path)
+	assert.Nil(t, err)
+	entry, _ = db.Get(source)
+	assert.Equal(t, StatusNamed, entry.Status)
+	assert.Equal(t, "X", entry.KeySuffix)
+	assert.Nil(t, entry.Upload)
+	assert.Nil(t, db.DeleteKeySuffix(source))
+	_, ok = db.Get(source)
+	assert.False(t, ok)
+	assert.Nil(t, db.Set(source, Entry{Status: StatusUploading, Upload: upload}))
+
+	// Uploaded contents are kept until they are too old
+	now := time.Now()
+	assert.Nil(t, db.AddContent("old", Content{File: "old.sql", UploadedAt: now.Add(-time.Hour)}, now.Add(-2*time.Hour)))
+	assert.Nil(t, db.AddContent("new", Content{File: "new.sql", UploadedAt: now}, now.Add(-time.Minute)))
+	db, err = Open(path)
+	assert.Nil(t, err)
+	_, ok = db.Content("old")
+	assert.False(t, ok)
+	content, ok := db.Content("new")
+	assert.True(t, ok)
+	assert.Equal(t, "new.sql", content.File)
+	_, ok = db.Get(source)
+	assert.True(t, ok)
+
+	// Uploaded objects are kept until they are too old
+	assert.Nil(t, db.AddObject("backups/dump.sql", Object{Source: source, Size: 4, ETag: "\"etag\"", UploadedAt: now}, now.Add(-time.Hour)))
+	db, err = Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), db.Objects()["backups/dump.sql"].Size)
+	assert.Nil(t, db.DeleteObject("backups/dump.sql"))
+	assert.Empty(t, db.Objects())
+	assert.Nil(t, db.DeleteContent("new"))
+	_, ok = db.Content("new")
+	assert.False(t, ok)
+
+	// Spilled files are kept until they are queued again
+	assert.Nil(t, db.AddSpill(source, Spill{Group: []string{source}, SpilledAt: now}))
+	db, err = Open(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{source}, db.Spilled()[source].Group)
+	assert.Nil(t, db.DeleteSpill(source))
+	assert.Empty(t, db.Spilled())
+
+	// State files of older versions only have files
+	old := filepath.Join(dir, "old.json")
+	assert.Nil(t, os.WriteFile(old, []byte(`{"/data/dump.sql": {"status": "undeletable", "size": 4}}`), 0644))
+	db, err = Open(old)
+	assert.Nil(t, err)
+	entry, ok = db.Get("/data/dump.sql")
+	assert.True(t, ok)
+	assert.Equal(t, StatusUndeletable, entry.Status)
+
+	// In-memory state
+	db, err = Open("")
+	assert.Nil(t, err)
+	assert.False(t, db.Persistent())
+	assert.Nil(t, db.Set(source, Entry{Status: StatusUndeletable}))
+}
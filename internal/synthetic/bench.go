@@ -0,0 +1,160 @@
+package synthetic
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+)
+
+// ParseSizes parses a comma separated list of file sizes, e.g. "1MB,10MB,100MB"
+func ParseSizes(s string) ([]int64, error) {
+	var sizes []int64
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		size, err := utils.ParseBytes(item)
+		if err != nil {
+			return nil, err
+		}
+		if size <= 0 {
+			return nil, fmt.Errorf("file size must be positive: %q", item)
+		}
+		sizes = append(sizes, size)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no file sizes given")
+	}
+	return sizes, nil
+}
+
+// GenerateFiles writes n files into dir, sizes are taken from the list in turn
+func GenerateFiles(dir string, n int, sizes []int64) ([]string, error) {
+	files := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("bench-%06d", i)
+		if err := Generate(filepath.Join(dir, "."+name), filepath.Join(dir, name), sizes[i%len(sizes)]); err != nil {
+			return files, err
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
+
+// Stats collects per-phase latencies and transferred bytes of a benchmark, it's safe for concurrent use
+type Stats struct {
+	mu       sync.Mutex
+	phases   []string
+	samples  map[string][]time.Duration
+	files    int
+	failed   int
+	size     int64
+	uploaded int64
+}
+
+// Record adds a phase latency sample
+func (s *Stats) Record(phase string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.samples == nil {
+		s.samples = make(map[string][]time.Duration)
+	}
+	if _, ok := s.samples[phase]; !ok {
+		s.phases = append(s.phases, phase)
+	}
+	s.samples[phase] = append(s.samples[phase], d)
+}
+
+// Done records a processed file with its source and uploaded sizes
+func (s *Stats) Done(size, uploaded int64, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err != nil {
+		s.failed++
+		return
+	}
+	s.files++
+	s.size += size
+	s.uploaded += uploaded
+}
+
+// Latency is a summary of a phase latencies
+type Latency struct {
+	Count int
+	Avg   time.Duration
+	P50   time.Duration
+	P95   time.Duration
+	Max   time.Duration
+}
+
+// Latency summarizes latencies of a phase
+func (s *Stats) Latency(phase string) Latency {
+	s.mu.Lock()
+	samples := slices.Clone(s.samples[phase])
+	s.mu.Unlock()
+
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	slices.Sort(samples)
+
+	var total time.Duration
+	for _, d := range samples {
+		total += d
+	}
+	return Latency{
+		Count: len(samples),
+		Avg:   total / time.Duration(len(samples)),
+		P50:   percentile(samples, 50),
+		P95:   percentile(samples, 95),
+		Max:   samples[len(samples)-1],
+	}
+}
+
+// Nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// Print writes throughput and latency report for the given wall clock duration
+func (s *Stats) Print(w io.Writer, elapsed time.Duration) {
+	s.mu.Lock()
+	phases := slices.Clone(s.phases)
+	files, failed, size, uploaded := s.files, s.failed, s.size, s.uploaded
+	s.mu.Unlock()
+
+	fmt.Fprintf(w, "Files: %d uploaded, %d failed in %s\n", files, failed, elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Source size: %s, upload size: %s\n", utils.HumanizeBytes(size, false), utils.HumanizeBytes(uploaded, false))
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		fmt.Fprintf(w, "Throughput: %.1f files/s, %s source, %s upload\n", float64(files)/seconds,
+			utils.HumanizeBytes(int64(float64(size)/seconds), true), utils.HumanizeBytes(int64(float64(uploaded)/seconds), true))
+	}
+
+	fmt.Fprintf(w, "\n%-12s %8s %12s %12s %12s %12s\n", "phase", "count", "avg", "p50", "p95", "max")
+	for _, phase := range phases {
+		l := s.Latency(phase)
+		fmt.Fprintf(w, "%-12s %8d %12s %12s %12s %12s\n", phase, l.Count, roundLatency(l.Avg), roundLatency(l.P50),
+			roundLatency(l.P95), roundLatency(l.Max))
+	}
+}
+
+// Round latency for printing, sub-millisecond phases are common for small files
+func roundLatency(d time.Duration) time.Duration {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond)
+	}
+	return d.Round(time.Millisecond)
+}
@@ -0,0 +1,84 @@
+package synthetic
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+)
+
+// Producer settings
+type Producer struct {
+	Files    int
+	Size     int64
+	Interval time.Duration
+}
+
+// Enabled checks if synthetic producer is configured
+func (p Producer) Enabled() bool {
+	return p.Files > 0 && p.Interval > 0
+}
+
+// Run generates Files files of Size bytes every Interval into the watched directory until context is cancelled.
+// Files are written into a temporary directory first and then moved, like a real producer is expected to do.
+func (p Producer) Run(ctx context.Context, config cfg.AppConfig) {
+	tmpDir := filepath.Join(config.PathToWatch, ".synthetic")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		config.Applog.Errorf("Synthetic producer failed to create temporary directory: %s", err.Error())
+		return
+	}
+
+	tick := time.NewTicker(p.Interval)
+	defer tick.Stop()
+
+	config.Applog.Infof("Synthetic producer started: %d files of %d bytes every %s", p.Files, p.Size, p.Interval)
+	for {
+		select {
+		case <-ctx.Done():
+			config.Applog.Info("Synthetic producer exiting")
+			return
+		case <-tick.C:
+			for i := 0; i < p.Files; i++ {
+				name := fmt.Sprintf("synthetic-%d-%d", time.Now().UnixNano(), i)
+				if err := Generate(filepath.Join(tmpDir, name), filepath.Join(config.PathToWatch, name), p.Size); err != nil {
+					config.Applog.Errorf("Synthetic producer failed to generate file: %s", err.Error())
+					continue
+				}
+				config.Metrics.SyntheticFiles.WithLabelValues().Inc()
+			}
+		}
+	}
+}
+
+// Generate writes a file with random content to tmpFile and moves it to dstFile
+func Generate(tmpFile, dstFile string, size int64) error {
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+
+	var seed [32]byte
+	if _, err := cryptorand.Read(seed[:]); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	rnd := rand.NewChaCha8(seed)
+	if _, err := io.CopyN(f, rnd, size); err != nil {
+		f.Close()
+		os.Remove(tmpFile)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpFile)
+		return err
+	}
+
+	return os.Rename(tmpFile, dstFile)
+}
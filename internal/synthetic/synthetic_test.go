@@ -0,0 +1,81 @@
+package synthetic
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	tmpFile := filepath.Join(dir, "tmp")
+	dstFile := filepath.Join(dir, "dst")
+
+	assert.Nil(t, Generate(tmpFile, dstFile, 12345))
+	fi, err := os.Stat(dstFile)
+	assert.Nil(t, err)
+	assert.Equal(t, fi.Size(), int64(12345))
+	assert.NoFileExists(t, tmpFile)
+
+	// Every file has different content
+	other := filepath.Join(dir, "other")
+	assert.Nil(t, Generate(tmpFile, other, 12345))
+	first, err := os.ReadFile(dstFile)
+	assert.Nil(t, err)
+	second, err := os.ReadFile(other)
+	assert.Nil(t, err)
+	assert.False(t, bytes.Equal(first, second))
+}
+
+func TestParseSizes(t *testing.T) {
+	sizes, err := ParseSizes("1KB, 2MB,")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1000, 2000000}, sizes)
+
+	_, err = ParseSizes("")
+	assert.NotNil(t, err)
+	_, err = ParseSizes("0")
+	assert.NotNil(t, err)
+	_, err = ParseSizes("1KB,big")
+	assert.NotNil(t, err)
+}
+
+func TestGenerateFiles(t *testing.T) {
+	dir := t.TempDir()
+	files, err := GenerateFiles(dir, 3, []int64{10, 20})
+	assert.Nil(t, err)
+	assert.Len(t, files, 3)
+
+	for i, size := range []int64{10, 20, 10} {
+		fi, err := os.Stat(files[i])
+		assert.Nil(t, err)
+		assert.Equal(t, size, fi.Size())
+	}
+}
+
+func TestStats(t *testing.T) {
+	stats := &Stats{}
+	for i := 1; i <= 100; i++ {
+		stats.Record("upload", time.Duration(i)*time.Millisecond)
+	}
+	stats.Record("compress", time.Second)
+	stats.Done(100, 50, nil)
+	stats.Done(100, 0, errors.New("failed"))
+
+	l := stats.Latency("upload")
+	assert.Equal(t, 100, l.Count)
+	assert.Equal(t, 50*time.Millisecond, l.P50)
+	assert.Equal(t, 95*time.Millisecond, l.P95)
+	assert.Equal(t, 100*time.Millisecond, l.Max)
+	assert.Equal(t, Latency{}, stats.Latency("encrypt"))
+
+	var out bytes.Buffer
+	stats.Print(&out, time.Second)
+	assert.Contains(t, out.String(), "Files: 1 uploaded, 1 failed")
+	assert.Regexp(t, `(?s)upload .*compress `, out.String())
+}
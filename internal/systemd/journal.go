@@ -0,0 +1,122 @@
+package systemd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// JournalSocket is the socket journald reads entries of the native protocol from
+const JournalSocket = "/run/systemd/journal/socket"
+
+// Journal priorities, the same as syslog severities
+const (
+	PriorityCrit    = 2
+	PriorityErr     = 3
+	PriorityWarning = 4
+	PriorityInfo    = 6
+)
+
+// Priorities of line prefixes of github.com/google/logger loggers
+var logPriorities = []struct {
+	prefix   string
+	priority int
+}{
+	{"INFO : ", PriorityInfo},
+	{"WARN : ", PriorityWarning},
+	{"ERROR: ", PriorityErr},
+	{"FATAL: ", PriorityCrit},
+}
+
+// JournalWriter sends log lines to journald as entries with the priority of their level, the source location of
+// the line is sent in the CODE_FILE and CODE_LINE fields. Lines that can't be sent are dropped, so other outputs of
+// the logger still get them.
+type JournalWriter struct {
+	identifier string
+
+	mu   sync.Mutex
+	conn *net.UnixConn
+}
+
+// NewJournalWriter connects to the journal socket, entries are sent with the identifier as SYSLOG_IDENTIFIER
+func NewJournalWriter(socket, identifier string) (*JournalWriter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &JournalWriter{identifier: identifier, conn: conn}, nil
+}
+
+// Write sends a log line as a journal entry
+func (w *JournalWriter) Write(p []byte) (int, error) {
+	priority, file, line, message := parseLogLine(string(p))
+	fields := []journalField{
+		{"PRIORITY", strconv.Itoa(priority)},
+		{"SYSLOG_IDENTIFIER", w.identifier},
+	}
+	if file != "" {
+		fields = append(fields, journalField{"CODE_FILE", file}, journalField{"CODE_LINE", line})
+	}
+	fields = append(fields, journalField{"MESSAGE", message})
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.conn.Write(encodeJournalEntry(fields))
+	return len(p), nil
+}
+
+// Close closes the connection to the journal
+func (w *JournalWriter) Close() error {
+	return w.conn.Close()
+}
+
+// parseLogLine splits a line of a google/logger logger, e.g.
+// "WARN : 2024/01/02 15:04:05.000000 main.go:42: message", into its priority, source location and message.
+// Lines without a level prefix are sent with the info priority as they are.
+func parseLogLine(s string) (priority int, file, line, message string) {
+	s = strings.TrimSuffix(s, "\n")
+	for _, level := range logPriorities {
+		rest, ok := strings.CutPrefix(s, level.prefix)
+		if !ok {
+			continue
+		}
+		// Journald has its own timestamps
+		fields := strings.SplitN(rest, " ", 3)
+		if len(fields) < 3 {
+			return level.priority, "", "", rest
+		}
+		rest = fields[2]
+		location, msg, found := strings.Cut(rest, ": ")
+		file, line, hasLine := strings.Cut(location, ":")
+		if found && hasLine && !strings.Contains(location, " ") {
+			if _, err := strconv.Atoi(line); err == nil {
+				return level.priority, file, line, msg
+			}
+		}
+		return level.priority, "", "", rest
+	}
+	return PriorityInfo, "", "", s
+}
+
+type journalField struct {
+	name  string
+	value string
+}
+
+// encodeJournalEntry encodes fields in the journal native protocol, values with new lines are sent with their size
+func encodeJournalEntry(fields []journalField) []byte {
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if !strings.Contains(field.value, "\n") {
+			buf.WriteString(field.name + "=" + field.value + "\n")
+			continue
+		}
+		buf.WriteString(field.name + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(field.value)))
+		buf.WriteString(field.value + "\n")
+	}
+	return buf.Bytes()
+}
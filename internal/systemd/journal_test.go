@@ -0,0 +1,57 @@
+package systemd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLogLine(t *testing.T) {
+	priority, file, line, message := parseLogLine("WARN : 2024/01/02 15:04:05.000000 main.go:42: disk is slow: 90% used\n")
+	assert.Equal(t, PriorityWarning, priority)
+	assert.Equal(t, "main.go", file)
+	assert.Equal(t, "42", line)
+	assert.Equal(t, "disk is slow: 90% used", message)
+
+	priority, file, _, message = parseLogLine("ERROR: 2024/01/02 15:04:05.000000 no location here\n")
+	assert.Equal(t, PriorityErr, priority)
+	assert.Empty(t, file)
+	assert.Equal(t, "no location here", message)
+
+	priority, _, _, message = parseLogLine("plain line")
+	assert.Equal(t, PriorityInfo, priority)
+	assert.Equal(t, "plain line", message)
+}
+
+func TestJournalWriter(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "journal")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets are not supported: %s", err.Error())
+	}
+	defer conn.Close()
+
+	w, err := NewJournalWriter(socket, "s3-file-uploader")
+	assert.Nil(t, err)
+	defer w.Close()
+	buf := make([]byte, 512)
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+
+	line := []byte("ERROR: 2024/01/02 15:04:05.000000 main.go:42: upload failed\n")
+	n, err := w.Write(line)
+	assert.Nil(t, err)
+	assert.Equal(t, len(line), n)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "PRIORITY=3\nSYSLOG_IDENTIFIER=s3-file-uploader\nCODE_FILE=main.go\nCODE_LINE=42\nMESSAGE=upload failed\n", string(buf[:n]))
+
+	// Multi-line messages are sent with their size
+	_, err = w.Write([]byte("INFO : 2024/01/02 15:04:05.000000 main.go:7: a\nb\n"))
+	assert.Nil(t, err)
+	n, err = conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "MESSAGE\n\x03\x00\x00\x00\x00\x00\x00\x00a\nb\n", string(buf[n-20:n]))
+}
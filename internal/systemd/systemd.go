@@ -0,0 +1,46 @@
+// Package systemd talks to the service manager with the sd_notify protocol, so the uploader can run as a
+// Type=notify unit with WatchdogSec. Nothing is sent when the uploader is not started by systemd. Logs can be
+// sent to journald with the native journal protocol.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a state, e.g. READY=1, to the socket in $NOTIFY_SOCKET. It returns false without an error when
+// the socket is not set. Abstract socket names start with @.
+func Notify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns the watchdog timeout of the unit, zero when the watchdog is not enabled for this
+// process. systemd recommends pinging it twice as often.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// The watchdog is meant for another process, e.g. a wrapper script
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
@@ -0,0 +1,53 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := Notify("READY=1")
+	assert.Nil(t, err)
+	assert.False(t, sent)
+
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets are not supported: %s", err.Error())
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socket)
+	sent, err = Notify("READY=1")
+	assert.Nil(t, err)
+	assert.True(t, sent)
+
+	buf := make([]byte, 64)
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	assert.Equal(t, time.Duration(0), WatchdogInterval())
+
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	assert.Equal(t, 30*time.Second, WatchdogInterval())
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	assert.Equal(t, 30*time.Second, WatchdogInterval())
+
+	// Watchdog of another process
+	t.Setenv("WATCHDOG_PID", "1")
+	assert.Equal(t, time.Duration(0), WatchdogInterval())
+}
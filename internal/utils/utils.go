@@ -3,6 +3,7 @@ package utils
 import (
 	"fmt"
 	"net/url"
+	"strings"
 
 	"github.com/dustin/go-humanize"
 )
@@ -20,6 +21,19 @@ func HumanizeBytes(b int64, rate bool) string {
 		suffix)
 }
 
+// ParseBytes parses human readable size like "10MB" into bytes, empty string means 0
+func ParseBytes(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	b, err := humanize.ParseBytes(size)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse size %q: %s", size, err.Error())
+	}
+	return int64(b), nil
+}
+
 // HumanizeDurationSeconds returns human readable duration for value in float64 seconds
 func HumanizeDurationSeconds(seconds float64) string {
 	const unit = 1000
@@ -75,3 +89,22 @@ func ParseS3URL(uri string) (string, string, error) {
 
 	return u.Host, u.Path, nil
 }
+
+// ParseLabels parses comma separated key=value pairs
+func ParseLabels(labels string) (map[string]string, error) {
+	result := map[string]string{}
+	for _, pair := range strings.Split(labels, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("bad label %q, must be key=value", pair)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
@@ -25,6 +25,19 @@ func TestHumanizeBytes(t *testing.T) {
 	assert.Equal(t, res, "26 MB", "they should be equal")
 }
 
+func TestParseBytes(t *testing.T) {
+	res, err := ParseBytes("10MB")
+	assert.Nil(t, err)
+	assert.Equal(t, res, int64(10000000))
+
+	res, err = ParseBytes("")
+	assert.Nil(t, err)
+	assert.Equal(t, res, int64(0))
+
+	_, err = ParseBytes("ten")
+	assert.NotNil(t, err)
+}
+
 func TestValidateUrl(t *testing.T) {
 	assert.Nil(t, ValidateUrl("s3://my-bucket/"))
 	assert.Nil(t, ValidateUrl("s3://my-bucket/path/to/dir"))
@@ -37,3 +50,18 @@ func TestParseS3URL(t *testing.T) {
 	assert.Equal(t, bucket, "my-bucket")
 	assert.Equal(t, key, "/path/to/dir")
 }
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels("instance=db1, env=prod")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"instance": "db1", "env": "prod"}, labels)
+
+	labels, err = ParseLabels("")
+	assert.Nil(t, err)
+	assert.Empty(t, labels)
+
+	_, err = ParseLabels("instance")
+	assert.NotNil(t, err)
+	_, err = ParseLabels("=db1")
+	assert.NotNil(t, err)
+}
@@ -4,22 +4,60 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/impossiblecloud/s3-file-uploader/internal/alert"
+	"github.com/impossiblecloud/s3-file-uploader/internal/audit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/breaker"
 	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/control"
+	"github.com/impossiblecloud/s3-file-uploader/internal/dlock"
+	"github.com/impossiblecloud/s3-file-uploader/internal/dryrun"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+	"github.com/impossiblecloud/s3-file-uploader/internal/failures"
+	"github.com/impossiblecloud/s3-file-uploader/internal/features"
 	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/grpcapi"
+	"github.com/impossiblecloud/s3-file-uploader/internal/httpput"
+	"github.com/impossiblecloud/s3-file-uploader/internal/logfile"
+	"github.com/impossiblecloud/s3-file-uploader/internal/manifest"
+	"github.com/impossiblecloud/s3-file-uploader/internal/membudget"
 	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/pool"
+	"github.com/impossiblecloud/s3-file-uploader/internal/progress"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/ratelimit"
 	"github.com/impossiblecloud/s3-file-uploader/internal/s3"
+	"github.com/impossiblecloud/s3-file-uploader/internal/schedule"
+	"github.com/impossiblecloud/s3-file-uploader/internal/secret"
+	"github.com/impossiblecloud/s3-file-uploader/internal/sqssource"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+	"github.com/impossiblecloud/s3-file-uploader/internal/synthetic"
+	"github.com/impossiblecloud/s3-file-uploader/internal/systemd"
 	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
 
 	"github.com/google/logger"
@@ -27,6 +65,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/client_golang/prometheus/push"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 // Constants and vars
@@ -34,352 +74,2982 @@ const version = "0.0.1"
 const workersCannelSize = 1024
 const errorBadHTTPCode = "Bad HTTP status code"
 
+// Exit code of a run with more failed uploads than -fail-on-any or -max-error-rate allow
+const exitCodeUploadsFailed = 2
+
+// Exit code of a run stopped by a configuration error of an upload, e.g. a missing bucket
+const exitCodeConfigError = 3
+
+// Targets of the application log
+const (
+	logTargetStdout   = "stdout"
+	logTargetSyslog   = "syslog"
+	logTargetJournald = "journald"
+)
+
+// Directory watched when -path-to-watch and -watch-paths-file are not set
+const defaultPathToWatch = "/app/tmp"
+
+// How often age and size caps of -trash-dir and -dedup-dir are enforced
+const janitorInterval = 5 * time.Minute
+
+// Already compressed content that is not worth compressing again
+const defaultNoCompressExtensions = ".gz,.tgz,.zip,.bz2,.xz,.zst,.lz4,.7z,.rar,.jpg,.jpeg,.png,.gif,.webp,.mp3,.mp4,.mkv,.mov,.avi"
+
 var applog *logger.Logger
-var workerStatuses []cfg.WorkerStatus
+var binaryVersions map[string]string
 
-// Let's use the same buckets for histograms as NGINX Ingress controller
-var secondsDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+// Number of workers processing a file right now
+var busyWorkers atomic.Int64
+var startTime = time.Now()
 
-// Status for future web endpoint
-func handleStatus(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(http.StatusOK)
+// Uploaded and failed files of this run, they decide the exit code
+var runTally = failures.NewTally()
+
+// Set when a configuration error of an upload stopped the uploader
+var configFailed atomic.Bool
+
+// Recent configuration errors of uploads, the uploader stops only when they repeat
+var configErrors errorWindow
+
+// errorWindow counts errors within a sliding time window
+type errorWindow struct {
+	mu    sync.Mutex
+	times []time.Time
+}
+
+// add records an error at now and returns how many errors happened within window before and including it
+func (w *errorWindow) add(now time.Time, window time.Duration) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 
-	myStatus := cfg.AppStatus{
-		Workers: workerStatuses,
-		Version: version,
+	kept := w.times[:0]
+	for _, t := range w.times {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
 	}
+	w.times = append(kept, now)
+	return len(w.times)
+}
 
-	// Set headers
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// reset forgets all recorded errors
+func (w *errorWindow) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.times = nil
+}
 
-	// Make json output
-	jsonOut, err := json.Marshal(myStatus)
-	applog.Infof("Sending status: %v", myStatus)
+// Unix time in nanoseconds when a worker took the last message from the queue
+var lastDequeue atomic.Int64
+
+// Instance IDs are used in S3 keys and metric labels
+var instanceIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// sharedS3Path returns the path of an S3 URI without {instance}, instances uploading to paths of their own share
+// it, e.g. /db for s3://backups/{instance}/db. Claim locks are kept there, so all instances lock the same files.
+func sharedS3Path(s3uri string) string {
+	_, s3path, err := utils.ParseS3URL(strings.ReplaceAll(s3uri, "{instance}", ""))
 	if err != nil {
-		applog.Errorf("Failed to json.Marshal() status: %v", err)
-		http.Error(w, "Failed to json.Marshal() status", http.StatusInternalServerError)
-		return
+		return ""
 	}
-
-	fmt.Fprint(w, string(jsonOut))
+	return strings.TrimSuffix(path.Clean("/"+s3path), "/")
 }
 
-// Health-check handler
-func handleHealth(w http.ResponseWriter, r *http.Request) {
-	applog.V(8).Info("Got HTTP request for /health")
-	healthy := true
+// Let's use the same buckets for histograms as NGINX Ingress controller
+var secondsDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
 
-	for id, status := range workerStatuses {
-		if !status.Running {
-			healthy = false
-			applog.V(8).Infof("Worker %v is not running", id)
-		}
+// Snapshot of the application status
+func appStatus(config cfg.AppConfig, comm *queue.Queue) cfg.AppStatus {
+	return cfg.AppStatus{
+		Workers:    config.Status.Workers(),
+		Instance:   config.InstanceID,
+		Version:    version,
+		Binaries:   binaryVersions,
+		Started:    startTime,
+		Uptime:     time.Since(startTime).Round(time.Second).String(),
+		QueueDepth: comm.Len(),
+		Paused:     config.Control.Paused(),
+		Draining:   config.Control.Draining(),
+		Circuit:    config.Breaker.State(),
+		Scanners:   config.Status.Scanners(),
 	}
+}
 
-	if healthy {
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintf(w, "All workers are up and running")
+// Log status snapshot on SIGUSR1 for operators without access to the HTTP port. INFO logs show up on stdout only
+// with -verbose, so without it the snapshot is written to stderr as well.
+// Goroutine stacks are written to a file in goroutineDumpDir if it's set.
+func statusDumper(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, goroutineDumpDir string) {
+	if statusSignal == nil {
 		return
 	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, statusSignal)
+	defer signal.Stop(sigs)
 
-	http.Error(w, "Some workers are not running. Check applog for more details", http.StatusInternalServerError)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			var status strings.Builder
+			dumpStatus(&status, appStatus(config, comm))
+			for _, line := range strings.Split(strings.TrimSuffix(status.String(), "\n"), "\n") {
+				applog.Info(line)
+			}
+			if !config.Verbose {
+				os.Stderr.WriteString(status.String())
+			}
+			if goroutineDumpDir == "" {
+				continue
+			}
+			file, err := dumpGoroutines(goroutineDumpDir)
+			if err != nil {
+				applog.Errorf("Failed to dump goroutines: %s", err.Error())
+				continue
+			}
+			applog.Infof("Goroutine stacks written to %s", file)
+			if !config.Verbose {
+				fmt.Fprintf(os.Stderr, "Goroutine stacks written to %s\n", file)
+			}
+		}
+	}
 }
 
-// Prometheus metrics handler
-func handleMetrics(config cfg.AppConfig) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		applog.V(8).Info("Got HTTP request for /metrics")
+// Write human readable status with average rates since start
+func dumpStatus(w io.Writer, status cfg.AppStatus) {
+	var processed, failed, uploaded int64
+	for _, worker := range status.Workers {
+		processed += worker.FilesProcessed
+		failed += worker.FilesFailed
+		uploaded += worker.BytesUploaded
+	}
+	uptime := time.Since(status.Started).Seconds()
+
+	fmt.Fprintf(w, "Status: instance %s, version %s, uptime %s, queue depth %d, busy workers %d/%d, paused %t, draining %t\n",
+		status.Instance, status.Version, status.Uptime, status.QueueDepth, busyWorkers.Load(), len(status.Workers), status.Paused, status.Draining)
+	fmt.Fprintf(w, "Totals: %d files processed, %d failed, %s uploaded, %.2f files/s, %s\n", processed, failed,
+		utils.HumanizeBytes(uploaded, false), float64(processed)/uptime, utils.HumanizeBytes(int64(float64(uploaded)/uptime), true))
+	for id, worker := range status.Workers {
+		fmt.Fprintf(w, "Worker %d: running %t, phase %s", id, worker.Running, worker.Phase)
+		if worker.File != "" {
+			fmt.Fprintf(w, " %q for %s", worker.File, time.Since(worker.PhaseStarted).Round(time.Millisecond))
+		}
+		fmt.Fprintf(w, ", %d processed, %d failed", worker.FilesProcessed, worker.FilesFailed)
+		if worker.LastError != "" {
+			fmt.Fprintf(w, ", last error: %s", worker.LastError)
+		}
+		fmt.Fprintln(w)
+	}
 
-		promhttp.HandlerFor(prometheus.Gatherer(config.Metrics.Registry), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	paths := []string{}
+	for path := range status.Scanners {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	for _, path := range paths {
+		scanner := status.Scanners[path]
+		fmt.Fprintf(w, "Scanner %q: last run %s ago", path, time.Since(scanner.LastRun).Round(time.Millisecond))
+		if !scanner.LastScan.IsZero() {
+			fmt.Fprintf(w, ", last scan found %d files in %d entries", scanner.FilesFound, scanner.Entries)
+		}
+		if scanner.LastError != "" {
+			fmt.Fprintf(w, ", last error: %s", scanner.LastError)
+		}
+		fmt.Fprintln(w)
 	}
 }
 
-// Main web server
-func runMainWebServer(config cfg.AppConfig, listen string) {
-	// Setup http router
-	router := mux.NewRouter().StrictSlash(true)
+// Write stacks of all goroutines to a new file in dir
+func dumpGoroutines(dir string) (string, error) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
 
-	// Prometheus metrics
-	router.HandleFunc("/metrics", handleMetrics(config)).Methods("GET")
+	file := filepath.Join(dir, fmt.Sprintf("goroutines-%s.txt", time.Now().Format("20060102-150405.000")))
+	return file, os.WriteFile(file, buf, 0644)
+}
 
-	// Health-check endpoint
-	router.HandleFunc("/health", handleHealth).Methods("GET")
+// Status for future web endpoint
+func handleStatus(config cfg.AppConfig, comm *queue.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
 
-	// Status endpoint
-	router.HandleFunc("/status", handleStatus).Methods("GET")
+		myStatus := appStatus(config, comm)
 
-	// Log
-	applog.Info("Main web server started")
+		// Set headers
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	// Run main http router
-	applog.Fatal(http.ListenAndServe(listen, router))
+		// Make json output
+		jsonOut, err := json.Marshal(myStatus)
+		applog.Infof("Sending status: %v", myStatus)
+		if err != nil {
+			applog.Errorf("Failed to json.Marshal() status: %v", err)
+			http.Error(w, "Failed to json.Marshal() status", http.StatusInternalServerError)
+			return
+		}
+
+		fmt.Fprint(w, string(jsonOut))
+	}
 }
 
-// Init client
-func initHTTPClient(config cfg.AppConfig) (cfg.SenderClient, error) {
-	var err error
-	client := cfg.SenderClient{}
+// Health-check handler
+func handleHealth(config cfg.AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Info("Got HTTP request for /health")
+		healthy := true
 
-	tr := &http.Transport{
-		DisableKeepAlives: true,
-		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true}}
-	client.HttpClient = &http.Client{Transport: tr, Timeout: config.SendTimeout}
+		for id, status := range config.Status.Workers() {
+			if !status.Running {
+				healthy = false
+				applog.V(8).Infof("Worker %v is not running", id)
+			}
+		}
 
-	return client, err
-}
+		if healthy {
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintf(w, "All workers are up and running")
+			return
+		}
 
-// Init client
-func initS3Client(config cfg.AppConfig) (*s3.Client, error) {
-	return s3.NewClient(config)
+		http.Error(w, "Some workers are not running. Check applog for more details", http.StatusInternalServerError)
+	}
 }
 
-// Close client
-func closeClient(config cfg.AppConfig, client cfg.SenderClient) error {
-	var err error
-	client.HttpClient.CloseIdleConnections()
-	return err
+// Liveness handler, the process is alive as long as it can respond
+func handleLive(w http.ResponseWriter, r *http.Request) {
+	applog.V(8).Info("Got HTTP request for /healthz")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "OK")
 }
 
-// Send file to s3 bucket
-func sendFileS3(config cfg.AppConfig, client *s3.Client, file string) error {
-	var uploadedBytes int64
+// Readiness handler, checks that workers are running, the queue is not stuck and S3 is reachable
+func handleReady(config cfg.AppConfig, comm *queue.Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Info("Got HTTP request for /readyz")
 
-	fi, err := os.Stat(file)
-	if err != nil {
-		return err
+		if err := checkReady(r.Context(), config, comm); err != nil {
+			applog.V(8).Infof("Not ready: %s", err.Error())
+			http.Error(w, fmt.Sprintf("Not ready: %s", err.Error()), http.StatusServiceUnavailable)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Ready")
 	}
+}
 
-	size := utils.HumanizeBytes(fi.Size(), false)
-	applog.Infof("Sending %q file (%s) to %s", file, size, config.S3bucket)
+// Readiness checks
+func checkReady(ctx context.Context, config cfg.AppConfig, comm *queue.Queue) error {
+	for id, status := range config.Status.Workers() {
+		if !status.Running {
+			return fmt.Errorf("worker %d is not running", id)
+		}
+	}
 
-	err = fs.GzipFile(config, file)
-	if err != nil {
-		return err
+	// Paused uploads don't drain the queue on purpose
+	if config.ReadyQueueStuckTimeout > 0 && comm.Len() > 0 && uploadsAllowed(config) {
+		idle := time.Since(time.Unix(0, lastDequeue.Load()))
+		if busyWorkers.Load() == 0 && idle > config.ReadyQueueStuckTimeout {
+			return fmt.Errorf("%d files are queued but none was taken by workers for %s", comm.Len(), idle.Round(time.Second))
+		}
 	}
 
-	err = fs.EncryptFile(config, file)
-	if err != nil {
-		return err
+	// The S3 client is shared with workers, so probes don't create a session per request
+	if config.ReadyCheckS3 && !config.DryRun && config.HTTPURL == "" {
+		client, err := initS3Client(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize S3 client: %s", err.Error())
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, config.SendTimeout)
+		defer cancel()
+		if err := client.CheckBucket(ctx, config); err != nil {
+			return fmt.Errorf("S3 bucket %q is not reachable: %s", config.S3bucket, err.Error())
+		}
 	}
 
-	if config.DryRun {
-		uploadedBytes, err = s3.FakeUploadFile(config, file)
-		// For tests with unpack/decrypt
-		// err = s3.CopyFile(config, file)
-	} else {
-		uploadedBytes, err = client.UploadFile(config, file)
+	return nil
+}
+
+// Liveness checks for the systemd watchdog, it's not pinged while a worker or a scanner is stuck, so systemd
+// restarts the service
+func checkAlive(config cfg.AppConfig, comm *queue.Queue) error {
+	for id, status := range config.Status.Workers() {
+		if !status.Running {
+			return fmt.Errorf("worker %d is not running", id)
+		}
+		// Stages are cancelled after -per-file-timeout, a worker that is still in one long after is hung
+		busy := status.Phase != cfg.PhaseIdle && status.Phase != cfg.PhaseQueued
+		if busy && config.PerFileTimeout > 0 && time.Since(status.PhaseStarted) > 2*config.PerFileTimeout {
+			return fmt.Errorf("worker %d is %s %q for %s", id, status.Phase, status.File, time.Since(status.PhaseStarted).Round(time.Second))
+		}
 	}
 
-	if err != nil {
-		return err
+	// Scanners wait for workers while the queue is full
+	if comm.Len() < comm.Cap() {
+		timeout := max(3*config.ScanInterval, 3*config.ScanIntervalMax, time.Minute)
+		if stalled := config.Status.StalledScanners(timeout); len(stalled) > 0 {
+			return fmt.Errorf("scanner of %s hasn't run for over %s", strings.Join(stalled, ", "), timeout)
+		}
 	}
 
-	// If we're here, upload was successful
-	config.Metrics.FileOrigBytesSum.WithLabelValues().Add(float64(fi.Size()))
-	config.Metrics.FileSendBytesSum.WithLabelValues().Add(float64(uploadedBytes))
-	return fs.DeleteFile(config, file)
+	return nil
 }
 
-// Main loop
-func upload(ctx context.Context, config cfg.AppConfig, comm *chan cfg.Message) {
-	applog.Info("Main upload loop started")
+// Ping the systemd watchdog twice per its timeout while workers and scanners are alive
+func systemdWatchdog(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, timeout time.Duration) {
+	tick := time.NewTicker(timeout / 2)
+	defer tick.Stop()
 
-	// Keep uploading until we receive exit signal
 	for {
 		select {
-		// Exit signal
 		case <-ctx.Done():
-			applog.Info("Upload function exiting")
-			close(*comm)
 			return
+		case <-tick.C:
+			if err := checkAlive(config, comm); err != nil {
+				applog.Errorf("Not pinging systemd watchdog: %s", err.Error())
+				systemd.Notify("STATUS=" + err.Error())
+				continue
+			}
+			if _, err := systemd.Notify("WATCHDOG=1"); err != nil {
+				applog.Errorf("Failed to ping systemd watchdog: %s", err.Error())
+			}
 		}
 	}
 }
 
-// Metrics updater
-func updateMetrics(config cfg.AppConfig, comm *chan cfg.Message) {
-	// Updating every 2 seconds is frequent enough
-	tick := time.Tick(2 * time.Second)
+// Runtime feature flags handler, GET returns all flags, POST and PUT update them from a JSON object
+func handleFlags(config cfg.AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Infof("Got HTTP %s request for /flags", r.Method)
 
-	for {
-		select {
-		// Tick handler
-		case <-tick:
-			config.Metrics.ChannelLength.WithLabelValues().Set(float64(len(*comm)))
+		if r.Method != http.MethodGet {
+			values := map[string]interface{}{}
+			if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+				http.Error(w, fmt.Sprintf("Failed to parse request body: %s", err.Error()), http.StatusBadRequest)
+				return
+			}
+			if err := config.Features.Update(values); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			applog.Infof("Feature flags updated: %v", values)
+		}
+
+		jsonOut, err := json.Marshal(config.Features.All())
+		if err != nil {
+			applog.Errorf("Failed to json.Marshal() feature flags: %v", err)
+			http.Error(w, "Failed to json.Marshal() feature flags", http.StatusInternalServerError)
+			return
 		}
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(jsonOut))
 	}
 }
 
-// Worker
-func worker(wg *sync.WaitGroup, ctx context.Context, id int, config cfg.AppConfig, comm chan cfg.Message, status *cfg.WorkerStatus) {
+// Failed uploads handler
+func handleFailures(config cfg.AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Info("Got HTTP request for /api/v1/failures")
 
-	applog.Infof("Worker %d started", id)
-	defer wg.Done()
-	status.ID = id
-	status.Running = true
+		jsonOut, err := json.Marshal(config.Failures.All())
+		if err != nil {
+			applog.Errorf("Failed to json.Marshal() failures: %v", err)
+			http.Error(w, "Failed to json.Marshal() failures", http.StatusInternalServerError)
+			return
+		}
 
-	// Init client per worker to use keep alive where possible
-	client, err := initS3Client(config)
-	if err != nil {
-		status.Running = false
-		applog.Errorf("Worker %v: Failed to initialize sender client: %s", id, err.Error())
-		applog.Errorf("Worker %v failed, exiting", id)
-		return
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(jsonOut))
 	}
+}
 
-	// Main select
-	for {
-		select {
+// Result of a file uploaded to the ingest endpoint
+type ingestResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
 
-		case <-ctx.Done():
-			status.Running = false
-			client.Close()
-			applog.Infof("Worker %d exiting", id)
-			return
+// Ingest handler, files of a multipart form are written into the first watched directory and queued. Files that
+// can't be queued right away are left for the directory scanner. Requests known to be over the size limit are
+// refused before any file is written. When the limit is hit partway, files of earlier parts stay queued and the
+// 413 response has the results of all parts read, so a client resends only the rejected ones.
+func handleIngest(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, maxSize int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Infof("Got HTTP request for /api/v1/ingest from %s", r.RemoteAddr)
 
-		case msg := <-comm:
+		if config.Control.Draining() {
+			http.Error(w, "Uploader is draining, no new files are accepted", http.StatusServiceUnavailable)
+			return
+		}
+		tooLarge := fmt.Sprintf("Request is larger than %s", utils.HumanizeBytes(maxSize, false))
+		if maxSize > 0 && r.ContentLength > maxSize {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if maxSize > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+		}
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read multipart form: %s", err.Error()), http.StatusBadRequest)
+			return
+		}
 
-			if config.ExitOnFilename != "" && msg.File == config.ExitOnFilename {
-				config.Applog.Infof("Worker %d: triggering exit on file: %q", id, msg.File)
-				config.CancelFunction()
+		results := []ingestResult{}
+		code := http.StatusAccepted
+	parts:
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if isMaxBytesError(err) {
+				code = http.StatusRequestEntityTooLarge
+				break
+			}
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Failed to read multipart form: %s", err.Error()), http.StatusBadRequest)
 				return
 			}
+			// Form fields without a file name aren't files
+			name := part.FileName()
+			if name == "" {
+				part.Close()
+				continue
+			}
 
-			applog.Infof("Worker %d: processing file %q", id, msg.File)
-			fs.Lock(msg.File, id)
-
-			config.Metrics.FileSendCount.WithLabelValues().Inc()
-			err := sendFileS3(config, client, msg.File)
-			if err != nil {
-				config.Metrics.FileSendErrors.WithLabelValues().Inc()
-				applog.Errorf("Failed to send file %q, it will be retried later. Error: %s", msg.File, err.Error())
-			} else {
-				config.Metrics.FileSendSuccess.WithLabelValues().Inc()
+			result, err := ingestFile(ctx, config, comm, name, part)
+			part.Close()
+			// The limit can be hit while a file is copied, the rest of the request is not read then
+			if isMaxBytesError(err) {
+				result.Error = tooLarge
+				results = append(results, result)
+				code = http.StatusRequestEntityTooLarge
+				break parts
+			}
+			if result.Error != "" {
+				code = http.StatusUnprocessableEntity
 			}
-			fs.UnLock(msg.File)
+			results = append(results, result)
 		}
+		if code == http.StatusRequestEntityTooLarge && len(results) == 0 {
+			http.Error(w, tooLarge, code)
+			return
+		}
+		if len(results) == 0 {
+			http.Error(w, "No files in multipart form", http.StatusBadRequest)
+			return
+		}
+
+		jsonOut, err := json.Marshal(results)
+		if err != nil {
+			applog.Errorf("Failed to json.Marshal() ingest results: %v", err)
+			http.Error(w, "Failed to json.Marshal() ingest results", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		fmt.Fprint(w, string(jsonOut))
 	}
 }
 
-// Functions for pushing metrics
-func prometheusMetricsPusher(config cfg.AppConfig) {
-	tick := time.Tick(config.PushInterval)
+// Check if reading a request body failed because it's over the size limit
+func isMaxBytesError(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
 
-	pusher := push.New(config.PushGateway, "app").Gatherer(config.Metrics.Registry)
+// Write a file uploaded to the ingest endpoint into the first watched directory and queue it. The error of
+// receiving the file is returned along with the rejected result.
+func ingestFile(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, name string, r io.Reader) (ingestResult, error) {
+	result := ingestResult{Name: name}
 
-	for {
-		select {
-		// Tick event
-		case <-tick:
+	file, err := fs.ReceiveFile(config, name, r)
+	if err != nil {
+		applog.Errorf("Failed to receive ingested file %q: %s", name, err.Error())
+		result.Status, result.Error = "rejected", err.Error()
+		config.Metrics.IngestedFiles.WithLabelValues(result.Status).Inc()
+		return result, err
+	}
 
-			applog.Info("Pushing metrics to Prometheus Pushgateway")
+	err = fs.QueueFile(ctx, comm, config, file)
+	switch {
+	case err == nil:
+		result.Status = "queued"
+	case errors.Is(err, fs.ErrFileSkipped):
+		// Nothing would ever upload the file
+		os.Remove(file)
+		result.Status, result.Error = "rejected", err.Error()
+	default:
+		applog.Infof("Ingested file %q is left for the directory scanner: %s", file, err.Error())
+		result.Status = "stored"
+	}
+	applog.Infof("Ingested file %q: %s", file, result.Status)
+	config.Metrics.IngestedFiles.WithLabelValues(result.Status).Inc()
+	return result, nil
+}
 
-			if err := pusher.Add(); err != nil {
-				applog.Errorf("Could not push to Pushgateway: %s", err.Error())
-			}
+// Directory scan trigger handler
+func handleScan(config cfg.AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Info("Got HTTP request for /admin/scan")
+
+		w.WriteHeader(http.StatusAccepted)
+		if !fs.TriggerScan(config) {
+			fmt.Fprint(w, "Directory scan is already pending")
+			return
 		}
+		applog.Info("Directory scan triggered via HTTP")
+		fmt.Fprint(w, "Directory scan triggered")
 	}
 }
 
-// Main!
-func main() {
-	var listen, s3uri string
-	var wg sync.WaitGroup
-	var showVersion bool
-	var ctxWithCancel context.Context
-	var err error
-
-	// Init config
-	config := cfg.AppConfig{}
-	config.WorkersCannelSize = workersCannelSize
+// Trigger directory scan on SIGUSR2
+func scanSignalHandler(ctx context.Context, config cfg.AppConfig) {
+	if scanSignal == nil {
+		return
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, scanSignal)
+	defer signal.Stop(sigs)
 
-	//Make a background context.
-	ctx := context.Background()
-	// Make a new context with cancel, we'll use it to make sure all routines can exit properly.
-	ctxWithCancel, config.CancelFunction = context.WithCancel(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sigs:
+			applog.Info("Directory scan triggered via SIGUSR2")
+			fs.TriggerScan(config)
+		}
+	}
+}
 
-	// Arguments
-	flag.BoolVar(&showVersion, "version", false, "Show version and exit")
-	flag.IntVar(&config.Workers, "workers", 1, "The number of worker threads")
-	flag.StringVar(&listen, "listen", ":8765", "Address:port to listen on for exposing metrics")
-	flag.BoolVar(&config.Verbose, "verbose", false, "Print INFO level applog to stdout")
-	flag.BoolVar(&config.DryRun, "dry-run", false, "Wether to run in a dry-run mode")
-	flag.StringVar(&config.PathToWatch, "path-to-watch", "/app/tmp", "FS path to watch for events")
-	flag.StringVar(&config.ExitOnFilename, "exit-on-filename", "", "If this filename is detected by fsWatch, the program exits")
-	flag.DurationVar(&config.ScanInterval, "scan-interval", time.Second*10, "Directory scan interval")
+// Runtime debug variables handler
+func handleDebugVars(w http.ResponseWriter, r *http.Request) {
+	applog.V(8).Info("Got HTTP request for /debug/vars")
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	vars := map[string]interface{}{
+		"goroutines":      runtime.NumGoroutine(),
+		"gomaxprocs":      runtime.GOMAXPROCS(0),
+		"heap_alloc":      mem.HeapAlloc,
+		"heap_sys":        mem.HeapSys,
+		"heap_objects":    mem.HeapObjects,
+		"total_alloc":     mem.TotalAlloc,
+		"sys":             mem.Sys,
+		"num_gc":          mem.NumGC,
+		"gc_pause_total":  time.Duration(mem.PauseTotalNs).String(),
+		"gc_last":         time.Unix(0, int64(mem.LastGC)).Format(time.RFC3339),
+		"gc_cpu_fraction": mem.GCCPUFraction,
+	}
 
-	flag.StringVar(&s3uri, "s3-uri", "", "S3 bucket to upload to")
-	flag.DurationVar(&config.SendTimeout, "send-timeout", time.Second*10, "Send request timeout")
+	jsonOut, err := json.Marshal(vars)
+	if err != nil {
+		applog.Errorf("Failed to json.Marshal() debug vars: %v", err)
+		http.Error(w, "Failed to json.Marshal() debug vars", http.StatusInternalServerError)
+		return
+	}
 
-	flag.BoolVar(&config.Encrypt, "gzip", true, "Wether to gzip a file before uploading")
-	flag.BoolVar(&config.Gzip, "encrypt", true, "Wether to encrypt a file before uploading")
-	flag.StringVar(&config.GzipDir, "gzip-dir", "/app/gzip", "Directory to store temporary gzipped files in")
-	flag.StringVar(&config.EncryptDir, "encrypt-dir", "/app/enc", "Directory to store temporary encrypted files in")
-	flag.StringVar(&config.EnvVarGPGPass, "env-var-name-gpg-password", "GPG_PASSWORD", "Env var name with GPG password")
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, string(jsonOut))
+}
 
-	flag.StringVar(&config.PushGateway, "push-gateway", "", "Prometheus Pushgateway URL")
-	flag.DurationVar(&config.PushInterval, "push-interval", time.Second*15, "Metrics push interval")
+// Prometheus metrics handler
+func handleMetrics(config cfg.AppConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		applog.V(8).Info("Got HTTP request for /metrics")
+
+		promhttp.HandlerFor(prometheus.Gatherer(config.Metrics.Registry), promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	}
+}
+
+// Main web server settings
+type webServerOptions struct {
+	Listen          string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+	TLSCertFile     string
+	TLSKeyFile      string
+	AdminAuth       string
+	Debug           bool
+	Ingest          bool
+	IngestMaxSize   int64
+}
+
+// noWriteDeadline lets the handler write longer than -http-write-timeout, profiles are collected for as long as
+// the client asks
+func noWriteDeadline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			applog.V(8).Infof("Failed to clear write deadline for %s: %s", r.URL.Path, err.Error())
+		}
+		next(w, r)
+	}
+}
+
+// Require HTTP basic auth for admin endpoints if credentials are set
+func adminAuth(opts webServerOptions, next http.HandlerFunc) http.HandlerFunc {
+	if opts.AdminAuth == "" {
+		return next
+	}
+	wantUser, wantPass, _ := strings.Cut(opts.AdminAuth, ":")
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(wantPass)) == 1
+		if !ok || !userOK || !passOK {
+			applog.V(8).Infof("Unauthorized HTTP request for %s from %s", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Basic realm="s3-file-uploader"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Main web server, shuts down gracefully when the context is cancelled and closes done after that
+func runMainWebServer(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, opts webServerOptions, done chan<- struct{}) {
+	defer close(done)
+
+	// Setup http router
+	router := mux.NewRouter().StrictSlash(true)
+
+	// Prometheus metrics
+	router.HandleFunc("/metrics", adminAuth(opts, handleMetrics(config))).Methods("GET")
+
+	// Health-check endpoint
+	router.HandleFunc("/health", handleHealth(config)).Methods("GET")
+
+	// Kubernetes liveness and readiness endpoints
+	router.HandleFunc("/healthz", handleLive).Methods("GET")
+	router.HandleFunc("/readyz", handleReady(config, comm)).Methods("GET")
+
+	// Status endpoint
+	router.HandleFunc("/status", adminAuth(opts, handleStatus(config, comm))).Methods("GET")
+
+	// Immediate directory scan endpoint
+	router.HandleFunc("/admin/scan", adminAuth(opts, handleScan(config))).Methods("POST")
+
+	// Last failed uploads
+	router.HandleFunc("/api/v1/failures", adminAuth(opts, handleFailures(config))).Methods("GET")
+
+	// File upload endpoint
+	if opts.Ingest {
+		router.HandleFunc("/api/v1/ingest", adminAuth(opts, handleIngest(ctx, config, comm, opts.IngestMaxSize))).Methods("POST")
+		applog.Infof("Accepting files on /api/v1/ingest")
+	}
+
+	// Runtime feature flags endpoint
+	router.HandleFunc("/flags", adminAuth(opts, handleFlags(config))).Methods("GET", "POST", "PUT")
+
+	// Profiling and runtime debug endpoints
+	if opts.Debug {
+		router.HandleFunc("/debug/vars", adminAuth(opts, handleDebugVars)).Methods("GET")
+		router.HandleFunc("/debug/pprof/cmdline", adminAuth(opts, pprof.Cmdline))
+		router.HandleFunc("/debug/pprof/profile", adminAuth(opts, noWriteDeadline(pprof.Profile)))
+		router.HandleFunc("/debug/pprof/symbol", adminAuth(opts, pprof.Symbol))
+		router.HandleFunc("/debug/pprof/trace", adminAuth(opts, noWriteDeadline(pprof.Trace)))
+		router.PathPrefix("/debug/pprof/").HandlerFunc(adminAuth(opts, noWriteDeadline(pprof.Index)))
+		applog.Info("Debug endpoints enabled on /debug/pprof and /debug/vars")
+	}
+
+	server := &http.Server{
+		Addr:         opts.Listen,
+		Handler:      router,
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			applog.Errorf("Failed to shut down main web server gracefully: %s", err.Error())
+			server.Close()
+		}
+	}()
+
+	// Log
+	applog.Info("Main web server started")
+
+	// Run main http router
+	var err error
+	if opts.TLSCertFile != "" {
+		err = server.ListenAndServeTLS(opts.TLSCertFile, opts.TLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		applog.Fatal(err)
+	}
+
+	<-shutdownDone
+	applog.Info("Main web server stopped")
+}
+
+// gRPC API server, it uses TLS and basic auth settings of the main web server. It stops when the context is
+// cancelled and closes done after that.
+func runGRPCServer(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, opts webServerOptions, listen string, done chan<- struct{}) {
+	defer close(done)
+
+	serverOpts := []grpc.ServerOption{}
+	if opts.TLSCertFile != "" {
+		creds, err := credentials.NewServerTLSFromFile(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			applog.Fatalf("Failed to load gRPC server certificate: %s", err.Error())
+		}
+		serverOpts = append(serverOpts, grpc.Creds(creds))
+	}
+	service := grpcapi.New(config, comm, func() cfg.AppStatus { return appStatus(config, comm) }, opts.IngestMaxSize)
+	server := grpcapi.NewServer(service, opts.AdminAuth, serverOpts...)
+
+	lis, err := net.Listen("tcp", listen)
+	if err != nil {
+		applog.Fatalf("Failed to listen for gRPC: %s", err.Error())
+	}
+
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+
+		stopped := make(chan struct{})
+		go func() {
+			server.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(opts.ShutdownTimeout):
+			applog.Error("Failed to shut down gRPC server gracefully")
+			server.Stop()
+		}
+	}()
+
+	applog.Infof("gRPC server started on %s", listen)
+	if err := server.Serve(lis); err != nil {
+		applog.Fatal(err)
+	}
+
+	<-shutdownDone
+	applog.Info("gRPC server stopped")
+}
+
+// Init client
+func initHTTPClient(config cfg.AppConfig) (cfg.SenderClient, error) {
+	var err error
+	client := cfg.SenderClient{}
+
+	// Large uploads take longer than -send-timeout, they are limited by -per-file-timeout instead
+	tr := &http.Transport{
+		DisableKeepAlives:     true,
+		ResponseHeaderTimeout: config.SendTimeout,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: config.HTTPInsecureTLS}}
+	client.HttpClient = &http.Client{Transport: tr}
+
+	return client, err
+}
+
+// Uploads prepared files to the destination, an S3 bucket or an HTTP endpoint
+type fileUploader interface {
+	UploadFile(ctx context.Context, config cfg.AppConfig, filename string) (int64, error)
+	Close()
+}
+
+// Uploads files to their destination, an S3 bucket or an HTTP endpoint
+type destinationClient struct {
+	s3   *s3.Client
+	http *httpput.Client
+}
+
+// UploadFile uploads a file with the client of its destination
+func (client *destinationClient) UploadFile(ctx context.Context, config cfg.AppConfig, filename string) (int64, error) {
+	if config.HTTPURL != "" {
+		return client.http.UploadFile(ctx, config, filename)
+	}
+	return client.s3.UploadFile(ctx, config, filename)
+}
+
+// Close closes clients of all destinations
+func (client *destinationClient) Close() {
+	client.s3.Close()
+	client.http.Close()
+}
+
+// Init uploader of all destinations, files are routed to -s3-uri, -http-url or -routes-file destinations
+func initUploader(config cfg.AppConfig) (fileUploader, error) {
+	s3Client, err := initS3Client(config)
+	if err != nil {
+		return nil, err
+	}
+	sender, err := initHTTPClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &destinationClient{s3: s3Client, http: httpput.NewClient(sender)}, nil
+}
+
+// Check that all buckets files are uploaded to have object lock enabled and lifecycle rules for the expiry tag
+func preflightBuckets(config cfg.AppConfig) error {
+	client, err := initS3Client(config)
+	if err != nil {
+		return err
+	}
+
+	buckets := []string{}
+	if config.S3bucket != "" {
+		buckets = append(buckets, config.S3bucket)
+	}
+	for _, route := range config.Routes {
+		if route.S3bucket != "" && !slices.Contains(buckets, route.S3bucket) {
+			buckets = append(buckets, route.S3bucket)
+		}
+	}
+
+	for _, bucket := range buckets {
+		bucketConfig := config
+		bucketConfig.S3bucket = bucket
+		ctx, cancel := context.WithTimeout(context.Background(), config.SendTimeout)
+		defer cancel()
+
+		if config.ObjectLockMode != "" {
+			if err := client.CheckObjectLock(ctx, bucketConfig); err != nil {
+				return err
+			}
+			applog.Infof("Object lock is enabled on bucket %q, objects are retained in %s mode", bucket, config.ObjectLockMode)
+		}
+		if config.ExpiryCheck {
+			if err := client.CheckLifecycle(ctx, bucketConfig); err != nil {
+				return err
+			}
+			applog.Infof("Bucket %q expires objects tagged %s=%s", bucket, s3.ExpiryTagKey, s3.ExpiryTagValue(config.ExpiryTagDays))
+		}
+	}
+	return nil
+}
+
+// Name of the destination for logs
+func destinationName(config cfg.AppConfig) string {
+	if config.HTTPURL != "" {
+		return config.HTTPURL
+	}
+	return fmt.Sprintf("s3://%s%s", config.S3bucket, config.S3path)
+}
+
+// S3 client shared by workers, the SDK reuses part buffers between uploads of the same client
+var sharedS3Client *s3.Client
+var sharedS3ClientLock sync.Mutex
+
+// Init client
+func initS3Client(config cfg.AppConfig) (*s3.Client, error) {
+	sharedS3ClientLock.Lock()
+	defer sharedS3ClientLock.Unlock()
+
+	if sharedS3Client == nil {
+		client, err := s3.NewClient(config)
+		if err != nil {
+			return nil, err
+		}
+		sharedS3Client = client
+	}
+	return sharedS3Client, nil
+}
+
+// Init secrets provider for a secret stored in a remote secrets store
+func initSecretsProvider(provider, ref, vaultAddr, vaultTokenFile string, refresh time.Duration) (secret.Provider, error) {
+	switch provider {
+	case "vault":
+		if vaultAddr == "" {
+			return nil, fmt.Errorf("-vault-addr is not specified")
+		}
+
+		var token secret.Provider = secret.Static(os.Getenv("VAULT_TOKEN"))
+		if vaultTokenFile != "" {
+			file, err := secret.NewFile(vaultTokenFile)
+			if err != nil {
+				return nil, err
+			}
+			token = file
+		}
+		return secret.NewVault(vaultAddr, token, ref, refresh)
+
+	case "aws-secrets-manager":
+		return secret.NewAWSSecretsManager(ref, refresh)
+	}
+
+	return nil, fmt.Errorf("unsupported secrets provider %q, must be vault or aws-secrets-manager", provider)
+}
+
+// Close client
+func closeClient(config cfg.AppConfig, client cfg.SenderClient) error {
+	var err error
+	client.HttpClient.CloseIdleConnections()
+	return err
+}
+
+// Check if workers may upload now, uploads can be paused with a feature flag or limited to a time window
+func uploadsAllowed(config cfg.AppConfig) bool {
+	return config.Features.Bool(features.UploadsEnabled) && config.UploadWindow.Contains(time.Now()) && !config.Control.Paused() &&
+		config.Breaker.Allow()
+}
+
+// Act on control files dropped into the watched directory by producers
+func controlLoop(ctx context.Context, config cfg.AppConfig, comm *queue.Queue) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+
+		changed, err := config.Control.Check()
+		if err != nil {
+			applog.Errorf("Failed to check control files: %s", err.Error())
+		}
+		if changed {
+			applog.Infof("Control files changed: paused %t, draining %t, exiting %t",
+				config.Control.Paused(), config.Control.Draining(), config.Control.Exiting())
+		}
+
+		if config.Control.Exiting() {
+			applog.Infof("Exiting on %s control file", control.ExitFile)
+			config.CancelFunction()
+			return
+		}
+		// Messages are counted in flight by the queue when they are taken, so one taken but not processed yet
+		// doesn't look drained
+		if config.Control.Draining() && comm.Idle() {
+			applog.Infof("Queue is drained on %s control file, exiting", control.DrainFile)
+			config.CancelFunction()
+			return
+		}
+	}
+}
+
+// Set worker phase and the file it works on
+func setWorkerPhase(worker cfg.WorkerRef, phase, file string) {
+	worker.Update(func(s *cfg.WorkerStatus) {
+		s.Phase = phase
+		s.File = file
+		s.PhaseStarted = time.Now()
+		s.UploadDone, s.UploadTotal, s.UploadRate = 0, 0, 0
+	})
+}
+
+// Update worker counters when it's done with a message
+func finishWorkerMessage(worker cfg.WorkerRef, err error) {
+	worker.Update(func(s *cfg.WorkerStatus) {
+		if err != nil {
+			s.FilesFailed++
+			s.LastError = err.Error()
+		} else {
+			s.FilesProcessed++
+		}
+		s.Phase = cfg.PhaseIdle
+		s.File = ""
+		s.PhaseStarted = time.Now()
+		s.UploadDone, s.UploadTotal, s.UploadRate = 0, 0, 0
+	})
+}
+
+// Set worker running state
+func setWorkerRunning(worker cfg.WorkerRef, running bool) {
+	worker.Update(func(s *cfg.WorkerStatus) {
+		s.Running = running
+	})
+}
+
+// Send file to its destination and delete it, a file with already uploaded content is only deleted
+func sendFileS3(config cfg.AppConfig, client fileUploader, status cfg.WorkerRef, file string) error {
+	config = fs.RouteConfig(config, file)
+
+	sum, err := fs.ContentSum(config, file)
+	if err != nil {
+		return err
+	}
+	if uploaded, ok := fs.UploadedContent(config, sum); ok {
+		applog.Infof("File %q has the same content as %q uploaded to %q at %s, skipping upload", file, uploaded.File,
+			uploaded.Key, uploaded.UploadedAt.Format(time.RFC3339))
+		config.Metrics.FileDedupHits.WithLabelValues().Inc()
+		return runStage(config, status, config.Pipeline.Cleanup, cfg.PhaseDeleting, file, func(ctx context.Context) error {
+			return fs.RemoveDuplicate(config, file, sum)
+		})
+	}
+
+	reserved, err := reserveInflight(config, status, []string{file})
+	if err != nil {
+		return err
+	}
+	defer config.InflightBytes.Release(reserved)
+
+	if err := uploadFileS3(config, client, status, file); err != nil {
+		return err
+	}
+	if err := fs.RecordContent(config, sum, file); err != nil {
+		applog.Errorf("Failed to record content of uploaded %q for dedup: %s", file, err.Error())
+	}
+	return runStage(config, status, config.Pipeline.Cleanup, cfg.PhaseDeleting, file, func(ctx context.Context) error {
+		return deleteUploadedFile(config, file)
+	})
+}
+
+// Delete uploaded file, a source that can't be deleted is quarantined instead of being uploaded again and again
+func deleteUploadedFile(config cfg.AppConfig, file string) error {
+	if err := fs.DeleteTempFiles(config, file); err != nil {
+		return err
+	}
+
+	err := fs.DeleteSource(config, file)
+	if err == nil {
+		return nil
+	}
+
+	applog.Errorf("File %q was uploaded but can't be deleted, it will be skipped until it changes. Error: %s", file, err.Error())
+	config.Metrics.FileUndeletable.WithLabelValues().Inc()
+	if err := fs.Quarantine(config, file, err); err != nil {
+		return fmt.Errorf("failed to quarantine undeletable file %q: %s", file, err.Error())
+	}
+	return nil
+}
+
+// Send all files of a group to s3 bucket, files are deleted only when all of them are uploaded
+func sendGroupS3(config cfg.AppConfig, client fileUploader, status cfg.WorkerRef, files []string) error {
+	reserved, err := reserveInflight(config, status, files)
+	if err != nil {
+		return err
+	}
+	defer config.InflightBytes.Release(reserved)
+
+	for _, file := range files {
+		if err := uploadFileS3(fs.RouteConfig(config, file), client, status, file); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range files {
+		err := runStage(config, status, config.Pipeline.Cleanup, cfg.PhaseDeleting, file, func(ctx context.Context) error {
+			return deleteUploadedFile(config, file)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reserve sizes of files within -max-inflight-bytes, the worker waits until other workers are done with enough
+// files. Reserved bytes are released when temporary files are deleted.
+func reserveInflight(config cfg.AppConfig, status cfg.WorkerRef, files []string) (int64, error) {
+	if config.InflightBytes == nil {
+		return 0, nil
+	}
+
+	var size int64
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return 0, err
+		}
+		size += fi.Size()
+	}
+
+	setWorkerPhase(status, cfg.PhaseQueued, files[0])
+	// Not derived from the app context, other workers release their files on shutdown
+	return config.InflightBytes.Acquire(context.Background(), size)
+}
+
+// Run a stage of the file on the stage pool, the worker waits in the stage queue while all pool workers are busy.
+// A stage stuck longer than -per-file-timeout is cancelled and the file is retried later. The timeout starts when
+// the stage does, so a file prepared ahead doesn't time out while it waits for an upload worker.
+func runStage(config cfg.AppConfig, status cfg.WorkerRef, stage *pool.Pool, phase, file string, run func(ctx context.Context) error) error {
+	setWorkerPhase(status, cfg.PhaseQueued, file)
+
+	// Not derived from the app context, uploads in progress are finished on shutdown
+	return stage.Run(context.Background(), func() error {
+		setWorkerPhase(status, phase, file)
+
+		ctx := context.Background()
+		if config.PerFileTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.PerFileTimeout)
+			defer cancel()
+		}
+
+		err := run(ctx)
+		if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			config.Metrics.FileTimeouts.WithLabelValues().Inc()
+			return fmt.Errorf("file %q timed out after %s: %s", file, config.PerFileTimeout, err.Error())
+		}
+		return err
+	})
+}
+
+// Pack, encrypt and upload file to s3 bucket. Stages run on their pools, so while upload workers are busy with
+// a slow link, other workers keep compressing and encrypting files of the backlog.
+func uploadFileS3(config cfg.AppConfig, client fileUploader, status cfg.WorkerRef, file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+
+	size := utils.HumanizeBytes(fi.Size(), false)
+	applog.Infof("Sending %q file (%s) to %s", file, size, destinationName(config))
+
+	// Dry-run can skip compression and encryption and estimate with source sizes.
+	// A resumed upload needs the file prepared before the restart, preparing it again would change it.
+	if (!config.DryRun || !config.DryRunSkipPipeline) && fs.ResumableUpload(config, file) == nil {
+		err = runStage(config, status, config.Pipeline.Compress, cfg.PhaseCompressing, file, func(ctx context.Context) error {
+			return fs.CompressFile(ctx, config, file)
+		})
+		if err != nil {
+			return err
+		}
+
+		err = runStage(config, status, config.Pipeline.Encrypt, cfg.PhaseEncrypting, file, func(ctx context.Context) error {
+			return fs.EncryptFile(ctx, config, file)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return runStage(config, status, config.Pipeline.Upload, cfg.PhaseUploading, file, func(ctx context.Context) error {
+		return uploadPreparedFile(ctx, config, client, status, file, fi.Size())
+	})
+}
+
+// Upload compressed and encrypted file
+func uploadPreparedFile(ctx context.Context, config cfg.AppConfig, client fileUploader, status cfg.WorkerRef, file string, origSize int64) (err error) {
+	var uploadedBytes int64
+
+	if config.AuditLog != nil {
+		record := newAuditRecord(config, file, origSize)
+		defer func() {
+			writeAuditRecord(config, record, uploadedBytes, err)
+		}()
+	}
+
+	config.Progress.Report = func(done, total int64, rate float64) {
+		status.Update(func(s *cfg.WorkerStatus) {
+			s.UploadDone, s.UploadTotal, s.UploadRate = done, total, rate
+		})
+	}
+	if config.DryRun {
+		uploadedBytes, err = s3.FakeUploadFile(ctx, config, file)
+		// For tests with unpack/decrypt
+		// err = s3.CopyFile(config, file)
+	} else {
+		uploadedBytes, err = client.UploadFile(ctx, config, file)
+	}
+
+	if err != nil {
+		if config.Breaker.Failure() {
+			applog.Errorf("Circuit breaker opened after %d uploads failed in a row, uploads are stopped for %s, files are still queued",
+				config.Breaker.Threshold(), config.Breaker.Backoff())
+		}
+		return err
+	}
+	if config.Breaker.Success() {
+		applog.Infof("Circuit breaker closed, uploads are resumed")
+	}
+
+	// If we're here, upload was successful
+	config.Metrics.FileOrigBytesSum.WithLabelValues().Add(float64(origSize))
+	config.Metrics.FileSendBytesSum.WithLabelValues().Add(float64(uploadedBytes))
+	config.Metrics.FileCompression.WithLabelValues(fs.FileCompression(config, file)).Inc()
+	status.Update(func(s *cfg.WorkerStatus) {
+		s.BytesUploaded += uploadedBytes
+	})
+	return nil
+}
+
+// Compress, encrypt and upload stdin as the key under the S3 path, the upload is aborted on SIGINT and SIGTERM
+func uploadStdin(ctx context.Context, config cfg.AppConfig, key string) error {
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return uploadStream(ctx, config, key, os.Stdin)
+}
+
+// Read streams written to the FIFO and upload each of them as an object with a key from the template
+func fifoReader(ctx context.Context, config cfg.AppConfig, path, keyTemplate string) {
+	hostname, _ := os.Hostname()
+	var seq int64
+
+	applog.Infof("Reading streams from FIFO %q", path)
+	err := fs.ReadFIFO(ctx, path, func(r io.Reader) {
+		seq++
+		key := fs.FIFOKey(config, keyTemplate, hostname, time.Now(), seq)
+
+		config.Metrics.FileSendCount.WithLabelValues().Inc()
+		if err := uploadStream(ctx, config, key, r); err != nil {
+			config.Metrics.FileSendErrors.WithLabelValues(errclass.Class(err)).Inc()
+			config.Alerter.Failure(err)
+			applog.Errorf("Failed to upload stream %d from FIFO %q, it's lost: %s", seq, path, err.Error())
+			return
+		}
+		config.Metrics.FileSendSuccess.WithLabelValues().Inc()
+		config.Alerter.Success()
+	})
+	if err != nil {
+		applog.Fatal(err.Error())
+	}
+}
+
+// Compress, encrypt and upload a stream as the key under the S3 path
+func uploadStream(ctx context.Context, config cfg.AppConfig, key string, r io.Reader) error {
+	objectKey, err := fs.StreamKey(config, key)
+	if err != nil {
+		return err
+	}
+	filename := filepath.Join(config.PathToWatch, key)
+	stream := fs.PrepareStream(ctx, config, key, r)
+	started := time.Now()
+
+	var size int64
+	if config.DryRun {
+		size, err = io.Copy(io.Discard, stream)
+	} else {
+		var client *s3.Client
+		client, err = initS3Client(config)
+		if err != nil {
+			return fmt.Errorf("failed to initialize S3 client: %s", err.Error())
+		}
+		size, err = client.UploadStream(ctx, fs.StreamConfig(config), filename, objectKey, stream)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload %q in bucket %s: %s", objectKey, config.S3bucket, err.Error())
+	}
+
+	config.Metrics.FileSendBytesSum.WithLabelValues().Add(float64(size))
+	applog.Infof("Stream uploaded to %q in bucket %s (%s) in %s", objectKey, config.S3bucket,
+		utils.HumanizeBytes(size, false), time.Since(started).Round(time.Millisecond))
+	return nil
+}
+
+// Print what the next run would do with files in the watched directories
+func printPlan(config cfg.AppConfig) error {
+	plan := []fs.PlanEntry{}
+	for _, watch := range config.WatchPaths {
+		entries, err := fs.Plan(fs.WatchConfig(config, watch))
+		if err != nil {
+			return err
+		}
+		plan = append(plan, entries...)
+	}
+
+	uploads, skips, quarantined := 0, 0, 0
+	for _, entry := range plan {
+		switch entry.Action {
+		case fs.PlanUpload:
+			uploads++
+			fmt.Printf("  + upload %q (%s) to %s\n", entry.File, utils.HumanizeBytes(entry.Size, false),
+				destinationName(fs.RouteConfig(fs.WatchPathConfig(config, entry.File), entry.File)))
+		case fs.PlanQuarantined:
+			quarantined++
+			fmt.Printf("  ! quarantined %q: %s\n", entry.File, entry.Reason)
+		default:
+			skips++
+			fmt.Printf("  ~ skip   %q: %s\n", entry.File, entry.Reason)
+		}
+	}
+
+	fmt.Printf("\nPlan: %d to upload, %d to skip, %d quarantined.\n", uploads, skips, quarantined)
+	return nil
+}
+
+// Create pools of the worker stages. A pool only limits its stage when it has fewer workers than there are
+// workers, so uploads are limited to -workers only when extra workers prepare files ahead.
+func newPipeline(config cfg.AppConfig, compressWorkers, encryptWorkers int) pool.Pipeline {
+	var pipeline pool.Pipeline
+	workers := config.Workers + config.PrepareAhead
+
+	if config.Gzip && compressWorkers > 0 && compressWorkers < workers {
+		pipeline.Compress = pool.New(compressWorkers)
+	}
+	if config.Encrypt && encryptWorkers > 0 && encryptWorkers < workers {
+		pipeline.Encrypt = pool.New(encryptWorkers)
+	}
+	if config.PrepareAhead > 0 {
+		pipeline.Upload = pool.New(config.Workers)
+		pipeline.Cleanup = pool.New(config.Workers)
+	}
+	return pipeline
+}
+
+// Main loop
+func upload(ctx context.Context, config cfg.AppConfig, comm *queue.Queue) {
+	applog.Info("Main upload loop started")
+
+	// Keep uploading until we receive exit signal
+	for {
+		select {
+		// Exit signal
+		case <-ctx.Done():
+			applog.Info("Upload function exiting")
+			comm.Close()
+			return
+		}
+	}
+}
+
+// Circuit breaker states exposed as gauge values
+var circuitStates = map[string]float64{
+	breaker.Closed:   0,
+	breaker.Open:     1,
+	breaker.HalfOpen: 2,
+}
+
+// Metrics updater
+func updateMetrics(config cfg.AppConfig, comm *queue.Queue) {
+	// Updating every 2 seconds is frequent enough
+	tick := time.Tick(2 * time.Second)
+
+	for {
+		select {
+		// Tick handler
+		case <-tick:
+			config.Metrics.ChannelLength.WithLabelValues().Set(float64(comm.Len()))
+
+			busy := busyWorkers.Load()
+			workers := int64(config.Status.WorkerCount())
+			config.Metrics.WorkersBusy.WithLabelValues().Set(float64(busy))
+			config.Metrics.WorkersIdle.WithLabelValues().Set(float64(workers - busy))
+			config.Metrics.WorkersSaturation.WithLabelValues().Set(float64(busy) / float64(workers))
+			if busy >= workers {
+				config.Metrics.NoIdleWorkers.WithLabelValues().Inc()
+			}
+			if config.UploadLimiter != nil {
+				config.Metrics.RateLimiterTokens.WithLabelValues().Set(config.UploadLimiter.Tokens())
+			}
+			// Files wait on purpose while uploads are paused, outside the upload window or while the circuit is open
+			if uploadsAllowed(config) {
+				config.Alerter.CheckBacklog(comm.Oldest())
+			}
+			config.Metrics.CircuitState.WithLabelValues().Set(circuitStates[config.Breaker.State()])
+			if config.BufferBudget != nil {
+				config.Metrics.BufferMemory.WithLabelValues().Set(float64(config.BufferBudget.Used()))
+			}
+			if config.InflightBytes != nil {
+				config.Metrics.InflightBytes.WithLabelValues().Set(float64(config.InflightBytes.Used()))
+			}
+			for name, stage := range config.Pipeline.Stages() {
+				config.Metrics.StageQueued.WithLabelValues(name).Set(float64(stage.Queued()))
+				config.Metrics.StageBusy.WithLabelValues(name).Set(float64(stage.Running()))
+			}
+
+			rate, avg1m, avg5m := config.Progress.Meter.Update(time.Now())
+			config.Metrics.Throughput.WithLabelValues().Set(rate)
+			config.Metrics.Throughput1m.WithLabelValues().Set(avg1m)
+			config.Metrics.Throughput5m.WithLabelValues().Set(avg5m)
+
+			for id, status := range config.Status.Workers() {
+				worker := strconv.Itoa(id)
+				ratio := 0.0
+				if status.UploadTotal > 0 {
+					ratio = float64(status.UploadDone) / float64(status.UploadTotal)
+				}
+				config.Metrics.UploadProgress.WithLabelValues(worker).Set(ratio)
+				config.Metrics.UploadRate.WithLabelValues(worker).Set(status.UploadRate)
+			}
+		}
+	}
+}
+
+// Worker
+func worker(wg *sync.WaitGroup, ctx context.Context, id int, config cfg.AppConfig, comm *queue.Queue, status cfg.WorkerRef) {
+
+	applog.Infof("Worker %d started", id)
+	defer wg.Done()
+	status.Update(func(s *cfg.WorkerStatus) {
+		s.Running = true
+		s.Phase = cfg.PhaseIdle
+		s.PhaseStarted = time.Now()
+	})
+
+	// Init client, the S3 client is shared with other workers
+	client, err := initUploader(config)
+	if err != nil {
+		setWorkerRunning(status, false)
+		applog.Errorf("Worker %v: Failed to initialize sender client: %s", id, err.Error())
+		applog.Errorf("Worker %v failed, exiting", id)
+		return
+	}
+
+	// Main loop
+	for {
+		// Wait while uploads are paused with a feature flag or outside of the upload window
+		if !uploadsAllowed(config) {
+			select {
+			case <-ctx.Done():
+				setWorkerRunning(status, false)
+				client.Close()
+				applog.Infof("Worker %d exiting", id)
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		msg, ok := comm.Pop(ctx)
+		lastDequeue.Store(time.Now().UnixNano())
+		if !ok {
+			setWorkerRunning(status, false)
+			client.Close()
+			applog.Infof("Worker %d exiting", id)
+			return
+		}
+
+		if config.ExitOnFilename != "" && msg.File == config.ExitOnFilename {
+			config.Applog.Infof("Worker %d: triggering exit on file: %q", id, msg.File)
+			comm.Done()
+			config.CancelFunction()
+			return
+		}
+
+		// Uploads could be paused while the worker was waiting for a message, put it back. If producers filled the
+		// queue in the meantime, the file is forgotten by the watcher and left for the next scan or watch event.
+		// Only one worker gets through with a probe upload while the circuit is half-open.
+		release := func() {}
+		allowed := uploadsAllowed(config)
+		if allowed {
+			release, allowed = config.Breaker.Acquire()
+		}
+		if !allowed {
+			if !comm.Push(msg) {
+				fs.ResolveMove(msg.File)
+				config.Metrics.EnqueueOverflow.WithLabelValues("dropped").Inc()
+				applog.Warningf("Worker %d: queue is full, %s taken while uploads are paused is left for the next scan", id, fs.GroupName(msg))
+			}
+			comm.Done()
+			continue
+		}
+
+		busyWorkers.Add(1)
+		processMessageSafe(config, client, id, status, msg)
+		busyWorkers.Add(-1)
+		release()
+		comm.Done()
+	}
+}
+
+// Process a single message and recover from a panic while processing it, e.g. on a malformed path. The file is
+// marked failed and retried later while the worker keeps going.
+func processMessageSafe(config cfg.AppConfig, client fileUploader, id int, status cfg.WorkerRef, msg cfg.Message) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		// Stages run on pool goroutines, their panics come with the stack of the pool worker
+		stack := debug.Stack()
+		if pe, ok := r.(*pool.PanicError); ok {
+			r, stack = pe.Value, pe.Stack
+		}
+
+		name := msg.File
+		if len(msg.Group) > 0 {
+			name = fs.GroupName(msg)
+		}
+		err := fmt.Errorf("panic while processing %s: %v", name, r)
+		applog.Errorf("Worker %d: %s\n%s", id, err.Error(), stack)
+		config.Metrics.WorkerPanics.WithLabelValues().Inc()
+		config.Metrics.FileSendErrors.WithLabelValues(errclass.ClassTransient).Inc()
+		finishWorkerMessage(status, err)
+		recordResult(config, name, err)
+	}()
+
+	processMessage(config, client, id, status, msg)
+}
+
+// Process a single message from the queue
+func processMessage(config cfg.AppConfig, client fileUploader, id int, status cfg.WorkerRef, msg cfg.Message) {
+	config = fs.WatchPathConfig(config, msg.File)
+
+	if len(msg.Group) > 0 {
+		applog.Infof("Worker %d: processing %s", id, fs.GroupName(msg))
+		setWorkerPhase(status, cfg.PhaseClaiming, msg.File)
+		claimed, err := fs.Claim(config, id, msg.Group)
+		if err != nil {
+			applog.Infof("Worker %d: skipping %s, it's claimed by someone else: %s", id, fs.GroupName(msg), err.Error())
+			setWorkerPhase(status, cfg.PhaseIdle, "")
+			return
+		}
+		defer fs.Release(config, claimed)
+
+		config.Metrics.FileSendCount.WithLabelValues().Inc()
+		err = sendGroupS3(config, client, status, claimed)
+		finishWorkerMessage(status, err)
+		recordResult(config, fs.GroupName(msg), err)
+		if err != nil {
+			handleSendError(config, fs.GroupName(msg), claimed, err)
+		} else {
+			config.Metrics.FileSendSuccess.WithLabelValues().Inc()
+			config.Alerter.Success()
+		}
+		return
+	}
+
+	// The file could have been moved within the watched directory while it was waiting in the queue
+	msg.File = fs.ResolveMove(msg.File)
+
+	applog.Infof("Worker %d: processing file %q", id, msg.File)
+	setWorkerPhase(status, cfg.PhaseClaiming, msg.File)
+	claimed, err := fs.Claim(config, id, []string{msg.File})
+	if err != nil {
+		applog.Infof("Worker %d: skipping file %q, it's claimed by someone else: %s", id, msg.File, err.Error())
+		setWorkerPhase(status, cfg.PhaseIdle, "")
+		return
+	}
+	defer fs.Release(config, claimed)
+	if fs.Replaced(msg, claimed[0]) {
+		applog.Warningf("Worker %d: skipping file %q, it was replaced since it was queued and is left for the next scan", id, msg.File)
+		config.Metrics.FileReplaced.WithLabelValues().Inc()
+		setWorkerPhase(status, cfg.PhaseIdle, "")
+		return
+	}
+
+	config.Metrics.FileSendCount.WithLabelValues().Inc()
+	err = sendFileS3(config, client, status, claimed[0])
+	finishWorkerMessage(status, err)
+	recordResult(config, msg.File, err)
+	if err != nil {
+		handleSendError(config, fmt.Sprintf("file %q", msg.File), claimed, err)
+	} else {
+		config.Metrics.FileSendSuccess.WithLabelValues().Inc()
+		config.Alerter.Success()
+	}
+}
+
+// Handle failed files by the class of the error: transient failures are retried later, files failed for good are
+// quarantined until they change and configuration errors stop the uploader as every other file would fail too. A
+// single configuration error may be a credential or policy still being rolled out, so the uploader stops only when
+// -config-error-threshold of them happen within -config-error-window
+func handleSendError(config cfg.AppConfig, name string, files []string, err error) {
+	class := errclass.Class(err)
+	config.Metrics.FileSendErrors.WithLabelValues(class).Inc()
+	config.Alerter.Failure(err)
+
+	switch class {
+	case errclass.ClassPermanent:
+		for _, file := range files {
+			if qerr := fs.QuarantineFailed(config, file, err); qerr != nil {
+				applog.Errorf("Failed to quarantine %q: %s", file, qerr.Error())
+				applog.Errorf("Failed to send %s, it will be retried later. Error: %s", name, err.Error())
+				return
+			}
+		}
+		applog.Errorf("Failed to send %s, it won't be retried until it changes. Error: %s", name, err.Error())
+	case errclass.ClassConfig:
+		if config.ConfigErrorThreshold <= 0 || configErrors.add(time.Now(), config.ConfigErrorWindow) < config.ConfigErrorThreshold {
+			applog.Errorf("Failed to send %s because of a configuration error, it will be retried later. Error: %s", name, err.Error())
+			return
+		}
+		applog.Errorf("Failed to send %s because of a configuration error, stopping. Error: %s", name, err.Error())
+		configFailed.Store(true)
+		config.CancelFunction()
+	default:
+		applog.Errorf("Failed to send %s, it will be retried later. Error: %s", name, err.Error())
+	}
+}
+
+// Add a failed upload to the failures list or reset failed attempts of an uploaded file
+func recordResult(config cfg.AppConfig, file string, err error) {
+	runTally.Add(file, err)
+	if err == nil {
+		config.Failures.Success(file)
+		return
+	}
+	if err := config.Failures.Add(file, err); err != nil {
+		applog.Errorf("Failed to record failed upload of %s: %s", file, err.Error())
+	}
+}
+
+// Start an audit record of an upload attempt. The key and checksum are taken before the upload, the upload state
+// of a resumed upload with its key is gone once it completes. The checksum is of the source file like the one of
+// the checksum sidecar, it's computed once per file version and shared with the sidecar and the dedup check.
+func newAuditRecord(config cfg.AppConfig, file string, size int64) audit.Record {
+	record := audit.Record{
+		Time:        time.Now(),
+		Instance:    config.InstanceID,
+		File:        fs.WatchedFileName(config, file),
+		Destination: destinationName(config),
+		Size:        size,
+		DryRun:      config.DryRun,
+	}
+	realFile := fs.PreparedFileName(config, file)
+	if key, err := fs.ObjectKey(config, file, realFile); err == nil {
+		record.Key = key
+	}
+	if sum, err := fs.SourceSHA256(config, file); err == nil {
+		record.SourceSHA256 = sum
+	}
+	return record
+}
+
+// Finish the audit record of an upload attempt and write it to the audit log
+func writeAuditRecord(config cfg.AppConfig, record audit.Record, uploaded int64, err error) {
+	record.Duration = time.Since(record.Time).Seconds()
+	record.Time = time.Now()
+	record.UploadedSize = uploaded
+	record.Result = audit.ResultUploaded
+	if err != nil {
+		record.Result = audit.ResultFailed
+		record.ErrorClass = errclass.Class(err)
+		record.Error = err.Error()
+	}
+	if err := config.AuditLog.Write(record); err != nil {
+		applog.Errorf("Failed to write upload of %q to the audit log: %s", record.File, err.Error())
+	}
+}
+
+// Add the -log-target to the log output, true means the logger writes to the system log itself
+func logTargetOutput(target string, output io.Writer) (io.Writer, bool, error) {
+	switch target {
+	case logTargetStdout:
+		return output, false, nil
+	case logTargetSyslog:
+		return output, true, nil
+	case logTargetJournald:
+		journal, err := systemd.NewJournalWriter(systemd.JournalSocket, "s3-file-uploader")
+		if err != nil {
+			return output, false, fmt.Errorf("failed to connect to journald: %s", err.Error())
+		}
+		// The journal writer never fails, so the rest of outputs always get the line
+		return io.MultiWriter(journal, output), false, nil
+	}
+	return output, false, fmt.Errorf("unsupported -log-target %q, must be %s, %s or %s", target, logTargetStdout, logTargetSyslog, logTargetJournald)
+}
+
+// Open the -log-file with its rotation, logs are only written to stdout and stderr without it
+func openLogFile(path, maxSize string, maxFiles int, maxAge time.Duration) (io.Writer, error) {
+	if path == "" {
+		return io.Discard, nil
+	}
+	size, err := utils.ParseBytes(maxSize)
+	if err != nil {
+		return io.Discard, fmt.Errorf("bad -log-file-max-size: %s", err.Error())
+	}
+	if maxFiles < 0 {
+		return io.Discard, fmt.Errorf("-log-file-max-files can't be negative")
+	}
+	f, err := logfile.Open(path, logfile.Rotation{MaxSize: size, MaxBackups: maxFiles, MaxAge: maxAge})
+	if err != nil {
+		return io.Discard, fmt.Errorf("failed to open log file: %s", err.Error())
+	}
+	return f, nil
+}
+
+// Change upload rate limit according to the bandwidth schedule
+func rateScheduler(ctx context.Context, config cfg.AppConfig, rateSchedule schedule.RateSchedule, fallback, burst int64) {
+	tick := time.Tick(time.Minute)
+
+	for {
+		select {
+		case <-tick:
+			rate := rateSchedule.RateAt(time.Now(), fallback)
+			if rate == config.UploadLimiter.Rate() {
+				continue
+			}
+
+			if rate > 0 {
+				applog.Infof("Upload rate limit changed to %s by the schedule", utils.HumanizeBytes(rate, true))
+			} else {
+				applog.Info("Upload rate limit disabled by the schedule")
+			}
+			config.UploadLimiter.SetRate(rate, burst)
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Periodically write upload manifests to the bucket
+func manifestWriter(ctx context.Context, config cfg.AppConfig) {
+	tick := time.Tick(config.ManifestInterval)
+
+	for {
+		select {
+		case <-tick:
+			writeManifest(config)
+
+		// Final manifest is written when workers are done
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Write collected manifest entries to the bucket
+func writeManifest(config cfg.AppConfig) {
+	client, err := initS3Client(config)
+	if err != nil {
+		applog.Errorf("Failed to initialize S3 client for the upload manifest: %s", err.Error())
+		return
+	}
+	defer client.Close()
+
+	if err := client.UploadManifest(config); err != nil {
+		applog.Errorf("Failed to write upload manifest: %s", err.Error())
+	}
+}
+
+// Heartbeat file and object settings
+type heartbeatOptions struct {
+	file     string
+	object   string
+	interval time.Duration
+}
+
+// Status with upload counts of this run and the time it was written, for the heartbeat
+type heartbeatStatus struct {
+	cfg.AppStatus
+	Time     time.Time `json:"time"`
+	Uploaded int       `json:"uploaded"`
+	Failed   int       `json:"failed"`
+}
+
+// Write heartbeat at start and then every interval
+func heartbeatWriter(ctx context.Context, config cfg.AppConfig, comm *queue.Queue, opts heartbeatOptions) {
+	tick := time.NewTicker(opts.interval)
+	defer tick.Stop()
+
+	for {
+		writeHeartbeat(config, comm, opts)
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Write status JSON to the heartbeat file and object
+func writeHeartbeat(config cfg.AppConfig, comm *queue.Queue, opts heartbeatOptions) {
+	status := heartbeatStatus{AppStatus: appStatus(config, comm), Time: time.Now()}
+	status.Uploaded, status.Failed = runTally.Counts()
+	body, err := json.Marshal(status)
+	if err != nil {
+		applog.Errorf("Failed to json.Marshal() heartbeat: %v", err)
+		return
+	}
+
+	if opts.file != "" {
+		if err := writeFileAtomic(opts.file, body); err != nil {
+			applog.Errorf("Failed to write heartbeat file: %s", err.Error())
+		}
+	}
+
+	if opts.object == "" {
+		return
+	}
+	if config.DryRun {
+		applog.Infof("Dry-run: heartbeat object %s/%s would be written", config.S3path, opts.object)
+		return
+	}
+	client, err := initS3Client(config)
+	if err != nil {
+		applog.Errorf("Failed to initialize S3 client for the heartbeat: %s", err.Error())
+		return
+	}
+	defer client.Close()
+
+	if err := client.UploadHeartbeat(config, opts.object, body); err != nil {
+		applog.Errorf("Failed to write heartbeat object: %s", err.Error())
+	}
+}
+
+// Replace the file with data, readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// Temporary files are only readable by the owner, monitoring may run as another user
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Enforce age and size caps of directories keeping local copies of files at start and then every few minutes
+func janitor(ctx context.Context, config cfg.AppConfig, dirs []fs.KeptDir) {
+	tick := time.NewTicker(janitorInterval)
+	defer tick.Stop()
+
+	for _, dir := range dirs {
+		config.Metrics.KeptFilesPurged.WithLabelValues(dir.Name).Add(0)
+	}
+	for {
+		for _, dir := range dirs {
+			purged, size, err := dir.Purge()
+			if err != nil {
+				applog.Errorf("Failed to purge %s directory: %s", dir.Name, err.Error())
+			}
+			if purged > 0 {
+				applog.Infof("Purged %d files from %s directory %q, %s left", purged, dir.Name, dir.Path,
+					utils.HumanizeBytes(size, false))
+				config.Metrics.KeptFilesPurged.WithLabelValues(dir.Name).Add(float64(purged))
+			}
+			config.Metrics.KeptDirSize.WithLabelValues(dir.Name).Set(float64(size))
+		}
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Abort abandoned multipart uploads under the S3 path at start and then every hour
+func staleUploadsCleaner(ctx context.Context, config cfg.AppConfig, olderThan time.Duration) {
+	tick := time.NewTicker(time.Hour)
+	defer tick.Stop()
+
+	for {
+		abortStaleUploads(ctx, config, olderThan)
+
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Abort multipart uploads that were started long ago and can't be resumed
+func abortStaleUploads(ctx context.Context, config cfg.AppConfig, olderThan time.Duration) {
+	client, err := initS3Client(config)
+	if err != nil {
+		applog.Errorf("Failed to initialize S3 client for stale multipart uploads cleanup: %s", err.Error())
+		return
+	}
+	defer client.Close()
+
+	aborted, err := client.AbortStaleUploads(ctx, config, olderThan)
+	if err != nil {
+		applog.Errorf("Failed to abort stale multipart uploads: %s", err.Error())
+	}
+	if aborted > 0 {
+		applog.Infof("Aborted %d stale multipart uploads older than %s", aborted, olderThan)
+	}
+}
+
+// Periodically check recently uploaded objects in the bucket
+func reconciler(ctx context.Context, config cfg.AppConfig) {
+	tick := time.NewTicker(config.ReconcileInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-tick.C:
+			reconcile(ctx, config)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Check uploaded objects, files of missing or corrupted objects are uploaded again if their sources still exist
+func reconcile(ctx context.Context, config cfg.AppConfig) {
+	client, err := initS3Client(config)
+	if err != nil {
+		applog.Errorf("Failed to initialize S3 client for reconciliation: %s", err.Error())
+		return
+	}
+	defer client.Close()
+
+	verified, mismatches, err := client.Reconcile(ctx, config)
+	config.Metrics.ObjectsVerified.WithLabelValues("ok").Add(float64(verified))
+	if err != nil {
+		applog.Errorf("Failed to reconcile uploaded objects: %s", err.Error())
+	}
+
+	for _, mismatch := range mismatches {
+		config.Metrics.ObjectsVerified.WithLabelValues("mismatch").Inc()
+		config.State.DeleteObject(mismatch.Key)
+
+		if _, err := os.Stat(mismatch.Source); err != nil {
+			err = fmt.Errorf("object %q doesn't match uploaded %q: %s, the source is deleted and can't be uploaded again",
+				mismatch.Key, mismatch.Source, mismatch.Reason)
+			applog.Error(err.Error())
+			config.Alerter.Failure(err)
+			continue
+		}
+
+		// Forget that the source was uploaded, so it's not skipped as quarantined or duplicate
+		applog.Errorf("Object %q doesn't match uploaded %q: %s, uploading it again", mismatch.Key, mismatch.Source, mismatch.Reason)
+		config.State.Delete(mismatch.Source)
+		routed := fs.RouteConfig(config, mismatch.Source)
+		if sum, err := fs.ContentSum(routed, mismatch.Source); err == nil {
+			fs.ForgetContent(routed, sum)
+		}
+		config.Metrics.ObjectsRequeued.WithLabelValues().Inc()
+		fs.TriggerScan(config)
+	}
+}
+
+// Metrics exporter that pushes current metric values somewhere
+type metricsExporter interface {
+	Push(ctx context.Context) error
+}
+
+// Prometheus Pushgateway exporter
+type pushgatewayExporter struct {
+	pusher *push.Pusher
+}
+
+func (e pushgatewayExporter) Push(ctx context.Context) error {
+	return e.pusher.AddContext(ctx)
+}
+
+// Functions for pushing metrics
+func prometheusMetricsPusher(ctx context.Context, config cfg.AppConfig, exporters map[string]metricsExporter) {
+	tick := time.Tick(config.PushInterval)
+
+	for {
+		select {
+		// Tick event
+		case <-tick:
+
+			for name, exporter := range exporters {
+				applog.Infof("Pushing metrics to %s", name)
+
+				if err := exporter.Push(ctx); err != nil {
+					applog.Errorf("Could not push metrics to %s: %s", name, err.Error())
+				}
+			}
+
+		// Final push is done by finishMetricsPush when workers are done
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Init metrics exporters for all configured push targets
+func newMetricsExporters(config cfg.AppConfig) map[string]metricsExporter {
+	exporters := map[string]metricsExporter{}
+	client := pushAuthDoer{client: &http.Client{Timeout: config.PushInterval}, basicAuth: config.PushBasicAuth, token: config.PushBearerToken}
+
+	if config.PushGateway != "" {
+		pusher := push.New(config.PushGateway, config.PushJobName).Gatherer(config.Metrics.Registry).Client(client)
+		for name, value := range config.PushGroupingLabels {
+			pusher = pusher.Grouping(name, value)
+		}
+		exporters["Prometheus Pushgateway"] = pushgatewayExporter{pusher: pusher}
+	}
+
+	if config.RemoteWriteURL != "" {
+		labels := map[string]string{"job": config.PushJobName}
+		for name, value := range config.PushGroupingLabels {
+			labels[name] = value
+		}
+		exporters["Prometheus remote-write"] = &metrics.RemoteWrite{
+			URL:      config.RemoteWriteURL,
+			Gatherer: config.Metrics.Registry,
+			Labels:   labels,
+			Client:   client,
+		}
+	}
+
+	if config.OTLPEndpoint != "" {
+		exporters["OTLP"] = &metrics.OTLP{
+			URL:         config.OTLPEndpoint,
+			Gatherer:    config.Metrics.Registry,
+			ServiceName: config.PushJobName,
+			Attributes:  config.PushGroupingLabels,
+			Client:      client,
+			Started:     startTime,
+		}
+	}
+
+	return exporters
+}
+
+// Push final metrics on clean shutdown, the pushgateway group can be deleted instead so stale metrics don't linger
+func finishMetricsPush(config cfg.AppConfig, exporters map[string]metricsExporter) {
+	for name, exporter := range exporters {
+		if pg, ok := exporter.(pushgatewayExporter); ok && config.PushDeleteOnExit {
+			applog.Infof("Deleting metrics group from %s", name)
+			if err := pg.pusher.Delete(); err != nil {
+				applog.Errorf("Could not delete metrics from %s: %s", name, err.Error())
+			}
+			continue
+		}
+
+		applog.Infof("Pushing final metrics to %s", name)
+		if err := exporter.Push(context.Background()); err != nil {
+			applog.Errorf("Could not push metrics to %s: %s", name, err.Error())
+		}
+	}
+}
+
+// HTTP client that adds basic auth or a bearer token to metrics push requests, the token is read on every push so it can be rotated
+type pushAuthDoer struct {
+	client    *http.Client
+	basicAuth string
+	token     secret.Provider
+}
+
+func (d pushAuthDoer) Do(req *http.Request) (*http.Response, error) {
+	if d.basicAuth != "" {
+		user, pass, _ := strings.Cut(d.basicAuth, ":")
+		req.SetBasicAuth(user, pass)
+	}
+
+	if d.token != nil {
+		token, err := d.token.Get()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bearer token: %s", err.Error())
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return d.client.Do(req)
+}
+
+// Main!
+func main() {
+	var s3uri, httpHeaders, pushGroupingLabels, pushBearerTokenFile string
+	var web webServerOptions
+	var wg sync.WaitGroup
+	var showVersion bool
+	var showPlan, controlFiles bool
+	var noCompressExtensions, ignorePatterns string
+	var gpgRecipients string
+	var ageRecipients, ageIdentityFile string
+	var gpgPasswordFile string
+	var secretsProvider, gpgPasswordSecret, vaultAddr, vaultTokenFile string
+	var secretsRefreshInterval time.Duration
+	var stateFile, goroutineDumpDir, failuresFile, pidFile string
+	var failuresLimit int
+	var auditLogFile, auditLogMaxSize string
+	var trashMaxSize, dedupDirMaxSize, kmsMaxFileSize string
+	var auditLogMaxFiles int
+	var logTarget, logFile, logFileMaxSize string
+	var logFileMaxFiles int
+	var logFileMaxAge time.Duration
+	var queueOrder string
+	var lockDir string
+	var lockTTL time.Duration
+	var featureFlagsFile, routesFile string
+	var pathsToWatch []string
+	var watchPathsFile string
+	var producer synthetic.Producer
+	var syntheticFileSize string
+	var fileGroups string
+	var uploadRateLimit, uploadRateBurst, uploadRateSchedule string
+	var minFileSize, maxFileSize, largeFileSize, dryRunBandwidth, s3PartSize, maxBufferMemory, maxInflightBytes, progressMinSize string
+	var alertWebhook, alertWebhookKind, manifestFormat, manifestSpool, objectLockRetainUntil string
+	var manifestMaxEntries int
+	var uploadWindow, uploadWindowTimezone string
+	var maxRuntime time.Duration
+	var failOnAny, metricsHistograms, stdin bool
+	var profile, stdinKey, fifoPath, fifoKey, sqsQueueURL, sqsDownloadHosts, ingestMaxSize, grpcListen string
+	var gzipLevel, compressWorkers, encryptWorkers int
+	var heartbeat heartbeatOptions
+	var maxErrorRate float64
+	var alertMaxErrors, circuitFailures int
+	var alertMaxBacklogAge, alertCooldown, circuitBackoff, abortStaleMultipart time.Duration
+	var ctxWithCancel context.Context
+	var err error
+
+	// Subcommands have their own flags
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		if err := runBench(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "bench: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Init config
+	config := cfg.AppConfig{}
+	config.WorkersCannelSize = workersCannelSize
+	config.ScanTrigger = make(chan struct{}, 1)
+
+	//Make a background context.
+	ctx := context.Background()
+	// Make a new context with cancel, we'll use it to make sure all routines can exit properly.
+	ctxWithCancel, config.CancelFunction = context.WithCancel(ctx)
+
+	// Arguments
+	flag.BoolVar(&showVersion, "version", false, "Show version and exit")
+	flag.StringVar(&profile, "profile", "", "Preset of flag defaults, flags set on the command line take precedence: "+strings.Join(profileNames(), ", ")+". The edge profile runs one worker with small upload buffers and no histograms on low-memory gateways")
+	flag.BoolVar(&stdin, "stdin", false, "Compress, encrypt and upload a stream from stdin as -key and exit instead of watching directories, e.g. pg_dump db | s3-file-uploader -stdin -key db.sql. Streams are compressed without tar and buffered in memory part by part, so they can't be larger than 10000 times -s3-part-size")
+	flag.StringVar(&stdinKey, "key", "", "Object key of the -stdin stream under the -s3-uri path, compression and encryption extensions are added to it")
+	flag.StringVar(&fifoPath, "fifo", "", "Read streams from this FIFO, it's created unless it exists. Every stream from a writer opening the FIFO until the last writer closes it is compressed, encrypted and uploaded as an object named by -fifo-key, like -stdin streams. Files in watched directories are uploaded as well")
+	flag.StringVar(&fifoKey, "fifo-key", "stream-{time}-{seq}", "Object key template of -fifo streams under the -s3-uri path, {time}, {seq}, {ulid}, {hostname} and {instance} are replaced. {seq} starts over on restart")
+	flag.StringVar(&sqsQueueURL, "sqs-queue-url", "", "Queue files named by messages of this SQS queue besides watching directories. A message body is a path of a file in a watched directory or a URL, e.g. a pre-signed one, downloaded into the first watched directory, or a JSON object {\"path\": ...} or {\"url\": ..., \"name\": ...}. Messages are deleted once the file is queued, failed ones are received again, set a redrive policy to move them to a dead-letter queue")
+	flag.StringVar(&sqsDownloadHosts, "sqs-download-hosts", "", "Comma separated shell patterns of hosts URLs of -sqs-queue-url messages are downloaded from, e.g. \"*.s3.eu-central-1.amazonaws.com\". Only https URLs are downloaded, messages with URLs fail when it's empty")
+	flag.IntVar(&config.Workers, "workers", 1, "The number of files uploaded at once")
+	flag.IntVar(&config.PrepareAhead, "prepare-ahead", 0, "The number of extra workers that compress and encrypt files while all -workers are uploading, prepared files take space in -gzip-dir and -encrypt-dir until they are uploaded. 0 disables preparing ahead")
+	flag.StringVar(&web.Listen, "listen", ":8765", "Address:port to listen on for exposing metrics")
+	flag.DurationVar(&web.ReadTimeout, "http-read-timeout", 10*time.Second, "Main web server timeout for reading a request")
+	flag.DurationVar(&web.WriteTimeout, "http-write-timeout", 30*time.Second, "Main web server timeout for writing a response")
+	flag.DurationVar(&web.ShutdownTimeout, "http-shutdown-timeout", 5*time.Second, "Time to wait for in-flight HTTP requests on exit")
+	flag.StringVar(&web.TLSCertFile, "listen-tls-cert", "", "Serve the main web server over HTTPS with this certificate file")
+	flag.StringVar(&web.TLSKeyFile, "listen-tls-key", "", "Private key file for -listen-tls-cert")
+	flag.StringVar(&pidFile, "pid-file", "", "Write the process ID to this file at start and remove it on exit, e.g. for PIDFile= of a systemd unit")
+	flag.StringVar(&goroutineDumpDir, "goroutine-dump-dir", "", "Write goroutine stacks to a file in this directory on SIGUSR1 along with the status dump")
+	flag.BoolVar(&web.Debug, "debug-endpoints", false, "Enable /debug/pprof profiling and /debug/vars runtime stats endpoints")
+	flag.StringVar(&web.AdminAuth, "admin-auth", "", "Protect /metrics, /status, /flags, /api/v1 and /debug endpoints with HTTP basic auth, format: user:password")
+	flag.BoolVar(&web.Ingest, "ingest", false, "Accept files uploaded as multipart form files with POST /api/v1/ingest, e.g. curl -F file=@report.csv. Files are written into the first watched directory under their file name and queued, existing files are not replaced. Uploads must finish within -http-read-timeout, protect the endpoint with -admin-auth")
+	flag.StringVar(&grpcListen, "grpc-listen", "", "Address:port to serve the gRPC API on: Enqueue, Status, Pause, Drain and StreamUpload of the Uploader service in internal/grpcapi/uploaderpb/uploader.proto. It uses -listen-tls-cert and -admin-auth of the main web server, Pause and Drain need -control-files")
+	flag.StringVar(&ingestMaxSize, "ingest-max-size", "1GB", "Maximum size of a request to /api/v1/ingest and of a file sent with gRPC StreamUpload, 0 means no limit")
+	flag.BoolVar(&config.ReadyCheckS3, "ready-check-s3", true, "Check that the S3 bucket is reachable in /readyz")
+	flag.DurationVar(&config.ReadyQueueStuckTimeout, "ready-queue-stuck-timeout", 10*time.Minute, "Report not ready in /readyz when queued files are not taken by workers for this long, 0 disables the check")
+	flag.BoolVar(&config.Verbose, "verbose", false, "Print INFO level applog to stdout")
+	flag.StringVar(&logTarget, "log-target", logTargetStdout, "Where to send the log: stdout, syslog (the Event Log on Windows) or journald with priorities of log levels. Errors are printed to stderr with every target")
+	flag.StringVar(&logFile, "log-file", "", "Also write the log to this file, INFO level included. Disabled when empty")
+	flag.StringVar(&logFileMaxSize, "log-file-max-size", "100MB", "Rotate -log-file when it grows over this size, 0 disables rotation")
+	flag.IntVar(&logFileMaxFiles, "log-file-max-files", 7, "Number of rotated -log-file files to keep, they get .1, .2 and so on suffixes")
+	flag.DurationVar(&logFileMaxAge, "log-file-max-age", 0, "Remove rotated -log-file files older than this, e.g. \"720h\". 0 keeps them regardless of age")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "Wether to run in a dry-run mode")
+	flag.BoolVar(&config.DryRunSkipPipeline, "dry-run-skip-pipeline", false, "Skip compression and encryption in a dry-run, upload sizes are estimated with source sizes")
+	flag.StringVar(&dryRunBandwidth, "dry-run-bandwidth", "", "Bandwidth to estimate upload time in the dry-run report, e.g. \"50MB\", defaults to -upload-rate-limit")
+	flag.BoolVar(&showPlan, "plan", false, "Show what the next run would upload or skip and exit")
+	flag.Func("path-to-watch", "FS path to watch for events, can be set several times to watch several directories. Defaults to "+defaultPathToWatch, func(path string) error {
+		pathsToWatch = append(pathsToWatch, path)
+		return nil
+	})
+	flag.StringVar(&watchPathsFile, "watch-paths-file", "", "JSON file with more directories to watch, each with optional include patterns and a key prefix under the S3 path, e.g. [{\"path\": \"/data/db\", \"include\": [\"*.sql\"], \"prefix\": \"db\"}]")
+	flag.StringVar(&config.ExitOnFilename, "exit-on-filename", "", "If this filename is detected by fsWatch, the program exits")
+	flag.BoolVar(&controlFiles, "control-files", false, "Act on control files in -path-to-watch: "+control.PauseFile+" pauses uploads while it exists, "+control.DrainFile+" uploads queued files and exits, "+control.ExitFile+" exits after in-flight uploads")
+	flag.StringVar(&ignorePatterns, "ignore-patterns", fs.DefaultIgnorePatterns, "Comma separated shell patterns of file names that are never uploaded, e.g. temporary files of editors and rsync. Empty to upload all files")
+	flag.BoolVar(&config.FollowSymlinks, "follow-symlinks", false, "Upload targets of symlinks in -path-to-watch, only the symlink is deleted after upload. Symlinks are skipped otherwise")
+	flag.DurationVar(&config.ScanInterval, "scan-interval", time.Second*10, "Directory scan interval, send SIGUSR2 or POST /admin/scan to scan immediately")
+	flag.DurationVar(&config.ScanIntervalMax, "scan-interval-max", 0, "Longest directory scan interval, the interval is doubled after every scan that finds no files up to this and goes back to -scan-interval once files are found. 0 keeps -scan-interval fixed")
+	flag.StringVar(&failuresFile, "failures-file", "", "JSON file to keep the list of last failed uploads in, it's also available on /api/v1/failures. The list is kept in memory only when empty")
+	flag.IntVar(&failuresLimit, "failures-limit", 100, "Number of last failed uploads to keep in the list")
+	flag.StringVar(&auditLogFile, "audit-log", "", "Append a JSON line for every upload attempt to this file: file, sizes, source checksum, key, duration, result and error. Disabled when empty")
+	flag.StringVar(&auditLogMaxSize, "audit-log-max-size", "100MB", "Rotate -audit-log when it grows over this size, 0 disables rotation")
+	flag.IntVar(&auditLogMaxFiles, "audit-log-max-files", 5, "Number of rotated -audit-log files to keep, they get .1, .2 and so on suffixes")
+	flag.StringVar(&stateFile, "state-file", "", "File to persist state of processed files and multipart uploads in, uploads of large files are resumed after a restart. State is kept in memory only when empty")
+	flag.DurationVar(&config.ReconcileInterval, "reconcile-interval", 0, "How often to check that objects uploaded within -reconcile-window are in the bucket with the same size and ETag, files of mismatched objects are uploaded again if they still exist. 0 disables reconciliation")
+	flag.DurationVar(&config.ReconcileWindow, "reconcile-window", 24*time.Hour, "How long uploaded objects are checked by the reconciler, they are kept in -state-file")
+	flag.DurationVar(&abortStaleMultipart, "abort-stale-multipart", 0, "Abort multipart uploads under the -s3-uri path started longer ago than this that can't be resumed, e.g. \"168h\". 0 disables the cleanup")
+	flag.IntVar(&config.DeleteRetries, "delete-retries", 3, "Number of retries to delete a source file after upload before it's quarantined")
+	flag.DurationVar(&config.DeleteRetryDelay, "delete-retry-delay", time.Second, "Delay between source file delete retries")
+	flag.StringVar(&queueOrder, "queue-order", "mtime", "Order files are processed in: mtime (oldest first) or size (smallest first)")
+	flag.StringVar(&config.ClaimMode, "claim-mode", fs.ClaimLock, "How workers claim files: lock (local lock files), rename (move into a processing directory), flock (lock files in a shared -lock-dir) or s3 (lock objects in the bucket). All but lock are safe for multiple uploaders")
+	flag.StringVar(&config.ProcessingDir, "processing-dir", "", "Directory to move claimed files into with -claim-mode=rename, must be on the same filesystem. Defaults to .processing in -path-to-watch. Files are claimed into a directory named by -instance-id, set it to a name that survives restarts, e.g. a StatefulSet pod name, so files claimed before a crash are recovered")
+	flag.StringVar(&lockDir, "lock-dir", "", "Shared directory for lock files with -claim-mode=flock. Defaults to .locks in -path-to-watch")
+	flag.DurationVar(&lockTTL, "lock-ttl", time.Hour, "Lock objects older than this are considered abandoned with -claim-mode=s3")
+	flag.BoolVar(&config.Watch, "watch", false, "Watch directory for new files with inotify instead of periodic scans, files must be moved into the directory")
+	flag.IntVar(&config.MaxFilesPerScan, "max-files-per-scan", 0, "Queue only this many oldest files per scan, the rest are left for the next scans. 0 means no limit")
+	flag.StringVar(&config.EnqueuePolicy, "enqueue-policy", fs.EnqueueDrop, "What to do with a file found when the queue is full: block until there's space, drop it until the next scan, or spill it to the state file to be queued first")
+	flag.StringVar(&fileGroups, "file-groups", "", "Semicolon separated file groups uploaded together, each is a comma separated list of suffixes, e.g. \".dat,.idx;.sql,.sql.sha256\"")
+	flag.DurationVar(&config.FileGroupTimeout, "file-group-timeout", time.Minute*10, "Upload an incomplete file group as is when its newest file is older than this")
+
+	flag.StringVar(&config.InstanceID, "instance-id", "", "Identity of this uploader shown in /status, {instance} in -s3-uri, -http-url and -routes-file destinations is replaced with it to keep files of multiple nodes apart. It's added to pushed metrics as the instance grouping label when set. Defaults to the host name")
+	flag.StringVar(&s3uri, "s3-uri", "", "S3 bucket to upload to, {instance} is replaced with -instance-id, e.g. \"s3://backups/{instance}/db\". Claim locks of -claim-mode=s3 are kept under the path without it, so all instances share them")
+	flag.StringVar(&config.HTTPURL, "http-url", "", "Upload files with HTTP PUT under this URL instead of S3, e.g. \"https://dav.example.com/backups\" for WebDAV or artifact servers")
+	flag.StringVar(&httpHeaders, "http-headers", "", "Comma separated headers sent with -http-url uploads, e.g. \"Authorization=Bearer $UPLOAD_TOKEN\". Environment variables in values are expanded")
+	flag.BoolVar(&config.HTTPInsecureTLS, "http-insecure-tls", false, "Don't verify the TLS certificate of -http-url")
+	flag.StringVar(&routesFile, "routes-file", "", "JSON file with routes of files to other destinations than -s3-uri or -http-url, e.g. [{\"pattern\": \"*.sql\", \"destination\": \"s3://db-backups/sql\"}]. The first route with a pattern matching the file name wins")
+	flag.StringVar(&config.S3Endpoint, "s3-endpoint", "", "Custom S3 endpoint URL for S3-compatible storage, buckets are addressed path-style")
+	flag.BoolVar(&config.S3Accelerate, "s3-accelerate", false, "Use the S3 Transfer Acceleration endpoint for uploads from far-away regions, it must be enabled on the bucket")
+	flag.BoolVar(&config.S3DualStack, "s3-dualstack", false, "Use the dual-stack S3 endpoint reachable over IPv6 and IPv4")
+	flag.BoolVar(&config.S3UseFIPS, "s3-use-fips", false, "Use the FIPS 140-2 validated S3 endpoint of the region, e.g. in GovCloud")
+	flag.BoolVar(&config.S3RequesterPays, "s3-requester-pays", false, "Send requests with RequestPayer=requester for requester-pays buckets, this uploader is charged for them")
+	flag.DurationVar(&config.SendTimeout, "send-timeout", time.Second*10, "Send request timeout")
+	flag.DurationVar(&config.PerFileTimeout, "per-file-timeout", 0, "Cancel compression, encryption or upload of a file when one of these stages takes longer, time spent waiting for a free stage worker is not counted. The file is retried later. 0 means no timeout")
+	flag.StringVar(&minFileSize, "min-file-size", "", "Skip files smaller than this, e.g. \"1KB\"")
+	flag.StringVar(&maxFileSize, "max-file-size", "", "Skip files larger than this, e.g. \"100GB\"")
+	flag.StringVar(&largeFileSize, "large-file-size", "", "Files of this size or larger are uploaded with -large-file-prefix and -large-file-storage-class, e.g. \"1GB\"")
+	flag.StringVar(&config.LargeFilePrefix, "large-file-prefix", "", "Path for large files relative to the -s3-uri path, e.g. \"archives\"")
+	flag.StringVar(&config.LargeFileStorageClass, "large-file-storage-class", "", "S3 storage class for large files, e.g. GLACIER")
+	flag.StringVar(&config.StorageClass, "storage-class", "", "S3 storage class for uploaded files, bucket default when empty")
+	flag.StringVar(&config.ObjectLockMode, "object-lock-mode", "", "Upload objects with S3 object lock retention in this mode, GOVERNANCE or COMPLIANCE, for WORM backup buckets. The bucket must have object lock enabled")
+	flag.StringVar(&objectLockRetainUntil, "object-lock-retain-until", "", "Retain objects locked with -object-lock-mode until this date, e.g. \"2030-01-01\" or RFC 3339 time")
+	flag.IntVar(&config.RetentionDays, "retention-days", 0, "Retain objects locked with -object-lock-mode for this many days after upload")
+	flag.IntVar(&config.ExpiryTagDays, "expiry-tag-days", 0, "Tag uploaded objects with expire-after=<days>d, e.g. expire-after=30d, for bucket lifecycle rules to delete them. 0 disables tagging")
+	flag.BoolVar(&config.ChecksumSidecar, "checksum-sidecar", false, "Upload a FILE.sha256 object next to each uploaded file with the SHA-256 checksum of the source file before compression and encryption, in sha256sum -c format")
+	flag.BoolVar(&config.VerifyBeforeDelete, "verify-before-delete", true, "Check with HeadObject that an uploaded object exists and has the uploaded size before deleting the source file. It can be turned off at runtime with the verify_enabled feature flag")
+	flag.BoolVar(&config.ExpiryCheck, "expiry-lifecycle-check", false, "Check on startup that buckets have an enabled lifecycle rule expiring objects with the -expiry-tag-days tag after the same number of days")
+	flag.StringVar(&s3PartSize, "s3-part-size", "", "S3 multipart upload part size, e.g. \"16MB\", SDK default of 5MB when empty")
+	flag.IntVar(&config.S3MaxRetries, "s3-max-retries", -1, "Number of retries of a failed S3 request, 0 disables retries, SDK default of 3 when negative")
+	flag.DurationVar(&config.S3SlowDownDelay, "s3-slowdown-delay", time.Second, "Initial retry delay when S3 throttles requests with 503 SlowDown, it doubles with every retry")
+	flag.DurationVar(&config.S3SlowDownMax, "s3-slowdown-max-delay", time.Minute, "Max retry delay when S3 throttles requests")
+	flag.IntVar(&config.S3Concurrency, "s3-concurrency", 0, "Number of parts of a file uploaded in parallel, so a single large file can saturate the link even with one worker. Each in-flight part is buffered in memory, SDK default of 5 when 0")
+	flag.StringVar(&maxInflightBytes, "max-inflight-bytes", "", "Total size of files compressed, encrypted and uploaded by all workers together, e.g. \"20GB\". Workers wait with the next file until there's room, a larger file waits for all others. Empty means no limit")
+	flag.StringVar(&maxBufferMemory, "max-buffer-memory", "", "Memory for buffered upload parts and files encrypted with -encrypt-engine=kms of all workers together, e.g. \"1GB\". Uploads wait for memory to be available, empty means no limit")
+	flag.StringVar(&progressMinSize, "progress-min-size", "1GB", "Log and export upload progress of files of this size or larger, e.g. \"500MB\", 0 disables progress reporting")
+	flag.DurationVar(&config.Progress.Interval, "progress-interval", 30*time.Second, "How often upload progress of large files is logged")
+	flag.StringVar(&uploadRateLimit, "upload-rate-limit", "", "Total upload rate limit per second for all workers, e.g. \"10MB\", empty means no limit")
+	flag.StringVar(&uploadRateBurst, "upload-rate-burst", "", "Upload rate limiter burst size, e.g. \"50MB\", defaults to one second of -upload-rate-limit")
+	flag.StringVar(&uploadRateSchedule, "upload-rate-schedule", "", "Comma separated upload rate limits by time of day, 0 means no limit, -upload-rate-limit applies outside of the windows, e.g. \"08:00-20:00=5MB,20:00-08:00=0\"")
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "Exit after this duration, e.g. for Job style runs, 0 means no limit")
+	flag.BoolVar(&failOnAny, "fail-on-any", false, fmt.Sprintf("Exit with code %d if any file failed to upload during the run and wasn't uploaded on a retry", exitCodeUploadsFailed))
+	flag.Float64Var(&maxErrorRate, "max-error-rate", 1, fmt.Sprintf("Exit with code %d if the share of files that failed to upload during the run is over this, from 0 to 1", exitCodeUploadsFailed))
+	flag.StringVar(&uploadWindow, "upload-window", "", "Daily time window for uploads, e.g. \"22:00-06:00\", files are still queued outside of it but workers pause")
+	flag.StringVar(&uploadWindowTimezone, "upload-window-timezone", "Local", "Time zone of -upload-window and -upload-rate-schedule, e.g. \"Europe/Berlin\"")
+	flag.StringVar(&manifestFormat, "manifest-format", "", "Write upload manifests in this format (json or csv) to the bucket, disabled when empty")
+	flag.StringVar(&config.ManifestPrefix, "manifest-prefix", "manifests", "Path for upload manifests relative to the -s3-uri path")
+	flag.DurationVar(&config.ManifestInterval, "manifest-interval", 10*time.Minute, "How often to write upload manifests, a final one is written on exit")
+	flag.StringVar(&manifestSpool, "manifest-spool", "", "Append upload manifest entries to this file until they are written to the bucket, so they survive a crash. Entries are kept in memory only when empty")
+	flag.IntVar(&manifestMaxEntries, "manifest-max-entries", 100000, "Maximum number of upload manifest entries in a single manifest and kept in memory while manifests fail to be written, the oldest ones are dropped over it")
+	flag.StringVar(&heartbeat.file, "heartbeat-file", "", "Local file to write status JSON to every -heartbeat-interval, so monitoring without Prometheus can tell the uploader is alive")
+	flag.StringVar(&heartbeat.object, "heartbeat-object", "", "Object to write status JSON to every -heartbeat-interval, relative to the -s3-uri path, e.g. \"heartbeats/{instance}.json\"")
+	flag.DurationVar(&heartbeat.interval, "heartbeat-interval", 5*time.Minute, "How often to write the heartbeat file and object")
+	flag.StringVar(&alertWebhook, "alert-webhook", "", "Slack or Teams incoming webhook URL for alerts on repeated upload errors or old backlog. Alerts can be turned off at runtime with the alerts_enabled feature flag")
+	flag.StringVar(&alertWebhookKind, "alert-webhook-kind", "slack", "Alert webhook kind: slack or teams")
+	flag.IntVar(&alertMaxErrors, "alert-max-errors", 5, "Alert when this many uploads fail in a row, 0 disables the check")
+	flag.DurationVar(&alertMaxBacklogAge, "alert-max-backlog-age", time.Hour, "Alert when the oldest file has been queued for longer than this while uploads are allowed, 0 disables the check")
+	flag.DurationVar(&alertCooldown, "alert-cooldown", 30*time.Minute, "Send at most one alert per this interval")
+	flag.IntVar(&circuitFailures, "circuit-breaker-failures", 10, "Stop uploads for -circuit-breaker-backoff after this many uploads fail in a row, files are still queued. 0 disables the circuit breaker")
+	flag.DurationVar(&circuitBackoff, "circuit-breaker-backoff", time.Minute, "How long uploads are stopped when the circuit breaker opens")
+	flag.IntVar(&config.ConfigErrorThreshold, "config-error-threshold", 3, "Stop with exit code 3 after this many uploads fail with a configuration error, e.g. AccessDenied or NoSuchBucket, within -config-error-window. 0 never stops")
+	flag.DurationVar(&config.ConfigErrorWindow, "config-error-window", 10*time.Minute, "Time window for -config-error-threshold")
+
+	flag.BoolVar(&config.Gzip, "gzip", true, "Wether to compress a file before uploading, same as -compression=none when false")
+	flag.BoolVar(&config.Encrypt, "encrypt", true, "Wether to encrypt a file before uploading")
+	flag.IntVar(&encryptWorkers, "encrypt-workers", runtime.GOMAXPROCS(0), "Number of files encrypted at once by all workers together. Defaults to GOMAXPROCS, 0 encrypts in every worker without a limit")
+	flag.StringVar(&config.Compression, "compression", "gzip", "Compression codec: gzip, zstd, lz4 or none")
+	flag.IntVar(&config.CompressionLevel, "compression-level", 0, "Compression level, 0 means the codec default")
+	flag.IntVar(&compressWorkers, "compress-workers", runtime.GOMAXPROCS(0), "Number of files compressed at once by all workers together, so compression doesn't take CPU from uploads. Defaults to GOMAXPROCS, 0 compresses in every worker without a limit")
+	flag.IntVar(&gzipLevel, "gzip-level", 0, "Gzip compression level from 1 to 9, same as -compression-level with -compression=gzip")
+	flag.StringVar(&config.Archive, "archive", fs.ArchiveTar, "Pack files into a tar archive before compression: tar, or none to upload plain .gz, .zst and .lz4 files")
+	flag.StringVar(&config.CompressEngine, "compress-engine", "", "Compression engine: exec runs external tar and compressors, native compresses in the process without external tools but doesn't support lz4. Defaults to native on Windows and with -no-exec, exec otherwise")
+	flag.BoolVar(&config.NoExec, "no-exec", !fs.ExecSupported, "Never run external tools, fail at startup if the pipeline needs gpg, tar or a compressor binary, so the uploader can run from an image with nothing but its binary. Always on in builds with the noexec tag")
+	flag.StringVar(&noCompressExtensions, "no-compress-extensions", defaultNoCompressExtensions, "Comma separated list of file extensions that are uploaded without compression")
+	flag.StringVar(&config.GzipDir, "gzip-dir", "/app/gzip", "Directory to store temporary compressed files in")
+	flag.StringVar(&config.EncryptDir, "encrypt-dir", "/app/enc", "Directory to store temporary encrypted files in")
+	flag.BoolVar(&config.LegacyKeyNames, "legacy-key-names", false, "Keep the compressed file suffix for encrypted files instead of adding .gpg or .age")
+	flag.BoolVar(&config.KeyOverride, "key-override", false, "Upload a file to the S3 key written by the producer into a companion file with .key suffix, e.g. dump.sql.key")
+	flag.DurationVar(&config.DedupWindow, "dedup-window", 0, "Skip uploads of files with the same content as a file uploaded within this time, e.g. \"168h\". Checksums are kept in -state-file. 0 disables dedup, file groups are never deduplicated")
+	flag.StringVar(&config.DedupDir, "dedup-dir", "", "Move files skipped by -dedup-window into this directory instead of deleting them")
+	flag.StringVar(&config.TrashDir, "trash-dir", "", "Move uploaded source files into this directory instead of deleting them, so they can be restored if uploads turn out to be corrupted. Must be on the same filesystem as watched directories")
+	flag.DurationVar(&config.TrashRetention, "trash-retention", 24*time.Hour, "How long uploaded files are kept in -trash-dir before they are deleted, e.g. \"72h\"")
+	flag.StringVar(&trashMaxSize, "trash-max-size", "", "Delete the oldest files in -trash-dir when files moved there grow over this size, e.g. \"50GB\", unlimited when empty. Other files in the directory don't count")
+	flag.StringVar(&dedupDirMaxSize, "dedup-dir-max-size", "", "Delete the oldest files in -dedup-dir when files moved there grow over this size, e.g. \"10GB\", unlimited when empty")
+	flag.DurationVar(&config.DedupDirMaxAge, "dedup-dir-max-age", 0, "Delete files in -dedup-dir this long after they were moved there, e.g. \"720h\", 0 keeps them")
+	flag.StringVar(&config.ReadyMarker, "ready-marker", "", "Upload a file only when the producer creates a marker file with this suffix next to it, e.g. \".done\" for dump.sql.done. The marker is deleted after upload")
+	flag.StringVar(&config.ReadySuffix, "ready-suffix", "", "Upload only files the producer renamed with this suffix, e.g. \".ready\", the suffix is not part of the S3 key")
+	flag.StringVar(&config.KeyOverridePrefix, "key-override-prefix", "", "Custom S3 keys must be under this prefix, defaults to the -s3-uri path")
+	flag.IntVar(&config.KeyShardLevels, "key-shard-levels", 0, "Spread object keys across hash-derived prefixes for request throughput with many objects, two hex digits of SHA-256 of the object name per level, e.g. 2 for /backups/ab/cd/dump.sql.tgz, stream keys of -stdin and -fifo get them before the file name. The scheme is recorded in the upload manifest. 0 disables sharding, keys from .key files are used as is")
+	flag.StringVar(&config.KeySuffix, "key-suffix", "", "Add a unique suffix before the first extension of object names, so files with reused names don't overwrite each other: ulid (sortable by time), uuid or counter (needs -state-file), e.g. dump-01J9ZQ4M2X8C7F3T6W1R5B0K9H.sql.tgz. Keys from .key files are used as is")
+	flag.StringVar(&config.EncryptionKeyID, "encryption-key-id", "", "Encryption key identifier stored in object metadata, derived from public keys when empty")
+	flag.BoolVar(&config.KeyIDInFilename, "key-id-in-filename", false, "Add encryption key identifier to the object key before the .gpg or .age suffix")
+	flag.StringVar(&config.EncryptEngine, "encrypt-engine", "gpg", "Encryption engine: gpg (external binary), age (built-in) or kms (per-file data keys from AWS KMS, in the S3 Encryption Client format)")
+	flag.StringVar(&config.KMSKeyID, "kms-key-id", "", "KMS key ID, ARN or alias to generate data keys with for -encrypt-engine=kms. Files are encrypted in memory with AES-GCM, the wrapped data key is stored in object metadata")
+	flag.StringVar(&kmsMaxFileSize, "kms-max-file-size", "1GB", "Largest file encrypted with -encrypt-engine=kms, larger files fail as they are encrypted in memory. The memory is reserved from -max-buffer-memory")
+	flag.StringVar(&config.KMSEndpoint, "kms-endpoint", "", "Custom KMS endpoint URL, resolved by the SDK when empty")
+	flag.StringVar(&ageRecipients, "age-recipients", "", "Comma separated list of age public keys to encrypt files to")
+	flag.StringVar(&ageIdentityFile, "age-identity-file", "", "age identity file, files are encrypted to the public keys of its identities")
+	flag.StringVar(&config.EnvVarGPGPass, "env-var-name-gpg-password", "GPG_PASSWORD", "Env var name with GPG password")
+	flag.StringVar(&gpgPasswordFile, "gpg-password-file", "", "File with GPG password, e.g. a secret mount, re-read when changed. Takes precedence over the env var")
+	flag.StringVar(&secretsProvider, "secrets-provider", "", "Fetch GPG password from a secrets store: vault or aws-secrets-manager")
+	flag.StringVar(&gpgPasswordSecret, "gpg-password-secret", "", "GPG password secret reference for -secrets-provider, \"path#key\" for vault, \"id\" or \"id#key\" for aws-secrets-manager")
+	flag.StringVar(&vaultAddr, "vault-addr", os.Getenv("VAULT_ADDR"), "Vault server address")
+	flag.StringVar(&vaultTokenFile, "vault-token-file", "", "File with Vault token, VAULT_TOKEN env variable is used when empty")
+	flag.DurationVar(&secretsRefreshInterval, "secrets-refresh-interval", time.Minute*5, "How often secrets are re-fetched from -secrets-provider to pick up rotation")
+	flag.StringVar(&gpgRecipients, "gpg-recipient", "", "Comma separated list of GPG recipients (key IDs or emails) to encrypt files to instead of using a password")
+	flag.StringVar(&config.GpgPublicKeyFile, "gpg-public-key-file", "", "GPG public key file to encrypt files to instead of using a password")
+
+	flag.StringVar(&featureFlagsFile, "feature-flags-file", "", "File to persist runtime feature flags changed via /flags endpoint in")
+
+	flag.IntVar(&producer.Files, "synthetic-files", 0, "Soak-test mode: number of synthetic files to generate into -path-to-watch every -synthetic-interval, 0 disables it")
+	flag.StringVar(&syntheticFileSize, "synthetic-file-size", "1MB", "Soak-test mode: size of synthetic files")
+	flag.DurationVar(&producer.Interval, "synthetic-interval", time.Second*10, "Soak-test mode: synthetic files generation interval")
+
+	flag.BoolVar(&metricsHistograms, "metrics-histograms", true, "Keep histogram metrics, every histogram takes memory for its buckets")
+	flag.StringVar(&config.PushGateway, "push-gateway", "", "Prometheus Pushgateway URL")
+	flag.DurationVar(&config.PushInterval, "push-interval", time.Second*15, "Metrics push interval")
+	flag.StringVar(&config.RemoteWriteURL, "remote-write-url", "", "Push metrics with Prometheus remote-write to this URL, e.g. Mimir or Grafana Cloud")
+	flag.StringVar(&config.OTLPEndpoint, "otlp-endpoint", "", "Push metrics with OTLP/HTTP (JSON) to this collector URL, /v1/metrics is added if the URL has no path")
+	flag.StringVar(&config.PushJobName, "push-job-name", "app", "Job name for pushed metrics, used as service.name with OTLP")
+	flag.StringVar(&pushGroupingLabels, "push-grouping-labels", "", "Comma separated key=value grouping labels for pushed metrics, {hostname} and {instance} in values are replaced with the host name and -instance-id, e.g. node={hostname}. The instance label is -instance-id if it's set, unless the label is set here")
+	flag.StringVar(&config.PushBasicAuth, "push-basic-auth", "", "HTTP basic auth for pushing metrics, format: user:password")
+	flag.StringVar(&pushBearerTokenFile, "push-bearer-token-file", "", "File with a bearer token for pushing metrics")
+	flag.BoolVar(&config.PushDeleteOnExit, "push-delete-on-exit", false, "Delete the metrics group from Prometheus Pushgateway on clean shutdown instead of pushing final values")
+
+	flag.Parse()
+	profileErr := applyProfile(flag.CommandLine, profile)
+
+	// Show and exit functions
+	if showVersion {
+		fmt.Printf("Version: %s\n", version)
+		os.Exit(0)
+	}
+
+	// Logger
+	logOutput, logErr := openLogFile(logFile, logFileMaxSize, logFileMaxFiles, logFileMaxAge)
+	logOutput, systemLog, targetErr := logTargetOutput(logTarget, logOutput)
+	logErr = errors.Join(logErr, targetErr)
+	applog = logger.Init("s3-file-uploader", config.Verbose, systemLog, logOutput)
+	config.Applog = applog
+	if logErr != nil {
+		applog.Fatal(logErr.Error())
+	}
+	if profileErr != nil {
+		applog.Fatal(profileErr.Error())
+	}
+
+	// Initialize the status registry, workers preparing files ahead are workers too
+	if config.PrepareAhead < 0 {
+		applog.Fatal("-prepare-ahead can't be negative")
+	}
+	config.Status = cfg.NewStatusRegistry(config.Workers + config.PrepareAhead)
+
+	// Some checks
+	instanceIDSet := config.InstanceID != ""
+	if config.InstanceID == "" {
+		if config.InstanceID, err = os.Hostname(); err != nil {
+			applog.Fatalf("-instance-id is not specified and the host name is unknown: %s", err.Error())
+		}
+	}
+	if !instanceIDRegexp.MatchString(config.InstanceID) {
+		applog.Fatalf("-instance-id %q must contain only letters, digits, dots, dashes and underscores", config.InstanceID)
+	}
+	lockPath := sharedS3Path(s3uri)
+	s3uri = strings.ReplaceAll(s3uri, "{instance}", config.InstanceID)
+	heartbeat.object = strings.Trim(strings.ReplaceAll(heartbeat.object, "{instance}", config.InstanceID), "/")
+	config.HTTPURL = strings.ReplaceAll(config.HTTPURL, "{instance}", config.InstanceID)
+
+	if config.HTTPURL != "" {
+		if s3uri != "" {
+			applog.Fatal("-s3-uri and -http-url are mutually exclusive")
+		}
+		u, err := url.Parse(config.HTTPURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			applog.Fatalf("-http-url must be an http:// or https:// URL, got %q", config.HTTPURL)
+		}
+		if config.ClaimMode == fs.ClaimS3 || manifestFormat != "" || config.ReconcileInterval > 0 || abortStaleMultipart > 0 || heartbeat.object != "" {
+			applog.Fatal("-claim-mode=s3, -manifest-format, -reconcile-interval, -abort-stale-multipart and -heartbeat-object need an S3 bucket and can't be used with -http-url")
+		}
+		// Object keys start with the URL path like they start with the -s3-uri path
+		config.S3path = strings.TrimSuffix(u.Path, "/")
+
+		config.HTTPHeaders, err = utils.ParseLabels(httpHeaders)
+		if err != nil {
+			applog.Fatalf("Bad -http-headers: %s", err.Error())
+		}
+		for name, value := range config.HTTPHeaders {
+			config.HTTPHeaders[name] = os.ExpandEnv(value)
+		}
+	} else {
+		if s3uri == "" {
+			applog.Fatal("-s3-uri or -http-url is not specified")
+		} else if err := utils.ValidateUrl(s3uri); err != nil {
+			applog.Fatal(err.Error())
+		}
+
+		config.S3bucket, config.S3path, err = utils.ParseS3URL(s3uri)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+		if config.S3bucket == "" || config.S3path == "" {
+			applog.Fatal("-s3-uri must contain bucket and path for backups")
+		}
+	}
 
-	flag.Parse()
+	if routesFile != "" {
+		if config.Routes, err = fs.LoadRoutes(routesFile, config.InstanceID); err != nil {
+			applog.Fatal(err.Error())
+		}
+	}
+	if config.S3Endpoint != "" && (config.S3Accelerate || config.S3DualStack || config.S3UseFIPS) {
+		applog.Fatal("-s3-accelerate, -s3-dualstack and -s3-use-fips can't be used with -s3-endpoint")
+	}
+	if config.S3Accelerate && config.S3UseFIPS {
+		applog.Fatal("-s3-accelerate can't be used with -s3-use-fips, there are no accelerated FIPS endpoints")
+	}
+	if config.S3Endpoint == "" {
+		endpoint, err := s3.ValidateRegion(config)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+		if endpoint != "" {
+			applog.Infof("Using S3 endpoint %s", endpoint)
+		}
+	}
+	if config.S3Accelerate {
+		buckets := []string{config.S3bucket}
+		for _, route := range config.Routes {
+			buckets = append(buckets, route.S3bucket)
+		}
+		for _, bucket := range buckets {
+			if strings.Contains(bucket, ".") {
+				applog.Fatalf("Bucket %q can't be used with -s3-accelerate, accelerated bucket names must not contain dots", bucket)
+			}
+		}
+	}
 
-	// Show and exit functions
-	if showVersion {
-		fmt.Printf("Version: %s\n", version)
-		os.Exit(0)
+	// The first watched directory has control files and lock files
+	for _, path := range pathsToWatch {
+		config.WatchPaths = append(config.WatchPaths, cfg.WatchPath{Path: path})
+	}
+	if watchPathsFile != "" {
+		paths, err := fs.LoadWatchPaths(watchPathsFile)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+		config.WatchPaths = append(config.WatchPaths, paths...)
+	}
+	if len(config.WatchPaths) == 0 {
+		config.WatchPaths = []cfg.WatchPath{{Path: defaultPathToWatch}}
+	}
+	if err := fs.ValidateWatchPaths(config.WatchPaths); err != nil {
+		applog.Fatal(err.Error())
+	}
+	config.PathToWatch = filepath.Clean(config.WatchPaths[0].Path)
+	if len(config.WatchPaths) > 1 && config.ProcessingDir != "" {
+		applog.Fatal("-processing-dir can't be shared by several watched directories, they use .processing in each of them")
+	}
+	if config.TrashDir != "" && config.TrashRetention <= 0 {
+		applog.Fatal("-trash-retention must be positive")
+	}
+	if trashMaxSize != "" {
+		if config.TrashMaxSize, err = utils.ParseBytes(trashMaxSize); err != nil {
+			applog.Fatalf("Bad -trash-max-size: %s", err.Error())
+		}
+	}
+	if dedupDirMaxSize != "" {
+		if config.DedupDirMaxSize, err = utils.ParseBytes(dedupDirMaxSize); err != nil {
+			applog.Fatalf("Bad -dedup-dir-max-size: %s", err.Error())
+		}
+	}
+	if config.DedupDirMaxAge < 0 {
+		applog.Fatal("-dedup-dir-max-age can't be negative")
+	}
+	if controlFiles {
+		config.Control = control.New(config.PathToWatch)
+	}
+
+	if (web.TLSCertFile == "") != (web.TLSKeyFile == "") {
+		applog.Fatal("-listen-tls-cert and -listen-tls-key must be specified together")
+	}
+	if web.AdminAuth != "" && !strings.Contains(web.AdminAuth, ":") {
+		applog.Fatal("-admin-auth must be in user:password format")
 	}
 
-	// Initialize the global status var
-	workerStatuses = make([]cfg.WorkerStatus, config.Workers)
+	if config.KeyOverridePrefix == "" {
+		config.KeyOverridePrefix = config.S3path
+	}
+	if config.ReadyMarker != "" && config.ReadySuffix != "" {
+		applog.Fatal("-ready-marker and -ready-suffix are mutually exclusive")
+	}
 
-	// Logger
-	applog = logger.Init("s3-file-uploader", config.Verbose, false, io.Discard)
-	config.Applog = applog
+	switch config.ClaimMode {
+	case fs.ClaimLock:
+	case fs.ClaimRename:
+	case fs.ClaimFlock:
+		if lockDir == "" {
+			lockDir = filepath.Join(config.PathToWatch, ".locks")
+		}
+		if config.Locker, err = dlock.NewFlock(lockDir); err != nil {
+			applog.Fatalf("Failed to create -lock-dir: %s", err.Error())
+		}
+	case fs.ClaimS3:
+		sess, err := s3.NewSession(config)
+		if err != nil {
+			applog.Fatalf("Failed to create S3 session: %s", err.Error())
+		}
+		config.Locker = dlock.NewS3(sess, config.S3bucket, lockPath+"/.locks", lockTTL)
+	default:
+		applog.Fatalf("Unsupported -claim-mode %q, must be lock, rename, flock or s3", config.ClaimMode)
+	}
 
-	// Some checks
-	if s3uri == "" {
-		applog.Fatal("-s3-uri is not specified")
-	} else if err := utils.ValidateUrl(s3uri); err != nil {
+	config.Features, err = features.New(featureFlagsFile)
+	if err != nil {
+		applog.Fatal(err.Error())
+	}
+
+	config.State, err = state.Open(stateFile)
+	if err != nil {
+		applog.Fatal(err.Error())
+	}
+	config.Failures, err = failures.Open(failuresFile, failuresLimit)
+	if err != nil {
+		applog.Fatal(err.Error())
+	}
+	if auditLogFile != "" {
+		maxSize, err := utils.ParseBytes(auditLogMaxSize)
+		if err != nil {
+			applog.Fatalf("Bad -audit-log-max-size: %s", err.Error())
+		}
+		if auditLogMaxFiles < 1 {
+			applog.Fatal("-audit-log-max-files must be at least 1")
+		}
+		if config.AuditLog, err = audit.Open(auditLogFile, maxSize, auditLogMaxFiles); err != nil {
+			applog.Fatal(err.Error())
+		}
+	}
+	if maxErrorRate < 0 || maxErrorRate > 1 {
+		applog.Fatalf("Bad -max-error-rate %v, must be from 0 to 1", maxErrorRate)
+	}
+	if config.MaxFilesPerScan < 0 {
+		applog.Fatal("-max-files-per-scan can't be negative")
+	}
+	if config.ScanIntervalMax != 0 && config.ScanIntervalMax < config.ScanInterval {
+		applog.Fatal("-scan-interval-max must not be shorter than -scan-interval")
+	}
+	if err := fs.ValidateEnqueuePolicy(config.EnqueuePolicy); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if err := fs.ValidateKeySuffix(config.KeySuffix); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if err := fs.ValidateKeyShardLevels(config.KeyShardLevels); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if config.KeySuffix == fs.KeySuffixCounter && !config.State.Persistent() {
+		applog.Fatal("-key-suffix=counter needs -state-file, the counter would start over after a restart")
+	}
+
+	if gzipLevel != 0 {
+		if config.Compression != "gzip" {
+			applog.Fatal("-gzip-level can only be used with -compression=gzip")
+		}
+		if config.CompressionLevel != 0 && config.CompressionLevel != gzipLevel {
+			applog.Fatal("-gzip-level and -compression-level are set to different levels")
+		}
+		config.CompressionLevel = gzipLevel
+	}
+	if err := fs.ValidateCompression(config.Compression, config.CompressionLevel); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if err := fs.ValidateArchive(config.Archive); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if !config.NoExec && !fs.ExecSupported {
+		applog.Fatal("This build can't run external tools, -no-exec can't be disabled")
+	}
+	if config.CompressEngine == "" {
+		config.CompressEngine = fs.DefaultCompressEngine(config.NoExec)
+	}
+	if err := fs.ValidateCompressEngine(config.CompressEngine, config.Compression); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if stdin && stdinKey == "" {
+		applog.Fatal("-stdin needs -key")
+	} else if !stdin && stdinKey != "" {
+		applog.Fatal("-key needs -stdin")
+	}
+	if stdin && fifoPath != "" {
+		applog.Fatal("-stdin and -fifo are mutually exclusive")
+	}
+	if stdin || fifoPath != "" {
+		if config.HTTPURL != "" || len(config.Routes) > 0 {
+			applog.Fatal("Streams are uploaded to -s3-uri only, -stdin and -fifo can't be used with -http-url or -routes-file")
+		}
+		if config.ChecksumSidecar {
+			applog.Fatal("-checksum-sidecar can't be used with -stdin or -fifo, streams are gone once they are uploaded")
+		}
+		if err := fs.ValidateStream(config); err != nil {
+			applog.Fatalf("Bad stream pipeline: %s", err.Error())
+		}
+	}
+	if fifoPath != "" {
+		if err := fs.MakeFIFO(fifoPath); err != nil {
+			applog.Fatal(err.Error())
+		}
+	}
+	var sqsSource *sqssource.Source
+	if sqsQueueURL != "" {
+		if stdin {
+			applog.Fatal("-stdin and -sqs-queue-url are mutually exclusive")
+		}
+		if config.DryRun {
+			applog.Fatal("-sqs-queue-url can't be used with -dry-run, messages are deleted once their files are queued")
+		}
+		hosts, err := sqssource.ParseHosts(sqsDownloadHosts)
+		if err != nil {
+			applog.Fatalf("Bad -sqs-download-hosts: %s", err.Error())
+		}
+		if sqsSource, err = sqssource.New(config, sqsQueueURL, hosts); err != nil {
+			applog.Fatalf("Failed to initialize SQS client: %s", err.Error())
+		}
+	}
+	if compressWorkers < 0 {
+		applog.Fatal("-compress-workers can't be negative")
+	}
+	if encryptWorkers < 0 {
+		applog.Fatal("-encrypt-workers can't be negative")
+	}
+	if config.Compression == "none" {
+		config.Gzip = false
+	}
+	config.Pipeline = newPipeline(config, compressWorkers, encryptWorkers)
+	config.NoCompressExtensions = fs.ParseExtensions(noCompressExtensions)
+	if config.IgnorePatterns, err = fs.ParseIgnorePatterns(ignorePatterns); err != nil {
 		applog.Fatal(err.Error())
 	}
 
-	config.S3bucket, config.S3path, err = utils.ParseS3URL(s3uri)
+	config.FileGroups, err = fs.ParseFileGroups(fileGroups)
 	if err != nil {
 		applog.Fatal(err.Error())
 	}
-	if config.S3bucket == "" || config.S3path == "" {
-		applog.Fatal("-s3-uri must contain bucket and path for backups")
+
+	if showPlan {
+		if err := printPlan(config); err != nil {
+			applog.Fatal(err.Error())
+		}
+		os.Exit(0)
+	}
+
+	for _, recipient := range strings.Split(gpgRecipients, ",") {
+		if recipient = strings.TrimSpace(recipient); recipient != "" {
+			config.GpgRecipients = append(config.GpgRecipients, recipient)
+		}
 	}
 
-	if config.PathToWatch == "" {
-		applog.Fatal("-path-to-watch is not specified")
+	if config.EncryptEngine != "gpg" && config.EncryptEngine != "age" && config.EncryptEngine != "kms" {
+		applog.Fatalf("Unsupported -encrypt-engine %q, must be gpg, age or kms", config.EncryptEngine)
 	}
 
-	if config.Encrypt {
-		config.GpgPassword = os.Getenv(config.EnvVarGPGPass)
-		if config.GpgPassword == "" {
+	if config.Encrypt && config.EncryptEngine == "kms" {
+		if config.KMSKeyID == "" {
+			applog.Fatal("-encrypt-engine=kms needs -kms-key-id")
+		}
+		if config.KMSMaxFileSize, err = utils.ParseBytes(kmsMaxFileSize); err != nil {
+			applog.Fatalf("Bad -kms-max-file-size: %s", err.Error())
+		}
+		if config.KMSMaxFileSize <= 0 || config.KMSMaxFileSize > fs.KMSMaxFileSizeLimit {
+			applog.Fatalf("-kms-max-file-size must be between 1 and %d bytes", int64(fs.KMSMaxFileSizeLimit))
+		}
+		if config.HTTPURL != "" {
+			applog.Fatal("-encrypt-engine=kms keeps data keys in S3 object metadata and can't be used with -http-url")
+		}
+		config.KMS, err = fs.NewKMSClient(config)
+		if err != nil {
+			applog.Fatalf("Failed to initialize KMS client: %s", err.Error())
+		}
+	} else if config.Encrypt && config.EncryptEngine == "age" {
+		keys := []string{}
+		for _, key := range strings.Split(ageRecipients, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				keys = append(keys, key)
+			}
+		}
+		config.AgeRecipients, err = fs.ParseAgeRecipients(keys, ageIdentityFile)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+	} else if config.Encrypt && fs.IsAsymmetricEncryption(config) {
+		if config.GpgPublicKeyFile != "" {
+			if _, err := os.Stat(config.GpgPublicKeyFile); err != nil {
+				applog.Fatalf("Can't read -gpg-public-key-file: %s", err.Error())
+			}
+		}
+	} else if config.Encrypt && secretsProvider != "" {
+		config.GpgPassword, err = initSecretsProvider(secretsProvider, gpgPasswordSecret, vaultAddr, vaultTokenFile, secretsRefreshInterval)
+		if err != nil {
+			applog.Fatalf("Failed to get GPG password from %s: %s", secretsProvider, err.Error())
+		}
+	} else if config.Encrypt && gpgPasswordFile != "" {
+		config.GpgPassword, err = secret.NewFile(gpgPasswordFile)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+	} else if config.Encrypt {
+		config.GpgPassword = secret.Static(os.Getenv(config.EnvVarGPGPass))
+		if _, err := config.GpgPassword.Get(); err != nil {
 			applog.Fatal("Empty or non existent GGP password env variable")
 		}
 	}
 
+	if config.Encrypt && config.EncryptionKeyID == "" {
+		config.EncryptionKeyID, err = fs.DefaultEncryptionKeyID(config)
+		if err != nil {
+			applog.Fatalf("Failed to derive encryption key identifier: %s", err.Error())
+		}
+	}
+
+	rateLimit, err := utils.ParseBytes(uploadRateLimit)
+	if err != nil {
+		applog.Fatalf("Bad -upload-rate-limit: %s", err.Error())
+	}
+	rateBurst, err := utils.ParseBytes(uploadRateBurst)
+	if err != nil {
+		applog.Fatalf("Bad -upload-rate-burst: %s", err.Error())
+	}
+	if config.MinFileSize, err = utils.ParseBytes(minFileSize); err != nil {
+		applog.Fatalf("Bad -min-file-size: %s", err.Error())
+	}
+	if web.IngestMaxSize, err = utils.ParseBytes(ingestMaxSize); err != nil {
+		applog.Fatalf("Bad -ingest-max-size: %s", err.Error())
+	}
+	if config.MaxFileSize, err = utils.ParseBytes(maxFileSize); err != nil {
+		applog.Fatalf("Bad -max-file-size: %s", err.Error())
+	}
+	if config.MaxFileSize > 0 && config.MaxFileSize < config.MinFileSize {
+		applog.Fatal("-max-file-size must be larger than -min-file-size")
+	}
+	if config.LargeFileSize, err = utils.ParseBytes(largeFileSize); err != nil {
+		applog.Fatalf("Bad -large-file-size: %s", err.Error())
+	}
+	if config.LargeFileSize == 0 && (config.LargeFilePrefix != "" || config.LargeFileStorageClass != "") {
+		applog.Fatal("-large-file-prefix and -large-file-storage-class require -large-file-size")
+	}
+	config.LargeFilePrefix = strings.Trim(config.LargeFilePrefix, "/")
+	for _, class := range []string{config.StorageClass, config.LargeFileStorageClass} {
+		if err := s3.ValidateStorageClass(class); err != nil {
+			applog.Fatal(err.Error())
+		}
+	}
+
+	if err := s3.ValidateObjectLockMode(config.ObjectLockMode); err != nil {
+		applog.Fatal(err.Error())
+	}
+	if objectLockRetainUntil != "" {
+		if config.RetainUntil, err = time.Parse(time.RFC3339, objectLockRetainUntil); err != nil {
+			if config.RetainUntil, err = time.Parse(time.DateOnly, objectLockRetainUntil); err != nil {
+				applog.Fatalf("Bad -object-lock-retain-until %q, must be a date or RFC 3339 time", objectLockRetainUntil)
+			}
+		}
+		if config.RetainUntil.Before(time.Now()) {
+			applog.Fatal("-object-lock-retain-until must be in the future")
+		}
+	}
+	if config.RetentionDays < 0 {
+		applog.Fatal("-retention-days must not be negative")
+	}
+	if config.ObjectLockMode != "" && config.RetainUntil.IsZero() == (config.RetentionDays == 0) {
+		applog.Fatal("-object-lock-mode needs either -object-lock-retain-until or -retention-days")
+	}
+	if config.ObjectLockMode == "" && (!config.RetainUntil.IsZero() || config.RetentionDays > 0) {
+		applog.Fatal("-object-lock-retain-until and -retention-days need -object-lock-mode")
+	}
+	if config.ExpiryTagDays < 0 {
+		applog.Fatal("-expiry-tag-days must not be negative")
+	}
+	if config.ExpiryCheck && config.ExpiryTagDays == 0 {
+		applog.Fatal("-expiry-lifecycle-check needs -expiry-tag-days")
+	}
+
+	config.S3PartSize, err = utils.ParseBytes(s3PartSize)
+	if err == nil {
+		err = s3.ValidatePartSize(config.S3PartSize)
+	}
+	if err != nil {
+		applog.Fatalf("Bad -s3-part-size: %s", err.Error())
+	}
+	bufferMemory, err := utils.ParseBytes(maxBufferMemory)
+	if err != nil {
+		applog.Fatalf("Bad -max-buffer-memory: %s", err.Error())
+	}
+	if bufferMemory > 0 {
+		config.BufferBudget = membudget.New(bufferMemory)
+	}
+	inflightBytes, err := utils.ParseBytes(maxInflightBytes)
+	if err != nil {
+		applog.Fatalf("Bad -max-inflight-bytes: %s", err.Error())
+	}
+	if inflightBytes > 0 {
+		config.InflightBytes = membudget.New(inflightBytes)
+	}
+	config.Progress.MinSize, err = utils.ParseBytes(progressMinSize)
+	if err != nil {
+		applog.Fatalf("Bad -progress-min-size: %s", err.Error())
+	}
+	config.Progress.Log = applog
+	config.Progress.Meter = progress.NewMeter()
+
+	if config.DryRun {
+		config.DryRunReport = &dryrun.Report{}
+	}
+	dryRunRate, err := utils.ParseBytes(dryRunBandwidth)
+	if err != nil {
+		applog.Fatalf("Bad -dry-run-bandwidth: %s", err.Error())
+	}
+
+	location, err := time.LoadLocation(uploadWindowTimezone)
+	if err != nil {
+		applog.Fatalf("Bad -upload-window-timezone: %s", err.Error())
+	}
+	rateSchedule, err := schedule.ParseRateSchedule(uploadRateSchedule, location)
+	if err != nil {
+		applog.Fatalf("Bad -upload-rate-schedule: %s", err.Error())
+	}
+	if rateLimit > 0 || len(rateSchedule) > 0 {
+		config.UploadLimiter = ratelimit.NewLimiter(rateSchedule.RateAt(time.Now(), rateLimit), rateBurst)
+	}
+
+	if uploadWindow != "" {
+		config.UploadWindow, err = schedule.ParseWindow(uploadWindow, location)
+		if err != nil {
+			applog.Fatalf("Bad -upload-window: %s", err.Error())
+		}
+	}
+
+	if manifestFormat != "" {
+		if config.DryRun {
+			applog.Fatal("-manifest-format can't be used with -dry-run")
+		}
+		if config.ManifestInterval <= 0 {
+			applog.Fatal("-manifest-interval must be positive")
+		}
+		config.Manifest, err = manifest.New(manifestFormat, manifestSpool, manifestMaxEntries)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+		config.ManifestPrefix = strings.Trim(config.ManifestPrefix, "/")
+	}
+
+	if config.ReconcileInterval <= 0 {
+		config.ReconcileWindow = 0
+	}
+
+	if (heartbeat.file != "" || heartbeat.object != "") && heartbeat.interval <= 0 {
+		applog.Fatal("-heartbeat-interval must be positive")
+	}
+
+	if config.ConfigErrorThreshold > 1 && config.ConfigErrorWindow <= 0 {
+		applog.Fatal("-config-error-window must be positive")
+	}
+
+	if circuitFailures > 0 {
+		config.Breaker = breaker.New(circuitFailures, circuitBackoff)
+	}
+
+	if alertWebhook != "" {
+		config.Alerter, err = alert.New(alertWebhook, alertWebhookKind, alertMaxErrors, alertMaxBacklogAge, alertCooldown, applog)
+		if err != nil {
+			applog.Fatal(err.Error())
+		}
+		flags := config.Features
+		config.Alerter.Enabled = func() bool {
+			return flags.Bool(features.AlertsEnabled)
+		}
+	}
+
+	producer.Size, err = utils.ParseBytes(syntheticFileSize)
+	if err != nil {
+		applog.Fatalf("Bad -synthetic-file-size: %s", err.Error())
+	}
+
 	if config.PushInterval < 10*time.Second {
 		applog.Fatal("-push-interval must be >= 10 seconds")
 	}
 
+	config.PushGroupingLabels, err = utils.ParseLabels(pushGroupingLabels)
+	if err != nil {
+		applog.Fatalf("Bad -push-grouping-labels: %s", err.Error())
+	}
+	hostname, _ := os.Hostname()
+	placeholders := strings.NewReplacer("{hostname}", hostname, "{instance}", config.InstanceID)
+	for name, value := range config.PushGroupingLabels {
+		config.PushGroupingLabels[name] = placeholders.Replace(value)
+	}
+	if _, ok := config.PushGroupingLabels["instance"]; !ok && instanceIDSet {
+		config.PushGroupingLabels["instance"] = config.InstanceID
+	}
+	if config.PushBasicAuth != "" && !strings.Contains(config.PushBasicAuth, ":") {
+		applog.Fatal("-push-basic-auth must be in user:password format")
+	}
+	if pushBearerTokenFile != "" {
+		if config.PushBasicAuth != "" {
+			applog.Fatal("-push-basic-auth and -push-bearer-token-file can't be used together")
+		}
+		config.PushBearerToken, err = secret.NewFile(pushBearerTokenFile)
+		if err != nil {
+			applog.Fatalf("Failed to read -push-bearer-token-file: %s", err.Error())
+		}
+	}
+
+	// Fail fast if external tools are missing instead of failing on the first file
+	binaryVersions, err = fs.CheckBinaries(config)
+	if err != nil {
+		applog.Fatal(err.Error())
+	}
+
 	// Checks complete, safe to start
 	applog.Info("Starting program")
+	if pidFile != "" {
+		if err := writeFileAtomic(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n")); err != nil {
+			applog.Fatalf("Failed to write -pid-file: %s", err.Error())
+		}
+	}
 
 	// Init metric
-	config.Metrics = metrics.InitMetrics(version, workersCannelSize, secondsDurationBuckets)
+	buckets := secondsDurationBuckets
+	if !metricsHistograms {
+		buckets = nil
+	}
+	config.Metrics = metrics.InitMetrics(version, workersCannelSize, buckets)
 
-	// Run a separate routine with http server
-	go runMainWebServer(config, listen)
+	// Uploads with retention are refused by buckets without object lock and objects tagged for expiry would be kept
+	// forever without a lifecycle rule, fail before taking any files
+	if (config.ObjectLockMode != "" || config.ExpiryCheck) && !config.DryRun {
+		if err := preflightBuckets(config); err != nil {
+			applog.Fatalf("Bucket preflight check failed: %s", err.Error())
+		}
+	}
+
+	// Upload the stream and exit, there are no files to watch
+	if stdin {
+		if err := uploadStdin(ctxWithCancel, config, stdinKey); err != nil {
+			applog.Fatal(err.Error())
+		}
+		return
+	}
+
+	// Return files claimed before a crash or restart
+	for _, watch := range config.WatchPaths {
+		if err := fs.RecoverClaims(fs.WatchConfig(config, watch)); err != nil {
+			applog.Fatalf("Failed to recover claimed files: %s", err.Error())
+		}
+	}
 
 	// Make a channel and start workers
-	comm := make(chan cfg.Message, workersCannelSize)
-	for i := 0; i < config.Workers; i++ {
+	comm, err := queue.New(queueOrder, workersCannelSize)
+	if err != nil {
+		applog.Fatal(err.Error())
+	}
+	lastDequeue.Store(time.Now().UnixNano())
+
+	// Run a separate routine with http server
+	webDone := make(chan struct{})
+	go runMainWebServer(ctxWithCancel, config, comm, web, webDone)
+	grpcDone := make(chan struct{})
+	if grpcListen != "" {
+		go runGRPCServer(ctxWithCancel, config, comm, web, grpcListen, grpcDone)
+	} else {
+		close(grpcDone)
+	}
+
+	for i := range config.Status.WorkerCount() {
 		wg.Add(1)
-		go worker(&wg, ctxWithCancel, i, config, comm, &workerStatuses[i])
+		go worker(&wg, ctxWithCancel, i, config, comm, config.Status.Worker(i))
 	}
 
 	// Channels for signal processing and locking main()
@@ -388,17 +3058,77 @@ func main() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 
 	// Run metrics updater routine
-	go updateMetrics(config, &comm)
+	go updateMetrics(config, comm)
+
+	// Act on control files
+	if config.Control != nil {
+		go controlLoop(ctxWithCancel, config, comm)
+	}
+
+	// Dump status on SIGUSR1
+	go statusDumper(ctxWithCancel, config, comm, goroutineDumpDir)
+
+	// Scan directory on SIGUSR2
+	go scanSignalHandler(ctxWithCancel, config)
 
 	// Upload stuff to the cloud!
 	started := time.Now()
-	go upload(ctxWithCancel, config, &comm)
-	//go fs.WatchDirectory(ctxWithCancel, &comm, config)
-	go fs.ScanDirectory(ctxWithCancel, &comm, config)
+	go upload(ctxWithCancel, config, comm)
+	go fs.WatchDirectories(ctxWithCancel, comm, config)
+	if fifoPath != "" {
+		go fifoReader(ctxWithCancel, config, fifoPath, fifoKey)
+	}
+	if sqsSource != nil {
+		go sqsSource.Run(ctxWithCancel, comm, config)
+	}
+
+	// Start synthetic producer for soak tests
+	if producer.Enabled() {
+		go producer.Run(ctxWithCancel, config)
+	}
+
+	// Apply bandwidth schedule
+	if len(rateSchedule) > 0 {
+		go rateScheduler(ctxWithCancel, config, rateSchedule, rateLimit, rateBurst)
+	}
+
+	// Start upload manifest writer if enabled
+	if config.Manifest != nil {
+		go manifestWriter(ctxWithCancel, config)
+	}
+
+	// Clean up abandoned multipart uploads if enabled
+	if abortStaleMultipart > 0 && !config.DryRun {
+		go staleUploadsCleaner(ctxWithCancel, config, abortStaleMultipart)
+	}
+
+	// Purge local copies of files over their caps if enabled
+	if dirs := fs.KeptDirs(config); len(dirs) > 0 {
+		go janitor(ctxWithCancel, config, dirs)
+	}
+
+	// Start heartbeat writer if enabled
+	if heartbeat.file != "" || heartbeat.object != "" {
+		go heartbeatWriter(ctxWithCancel, config, comm, heartbeat)
+	}
+
+	// Start uploaded objects reconciler if enabled
+	if config.ReconcileInterval > 0 && !config.DryRun {
+		go reconciler(ctxWithCancel, config)
+	}
 
 	// Start metrics pusher if enabled
-	if config.PushGateway != "" {
-		go prometheusMetricsPusher(config)
+	exporters := newMetricsExporters(config)
+	if len(exporters) > 0 {
+		go prometheusMetricsPusher(ctxWithCancel, config, exporters)
+	}
+
+	// Exit after max runtime, in-flight uploads are finished as on a signal
+	if maxRuntime > 0 {
+		time.AfterFunc(maxRuntime, func() {
+			applog.Infof("Max runtime of %s reached, exiting", maxRuntime)
+			config.CancelFunction()
+		})
 	}
 
 	// Wait for signals to exit or for context to be cancaelled to and send signal to "exit" channel
@@ -414,11 +3144,50 @@ func main() {
 		}
 	}()
 
+	// Tell systemd the service is up, its watchdog is pinged only while workers and scanners are alive
+	if _, err := systemd.Notify("READY=1"); err != nil {
+		applog.Errorf("Failed to notify systemd: %s", err.Error())
+	}
+	if timeout := systemd.WatchdogInterval(); timeout > 0 {
+		go systemdWatchdog(ctxWithCancel, config, comm, timeout)
+	}
+
 	applog.Info("Application is started and waiting for an exit condition.")
 	<-exit
+	systemd.Notify("STOPPING=1")
 	duration := time.Since(started).Seconds()
 
-	// Wait for workers to exit
+	// Wait for workers, web and gRPC servers to exit
 	wg.Wait()
+	config.Pipeline.Close()
+	<-webDone
+	<-grpcDone
+	if config.Manifest != nil {
+		writeManifest(config)
+	}
+	finishMetricsPush(config, exporters)
+	if config.DryRunReport != nil {
+		if dryRunRate == 0 && config.UploadLimiter != nil {
+			dryRunRate = config.UploadLimiter.Rate()
+		}
+		config.DryRunReport.Print(os.Stdout, dryRunRate)
+	}
+	if err := config.AuditLog.Close(); err != nil {
+		applog.Errorf("Failed to close audit log: %s", err.Error())
+	}
 	applog.Infof("Complete. Duration %s", utils.HumanizeDurationSeconds(duration))
+	if pidFile != "" {
+		os.Remove(pidFile)
+	}
+
+	uploaded, failed := runTally.Counts()
+	applog.Infof("Uploaded %d files, %d failed", uploaded, failed)
+	if configFailed.Load() {
+		applog.Errorf("Run failed: uploads were stopped by a configuration error")
+		os.Exit(exitCodeConfigError)
+	}
+	if err := runTally.Check(failOnAny, maxErrorRate); err != nil {
+		applog.Errorf("Run failed: %s", err.Error())
+		os.Exit(exitCodeUploadsFailed)
+	}
 }
@@ -1 +1,412 @@
 package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/audit"
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/errclass"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/membudget"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+	"github.com/impossiblecloud/s3-file-uploader/internal/pool"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+	"github.com/impossiblecloud/s3-file-uploader/internal/state"
+
+	"github.com/google/logger"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpStatus(t *testing.T) {
+	var out bytes.Buffer
+	dumpStatus(&out, cfg.AppStatus{
+		Instance:   "node1",
+		Version:    version,
+		Started:    time.Now().Add(-10 * time.Second),
+		Uptime:     "10s",
+		QueueDepth: 3,
+		Workers: []cfg.WorkerStatus{
+			{Running: true, Phase: cfg.PhaseUploading, File: "/data/dump.sql", PhaseStarted: time.Now(), FilesProcessed: 10, BytesUploaded: 1000},
+			{Running: true, Phase: cfg.PhaseIdle, FilesFailed: 1, LastError: "access denied"},
+		},
+		Scanners: map[string]cfg.ScannerStatus{
+			"/data": {LastRun: time.Now(), LastScan: time.Now(), FilesFound: 2, Entries: 5},
+		},
+	})
+
+	assert.Contains(t, out.String(), "instance node1")
+	assert.Contains(t, out.String(), "queue depth 3")
+	assert.Contains(t, out.String(), "10 files processed, 1 failed, 1.0 kB uploaded")
+	assert.Contains(t, out.String(), `Worker 0: running true, phase uploading "/data/dump.sql"`)
+	assert.Contains(t, out.String(), "last error: access denied")
+	assert.Contains(t, out.String(), "last scan found 2 files in 5 entries")
+}
+
+func TestSharedS3Path(t *testing.T) {
+	assert.Equal(t, "/backups", sharedS3Path("s3://bucket/backups/"))
+	assert.Equal(t, "/db", sharedS3Path("s3://bucket/{instance}/db"))
+	assert.Equal(t, "/backups/db", sharedS3Path("s3://bucket/backups/{instance}/db"))
+	assert.Equal(t, "", sharedS3Path("s3://bucket/{instance}"))
+}
+
+func TestDumpGoroutines(t *testing.T) {
+	file, err := dumpGoroutines(t.TempDir())
+	assert.Nil(t, err)
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "TestDumpGoroutines")
+}
+
+func TestApplyProfile(t *testing.T) {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	workers := flags.Int("workers", 4, "")
+	partSize := flags.String("s3-part-size", "", "")
+	for name := range profiles["edge"] {
+		if flags.Lookup(name) == nil {
+			flags.String(name, "", "")
+		}
+	}
+	assert.Nil(t, flags.Parse([]string{"-s3-part-size", "8MiB"}))
+
+	// Flags set on the command line are kept
+	assert.Nil(t, applyProfile(flags, "edge"))
+	assert.Equal(t, 1, *workers)
+	assert.Equal(t, "8MiB", *partSize)
+	assert.Equal(t, "false", flags.Lookup("metrics-histograms").Value.String())
+
+	assert.ErrorContains(t, applyProfile(flags, "cloud"), "unknown profile \"cloud\", must be one of: edge")
+	assert.Nil(t, applyProfile(flags, ""))
+}
+
+func TestNoWriteDeadline(t *testing.T) {
+	slow := func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("profile"))
+	}
+	server := httptest.NewUnstartedServer(noWriteDeadline(slow))
+	server.Config.WriteTimeout = 50 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	assert.Equal(t, "profile", string(body))
+}
+
+func TestHandleIngest(t *testing.T) {
+	applog = logger.Init("test", false, false, io.Discard)
+	dir := t.TempDir()
+	config := cfg.AppConfig{
+		PathToWatch:    dir,
+		WatchPaths:     []cfg.WatchPath{{Path: dir}},
+		IgnorePatterns: []string{".*", "*.tmp"},
+		Metrics:        metrics.InitMetrics("test", 10, nil),
+		Applog:         applog,
+	}
+	comm, err := queue.New("mtime", 10)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "exists.csv"), []byte("old"), 0644))
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	assert.Nil(t, form.WriteField("comment", "not a file"))
+	for name, data := range map[string]string{"report.csv": "a,b\n", "exists.csv": "new", "partial.tmp": "x"} {
+		part, err := form.CreateFormFile("file", name)
+		assert.Nil(t, err)
+		io.WriteString(part, data)
+	}
+	assert.Nil(t, form.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/ingest", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handleIngest(context.Background(), config, comm, 1024)(rec, req)
+
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	results := []ingestResult{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	statuses := map[string]string{}
+	for _, result := range results {
+		statuses[result.Name] = result.Status
+	}
+	assert.Equal(t, map[string]string{"report.csv": "queued", "exists.csv": "rejected", "partial.tmp": "rejected"}, statuses)
+	assert.Equal(t, 1, comm.Len())
+
+	data, err := os.ReadFile(filepath.Join(dir, "report.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a,b\n", string(data))
+	data, err = os.ReadFile(filepath.Join(dir, "exists.csv"))
+	assert.Nil(t, err)
+	assert.Equal(t, "old", string(data))
+	_, err = os.Stat(filepath.Join(dir, "partial.tmp"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Requests over the limit are refused
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "large.bin")
+	assert.Nil(t, err)
+	part.Write(make([]byte, 2048))
+	assert.Nil(t, form.Close())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/ingest", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec = httptest.NewRecorder()
+	handleIngest(context.Background(), config, comm, 1024)(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	_, err = os.Stat(filepath.Join(dir, "large.bin"))
+	assert.True(t, os.IsNotExist(err))
+
+	// The limit hit while a file is copied refuses the rest of the request, earlier files are reported queued
+	body.Reset()
+	form = multipart.NewWriter(&body)
+	part, err = form.CreateFormFile("file", "small.csv")
+	assert.Nil(t, err)
+	io.WriteString(part, "c,d\n")
+	part, err = form.CreateFormFile("file", "larger.bin")
+	assert.Nil(t, err)
+	part.Write(make([]byte, 64*1024))
+	assert.Nil(t, form.Close())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/ingest", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.ContentLength = -1
+	rec = httptest.NewRecorder()
+	handleIngest(context.Background(), config, comm, 16*1024)(rec, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	results = []ingestResult{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	assert.Len(t, results, 2)
+	assert.Equal(t, ingestResult{Name: "small.csv", Status: "queued"}, results[0])
+	assert.Equal(t, "rejected", results[1].Status)
+	assert.Equal(t, "Request is larger than 16 kB", results[1].Error)
+	assert.FileExists(t, filepath.Join(dir, "small.csv"))
+	_, err = os.Stat(filepath.Join(dir, "larger.bin"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+// panickingUploader panics like a library on a malformed file
+type panickingUploader struct{}
+
+func (panickingUploader) UploadFile(context.Context, cfg.AppConfig, string) (int64, error) {
+	panic("malformed path")
+}
+
+func (panickingUploader) Close() {}
+
+func TestProcessMessagePanic(t *testing.T) {
+	applog = logger.Init("test", false, false, io.Discard)
+	dir := t.TempDir()
+	config := cfg.AppConfig{
+		PathToWatch: dir,
+		WatchPaths:  []cfg.WatchPath{{Path: dir}},
+		Pipeline:    pool.Pipeline{Upload: pool.New(1)},
+		Metrics:     metrics.InitMetrics("test", 10, nil),
+		Status:      cfg.NewStatusRegistry(1),
+		Applog:      applog,
+	}
+	defer config.Pipeline.Close()
+	file := filepath.Join(dir, "report.csv")
+	assert.Nil(t, os.WriteFile(file, []byte("a,b\n"), 0644))
+
+	// The panic of the upload stage fails the file, the worker goes on
+	assert.NotPanics(t, func() {
+		processMessageSafe(config, panickingUploader{}, 0, config.Status.Worker(0), cfg.Message{File: file})
+	})
+	worker := config.Status.Workers()[0]
+	assert.Equal(t, int64(1), worker.FilesFailed)
+	assert.Equal(t, cfg.PhaseIdle, worker.Phase)
+	assert.Contains(t, worker.LastError, "malformed path")
+	m := &dto.Metric{}
+	assert.Nil(t, config.Metrics.WorkerPanics.WithLabelValues().Write(m))
+	assert.Equal(t, float64(1), m.GetCounter().GetValue())
+
+	// The claim is released, so the file is retried
+	_, err := os.Stat(file)
+	assert.Nil(t, err)
+	assert.False(t, fs.IsInFlight(file))
+}
+
+func TestHandleSendError(t *testing.T) {
+	applog = logger.Init("test", false, false, io.Discard)
+	dir := t.TempDir()
+	db, err := state.Open("")
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := cfg.AppConfig{
+		PathToWatch:    dir,
+		State:          db,
+		Metrics:        metrics.InitMetrics("test", 10, nil),
+		Applog:         applog,
+		CancelFunction: cancel,
+
+		ConfigErrorThreshold: 2,
+		ConfigErrorWindow:    time.Minute,
+	}
+	file := filepath.Join(dir, "report.csv")
+	assert.Nil(t, os.WriteFile(file, []byte("a,b\n"), 0644))
+
+	// Transient failures are retried
+	handleSendError(config, "file", []string{file}, errors.New("connection reset by peer"))
+	assert.False(t, fs.IsQuarantined(config, file))
+
+	// Files failed for good are skipped until they change
+	handleSendError(config, "file", []string{file}, errclass.Permanent(errors.New("EntityTooLarge")))
+	assert.True(t, fs.IsQuarantined(config, file))
+	assert.Nil(t, ctx.Err())
+
+	// A single configuration error is retried, repeated ones stop the uploader
+	defer configErrors.reset()
+	defer configFailed.Store(false)
+	handleSendError(config, "file", []string{file}, errclass.Config(errors.New("AccessDenied")))
+	assert.Nil(t, ctx.Err())
+	assert.False(t, configFailed.Load())
+	handleSendError(config, "file", []string{file}, errclass.Config(errors.New("NoSuchBucket")))
+	assert.NotNil(t, ctx.Err())
+	assert.True(t, configFailed.Load())
+
+	m := &dto.Metric{}
+	for _, class := range errclass.Classes {
+		assert.Nil(t, config.Metrics.FileSendErrors.WithLabelValues(class).Write(m))
+		want := float64(1)
+		if class == errclass.ClassConfig {
+			want = 2
+		}
+		assert.Equal(t, want, m.GetCounter().GetValue(), class)
+	}
+}
+
+func TestErrorWindow(t *testing.T) {
+	var w errorWindow
+	now := time.Now()
+	assert.Equal(t, 1, w.add(now, time.Minute))
+	assert.Equal(t, 2, w.add(now.Add(30*time.Second), time.Minute))
+	// The first error fell out of the window
+	assert.Equal(t, 2, w.add(now.Add(time.Minute), time.Minute))
+	assert.Equal(t, 1, w.add(now.Add(3*time.Minute), time.Minute))
+	w.reset()
+	assert.Equal(t, 1, w.add(now, time.Minute))
+}
+
+// stubUploader uploads nothing and returns its result
+type stubUploader struct {
+	size int64
+	err  error
+}
+
+func (u stubUploader) UploadFile(context.Context, cfg.AppConfig, string) (int64, error) {
+	return u.size, u.err
+}
+
+func (stubUploader) Close() {}
+
+func TestAuditLog(t *testing.T) {
+	applog = logger.Init("test", false, false, io.Discard)
+	dir := t.TempDir()
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := audit.Open(auditFile, 0, 1)
+	assert.Nil(t, err)
+	config := cfg.AppConfig{
+		PathToWatch: dir,
+		S3bucket:    "backups",
+		S3path:      "/db",
+		InstanceID:  "node1",
+		Metrics:     metrics.InitMetrics("test", 10, nil),
+		AuditLog:    auditLog,
+		Applog:      applog,
+	}
+	file := filepath.Join(dir, "report.csv")
+	assert.Nil(t, os.WriteFile(file, []byte("a,b\n"), 0644))
+
+	status := cfg.NewStatusRegistry(1).Worker(0)
+	assert.Nil(t, uploadPreparedFile(context.Background(), config, stubUploader{size: 4}, status, file, 4))
+	assert.NotNil(t, uploadPreparedFile(context.Background(), config, stubUploader{err: errclass.Config(errors.New("NoSuchBucket"))}, status, file, 4))
+	assert.Nil(t, auditLog.Close())
+
+	data, err := os.ReadFile(auditFile)
+	assert.Nil(t, err)
+	lines := bytes.Split(bytes.TrimSpace(data), []byte("\n"))
+	assert.Len(t, lines, 2)
+	var uploaded, failed audit.Record
+	assert.Nil(t, json.Unmarshal(lines[0], &uploaded))
+	assert.Nil(t, json.Unmarshal(lines[1], &failed))
+
+	assert.Equal(t, "node1", uploaded.Instance)
+	assert.Equal(t, file, uploaded.File)
+	assert.Equal(t, "s3://backups/db", uploaded.Destination)
+	assert.Equal(t, "/db/report.csv", uploaded.Key)
+	assert.Equal(t, int64(4), uploaded.UploadedSize)
+	assert.Equal(t, "5be08c9684a1d25efcee09318204824278b08bbfb4aef973ffefd0b9d7478313", uploaded.SourceSHA256)
+	assert.Equal(t, audit.ResultUploaded, uploaded.Result)
+	assert.Empty(t, uploaded.Error)
+
+	assert.Equal(t, audit.ResultFailed, failed.Result)
+	assert.Equal(t, errclass.ClassConfig, failed.ErrorClass)
+	assert.Equal(t, "NoSuchBucket", failed.Error)
+}
+
+func TestReserveInflight(t *testing.T) {
+	dir := t.TempDir()
+	small, large := filepath.Join(dir, "small.sql"), filepath.Join(dir, "large.sql")
+	assert.Nil(t, os.WriteFile(small, make([]byte, 40), 0644))
+	assert.Nil(t, os.WriteFile(large, make([]byte, 80), 0644))
+	registry := cfg.NewStatusRegistry(2)
+
+	// Nothing is reserved without a limit
+	reserved, err := reserveInflight(cfg.AppConfig{}, registry.Worker(0), []string{small})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), reserved)
+
+	config := cfg.AppConfig{InflightBytes: membudget.New(100)}
+	reserved, err = reserveInflight(config, registry.Worker(0), []string{small})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(40), reserved)
+	assert.Equal(t, int64(40), config.InflightBytes.Used())
+
+	// The next file waits until there's room for it
+	acquired := make(chan int64)
+	go func() {
+		reserved, err := reserveInflight(config, registry.Worker(1), []string{large})
+		assert.Nil(t, err)
+		acquired <- reserved
+	}()
+	assert.Eventually(t, func() bool { return registry.Workers()[1].Phase == cfg.PhaseQueued }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case <-acquired:
+		t.Fatal("file reserved over the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	config.InflightBytes.Release(reserved)
+	assert.Equal(t, int64(80), <-acquired)
+	assert.Equal(t, int64(80), config.InflightBytes.Used())
+
+	// Group sizes are summed up, missing files fail
+	config.InflightBytes.Release(80)
+	reserved, err = reserveInflight(config, registry.Worker(0), []string{small, large})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), reserved)
+	config.InflightBytes.Release(reserved)
+	_, err = reserveInflight(config, registry.Worker(0), []string{filepath.Join(dir, "missing.sql")})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), config.InflightBytes.Used())
+}
@@ -0,0 +1,45 @@
+package uploader
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/s3"
+	"github.com/impossiblecloud/s3-file-uploader/internal/utils"
+)
+
+// Destination stores prepared files
+type Destination interface {
+	Upload(ctx context.Context, artifact Artifact) error
+}
+
+// S3Destination uploads files to an S3 bucket with credentials from the AWS SDK default chain, it's set up by WithS3
+type S3Destination struct {
+	config cfg.AppConfig
+	client *s3.Client
+}
+
+// newS3Destination creates a destination for an s3://bucket/path URI and sets the bucket and path in the runner config
+func newS3Destination(config *cfg.AppConfig, uri string) (*S3Destination, error) {
+	var err error
+	config.S3bucket, config.S3path, err = utils.ParseS3URL(uri)
+	if err != nil {
+		return nil, err
+	}
+	if config.S3bucket == "" || config.S3path == "" {
+		return nil, fmt.Errorf("S3 URI must contain bucket and path")
+	}
+
+	client, err := s3.NewClient(*config)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Destination{config: *config, client: client}, nil
+}
+
+// Upload uploads a prepared file
+func (d *S3Destination) Upload(ctx context.Context, artifact Artifact) error {
+	_, err := d.client.UploadPrepared(ctx, d.config, artifact.Source, artifact.Path, artifact.Key)
+	return err
+}
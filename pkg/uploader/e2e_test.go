@@ -0,0 +1,54 @@
+//go:build e2e
+
+package uploader
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/s3mock"
+
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestE2ES3Destination(t *testing.T) {
+	server := s3mock.New("bucket")
+	defer server.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "us-east-1")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	assert.Nil(t, os.WriteFile(file, []byte("select 1;"), 0644))
+
+	runner, err := New(dir,
+		WithS3("s3://bucket/backups"),
+		WithS3Endpoint(server.URL),
+		WithTempDir(t.TempDir()),
+		WithLogger(logger.Init("test", false, false, io.Discard)),
+	)
+	assert.Nil(t, err)
+	assert.Nil(t, runner.Process(context.Background(), 0, []string{file}))
+	assert.NoFileExists(t, file)
+
+	// Uploaded object is a compressed tarball of the source file
+	obj, ok := server.Object("bucket", "backups/dump.sql.tgz")
+	assert.True(t, ok)
+	gz, err := gzip.NewReader(bytes.NewReader(obj.Data))
+	assert.Nil(t, err)
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	assert.Nil(t, err)
+	assert.Equal(t, "dump.sql", hdr.Name)
+	data, _ := io.ReadAll(tr)
+	assert.Equal(t, []byte("select 1;"), data)
+}
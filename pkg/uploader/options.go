@@ -0,0 +1,144 @@
+package uploader
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/secret"
+
+	"github.com/google/logger"
+)
+
+// Option configures a Runner
+type Option func(*Runner) error
+
+// WithS3 uploads files to an s3://bucket/path URI
+func WithS3(uri string) Option {
+	return func(r *Runner) error {
+		r.s3uri = uri
+		return nil
+	}
+}
+
+// WithS3Endpoint uses a custom endpoint URL for S3-compatible storage
+func WithS3Endpoint(endpoint string) Option {
+	return func(r *Runner) error {
+		r.config.S3Endpoint = endpoint
+		return nil
+	}
+}
+
+// WithDestination uploads files to a custom destination
+func WithDestination(d Destination) Option {
+	return func(r *Runner) error {
+		r.Destination = d
+		return nil
+	}
+}
+
+// WithWorkers sets the number of parallel uploads
+func WithWorkers(n int) Option {
+	return func(r *Runner) error {
+		r.config.Workers = n
+		return nil
+	}
+}
+
+// WithCompression sets compression (gzip, zstd, lz4 or none) and level, zero level means the compressor default
+func WithCompression(compression string, level int) Option {
+	return func(r *Runner) error {
+		r.config.Compression = compression
+		r.config.CompressionLevel = level
+		return nil
+	}
+}
+
+// WithGPGPassword encrypts files with gpg and a shared passphrase
+func WithGPGPassword(password string) Option {
+	return func(r *Runner) error {
+		if password == "" {
+			return fmt.Errorf("GPG password is empty")
+		}
+		r.gpgPassword = password
+		r.config.GpgPassword = secret.Static(password)
+		return nil
+	}
+}
+
+// WithAgeRecipients encrypts files with age to the given public keys
+func WithAgeRecipients(keys ...string) Option {
+	return func(r *Runner) error {
+		r.ageKeys = append(r.ageKeys, keys...)
+		return nil
+	}
+}
+
+// WithWatch uses inotify instead of periodic directory scans
+func WithWatch(watch bool) Option {
+	return func(r *Runner) error {
+		r.config.Watch = watch
+		return nil
+	}
+}
+
+// WithScanInterval sets how often the directory is scanned
+func WithScanInterval(interval time.Duration) Option {
+	return func(r *Runner) error {
+		if interval <= 0 {
+			return fmt.Errorf("scan interval must be positive")
+		}
+		r.config.ScanInterval = interval
+		return nil
+	}
+}
+
+// WithScanIntervalMax lets the scan interval grow up to max while scans find no files
+func WithScanIntervalMax(max time.Duration) Option {
+	return func(r *Runner) error {
+		if max < 0 {
+			return fmt.Errorf("maximum scan interval can't be negative")
+		}
+		r.config.ScanIntervalMax = max
+		return nil
+	}
+}
+
+// WithIgnorePatterns replaces the default ignore list of hidden and temporary files with shell patterns matched
+// against file names, no patterns means all files are uploaded
+func WithIgnorePatterns(patterns ...string) Option {
+	return func(r *Runner) error {
+		for _, pattern := range patterns {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return fmt.Errorf("bad ignore pattern %q: %s", pattern, err.Error())
+			}
+		}
+		r.config.IgnorePatterns = patterns
+		return nil
+	}
+}
+
+// WithQueue sets queue order (mtime or size) and capacity
+func WithQueue(order string, size int) Option {
+	return func(r *Runner) error {
+		r.queueOrder = order
+		r.queueSize = size
+		return nil
+	}
+}
+
+// WithTempDir sets the directory for compressed and encrypted temporary files
+func WithTempDir(dir string) Option {
+	return func(r *Runner) error {
+		r.tempDir = dir
+		return nil
+	}
+}
+
+// WithLogger sets the logger, by default logs go to stderr
+func WithLogger(l *logger.Logger) Option {
+	return func(r *Runner) error {
+		r.config.Applog = l
+		return nil
+	}
+}
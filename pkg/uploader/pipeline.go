@@ -0,0 +1,76 @@
+package uploader
+
+import (
+	"context"
+	"os"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+)
+
+// Artifact is a file prepared for upload
+type Artifact struct {
+	// Source is the original file
+	Source string
+
+	// Path is the compressed and encrypted file to upload, it's the same as Source if there's nothing to do
+	Path string
+
+	// Key is the destination object key
+	Key string
+
+	Size int64
+}
+
+// Pipeline compresses and encrypts files before upload. With transformers it runs them instead of the built-in
+// tar compression and file encryption.
+type Pipeline struct {
+	config       cfg.AppConfig
+	transformers []Transformer
+	dir          string
+}
+
+// Prepare compresses and encrypts a file
+func (p *Pipeline) Prepare(ctx context.Context, file string) (Artifact, error) {
+	path, err := p.prepare(ctx, file)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	key, err := fs.ObjectKey(p.config, file, path)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Artifact{}, err
+	}
+	return Artifact{Source: file, Path: path, Key: key, Size: fi.Size()}, nil
+}
+
+// Run the transformer chain or built-in stages and return the file to upload
+func (p *Pipeline) prepare(ctx context.Context, file string) (string, error) {
+	if len(p.transformers) > 0 {
+		return transformFile(ctx, p.transformers, file, p.dir)
+	}
+
+	if err := fs.CompressFile(ctx, p.config, file); err != nil {
+		return "", err
+	}
+	if err := fs.EncryptFile(ctx, p.config, file); err != nil {
+		return "", err
+	}
+	return fs.PreparedFileName(p.config, file), nil
+}
+
+// Cleanup deletes temporary files of a prepared file
+func (p *Pipeline) Cleanup(file string) error {
+	if len(p.transformers) > 0 {
+		if err := os.Remove(transformedFileName(p.transformers, file, p.dir)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return fs.DeleteTempFiles(p.config, file)
+}
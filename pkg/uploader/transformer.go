@@ -0,0 +1,224 @@
+package uploader
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"filippo.io/age"
+)
+
+// Transformer is a pipeline stage that transforms file contents, e.g. compression, encryption or header stripping.
+// Stages run in the order they are given to WithTransformers, each one reads the output of the previous one.
+type Transformer interface {
+	Name() string
+	Process(ctx context.Context, in io.Reader) (io.Reader, error)
+}
+
+// Extensioner is implemented by transformers that add a suffix to the object key, e.g. ".gz"
+type Extensioner interface {
+	Extension() string
+}
+
+// WithTransformers replaces built-in tar compression and gpg/age file encryption with a chain of streaming stages.
+// Objects are named after the source file with extensions of all stages.
+func WithTransformers(transformers ...Transformer) Option {
+	return func(r *Runner) error {
+		for _, t := range transformers {
+			if t == nil {
+				return fmt.Errorf("transformer is nil")
+			}
+		}
+		r.transformers = append(r.transformers, transformers...)
+		return nil
+	}
+}
+
+// pipe runs fn in a goroutine writing to the returned reader, fn errors are returned to the reader.
+// The reader is closed when ctx is done, so fn doesn't block on writes nobody reads anymore.
+func pipe(ctx context.Context, fn func(w io.Writer) error) io.Reader {
+	pr, pw := io.Pipe()
+	stop := context.AfterFunc(ctx, func() { pr.CloseWithError(ctx.Err()) })
+	go func() {
+		defer stop()
+		err := fn(pw)
+		if err == nil {
+			err = ctx.Err()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// transformFile runs a file through the chain and writes the result to a temporary file in dir.
+// Stages are cancelled when it returns, so a failed chain doesn't leave goroutines or gpg processes behind.
+func transformFile(ctx context.Context, transformers []Transformer, file, dir string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	src, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	var r io.Reader = src
+	for _, t := range transformers {
+		if r, err = t.Process(ctx, r); err != nil {
+			return "", fmt.Errorf("%s stage failed for %q: %s", t.Name(), file, err.Error())
+		}
+	}
+
+	out := transformedFileName(transformers, file, dir)
+	dst, err := os.Create(out)
+	if err != nil {
+		closeReader(r, err)
+		return "", err
+	}
+	if _, err := io.Copy(dst, r); err != nil {
+		closeReader(r, err)
+		dst.Close()
+		os.Remove(out)
+		return "", fmt.Errorf("pipeline failed for %q: %s", file, err.Error())
+	}
+	return out, dst.Close()
+}
+
+// closeReader stops the writer of a stage output that won't be read anymore
+func closeReader(r io.Reader, err error) {
+	if pr, ok := r.(*io.PipeReader); ok {
+		pr.CloseWithError(err)
+	}
+}
+
+// transformedFileName returns the name of the chain output, extensions of all stages are added to the file name
+func transformedFileName(transformers []Transformer, file, dir string) string {
+	name := filepath.Base(file)
+	for _, t := range transformers {
+		if e, ok := t.(Extensioner); ok {
+			name += e.Extension()
+		}
+	}
+	return filepath.Join(dir, name)
+}
+
+// gzipTransformer compresses with gzip
+type gzipTransformer struct {
+	level int
+}
+
+// Gzip returns a gzip compression stage, zero level means the default one
+func Gzip(level int) Transformer {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzipTransformer{level: level}
+}
+
+func (t gzipTransformer) Name() string      { return "gzip" }
+func (t gzipTransformer) Extension() string { return ".gz" }
+
+func (t gzipTransformer) Process(ctx context.Context, in io.Reader) (io.Reader, error) {
+	if _, err := gzip.NewWriterLevel(io.Discard, t.level); err != nil {
+		return nil, err
+	}
+
+	return pipe(ctx, func(w io.Writer) error {
+		gz, _ := gzip.NewWriterLevel(w, t.level)
+		if _, err := io.Copy(gz, in); err != nil {
+			return err
+		}
+		return gz.Close()
+	}), nil
+}
+
+// ageTransformer encrypts to age recipients
+type ageTransformer struct {
+	recipients []age.Recipient
+}
+
+// Age returns an age encryption stage for the given public keys
+func Age(keys ...string) (Transformer, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no age recipients")
+	}
+
+	t := ageTransformer{}
+	for _, key := range keys {
+		recipient, err := age.ParseX25519Recipient(key)
+		if err != nil {
+			return nil, fmt.Errorf("bad age recipient %q: %s", key, err.Error())
+		}
+		t.recipients = append(t.recipients, recipient)
+	}
+	return t, nil
+}
+
+func (t ageTransformer) Name() string      { return "age" }
+func (t ageTransformer) Extension() string { return ".age" }
+
+func (t ageTransformer) Process(ctx context.Context, in io.Reader) (io.Reader, error) {
+	return pipe(ctx, func(w io.Writer) error {
+		enc, err := age.Encrypt(w, t.recipients...)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(enc, in); err != nil {
+			return err
+		}
+		return enc.Close()
+	}), nil
+}
+
+// gpgTransformer encrypts with the gpg binary and a passphrase
+type gpgTransformer struct {
+	password string
+}
+
+// GPG returns a gpg symmetric encryption stage, the gpg binary must be installed
+func GPG(password string) Transformer {
+	return gpgTransformer{password: password}
+}
+
+func (t gpgTransformer) Name() string      { return "gpg" }
+func (t gpgTransformer) Extension() string { return ".gpg" }
+
+func (t gpgTransformer) Process(ctx context.Context, in io.Reader) (io.Reader, error) {
+	// The passphrase goes through a separate pipe as stdin is used for data
+	passR, passW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "gpg", "-c", "--batch", "--yes", "--pinentry-mode", "loopback", "--passphrase-fd", "3", "-o", "-")
+	cmd.Stdin = in
+	cmd.ExtraFiles = []*os.File{passR}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		passR.Close()
+		passW.Close()
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		passR.Close()
+		passW.Close()
+		return nil, err
+	}
+	passR.Close()
+	go func() {
+		io.WriteString(passW, t.password+"\n")
+		passW.Close()
+	}()
+
+	return pipe(ctx, func(w io.Writer) error {
+		if _, err := io.Copy(w, stdout); err != nil {
+			cmd.Wait()
+			return err
+		}
+		return cmd.Wait()
+	}), nil
+}
@@ -0,0 +1,215 @@
+// Package uploader lets other services embed the upload pipeline: files found in a directory by a Watcher
+// are compressed and encrypted by a Pipeline, uploaded to a Destination and deleted. Runner ties them together.
+//
+//	runner, err := uploader.New("/data/backups",
+//		uploader.WithS3("s3://bucket/backups"),
+//		uploader.WithCompression("zstd", 3),
+//		uploader.WithGPGPassword(os.Getenv("GPG_PASSWORD")),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	return runner.Run(ctx)
+package uploader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/metrics"
+
+	"github.com/google/logger"
+)
+
+// Runner watches a directory and uploads files with a pool of workers
+type Runner struct {
+	Watcher     *Watcher
+	Pipeline    *Pipeline
+	Destination Destination
+
+	config       cfg.AppConfig
+	s3uri        string
+	tempDir      string
+	queueOrder   string
+	queueSize    int
+	ageKeys      []string
+	gpgPassword  string
+	transformers []Transformer
+}
+
+// New creates a runner for a directory. Either WithS3 or WithDestination is required.
+func New(dir string, opts ...Option) (*Runner, error) {
+	r := &Runner{
+		config: cfg.AppConfig{
+			PathToWatch:  dir,
+			Workers:      1,
+			ScanInterval: 10 * time.Second,
+			Gzip:         true,
+			Compression:  "gzip",
+			SendTimeout:  time.Minute,
+			ClaimMode:    fs.ClaimLock,
+			S3MaxRetries: -1,
+		},
+		tempDir:    filepath.Join(os.TempDir(), "s3-file-uploader"),
+		queueOrder: "mtime",
+		queueSize:  1000,
+	}
+
+	// Default patterns are valid
+	r.config.IgnorePatterns, _ = fs.ParseIgnorePatterns(fs.DefaultIgnorePatterns)
+
+	for _, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.init(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// init validates options and prepares the config shared with internal packages
+func (r *Runner) init() error {
+	var err error
+	config := &r.config
+
+	if config.Applog == nil {
+		config.Applog = logger.Init("s3-file-uploader", false, false, os.Stderr)
+	}
+	if config.Workers < 1 {
+		return fmt.Errorf("number of workers must be positive")
+	}
+	if config.Compression == "none" || len(r.transformers) > 0 {
+		config.Gzip = false
+		config.Compression = "none"
+	}
+	if len(r.transformers) > 0 && (len(r.ageKeys) > 0 || r.gpgPassword != "") {
+		return fmt.Errorf("use Age or GPG transformers instead of WithAgeRecipients and WithGPGPassword with WithTransformers")
+	}
+	if err := fs.ValidateCompression(config.Compression, config.CompressionLevel); err != nil {
+		return err
+	}
+
+	config.GzipDir = filepath.Join(r.tempDir, "gzip")
+	config.EncryptDir = filepath.Join(r.tempDir, "enc")
+	for _, dir := range []string{config.GzipDir, config.EncryptDir} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+
+	if len(r.ageKeys) > 0 {
+		config.Encrypt = true
+		config.EncryptEngine = "age"
+		if config.AgeRecipients, err = fs.ParseAgeRecipients(r.ageKeys, ""); err != nil {
+			return err
+		}
+	} else if r.gpgPassword != "" {
+		config.Encrypt = true
+		config.EncryptEngine = "gpg"
+	}
+	if config.Encrypt {
+		if config.EncryptionKeyID, err = fs.DefaultEncryptionKeyID(*config); err != nil {
+			return err
+		}
+	}
+
+	// Each runner has its own registry so several runners can live in one process
+	config.Metrics = metrics.InitMetrics("library", r.queueSize, prometheusBuckets)
+
+	if r.Destination == nil {
+		if r.s3uri == "" {
+			return fmt.Errorf("destination is not set, use WithS3 or WithDestination")
+		}
+		if r.Destination, err = newS3Destination(config, r.s3uri); err != nil {
+			return err
+		}
+	}
+
+	config.ScanTrigger = make(chan struct{}, 1)
+	if r.Watcher, err = newWatcher(*config, r.queueOrder, r.queueSize); err != nil {
+		return err
+	}
+	r.Pipeline = &Pipeline{config: *config, transformers: r.transformers, dir: filepath.Join(r.tempDir, "pipeline")}
+	if len(r.transformers) > 0 {
+		if err := os.MkdirAll(r.Pipeline.dir, 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Metrics histogram buckets for file upload duration in seconds
+var prometheusBuckets = []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+// Run uploads files until the context is cancelled and waits for in-flight uploads
+func (r *Runner) Run(ctx context.Context) error {
+	if err := fs.RecoverClaims(r.config); err != nil {
+		return fmt.Errorf("failed to recover claimed files: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < r.config.Workers; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			r.worker(ctx, id)
+		}(i)
+	}
+
+	r.Watcher.Run(ctx)
+	wg.Wait()
+	return nil
+}
+
+// worker uploads files from the watcher until it's closed
+func (r *Runner) worker(ctx context.Context, id int) {
+	for {
+		files, ok := r.Watcher.Next(ctx)
+		if !ok {
+			return
+		}
+
+		if err := r.Process(ctx, id, files); err != nil {
+			r.config.Applog.Errorf("Worker %d: failed to upload %v, it will be retried later: %s", id, files, err.Error())
+		}
+	}
+}
+
+// Process claims, uploads and deletes a file or a group of files that must be uploaded together
+func (r *Runner) Process(ctx context.Context, id int, files []string) error {
+	claimed, err := fs.Claim(r.config, id, files)
+	if err != nil {
+		r.config.Applog.Infof("Worker %d: skipping %v, it's claimed by someone else: %s", id, files, err.Error())
+		return nil
+	}
+	defer fs.Release(r.config, claimed)
+
+	for _, file := range claimed {
+		artifact, err := r.Pipeline.Prepare(ctx, file)
+		if err != nil {
+			return err
+		}
+		if err := r.Destination.Upload(ctx, artifact); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range claimed {
+		if err := r.Pipeline.Cleanup(file); err != nil {
+			return err
+		}
+		if err := fs.DeleteSource(r.config, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/google/logger"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryDestination keeps uploaded artifacts in memory
+type memoryDestination struct {
+	mu       sync.Mutex
+	uploaded map[string][]byte
+}
+
+func (d *memoryDestination) Upload(ctx context.Context, artifact Artifact) error {
+	data, err := os.ReadFile(artifact.Path)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.uploaded[artifact.Key] = data
+	return nil
+}
+
+func (d *memoryDestination) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.uploaded)
+}
+
+func TestRunner(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "dump.sql"), []byte("select 1;"), 0644))
+
+	_, err := New(dir, WithTempDir(t.TempDir()))
+	assert.NotNil(t, err)
+
+	dest := &memoryDestination{uploaded: map[string][]byte{}}
+	runner, err := New(dir,
+		WithDestination(dest),
+		WithCompression("none", 0),
+		WithScanInterval(10*time.Millisecond),
+		WithTempDir(t.TempDir()),
+		WithLogger(logger.Init("test", false, false, io.Discard)),
+	)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		assert.Nil(t, runner.Run(ctx))
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool { return dest.count() == 1 }, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, []byte("select 1;"), dest.uploaded["/dump.sql"])
+	assert.NoFileExists(t, filepath.Join(dir, "dump.sql"))
+}
+
+// stripHeader drops the first line of a file
+type stripHeader struct{}
+
+func (stripHeader) Name() string { return "strip-header" }
+
+func (stripHeader) Process(ctx context.Context, in io.Reader) (io.Reader, error) {
+	data, err := io.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+	_, body, _ := bytes.Cut(data, []byte("\n"))
+	return bytes.NewReader(body), nil
+}
+
+func TestTransformers(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.csv")
+	assert.Nil(t, os.WriteFile(file, []byte("id,name\n1,a\n"), 0644))
+
+	dest := &memoryDestination{uploaded: map[string][]byte{}}
+	runner, err := New(dir,
+		WithDestination(dest),
+		WithTransformers(stripHeader{}, Gzip(9)),
+		WithTempDir(t.TempDir()),
+		WithLogger(logger.Init("test", false, false, io.Discard)),
+	)
+	assert.Nil(t, err)
+
+	assert.Nil(t, runner.Process(context.Background(), 0, []string{file}))
+	gz, err := gzip.NewReader(bytes.NewReader(dest.uploaded["/dump.csv.gz"]))
+	assert.Nil(t, err)
+	data, err := io.ReadAll(gz)
+	assert.Nil(t, err)
+	assert.Equal(t, "1,a\n", string(data))
+	assert.NoFileExists(t, file)
+
+	_, err = New(dir, WithDestination(dest), WithTransformers(Gzip(0)), WithGPGPassword("secret"))
+	assert.NotNil(t, err)
+}
+
+// failingStage reads a little of its input and fails
+type failingStage struct{}
+
+func (failingStage) Name() string { return "failing" }
+
+func (failingStage) Process(ctx context.Context, in io.Reader) (io.Reader, error) {
+	return io.MultiReader(io.LimitReader(in, 10), iotest.ErrReader(errors.New("broken"))), nil
+}
+
+func TestTransformFileError(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "dump.sql")
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	assert.Nil(t, os.WriteFile(file, data, 0644))
+
+	_, err := transformFile(context.Background(), []Transformer{Gzip(1), failingStage{}, Gzip(1)}, file, t.TempDir())
+	assert.NotNil(t, err)
+
+	// Gzip stages blocked on writes are stopped
+	assert.Eventually(t, func() bool {
+		stacks := make([]byte, 1<<20)
+		return !bytes.Contains(stacks[:runtime.Stack(stacks, true)], []byte("uploader.pipe.func"))
+	}, 5*time.Second, 10*time.Millisecond)
+}
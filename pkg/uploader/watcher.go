@@ -0,0 +1,59 @@
+package uploader
+
+import (
+	"context"
+
+	"github.com/impossiblecloud/s3-file-uploader/internal/cfg"
+	"github.com/impossiblecloud/s3-file-uploader/internal/fs"
+	"github.com/impossiblecloud/s3-file-uploader/internal/queue"
+)
+
+// Watcher finds files in a directory with periodic scans or inotify and queues them for workers
+type Watcher struct {
+	config cfg.AppConfig
+	queue  *queue.Queue
+}
+
+func newWatcher(config cfg.AppConfig, order string, size int) (*Watcher, error) {
+	q, err := queue.New(order, size)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{config: config, queue: q}, nil
+}
+
+// Run watches the directory until the context is cancelled, then closes the queue
+func (w *Watcher) Run(ctx context.Context) {
+	defer w.queue.Close()
+
+	if w.config.Watch {
+		fs.WatchDirectory(ctx, w.queue, w.config)
+	} else {
+		fs.ScanDirectory(ctx, w.queue, w.config)
+	}
+}
+
+// Next waits for the next file or group of files, it returns false when the watcher is stopped
+func (w *Watcher) Next(ctx context.Context) ([]string, bool) {
+	msg, ok := w.queue.Pop(ctx)
+	if !ok {
+		return nil, false
+	}
+	// Callers keep track of the files they take
+	w.queue.Done()
+
+	if len(msg.Group) > 0 {
+		return msg.Group, true
+	}
+	return []string{fs.ResolveMove(msg.File)}, true
+}
+
+// Scan requests an immediate directory scan, it returns false if a scan is already pending
+func (w *Watcher) Scan() bool {
+	return fs.TriggerScan(w.config)
+}
+
+// Len returns the number of queued files and groups
+func (w *Watcher) Len() int {
+	return w.queue.Len()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Flag presets selected with -profile, flags set on the command line take precedence
+var profiles = map[string]map[string]string{
+	// Low-memory ARM gateways forwarding sensor data files: a single file is uploaded in minimal parts one at
+	// a time, compression and encryption don't run ahead, and histograms aren't kept
+	"edge": {
+		"workers":            "1",
+		"prepare-ahead":      "0",
+		"compress-workers":   "1",
+		"encrypt-workers":    "1",
+		"s3-part-size":       "5MiB",
+		"s3-concurrency":     "1",
+		"max-buffer-memory":  "16MiB",
+		"metrics-histograms": "false",
+	},
+}
+
+// profileNames returns sorted names of the profiles
+func profileNames() []string {
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// applyProfile sets flags of the profile that are not set on the command line, empty name applies nothing
+func applyProfile(flags *flag.FlagSet, name string) error {
+	if name == "" {
+		return nil
+	}
+	preset, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("unknown profile %q, must be one of: %s", name, strings.Join(profileNames(), ", "))
+	}
+
+	set := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for flagName, value := range preset {
+		if set[flagName] {
+			continue
+		}
+		if err := flags.Set(flagName, value); err != nil {
+			return fmt.Errorf("failed to set -%s of profile %q: %s", flagName, name, err.Error())
+		}
+	}
+	return nil
+}
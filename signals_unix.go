@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that dump status and trigger a directory scan
+var (
+	statusSignal os.Signal = syscall.SIGUSR1
+	scanSignal   os.Signal = syscall.SIGUSR2
+)
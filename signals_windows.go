@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no user signals, status and directory scans are available over HTTP only
+var (
+	statusSignal os.Signal
+	scanSignal   os.Signal
+)